@@ -0,0 +1,182 @@
+// provides role-based access control, a policy grants roles operations on
+// keys by prefix and maps identities to roles
+package acl
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/themillenniumfalcon/smolDB/auth"
+)
+
+// operations a rule can allow, "*" allows all of them
+const (
+	Read   = "read"
+	Write  = "write"
+	Patch  = "patch"
+	Delete = "delete"
+	Admin  = "admin"
+)
+
+// Anonymous is the identity of requests that didn't authenticate
+const Anonymous = "anonymous"
+
+var operations = map[string]bool{Read: true, Write: true, Patch: true, Delete: true, Admin: true, "*": true}
+
+// Rule allows operations on the keys starting with Prefix, an empty or "*"
+// prefix covers every key as well as actions on the whole database
+type Rule struct {
+	Prefix string   `json:"prefix"`
+	Allow  []string `json:"allow"`
+}
+
+// Policy is the content of a policy file, e.g.
+//
+//	{
+//	  "roles": {"team-a": [{"prefix": "team-a-", "allow": ["read", "write"]}]},
+//	  "identities": {"alice": ["team-a"], "anonymous": []}
+//	}
+//
+// roles named in the "roles" or "role" claim of a token apply as well
+type Policy struct {
+	Roles      map[string][]Rule   `json:"roles"`
+	Identities map[string][]string `json:"identities"`
+}
+
+// current is the policy requests are checked against, everything is
+// allowed while there is none
+var current atomic.Pointer[Policy]
+
+// Set makes p the policy requests are checked against, nil allows
+// everything. It can be called while requests are served
+func Set(p *Policy) {
+	current.Store(p)
+}
+
+// Current returns the policy requests are checked against, nil when
+// everything is allowed
+func Current() *Policy {
+	return current.Load()
+}
+
+// Load reads and validates the policy file at path
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read acl policy: %v", err)
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("invalid acl policy: %v", err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid acl policy: %v", err)
+	}
+	return p, nil
+}
+
+// checks operations are known and identities only name defined roles
+func (p *Policy) validate() error {
+	for role, rules := range p.Roles {
+		for _, rule := range rules {
+			for _, op := range rule.Allow {
+				if !operations[op] {
+					return fmt.Errorf("role '%s' allows unknown operation '%s'", role, op)
+				}
+			}
+		}
+	}
+	for name, roles := range p.Identities {
+		for _, role := range roles {
+			if _, ok := p.Roles[role]; !ok {
+				return fmt.Errorf("identity '%s' has undefined role '%s'", name, role)
+			}
+		}
+	}
+	return nil
+}
+
+// RolesOf returns the roles of id, those the policy gives its name and
+// those its token claims, a nil id is anonymous
+func (p *Policy) RolesOf(id *auth.Identity) []string {
+	if id == nil {
+		return p.Identities[Anonymous]
+	}
+	roles := append([]string(nil), p.Identities[id.Name]...)
+	switch claimed := id.Claims["roles"].(type) {
+	case []interface{}:
+		for _, role := range claimed {
+			if s, ok := role.(string); ok {
+				roles = append(roles, s)
+			}
+		}
+	case string:
+		roles = append(roles, strings.Fields(claimed)...)
+	}
+	if role, ok := id.Claims["role"].(string); ok {
+		roles = append(roles, role)
+	}
+	return roles
+}
+
+// Check reports whether roles may perform op on key, an empty key stands
+// for the whole database, and explains the decision
+func (p *Policy) Check(roles []string, op string, key string) (bool, string) {
+	sorted := append([]string(nil), roles...)
+	sort.Strings(sorted)
+	for _, role := range sorted {
+		for _, rule := range p.Roles[role] {
+			prefix := strings.TrimSuffix(rule.Prefix, "*")
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			for _, allowed := range rule.Allow {
+				if allowed == op || allowed == "*" {
+					return true, fmt.Sprintf("role '%s' allows %s on prefix '%s'", role, allowed, rule.Prefix)
+				}
+			}
+		}
+	}
+	if len(roles) == 0 {
+		return false, "no roles"
+	}
+	return false, fmt.Sprintf("no rule of roles %s allows %s", strings.Join(sorted, ", "), op)
+}
+
+// Allowed reports whether id may perform op on key under the current policy
+func Allowed(id *auth.Identity, op string, key string) bool {
+	p := Current()
+	if p == nil {
+		return true
+	}
+	ok, _ := p.Check(p.RolesOf(id), op, key)
+	return ok
+}
+
+// Readable returns the keys id may read under the current policy
+func Readable(id *auth.Identity, keys []string) []string {
+	p := Current()
+	if p == nil {
+		return keys
+	}
+	roles := p.RolesOf(id)
+	res := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if ok, _ := p.Check(roles, Read, key); ok {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+// Name returns the name id is known by in a policy
+func Name(id *auth.Identity) string {
+	if id == nil {
+		return Anonymous
+	}
+	return id.Name
+}
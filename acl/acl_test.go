@@ -0,0 +1,95 @@
+package acl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/auth"
+)
+
+const policy = `{
+  "roles": {
+    "reader": [{"prefix": "*", "allow": ["read"]}],
+    "team-a": [{"prefix": "team-a-", "allow": ["read", "write", "patch", "delete"]}],
+    "ops": [{"prefix": "", "allow": ["*"]}]
+  },
+  "identities": {
+    "alice": ["team-a"],
+    "root": ["ops"],
+    "anonymous": ["reader"]
+  }
+}`
+
+// writes content to a policy file and returns its path
+func writePolicy(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestPolicy(t *testing.T) {
+	p, err := Load(writePolicy(t, policy))
+	assert.NoError(t, err)
+	alice := &auth.Identity{Name: "alice"}
+
+	// Test Case 1: rules apply to the keys under their prefix
+	t.Run("prefixes", func(t *testing.T) {
+		roles := p.RolesOf(alice)
+		ok, _ := p.Check(roles, Delete, "team-a-x")
+		assert.True(t, ok)
+		ok, _ = p.Check(roles, Write, "team-b-x")
+		assert.False(t, ok)
+		ok, _ = p.Check(roles, Admin, "")
+		assert.False(t, ok, "a prefix doesn't cover the whole database")
+		ok, reason := p.Check(p.RolesOf(&auth.Identity{Name: "root"}), Admin, "")
+		assert.True(t, ok)
+		assert.Contains(t, reason, "ops")
+	})
+
+	// Test Case 2: anonymous and unknown identities get only their roles
+	t.Run("identities", func(t *testing.T) {
+		ok, _ := p.Check(p.RolesOf(nil), Read, "team-b-x")
+		assert.True(t, ok)
+		ok, _ = p.Check(p.RolesOf(nil), Write, "team-b-x")
+		assert.False(t, ok)
+		ok, reason := p.Check(p.RolesOf(&auth.Identity{Name: "mallory"}), Read, "x")
+		assert.False(t, ok)
+		assert.Equal(t, "no roles", reason)
+	})
+
+	// Test Case 3: roles claimed by a token apply as well
+	t.Run("claims", func(t *testing.T) {
+		id := &auth.Identity{Name: "bob", Claims: map[string]interface{}{"roles": []interface{}{"team-a"}}}
+		ok, _ := p.Check(p.RolesOf(id), Write, "team-a-x")
+		assert.True(t, ok)
+		id = &auth.Identity{Name: "bob", Claims: map[string]interface{}{"role": "reader"}}
+		ok, _ = p.Check(p.RolesOf(id), Read, "team-a-x")
+		assert.True(t, ok)
+	})
+
+	// Test Case 4: the global policy filters listings, no policy allows all
+	t.Run("global", func(t *testing.T) {
+		defer Set(nil)
+		keys := []string{"team-a-1", "team-b-1"}
+		assert.True(t, Allowed(nil, Delete, "x"))
+		assert.Equal(t, keys, Readable(nil, keys))
+
+		p, _ := Load(writePolicy(t, `{"roles": {"team-a": [{"prefix": "team-a-", "allow": ["read"]}]}, "identities": {"alice": ["team-a"]}}`))
+		Set(p)
+		assert.Equal(t, []string{"team-a-1"}, Readable(alice, keys))
+		assert.Empty(t, Readable(nil, keys))
+		assert.False(t, Allowed(nil, Read, "team-a-1"))
+	})
+
+	// Test Case 5: invalid policies fail to load
+	t.Run("invalid", func(t *testing.T) {
+		_, err := Load(writePolicy(t, `{"roles": {"r": [{"prefix": "", "allow": ["drop"]}]}}`))
+		assert.Error(t, err)
+		_, err = Load(writePolicy(t, `{"identities": {"alice": ["missing"]}}`))
+		assert.Error(t, err)
+		_, err = Load(writePolicy(t, `{`))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,31 @@
+package admin
+
+import (
+	"fmt"
+
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/auth"
+)
+
+// CheckACL reports whether the policy at path lets identity perform op on
+// key, an empty key standing for the whole database, and explains why.
+// roles are added to those the policy gives identity, as a token claiming
+// them would. An empty identity is checked as anonymous
+func CheckACL(path string, identity string, roles []string, op string, key string) (bool, string, error) {
+	switch op {
+	case acl.Read, acl.Write, acl.Patch, acl.Delete, acl.Admin:
+	default:
+		return false, "", fmt.Errorf("unknown operation '%s', use read, write, patch, delete or admin", op)
+	}
+	p, err := acl.Load(path)
+	if err != nil {
+		return false, "", err
+	}
+
+	var id *auth.Identity
+	if identity != "" && identity != acl.Anonymous {
+		id = &auth.Identity{Name: identity}
+	}
+	ok, reason := p.Check(append(p.RolesOf(id), roles...), op, key)
+	return ok, reason, nil
+}
@@ -0,0 +1,46 @@
+package admin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckACL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{
+		"roles": {
+			"team-a": [{"prefix": "team-a-", "allow": ["read", "write"]}],
+			"reader": [{"prefix": "*", "allow": ["read"]}]
+		},
+		"identities": {"alice": ["team-a"], "anonymous": ["reader"]}
+	}`), 0644))
+
+	// Test Case 1: decisions follow the identity's roles and explain themselves
+	ok, reason, err := CheckACL(path, "alice", nil, "write", "team-a-doc")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Contains(t, reason, "team-a")
+	ok, _, err = CheckACL(path, "alice", nil, "delete", "team-a-doc")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Test Case 2: claimed roles add to the policy's, anonymous is the default
+	ok, _, err = CheckACL(path, "bob", []string{"team-a"}, "write", "team-a-doc")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, _, err = CheckACL(path, "", nil, "read", "team-b-doc")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, _, err = CheckACL(path, "", nil, "admin", "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Test Case 3: unknown operations and policies are errors
+	_, _, err = CheckACL(path, "alice", nil, "drop", "x")
+	assert.Error(t, err)
+	_, _, err = CheckACL(filepath.Join(t.TempDir(), "missing.json"), "alice", nil, "read", "x")
+	assert.Error(t, err)
+}
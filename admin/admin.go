@@ -1,6 +1,16 @@
 // Package admin provides maintenance and operational tools for smolDB
 package admin
 
+import (
+	"errors"
+	"fmt"
+
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/lock"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
 // CompactionStats tracks statistics during compaction
 type CompactionStats struct {
 	FilesProcessed    int
@@ -17,3 +27,66 @@ type IntegrityReport struct {
 	Repairs         []string
 	IndexMismatches []string
 }
+
+// openIndex builds an index over dir for offline maintenance, it also becomes
+// the global index so that File helpers resolve paths against dir
+func openIndex(dir string) *index.FileIndex {
+	idx := index.NewFileIndex(dir)
+	index.I = idx
+	idx.Regenerate()
+	return idx
+}
+
+// lockOffline takes the lock of dir and keeps read-only processes out of
+// it until the returned release is called, tools hold both for their whole
+// run. A stale lock is taken over, one held by a running server or readers
+// fails unless force is set, then the tool runs without it
+func lockOffline(dir string, force bool) (func(), error) {
+	var held []*lock.Lock
+	release := func() {
+		for k := len(held) - 1; k >= 0; k-- {
+			held[k].Release()
+		}
+	}
+
+	l, err := lock.Acquire(dir)
+	var inUse *lock.HeldError
+	switch {
+	case err == nil:
+		held = append(held, l)
+	case errors.As(err, &inUse) && force:
+		log.Warn("database is in use by %s, running anyway", inUse.Owner)
+	case errors.As(err, &inUse):
+		return nil, fmt.Errorf("database is in use by %s. Use --force to override", inUse.Owner)
+	default:
+		return nil, err
+	}
+
+	readers, err := lock.AcquireExclusive(dir)
+	switch {
+	case err == nil:
+		held = append(held, readers)
+	case errors.Is(err, lock.ErrReaders) && force:
+		log.Warn("database is open read-only by other processes, running anyway")
+	case errors.Is(err, lock.ErrReaders):
+		release()
+		return nil, fmt.Errorf("%w. Use --force to override", err)
+	default:
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// ensureUnsharded refuses to run a tool that only knows a single FileIndex
+// against a database split into shards
+func ensureUnsharded(dir string) error {
+	n, err := index.ReadShardCount(af.NewOsFs(), dir)
+	if err != nil {
+		return err
+	}
+	if n > 1 {
+		return fmt.Errorf("database is split into %d shards, run admin reshard --shards 1 first", n)
+	}
+	return nil
+}
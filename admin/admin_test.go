@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/lock"
 )
 
 func TestCompactDB(t *testing.T) {
@@ -185,3 +187,194 @@ func TestCompactionRestart(t *testing.T) {
 		assert.Equal(t, original, current, "File content should be preserved")
 	}
 }
+
+// TestLockOffline ensures a tool keeps servers and readers out while it runs
+func TestLockOffline(t *testing.T) {
+	dir := t.TempDir()
+
+	release, err := lockOffline(dir, false)
+	assert.NoError(t, err)
+	_, err = lock.Acquire(dir)
+	var held *lock.HeldError
+	assert.ErrorAs(t, err, &held)
+	_, err = lock.AcquireShared(dir)
+	assert.Error(t, err)
+	_, err = lockOffline(dir, false)
+	assert.Error(t, err)
+	release()
+
+	// Readers block a tool unless forced, a forced one still takes the
+	// lock nobody holds
+	r, err := lock.AcquireShared(dir)
+	assert.NoError(t, err)
+	_, err = lockOffline(dir, false)
+	assert.ErrorIs(t, err, lock.ErrReaders)
+	s, err := lock.Inspect(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, lock.Free, s.State)
+
+	release, err = lockOffline(dir, true)
+	assert.NoError(t, err)
+	_, err = lock.Acquire(dir)
+	assert.ErrorAs(t, err, &held)
+	release()
+	assert.NoError(t, r.Release())
+}
+
+// TestConvertWAL ensures an offline WAL can be migrated to the binary format
+func TestConvertWAL(t *testing.T) {
+	dir := t.TempDir()
+
+	// Write a few records using the default json format
+	idx := index.NewFileIndex(dir)
+	index.I = idx
+	assert.NoError(t, idx.InitWAL(index.DurabilityCommit))
+	assert.NoError(t, idx.Put(&index.File{FileName: "doc"}, []byte(`{"hello":"world"}`)))
+	assert.NoError(t, idx.Put(&index.File{FileName: "doc"}, []byte(`{"hello":"again"}`)))
+
+	// A held lock blocks conversion unless forced
+	held, err := lock.Acquire(dir)
+	assert.NoError(t, err)
+	_, err = ConvertWAL(dir, "binary", false, false)
+	assert.Error(t, err)
+	assert.NoError(t, held.Release())
+
+	// Compression is rejected for the json format
+	_, err = ConvertWAL(dir, "json", true, false)
+	assert.Error(t, err)
+
+	stats, err := ConvertWAL(dir, "binary", false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, stats.Records, "two puts and their commit markers")
+	assert.True(t, stats.BytesAfter < stats.BytesBefore, "binary log should be smaller")
+
+	// Replay of the converted log restores the latest document
+	assert.NoError(t, os.Remove(filepath.Join(dir, "doc.json")))
+	idx = index.NewFileIndex(dir)
+	index.I = idx
+	assert.NoError(t, idx.InitWAL(index.DurabilityNone))
+	assert.NoError(t, idx.WALReplay())
+	data, err := os.ReadFile(filepath.Join(dir, "doc.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"hello":"again"}`, string(data))
+}
+
+func TestRestoreToPoint(t *testing.T) {
+	dir := t.TempDir()
+	into := filepath.Join(t.TempDir(), "restored")
+
+	idx := index.NewFileIndex(dir)
+	index.I = idx
+	assert.NoError(t, idx.InitWAL(index.DurabilityCommit))
+	assert.NoError(t, idx.Put(&index.File{FileName: "doc"}, []byte(`{"deploy":1}`)))
+	assert.NoError(t, idx.CreateCheckpoint())
+	assert.NoError(t, idx.Put(&index.File{FileName: "doc"}, []byte(`{"deploy":2}`)))
+	before := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	assert.NoError(t, idx.Put(&index.File{FileName: "doc"}, []byte(`{"deploy":"bad"}`)))
+
+	// Restoring into the live directory is refused
+	_, err := RestoreToPoint(dir, "2", dir)
+	assert.Error(t, err)
+	_, err = RestoreToPoint(dir, "not a target", into)
+	assert.Error(t, err)
+
+	stats, err := RestoreToPoint(dir, before.Format(time.RFC3339Nano), into)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), stats.LSN)
+
+	data, err := os.ReadFile(filepath.Join(into, "doc.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"deploy":2}`, string(data))
+
+	// The live database still has the latest write
+	data, err = os.ReadFile(filepath.Join(dir, "doc.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"deploy":"bad"}`, string(data))
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	out := filepath.Join(t.TempDir(), "backup.tar.gz")
+
+	idx := index.NewFileIndex(dir)
+	index.I = idx
+	assert.NoError(t, idx.InitWAL(index.DurabilityCommit))
+	assert.NoError(t, idx.Put(&index.File{FileName: "doc"}, []byte(`{"hello":"world"}`)))
+	assert.NoError(t, idx.CreateCheckpoint())
+	assert.NoError(t, idx.Put(&index.File{FileName: "doc"}, []byte(`{"hello":"again"}`)))
+
+	// The WAL written after the checkpoint goes into the backup
+	assert.NoError(t, os.Remove(filepath.Join(dir, "doc.json")))
+	manifest, err := BackupDB(dir, out, "", true, false)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), manifest.LSN)
+	assert.Equal(t, 1, manifest.WALRecords)
+	_, err = os.Stat(out + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	// A held lock blocks restoring unless forced
+	held, err := lock.Acquire(dir)
+	assert.NoError(t, err)
+	_, err = RestoreBackup(dir, []string{out}, false)
+	assert.Error(t, err)
+	assert.NoError(t, held.Release())
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "doc.json"), []byte(`{"hello":"later"}`), 0644))
+	stats, err := RestoreBackup(dir, []string{out}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), stats.LSN)
+
+	data, err := os.ReadFile(filepath.Join(dir, "doc.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"hello":"again"}`, string(data))
+
+	// The replaced directory is kept
+	data, err = os.ReadFile(filepath.Join(stats.Previous, "doc.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"hello":"later"}`, string(data))
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	backups := t.TempDir()
+	full := filepath.Join(backups, "full.tar")
+	incr := filepath.Join(backups, "incr.tar")
+
+	idx := index.NewFileIndex(dir)
+	index.I = idx
+	assert.NoError(t, idx.InitWAL(index.DurabilityCommit))
+	assert.NoError(t, idx.Put(&index.File{FileName: "a"}, []byte(`{"v":1}`)))
+	assert.NoError(t, idx.Put(&index.File{FileName: "b"}, []byte(`{"v":1}`)))
+	assert.NoError(t, idx.CreateCheckpoint())
+	_, err := BackupDB(dir, full, "", false, false)
+	assert.NoError(t, err)
+
+	// Only the changed document goes into the incremental
+	index.I = idx
+	assert.NoError(t, idx.Put(&index.File{FileName: "a"}, []byte(`{"v":2}`)))
+	assert.NoError(t, idx.CreateCheckpoint())
+	manifest, err := BackupDB(dir, incr, full, true, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "incremental", manifest.Type)
+	assert.Len(t, manifest.Documents, 1)
+	assert.Equal(t, "a", manifest.Documents[0].Key)
+
+	// The chain verifies in order only
+	manifests, err := VerifyBackups([]string{full, incr})
+	assert.NoError(t, err)
+	assert.Len(t, manifests, 2)
+	_, err = VerifyBackups([]string{incr})
+	assert.Error(t, err)
+
+	stats, err := RestoreBackup(dir, []string{full, incr}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Backups)
+
+	data, err := os.ReadFile(filepath.Join(dir, "a.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"v":2}`, string(data))
+	data, err = os.ReadFile(filepath.Join(dir, "b.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"v":1}`, string(data))
+}
@@ -0,0 +1,43 @@
+package admin
+
+import (
+	"fmt"
+	"time"
+
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/audit"
+)
+
+// QueryAudit returns the audit entries of the database in dir, optionally
+// only those of key and within since and until, given as RFC3339 timestamps
+// or dates. The log is append-only so this is safe while a server runs
+func QueryAudit(dir string, key string, since string, until string) ([]audit.Entry, error) {
+	filter := audit.Filter{Key: key}
+	var err error
+	if filter.Since, err = parseAuditTime(since, false); err != nil {
+		return nil, err
+	}
+	if filter.Until, err = parseAuditTime(until, true); err != nil {
+		return nil, err
+	}
+	return audit.Query(af.NewOsFs(), dir, filter)
+}
+
+// parses a timestamp or a date, a date used as the end of a range covers
+// that whole day
+func parseAuditTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s', expected RFC3339 or YYYY-MM-DD", value)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
@@ -0,0 +1,43 @@
+package admin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/audit"
+)
+
+func TestQueryAudit(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "doc.json"), []byte(`{"a":1}`), 0644))
+
+	l, err := audit.Open(af.NewOsFs(), dir)
+	assert.NoError(t, err)
+	day := time.Date(2024, 5, 1, 23, 30, 0, 0, time.Local)
+	assert.NoError(t, l.Record(audit.Entry{Time: day, Client: "10.0.0.1:1", Op: audit.OpPut, Key: "doc"}))
+	assert.NoError(t, l.Close())
+
+	// Test Case 1: a date as the end of the range covers the whole day
+	entries, err := QueryAudit(dir, "doc", "2024-05-01", "2024-05-01")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	entries, err = QueryAudit(dir, "", "2024-05-02", "")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	_, err = QueryAudit(dir, "", "yesterday", "")
+	assert.Error(t, err)
+
+	// Test Case 2: the history survives a reshard, which records itself
+	_, err = Reshard(dir, 2, false)
+	assert.NoError(t, err)
+	entries, err = QueryAudit(dir, "", "", "")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, audit.OpAdmin, entries[1].Op)
+	assert.Equal(t, "reshard from 1 to 2 shards", entries[1].Detail)
+}
@@ -0,0 +1,138 @@
+package admin
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/audit"
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+// BackupDB writes a backup of the offline database in dir to the file out,
+// the file only appears once the backup is complete. With parent set to an
+// earlier backup or its manifest only what changed since it is written
+func BackupDB(dir string, out string, parent string, compress bool, force bool) (*index.BackupManifest, error) {
+	release, err := lockOffline(dir, force)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := ensureUnsharded(dir); err != nil {
+		return nil, err
+	}
+
+	opts := index.BackupOptions{Compress: compress}
+	if parent != "" {
+		manifest, err := readManifest(parent)
+		if err != nil {
+			return nil, err
+		}
+		opts.Parent = manifest
+	}
+
+	idx := openIndex(dir)
+	tmp := out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backup file: %v", err)
+	}
+
+	manifest, err := idx.Backup(f, opts)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("failed to write backup file: %v", err)
+	}
+	audit.RecordAdmin(af.NewOsFs(), dir, "%s backup to %s at lsn %d", manifest.Type, out, manifest.LSN)
+	return manifest, nil
+}
+
+// reads the manifest of a backup file or a standalone manifest file
+func readManifest(path string) (*index.BackupManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup: %v", err)
+	}
+	defer f.Close()
+	return index.ReadBackupManifest(f)
+}
+
+// opens every backup file of a chain in order, the caller closes them
+func openBackups(from []string) ([]io.Reader, func(), error) {
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	readers := make([]io.Reader, 0, len(from))
+	for _, path := range from {
+		f, err := os.Open(path)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("failed to open backup: %v", err)
+		}
+		files = append(files, f)
+		readers = append(readers, f)
+	}
+	return readers, closeAll, nil
+}
+
+// RestoreBackup replaces the database in dir with a full backup followed by
+// the incrementals taken after it, all in the order given, the current
+// contents of dir are moved aside rather than deleted
+func RestoreBackup(dir string, from []string, force bool) (*index.BackupRestoreStats, error) {
+	release, err := lockOffline(dir, force)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	readers, closeAll, err := openBackups(from)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAll()
+
+	fs := af.NewOsFs()
+	stats, err := index.RestoreBackup(fs, readers, abs)
+	if err != nil {
+		return nil, err
+	}
+	// the history of the replaced database stays with it
+	if stats.Previous != "" {
+		if err := audit.Carry(fs, stats.Previous, abs); err != nil {
+			return stats, fmt.Errorf("failed to carry over the audit log: %v", err)
+		}
+	}
+	audit.RecordAdmin(fs, abs, "restore of %s at lsn %d", strings.Join(from, ", "), stats.LSN)
+	return stats, nil
+}
+
+// VerifyBackups checks a full backup followed by its incrementals without
+// restoring them, returns their manifests in order
+func VerifyBackups(from []string) ([]*index.BackupManifest, error) {
+	readers, closeAll, err := openBackups(from)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAll()
+
+	return index.VerifyBackupChain(readers)
+}
@@ -6,20 +6,23 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/themillenniumfalcon/smolDB/index"
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/audit"
 )
 
 // CompactDB performs database compaction by rewriting JSON files and trimming WAL
 func CompactDB(dir string, force bool) (*CompactionStats, error) {
-	// Check for active lock unless force flag is used
-	if !force {
-		if _, err := os.Stat(filepath.Join(dir, "smoldb_lock")); !os.IsNotExist(err) {
-			return nil, fmt.Errorf("database is in use (lock exists). Use --force to override")
-		}
+	release, err := lockOffline(dir, force)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := ensureUnsharded(dir); err != nil {
+		return nil, err
 	}
 
 	stats := &CompactionStats{}
-	idx := index.NewFileIndex(dir)
+	idx := openIndex(dir)
 
 	// Process each file
 	for _, key := range idx.ListKeys() {
@@ -58,5 +61,6 @@ func CompactDB(dir string, force bool) (*CompactionStats, error) {
 	// TODO: WAL trimming when implemented
 	// stats.WalEntriesTrimmed = trimWAL(dir)
 
+	audit.RecordAdmin(af.NewOsFs(), dir, "compact of %d files, %d bytes saved", stats.FilesProcessed, stats.BytesBefore-stats.BytesAfter)
 	return stats, nil
 }
@@ -0,0 +1,111 @@
+package admin
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/audit"
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+// ExportDB writes the documents of the offline database in dir whose keys
+// start with prefix as NDJSON to the file out, or to stdout when out is
+// empty. The file only appears once the export is complete
+func ExportDB(dir string, out string, prefix string, force bool) (*index.ExportStats, error) {
+	release, err := lockOffline(dir, force)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	r, err := index.OpenRouter(af.NewOsFs(), dir, index.DurabilityCommit)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if out == "" {
+		return r.Export(os.Stdout, prefix, nil)
+	}
+	tmp := out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create export file: %v", err)
+	}
+	stats, err := r.Export(f, prefix, nil)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("failed to write export file: %v", err)
+	}
+	return stats, nil
+}
+
+// ImportDB writes the documents of an NDJSON export read from the file
+// from, or from stdin when from is empty, into the offline database in dir.
+// Every key written is recorded in the audit log, a dry run writes nothing
+func ImportDB(dir string, from string, opts index.ImportOptions, force bool) (*index.ImportStats, error) {
+	release, err := lockOffline(dir, force)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var rd io.Reader = os.Stdin
+	if from != "" {
+		f, err := os.Open(from)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open import file: %v", err)
+		}
+		defer f.Close()
+		rd = f
+	} else {
+		from = "stdin"
+	}
+
+	fs := af.NewOsFs()
+	r, err := index.OpenRouter(fs, dir, index.DurabilityCommit)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if opts.DryRun {
+		return r.Import(rd, opts)
+	}
+
+	auditLog, err := audit.Open(fs, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+	client := audit.LocalUser()
+
+	opts.Apply = func(ops []index.BatchOp) error {
+		before := make([]string, len(ops))
+		for k, op := range ops {
+			before[k] = r.Checksum(op.Key)
+		}
+		if err := r.Batch(ops, false); err != nil {
+			return err
+		}
+		for k, op := range ops {
+			err := auditLog.Record(audit.Entry{Client: client, Op: audit.OpPut, Key: op.Key, Before: before[k], After: r.Checksum(op.Key), Detail: "imported from " + from})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	stats, err := r.Import(rd, opts)
+	if stats != nil && stats.Imported > 0 {
+		auditLog.Record(audit.Entry{Client: client, Op: audit.OpAdmin, Detail: fmt.Sprintf("import from %s, %d imported, %d skipped", from, stats.Imported, stats.Skipped)})
+	}
+	return stats, err
+}
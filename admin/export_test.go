@@ -0,0 +1,57 @@
+package admin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/audit"
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+func TestExportImport(t *testing.T) {
+	src := t.TempDir()
+	writeLocal(t, src, [][2]string{{"user-1", `{"v":1}`}, {"user-2", `{"v":2}`}, {"order-1", `{"v":3}`}})
+	out := filepath.Join(t.TempDir(), "users.ndjson")
+
+	stats, err := ExportDB(src, out, "user-", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Exported)
+	data, err := os.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "\n"))
+
+	// Test Case 1: a dry run reports what would be imported and writes nothing
+	dst := t.TempDir()
+	writeLocal(t, dst, [][2]string{{"user-1", `{"v":0}`}})
+	dry, err := ImportDB(dst, out, index.ImportOptions{DryRun: true}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dry.Imported)
+	assert.Equal(t, 1, dry.Skipped)
+
+	// Test Case 2: an import writes the documents and records them in the
+	// audit log
+	imported, err := ImportDB(dst, out, index.ImportOptions{Conflict: index.ImportOverwrite}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, imported.Imported)
+	r, err := index.OpenRouter(af.NewOsFs(), dst, index.DurabilityCommit)
+	assert.NoError(t, err)
+	body, _, ok, err := r.Document("user-1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.JSONEq(t, `{"v":1}`, string(body))
+	assert.NoError(t, r.Close())
+
+	entries, err := audit.Query(af.NewOsFs(), dst, audit.Filter{})
+	assert.NoError(t, err)
+	var puts int
+	for _, e := range entries {
+		if e.Op == audit.OpPut {
+			puts++
+		}
+	}
+	assert.Equal(t, 2, puts)
+}
@@ -0,0 +1,42 @@
+package admin
+
+import (
+	"fmt"
+	"path/filepath"
+
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/audit"
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+// RestoreToPoint rebuilds the database in dir as it was at target, an LSN or
+// a timestamp, into the new directory into, dir itself is only read so this
+// is safe while a server is running
+func RestoreToPoint(dir string, target string, into string) (*index.PITRStats, error) {
+	if err := ensureUnsharded(dir); err != nil {
+		return nil, err
+	}
+	to, err := index.ParseRecoveryTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := filepath.Abs(into)
+	if err != nil {
+		return nil, err
+	}
+	if src == dst {
+		return nil, fmt.Errorf("restore directory must differ from the database directory")
+	}
+
+	stats, err := index.RestoreToPoint(af.NewOsFs(), dir, into, to)
+	if err != nil {
+		return nil, err
+	}
+	audit.RecordAdmin(af.NewOsFs(), into, "restore of %s to %s", dir, target)
+	return stats, nil
+}
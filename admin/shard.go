@@ -0,0 +1,31 @@
+package admin
+
+import (
+	"fmt"
+
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/audit"
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+// Reshard splits the offline database in dir into the given number of
+// shards, or merges it back with shards set to 1, the previous layout is
+// moved aside rather than deleted
+func Reshard(dir string, shards int, force bool) (*index.ReshardStats, error) {
+	release, err := lockOffline(dir, force)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	fs := af.NewOsFs()
+	stats, err := index.Reshard(fs, dir, shards)
+	if err != nil {
+		return nil, err
+	}
+	// the history of the database stays in the new layout
+	if err := audit.Carry(fs, stats.Previous, dir); err != nil {
+		return stats, fmt.Errorf("failed to carry over the audit log: %v", err)
+	}
+	audit.RecordAdmin(fs, dir, "reshard from %d to %d shards", stats.From, stats.To)
+	return stats, nil
+}
@@ -0,0 +1,237 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/audit"
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+// sync actions
+const (
+	SyncPull     = "pull"     // the peer's copy replaces the local one
+	SyncPush     = "push"     // the local copy replaces the peer's
+	SyncConflict = "conflict" // both copies are equally new, left alone
+)
+
+// SyncAction is a difference found between the local database and the peer
+type SyncAction struct {
+	Key    string
+	Action string
+	Reason string
+}
+
+// SyncReport describes what SyncDB found and, unless it was a dry run, repaired
+type SyncReport struct {
+	Peer     string
+	DryRun   bool
+	Buckets  int // tree buckets whose hashes differed
+	Compared int // keys compared in those buckets
+	Actions  []SyncAction
+}
+
+// counts the actions of a kind
+func (r *SyncReport) Count(action string) int {
+	n := 0
+	for _, a := range r.Actions {
+		if a.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// SyncDB compares the offline database in dir with the server at peer
+// through their Merkle trees and repairs the keys that differ, the newer
+// copy wins by last modification or, with prefer set to "lsn", by LSN. A
+// key missing on one side is copied over, deletions aren't tracked so they
+// can't win. With dryRun nothing is changed, the report lists what would be
+func SyncDB(dir string, peer string, prefer string, dryRun bool, force bool) (*SyncReport, error) {
+	release, err := lockOffline(dir, force)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var byLSN bool
+	switch prefer {
+	case "", "modified":
+	case "lsn":
+		byLSN = true
+	default:
+		return nil, fmt.Errorf("unknown precedence '%s', expected modified or lsn", prefer)
+	}
+
+	r, err := index.OpenRouter(af.NewOsFs(), dir, index.DurabilityCommit)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	p := &peerClient{addr: strings.TrimSuffix(peer, "/"), client: &http.Client{Timeout: 30 * time.Second}}
+	report := &SyncReport{Peer: p.addr, DryRun: dryRun}
+
+	remote := &index.MerkleTree{}
+	if err := p.get("/merkle", remote); err != nil {
+		return nil, err
+	}
+	buckets, err := r.MerkleTree().Diff(remote)
+	if err != nil {
+		return nil, fmt.Errorf("peer sent an unusable tree: %v", err)
+	}
+	report.Buckets = len(buckets)
+
+	for _, b := range buckets {
+		local, _ := r.MerkleBucket(b)
+		var theirs struct {
+			Entries []index.MerkleEntry `json:"entries"`
+		}
+		if err := p.get("/merkle/buckets/"+strconv.Itoa(b), &theirs); err != nil {
+			return nil, err
+		}
+		report.Actions = append(report.Actions, compareBucket(local, theirs.Entries, byLSN, report)...)
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	auditLog, err := audit.Open(af.NewOsFs(), dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+	client := audit.LocalUser()
+
+	for _, a := range report.Actions {
+		var err error
+		switch a.Action {
+		case SyncPull:
+			before := r.Checksum(a.Key)
+			if err = pullKey(r, p, a.Key); err == nil {
+				err = auditLog.Record(audit.Entry{Client: client, Op: audit.OpPut, Key: a.Key, Before: before, After: r.Checksum(a.Key), Detail: "pulled from " + p.addr})
+			}
+		case SyncPush:
+			err = pushKey(r, p, a.Key)
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to %s key %s: %v", a.Action, a.Key, err)
+		}
+	}
+	err = auditLog.Record(audit.Entry{Client: client, Op: audit.OpAdmin, Detail: fmt.Sprintf("sync with %s, %d pulled, %d pushed", p.addr, report.Count(SyncPull), report.Count(SyncPush))})
+	return report, err
+}
+
+// compares the entries of a bucket on both sides, both sorted by key
+func compareBucket(local, remote []index.MerkleEntry, byLSN bool, report *SyncReport) []SyncAction {
+	mine := map[string]index.MerkleEntry{}
+	for _, e := range local {
+		mine[e.Key] = e
+	}
+	theirs := map[string]index.MerkleEntry{}
+	for _, e := range remote {
+		theirs[e.Key] = e
+	}
+
+	var actions []SyncAction
+	for _, e := range local {
+		report.Compared++
+		other, ok := theirs[e.Key]
+		switch {
+		case !ok:
+			actions = append(actions, SyncAction{Key: e.Key, Action: SyncPush, Reason: "missing on peer"})
+		case other.Checksum == e.Checksum:
+		default:
+			newer, decided := e.Newer(other, byLSN)
+			switch {
+			case !decided:
+				actions = append(actions, SyncAction{Key: e.Key, Action: SyncConflict, Reason: "both copies are equally new"})
+			case newer:
+				actions = append(actions, SyncAction{Key: e.Key, Action: SyncPush, Reason: "local copy is newer"})
+			default:
+				actions = append(actions, SyncAction{Key: e.Key, Action: SyncPull, Reason: "peer copy is newer"})
+			}
+		}
+	}
+	for _, e := range remote {
+		if _, ok := mine[e.Key]; !ok {
+			report.Compared++
+			actions = append(actions, SyncAction{Key: e.Key, Action: SyncPull, Reason: "missing locally"})
+		}
+	}
+	return actions
+}
+
+// replaces the local copy of key with the peer's
+func pullKey(r *index.Router, p *peerClient, key string) error {
+	var doc struct {
+		Body string `json:"body"`
+	}
+	if err := p.get("/merkle/docs/"+url.PathEscape(key), &doc); err != nil {
+		return err
+	}
+	file, _ := r.Lookup(key)
+	return r.Put(file, []byte(doc.Body))
+}
+
+// replaces the peer's copy of key with the local one
+func pushKey(r *index.Router, p *peerClient, key string) error {
+	body, _, ok, err := r.Document(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("key disappeared")
+	}
+	req, err := http.NewRequest(http.MethodPut, p.addr+"/key/"+url.PathEscape(key), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	auth.Attach(req)
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s answered %s: %s", p.addr, res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// peerClient reads from the server being synced with
+type peerClient struct {
+	addr   string
+	client *http.Client
+}
+
+// decodes the JSON answer to GET path into out
+func (p *peerClient) get(path string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, p.addr+path, nil)
+	if err != nil {
+		return err
+	}
+	auth.Attach(req)
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s answered %s: %s", p.addr, res.Status, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid answer from %s%s: %v", p.addr, path, err)
+	}
+	return nil
+}
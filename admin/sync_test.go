@@ -0,0 +1,101 @@
+package admin
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/api"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/lock"
+)
+
+// writes docs in order into the offline database in dir
+func writeLocal(t *testing.T, dir string, docs [][2]string) {
+	r, err := index.OpenRouter(af.NewOsFs(), dir, index.DurabilityCommit)
+	assert.NoError(t, err)
+	defer r.Close()
+	for _, doc := range docs {
+		file, _ := r.Lookup(doc[0])
+		assert.NoError(t, r.Put(file, []byte(doc[1])))
+	}
+}
+
+func TestSyncDB(t *testing.T) {
+	defer func(i *index.FileIndex) { index.I, index.R = i, nil }(index.I)
+
+	// the peer serves its own database, its LSNs end up higher for "both"
+	peerDir := t.TempDir()
+	index.I = index.NewFileIndex(peerDir)
+	index.R = nil
+	assert.NoError(t, index.I.InitWAL(index.DurabilityCommit))
+	for _, doc := range [][2]string{{"same", `{"v":0}`}, {"theirs", `{"v":1}`}, {"edited", `{"v":"peer"}`}, {"both", `{"v":1}`}, {"both", `{"v":2}`}, {"both", `{"v":"peer"}`}} {
+		assert.NoError(t, index.I.Put(&index.File{FileName: doc[0]}, []byte(doc[1])))
+	}
+	router := httprouter.New()
+	router.GET("/merkle", api.GetMerkleTree)
+	router.GET("/merkle/buckets/:bucket", api.GetMerkleBucket)
+	router.GET("/merkle/docs/:key", api.GetMerkleDocument)
+	router.PUT("/key/:key", api.UpdateKey)
+	peer := httptest.NewServer(router)
+	defer peer.Close()
+
+	// the local database has its own history
+	dir := t.TempDir()
+	writeLocal(t, dir, [][2]string{{"same", `{"v":0}`}, {"mine", `{"v":1}`}, {"both", `{"v":"local"}`}, {"edited", `{"v":1}`}, {"edited", `{"v":2}`}, {"edited", `{"v":"local"}`}})
+
+	// Test Case 1: a dry run reports the differences and changes nothing
+	t.Run("dry run", func(t *testing.T) {
+		_, err := SyncDB(dir, peer.URL, "newest", true, false)
+		assert.Error(t, err)
+
+		report, err := SyncDB(dir, peer.URL, "lsn", true, false)
+		assert.NoError(t, err)
+		actions := map[string]string{}
+		for _, a := range report.Actions {
+			actions[a.Key] = a.Action
+		}
+		assert.Equal(t, map[string]string{"mine": SyncPush, "theirs": SyncPull, "both": SyncPull, "edited": SyncPush}, actions)
+		assert.True(t, report.Buckets > 0)
+
+		_, err = os.Stat(filepath.Join(dir, "theirs.json"))
+		assert.True(t, os.IsNotExist(err))
+		_, ok := index.I.Lookup("mine")
+		assert.False(t, ok)
+	})
+
+	// Test Case 2: a sync repairs both sides until the trees match
+	t.Run("repair", func(t *testing.T) {
+		held, err := lock.Acquire(dir)
+		assert.NoError(t, err)
+		_, err = SyncDB(dir, peer.URL, "lsn", false, false)
+		assert.Error(t, err)
+		assert.NoError(t, held.Release())
+
+		report, err := SyncDB(dir, peer.URL, "lsn", false, false)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, report.Count(SyncPull))
+		assert.Equal(t, 2, report.Count(SyncPush))
+
+		for key, want := range map[string]string{"theirs": `{"v":1}`, "both": `{"v":"peer"}`} {
+			data, err := os.ReadFile(filepath.Join(dir, key+".json"))
+			assert.NoError(t, err)
+			assert.JSONEq(t, want, string(data))
+		}
+		for key, want := range map[string]string{"mine": `{"v":1}`, "edited": `{"v":"local"}`} {
+			body, _, ok, err := index.R.Document(key)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.JSONEq(t, want, string(body))
+		}
+
+		report, err = SyncDB(dir, peer.URL, "lsn", true, false)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, report.Buckets)
+		assert.Empty(t, report.Actions)
+	})
+}
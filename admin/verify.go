@@ -5,15 +5,20 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
-	"github.com/themillenniumfalcon/smolDB/index"
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/audit"
 )
 
 // VerifyDB scans database files and checks for integrity issues
 func VerifyDB(dir string, repair bool) (*IntegrityReport, error) {
+	if err := ensureUnsharded(dir); err != nil {
+		return nil, err
+	}
 	report := &IntegrityReport{}
-	idx := index.NewFileIndex(dir)
+	idx := openIndex(dir)
 	var mu sync.Mutex
 	var wg sync.WaitGroup
 
@@ -71,6 +76,9 @@ func VerifyDB(dir string, repair bool) (*IntegrityReport, error) {
 	}
 
 	wg.Wait()
+	if len(report.Repairs) > 0 {
+		audit.RecordAdmin(af.NewOsFs(), dir, "verify repaired %s", strings.Join(report.Repairs, ", "))
+	}
 	return report, nil
 }
 
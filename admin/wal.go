@@ -0,0 +1,37 @@
+package admin
+
+import (
+	"fmt"
+
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/audit"
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+// ConvertWAL rewrites the WAL of an offline database into the given record
+// format ("json" or "binary"), compress only applies to the binary format
+func ConvertWAL(dir string, format string, compress bool, force bool) (*index.WALConvertStats, error) {
+	release, err := lockOffline(dir, force)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := ensureUnsharded(dir); err != nil {
+		return nil, err
+	}
+
+	to, err := index.ParseWALFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	if compress && to != index.WALFormatBinary {
+		return nil, fmt.Errorf("compression requires the binary wal format")
+	}
+
+	stats, err := index.ConvertWAL(af.NewOsFs(), dir, to, compress)
+	if err != nil {
+		return nil, err
+	}
+	audit.RecordAdmin(af.NewOsFs(), dir, "wal convert to %s of %d records", format, stats.Records)
+	return stats, nil
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// checks that the client of r may perform op on key, an empty key for
+// actions on the whole database. A forbidden request is answered with 403
+func permitted(w http.ResponseWriter, r *http.Request, op string, key string) bool {
+	id := auth.FromContext(r.Context())
+	if acl.Allowed(id, op, key) {
+		return true
+	}
+	w.WriteHeader(http.StatusForbidden)
+	if key == "" {
+		log.WWarn(w, "forbidden: '%s' may not %s", acl.Name(id), op)
+	} else {
+		log.WWarn(w, "forbidden: '%s' may not %s key '%s'", acl.Name(id), op, key)
+	}
+	return false
+}
+
+// resolves the references in val that the client of r may read, others
+// are redacted
+func resolveFor(r *http.Request, val interface{}, depth int) interface{} {
+	if acl.Current() == nil {
+		return index.ResolveReferences(val, depth)
+	}
+	id := auth.FromContext(r.Context())
+	return index.ResolveReferencesFor(val, depth, func(key string) bool {
+		return acl.Allowed(id, acl.Read, key)
+	})
+}
@@ -0,0 +1,96 @@
+// provides tests for access control of the API
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+// verifies that handlers enforce the policy and references to forbidden
+// keys are redacted
+func TestACL(t *testing.T) {
+	index.I.SetFileSystem(af.NewMemMapFs())
+	keys, err := auth.NewAPIKeys("", "alice:a-secret,root:r-secret")
+	assert.NoError(t, err)
+	SetAuth(keys, DefaultPublic)
+	defer SetAuth(nil, nil)
+
+	path := filepath.Join(t.TempDir(), "acl.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{
+		"roles": {
+			"team-a": [{"prefix": "team-a-", "allow": ["read", "write", "patch"]}],
+			"ops": [{"prefix": "*", "allow": ["*"]}]
+		},
+		"identities": {"alice": ["team-a"], "root": ["ops"]}
+	}`), 0o600))
+	policy, err := acl.Load(path)
+	assert.NoError(t, err)
+	acl.Set(policy)
+	defer acl.Set(nil)
+
+	router := httprouter.New()
+	router.GET("/keys", GetKeys)
+	router.GET("/key/:key", GetKey)
+	router.PUT("/key/:key", UpdateKey)
+	router.DELETE("/key/:key", DeleteKey)
+	router.GET("/key/:key/field/:field", GetKeyField)
+	router.POST("/regenerate", RegenerateIndex)
+	handler := Middleware(router)
+	serve := func(method, path, key, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", key)
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assertHTTPStatus(t, serve("PUT", "/key/secret", "r-secret", `{"pin":"1234"}`), http.StatusOK)
+	assertHTTPStatus(t, serve("PUT", "/key/team-a-doc", "a-secret", `{"ref":"REF::secret","own":"REF::team-a-other"}`), http.StatusOK)
+	assertHTTPStatus(t, serve("PUT", "/key/team-a-other", "a-secret", `{"v":1}`), http.StatusOK)
+
+	// Test Case 1: operations outside the granted prefixes are forbidden
+	t.Run("enforced", func(t *testing.T) {
+		assertHTTPStatus(t, serve("GET", "/key/secret", "a-secret", ""), http.StatusForbidden)
+		assertHTTPStatus(t, serve("PUT", "/key/secret", "a-secret", `{}`), http.StatusForbidden)
+		assertHTTPStatus(t, serve("DELETE", "/key/team-a-other", "a-secret", ""), http.StatusForbidden)
+		assertHTTPStatus(t, serve("POST", "/regenerate", "a-secret", ""), http.StatusForbidden)
+		assertHTTPStatus(t, serve("POST", "/regenerate", "r-secret", ""), http.StatusOK)
+		_, ok := index.I.Lookup("team-a-other")
+		assert.True(t, ok)
+	})
+
+	// Test Case 2: references to forbidden keys are redacted
+	t.Run("redacted", func(t *testing.T) {
+		rr := serve("GET", "/key/team-a-doc", "a-secret", "")
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assert.NotContains(t, rr.Body.String(), "1234")
+		assert.Contains(t, rr.Body.String(), "REF::ERR key 'secret' forbidden")
+		assert.Contains(t, rr.Body.String(), `"v":1`)
+
+		rr = serve("GET", "/key/team-a-doc/field/ref", "a-secret", "")
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assert.NotContains(t, rr.Body.String(), "1234")
+
+		rr = serve("GET", "/key/team-a-doc", "r-secret", "")
+		assert.Contains(t, rr.Body.String(), "1234")
+	})
+
+	// Test Case 3: listings only hold readable keys
+	t.Run("listed", func(t *testing.T) {
+		rr := serve("GET", "/keys", "a-secret", "")
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assert.NotContains(t, rr.Body.String(), `"secret"`)
+		assert.Contains(t, rr.Body.String(), "team-a-doc")
+	})
+}
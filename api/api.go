@@ -3,11 +3,16 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
 
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/audit"
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/cluster"
 	"github.com/themillenniumfalcon/smolDB/index"
 	"github.com/themillenniumfalcon/smolDB/log"
 
@@ -47,8 +52,8 @@ func Health(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 // handles GET /keys
 // returns a list of all keys in the database
 func GetKeys(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	log.Info("retrieving index")
-	files := index.I.ListKeys()
+	log.RInfo(w, "retrieving index")
+	files := acl.Readable(auth.FromContext(r.Context()), index.R.ListKeys())
 
 	data := struct {
 		Files []string `json:"files"`
@@ -64,7 +69,11 @@ func GetKeys(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 // handles POST /regenerate
 // rebuilds the entire database index
 func RegenerateIndex(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	index.I.Regenerate()
+	if !permitted(w, r, acl.Admin, "") {
+		return
+	}
+	index.R.Regenerate()
+	audited(w, r, audit.OpRegenerate, index.Change{})
 	log.WInfo(w, "regenerated index")
 }
 
@@ -73,9 +82,12 @@ func RegenerateIndex(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 // supports recursive resolution of references up to specified depth
 func GetKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	key := ps.ByName("key")
-	log.Info("get key '%s'", key)
+	log.RInfo(w, "get key '%s'", key)
+	if !permitted(w, r, acl.Read, key) {
+		return
+	}
 
-	file, ok := index.I.Lookup(key)
+	file, ok := index.R.Lookup(key)
 	if ok {
 		w.Header().Set("Content-Type", "application/json")
 
@@ -88,7 +100,7 @@ func GetKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 		w.Header().Set("Content-Type", "application/json")
 		maxDepth := getMaxDepthParam(r)
-		resolvedJsonMap := index.ResolveReferences(jsonMap, maxDepth)
+		resolvedJsonMap := resolveFor(r, jsonMap, maxDepth)
 
 		jsonData, _ := json.Marshal(resolvedJsonMap)
 		fmt.Fprintf(w, "%+v", string(jsonData))
@@ -103,8 +115,11 @@ func GetKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 // creates or updates the content for a specific key
 func UpdateKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	key := ps.ByName("key")
-	log.Info("put key '%s'", key)
-	file, ok := index.I.Lookup(key)
+	log.RInfo(w, "put key '%s'", key)
+	if !permitted(w, r, acl.Write, key) {
+		return
+	}
+	file, ok := index.R.Lookup(key)
 
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -113,12 +128,16 @@ func UpdateKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 
-	err = index.I.Put(file, bodyBytes)
+	changes, err := commit(w, r, cluster.Command{Op: cluster.OpPut, Key: key, Body: string(bodyBytes)}, func() ([]index.Change, error) {
+		change, err := index.R.PutChange(file, bodyBytes)
+		return []index.Change{change}, err
+	})
 	if err != nil {
-		w.WriteHeader(serverErrorStatus)
+		w.WriteHeader(writeErrorStatus(err))
 		log.WWarn(w, "err updating key '%s': %s", key, err.Error())
 		return
 	}
+	audited(w, r, audit.OpPut, changes...)
 
 	if ok {
 		log.WInfo(w, "update '%s' successful", key)
@@ -131,16 +150,23 @@ func UpdateKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 // removes a key and its associated content from the database
 func DeleteKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	key := ps.ByName("key")
-	log.Info("delete key '%s'", key)
+	log.RInfo(w, "delete key '%s'", key)
+	if !permitted(w, r, acl.Delete, key) {
+		return
+	}
 
-	file, ok := index.I.Lookup(key)
+	file, ok := index.R.Lookup(key)
 	if ok {
-		err := index.I.Delete(file)
+		changes, err := commit(w, r, cluster.Command{Op: cluster.OpDelete, Key: key}, func() ([]index.Change, error) {
+			change, err := index.R.DeleteChange(file)
+			return []index.Change{change}, err
+		})
 		if err != nil {
-			w.WriteHeader(serverErrorStatus)
+			w.WriteHeader(writeErrorStatus(err))
 			log.WWarn(w, "err unable to delete key '%s': '%s'", key, err.Error())
 			return
 		}
+		audited(w, r, audit.OpDelete, changes...)
 		log.WInfo(w, "delete '%s' successful", key)
 		return
 	}
@@ -156,9 +182,12 @@ func GetKeyField(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	key := ps.ByName("key")
 	field := ps.ByName("field")
 
-	log.Info("get field '%s' in key '%s'", field, key)
+	log.RInfo(w, "get field '%s' in key '%s'", field, key)
+	if !permitted(w, r, acl.Read, key) {
+		return
+	}
 
-	file, ok := index.I.Lookup(key)
+	file, ok := index.R.Lookup(key)
 	if ok {
 		jsonMap, err := file.ToMap()
 		if err != nil {
@@ -177,7 +206,7 @@ func GetKeyField(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 		w.Header().Set("Content-Type", "application/json")
 		maxDepth := getMaxDepthParam(r)
-		resolvedValue := index.ResolveReferences(val, maxDepth)
+		resolvedValue := resolveFor(r, val, maxDepth)
 
 		jsonData, _ := json.Marshal(resolvedValue)
 		fmt.Fprintf(w, "%+v", string(jsonData))
@@ -194,7 +223,10 @@ func GetKeyField(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 func PatchKeyField(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	key := ps.ByName("key")
 	field := ps.ByName("field")
-	log.Info("patch field '%s' in key '%s'", field, key)
+	log.RInfo(w, "patch field '%s' in key '%s'", field, key)
+	if !permitted(w, r, acl.Patch, key) {
+		return
+	}
 
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -203,34 +235,37 @@ func PatchKeyField(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		return
 	}
 
-	file, ok := index.I.Lookup(key)
+	file, ok := index.R.Lookup(key)
 	if ok {
-		jsonMap, err := file.ToMap()
-		if err != nil {
-			w.WriteHeader(badRequestStatus)
-			log.WWarn(w, "err key '%s' cannot be parsed into json: %s", key, err.Error())
-			return
-		}
-
+		var value interface{}
 		var parsedJSON map[string]interface{}
 
 		err = json.Unmarshal(bodyBytes, &parsedJSON)
 		if err != nil {
 			// if parsing as JSON fails, treat it as a primitive value
-			jsonMap[field] = string(bodyBytes)
+			value = string(bodyBytes)
 		} else {
 			// if parsing succeeds, it's a JSON object
-			jsonMap[field] = parsedJSON
+			value = parsedJSON
 		}
-		jsonData, _ := json.Marshal(jsonMap)
 
-		err = index.I.Put(file, jsonData)
+		body, _ := json.Marshal(value)
+		changes, err := commit(w, r, cluster.Command{Op: cluster.OpPatch, Key: key, Field: field, Body: string(body)}, func() ([]index.Change, error) {
+			change, err := index.R.PatchFieldChange(file, field, value)
+			return []index.Change{change}, err
+		})
+		if errors.Is(err, index.ErrNotJSONObject) {
+			w.WriteHeader(badRequestStatus)
+			log.WWarn(w, "err key '%s' cannot be parsed into json: %s", key, err.Error())
+			return
+		}
 		if err != nil {
-			w.WriteHeader(serverErrorStatus)
+			w.WriteHeader(writeErrorStatus(err))
 			log.WWarn(w, "err setting content of key '%s': %s", key, err.Error())
 			return
 		}
 
+		audited(w, r, audit.OpPatch, changes...)
 		w.WriteHeader(successStatus)
 		log.WInfo(w, "patch field '%s' of key '%s' successful", field, key)
 		return
@@ -2,7 +2,10 @@
 package api
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -368,4 +371,110 @@ func TestPatchKeyField(t *testing.T) {
 		assertHTTPStatus(t, rr, http.StatusOK)
 		assertJSONFileContents(t, index.I, "test", expected)
 	})
+
+	// Test Case 4: when the stored document isn't a JSON object
+	t.Run("patch field of key that isn't a json object", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+
+		af.WriteFile(index.I.FileSystem, "test.json", []byte("[1, 2, 3]"), 0644)
+		index.I.Regenerate()
+
+		req, _ := http.NewRequest("PATCH", "/test/field", bytes.NewReader([]byte("value")))
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusBadRequest)
+		assertRawFileContents(t, index.I, "test", []byte("[1, 2, 3]"))
+	})
+}
+
+// verifies the backup endpoint streams a complete tar archive
+func TestBackup(t *testing.T) {
+	router := httprouter.New()
+	router.POST("/admin/backup", Backup)
+
+	// returns the names of the entries in a backup stream
+	entryNames := func(t *testing.T, r io.Reader) []string {
+		var names []string
+		tr := tar.NewReader(r)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return names
+			}
+			if err != nil {
+				t.Fatalf("failed to read backup: %v", err)
+			}
+			names = append(names, header.Name)
+		}
+	}
+
+	// Test Case 1: plain tar backup
+	t.Run("backup as tar", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+		_ = makeNewJSON("something", exampleJSON)
+		index.I.Regenerate()
+
+		req := httptest.NewRequest("POST", "/admin/backup", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		if got := rr.Header().Get("Content-Type"); got != "application/x-tar" {
+			t.Errorf("wrong content type %s", got)
+		}
+		names := entryNames(t, rr.Body)
+		assertSliceContains(t, names, "documents/something.json")
+		assertSliceContains(t, names, "documents/something.json.meta")
+		assertSliceContains(t, names, "manifest.json")
+	})
+
+	// Test Case 2: gzip compressed backup
+	t.Run("backup as gzip", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+		_ = makeNewJSON("something", exampleJSON)
+		index.I.Regenerate()
+
+		req := httptest.NewRequest("POST", "/admin/backup?gzip=true", nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		gz, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatalf("backup isn't gzip compressed: %v", err)
+		}
+		assertSliceContains(t, entryNames(t, gz), "manifest.json")
+	})
+
+	// Test Case 3: incremental backup on top of a previous one
+	t.Run("incremental backup", func(t *testing.T) {
+		index.I.SetFileSystem(af.NewMemMapFs())
+		index.I.Regenerate()
+		_ = index.I.Put(&index.File{FileName: "something"}, []byte(`{"v":1}`))
+
+		req := httptest.NewRequest("POST", "/admin/backup", nil)
+		full := httptest.NewRecorder()
+		router.ServeHTTP(full, req)
+		assertHTTPStatus(t, full, http.StatusOK)
+
+		_ = index.I.Put(&index.File{FileName: "other"}, []byte(`{"v":1}`))
+		req = httptest.NewRequest("POST", "/admin/backup?incremental=true", full.Body)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		names := entryNames(t, rr.Body)
+		assertSliceContains(t, names, "documents/other.json")
+		for _, name := range names {
+			if name == "documents/something.json" {
+				t.Errorf("unchanged document in incremental backup")
+			}
+		}
+
+		// a body that isn't a backup is rejected
+		req = httptest.NewRequest("POST", "/admin/backup?incremental=true", bytes.NewBufferString("nope"))
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assertHTTPStatus(t, rr, http.StatusBadRequest)
+	})
 }
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/themillenniumfalcon/smolDB/audit"
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/cluster"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// records the changes a write r asked for made in the audit log as op,
+// their checksums were read by the write itself
+func audited(w http.ResponseWriter, r *http.Request, op string, changes ...index.Change) {
+	if audit.L == nil {
+		return
+	}
+	for _, c := range changes {
+		audit.Record(audit.Entry{
+			Client:    clientOf(r),
+			Op:        op,
+			Key:       c.Key,
+			Before:    c.Before,
+			After:     c.After,
+			RequestID: w.Header().Get(log.RequestIDHeader),
+		})
+	}
+}
+
+// AuditApplied records the changes a command applied by the cluster made,
+// every node records the commands it applies under the client that sent
+// them to the leader
+func AuditApplied(cmd *cluster.Command, changes []index.Change) {
+	if audit.L == nil {
+		return
+	}
+	for _, c := range changes {
+		audit.Record(audit.Entry{
+			Client:    cmd.Client,
+			Op:        audit.OpOf(cmd.Op, c.After),
+			Key:       c.Key,
+			Before:    c.Before,
+			After:     c.After,
+			RequestID: cmd.RequestID,
+		})
+	}
+}
+
+// records an admin action r asked for in the audit log
+func auditedAdmin(w http.ResponseWriter, r *http.Request, format string, args ...interface{}) {
+	audit.Record(audit.Entry{
+		Client:    clientOf(r),
+		Op:        audit.OpAdmin,
+		Detail:    fmt.Sprintf(format, args...),
+		RequestID: w.Header().Get(log.RequestIDHeader),
+	})
+}
+
+// identifies the client that sent r, by the identity it authenticated as
+// when it did
+func clientOf(r *http.Request) string {
+	if id := auth.FromContext(r.Context()); id != nil {
+		return id.Name + " (" + r.RemoteAddr + ")"
+	}
+	return r.RemoteAddr
+}
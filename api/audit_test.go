@@ -0,0 +1,115 @@
+// provides tests for auditing changes made through the API
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/audit"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// verifies that every change is recorded with its client and checksums
+func TestAudit(t *testing.T) {
+	fs := af.NewMemMapFs()
+	index.I.SetFileSystem(fs)
+	l, err := audit.Open(fs, "db")
+	assert.NoError(t, err)
+	audit.L = l
+	defer func() {
+		audit.L = nil
+		l.Close()
+	}()
+
+	router := httprouter.New()
+	router.GET("/key/:key", GetKey)
+	router.PUT("/key/:key", UpdateKey)
+	router.DELETE("/key/:key", DeleteKey)
+	router.PATCH("/key/:key/field/:field", PatchKeyField)
+	router.POST("/regenerate", RegenerateIndex)
+	handler := Middleware(router)
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.RemoteAddr = "10.0.0.7:5000"
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test Case 1: changes are recorded in order, reads aren't
+	t.Run("changes", func(t *testing.T) {
+		assertHTTPStatus(t, serve("PUT", "/key/audited", `{"v":1}`), http.StatusOK)
+		assertHTTPStatus(t, serve("PUT", "/key/audited", `{"v":2}`), http.StatusOK)
+		assertHTTPStatus(t, serve("GET", "/key/audited", ""), http.StatusOK)
+		assertHTTPStatus(t, serve("PATCH", "/key/audited/field/v", `3`), http.StatusOK)
+		rr := serve("DELETE", "/key/audited", "")
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertHTTPStatus(t, serve("DELETE", "/key/audited", ""), http.StatusNotFound)
+		assertHTTPStatus(t, serve("POST", "/regenerate", ""), http.StatusOK)
+
+		entries, err := audit.Query(fs, "db", audit.Filter{})
+		assert.NoError(t, err)
+		var ops []string
+		for _, e := range entries {
+			ops = append(ops, e.Op)
+			assert.Equal(t, "10.0.0.7:5000", e.Client)
+			assert.NotEmpty(t, e.RequestID)
+		}
+		assert.Equal(t, []string{audit.OpPut, audit.OpPut, audit.OpPatch, audit.OpDelete, audit.OpRegenerate}, ops)
+
+		// each change starts from where the previous one left the key
+		assert.Empty(t, entries[0].Before)
+		for k := 1; k < 4; k++ {
+			assert.Equal(t, entries[k-1].After, entries[k].Before)
+			assert.NotEmpty(t, entries[k].Before)
+		}
+		assert.Empty(t, entries[3].After)
+		assert.Equal(t, rr.Header().Get(log.RequestIDHeader), entries[3].RequestID)
+	})
+
+	// Test Case 2: concurrent writes to a key each record the checksums
+	// around their own change, so the entries chain up
+	t.Run("concurrent writers", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for n := 0; n < 100; n++ {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				if n%2 == 0 {
+					assertHTTPStatus(t, serve("PUT", "/key/racy", fmt.Sprintf(`{"n":%d}`, n)), http.StatusOK)
+					return
+				}
+				rr := serve("PATCH", fmt.Sprintf("/key/racy/field/f%d", n), "1")
+				// patches before the first put find no key
+				if rr.Code != http.StatusNotFound {
+					assertHTTPStatus(t, rr, http.StatusOK)
+				}
+			}(n)
+		}
+		wg.Wait()
+
+		entries, err := audit.Query(fs, "db", audit.Filter{Key: "racy"})
+		assert.NoError(t, err)
+		next := map[string]audit.Entry{}
+		for _, e := range entries {
+			_, dup := next[e.Before]
+			assert.False(t, dup, "two changes start from %q", e.Before)
+			next[e.Before] = e
+		}
+		at, walked := "", 0
+		for e, ok := next[at]; ok; e, ok = next[at] {
+			at = e.After
+			walked++
+		}
+		assert.Equal(t, len(entries), walked)
+		assert.Equal(t, index.R.Checksum("racy"), at)
+	})
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// DefaultPublic are the routes served without credentials unless
+// configured otherwise, the health check
+var DefaultPublic = []string{"GET /"}
+
+// authenticator checks requests when set, routes in public skip it
+var (
+	authenticator auth.Authenticator
+	public        map[string]bool
+)
+
+// SetAuth makes every request authenticate with a, except for the public
+// routes, given as a route pattern like /key/:key optionally preceded by a
+// method, e.g. "GET /". A nil a turns authentication off
+func SetAuth(a auth.Authenticator, routes []string) {
+	authenticator = a
+	public = map[string]bool{}
+	for _, route := range routes {
+		if route = strings.TrimSpace(route); route != "" {
+			public[route] = true
+		}
+	}
+}
+
+// reports whether the route pattern may be requested without credentials
+func isPublic(method, route string) bool {
+	return public[route] || public[method+" "+route]
+}
+
+// authenticates r unless the route is public, a rejected request is
+// answered with 401 and nil is returned
+func authenticate(w http.ResponseWriter, r *http.Request, route string) (*http.Request, bool) {
+	if authenticator == nil || isPublic(r.Method, route) {
+		return r, true
+	}
+	id, err := authenticator.Authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="smoldb"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		if errors.Is(err, auth.ErrNoCredentials) {
+			log.WWarn(w, "unauthorized: credentials required for %s %s", r.Method, r.URL.Path)
+		} else {
+			log.WWarn(w, "unauthorized: %s", err.Error())
+		}
+		return nil, false
+	}
+	return r.WithContext(auth.NewContext(r.Context(), id)), true
+}
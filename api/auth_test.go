@@ -0,0 +1,73 @@
+// provides tests for authenticating requests
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+// verifies that only public routes are served without credentials and
+// that handlers see who a request authenticated as
+func TestAuth(t *testing.T) {
+	index.I.SetFileSystem(af.NewMemMapFs())
+	keys, err := auth.NewAPIKeys("", "alice:a-secret")
+	assert.NoError(t, err)
+	SetAuth(keys, DefaultPublic)
+	defer SetAuth(nil, nil)
+
+	router := httprouter.New()
+	router.GET("/", Health)
+	router.GET("/key/:key", GetKey)
+	router.PUT("/key/:key", UpdateKey)
+	router.GET("/whoami", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.Write([]byte(auth.FromContext(r.Context()).Name))
+	})
+	handler := Middleware(router)
+	serve := func(method, path, key string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"a":1}`))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test Case 1: requests without valid credentials are refused
+	t.Run("refused", func(t *testing.T) {
+		rr := serve("PUT", "/key/secured", "")
+		assertHTTPStatus(t, rr, http.StatusUnauthorized)
+		assert.NotEmpty(t, rr.Header().Get("WWW-Authenticate"))
+		assertHTTPStatus(t, serve("GET", "/key/secured", "wrong"), http.StatusUnauthorized)
+		_, ok := index.I.Lookup("secured")
+		assert.False(t, ok)
+	})
+
+	// Test Case 2: authenticated requests reach the handler with an identity
+	t.Run("accepted", func(t *testing.T) {
+		assertHTTPStatus(t, serve("PUT", "/key/secured", "a-secret"), http.StatusOK)
+		assertHTTPStatus(t, serve("GET", "/key/secured", "a-secret"), http.StatusOK)
+		rr := serve("GET", "/whoami", "a-secret")
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assert.Equal(t, "alice", rr.Body.String())
+	})
+
+	// Test Case 3: public routes are served to anyone, per method
+	t.Run("public", func(t *testing.T) {
+		assertHTTPStatus(t, serve("GET", "/", ""), http.StatusOK)
+		SetAuth(keys, []string{"/key/:key"})
+		assertHTTPStatus(t, serve("GET", "/key/secured", ""), http.StatusOK)
+		assertHTTPStatus(t, serve("GET", "/", ""), http.StatusUnauthorized)
+		SetAuth(keys, []string{"GET /key/:key"})
+		assertHTTPStatus(t, serve("GET", "/key/secured", ""), http.StatusOK)
+		assertHTTPStatus(t, serve("PUT", "/key/secured", ""), http.StatusUnauthorized)
+	})
+}
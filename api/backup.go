@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// countingWriter remembers whether anything reached the client yet
+type countingWriter struct {
+	w       http.ResponseWriter
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// handles POST /admin/backup
+// streams a consistent tar backup of the database, gzip compressed with ?gzip=true.
+// with ?incremental=true the request body holds the manifest of the backup
+// to build on, or that whole backup, and only the changes since it are streamed
+func Backup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !permitted(w, r, acl.Admin, "") {
+		return
+	}
+	compress, _ := strconv.ParseBool(r.URL.Query().Get("gzip"))
+	opts := index.BackupOptions{Compress: compress}
+	if incremental, _ := strconv.ParseBool(r.URL.Query().Get("incremental")); incremental {
+		parent, err := index.ReadBackupManifest(r.Body)
+		if err != nil {
+			w.WriteHeader(badRequestStatus)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		opts.Parent = parent
+	}
+
+	name := "smoldb-backup.tar"
+	w.Header().Set("Content-Type", "application/x-tar")
+	if compress {
+		name += ".gz"
+		w.Header().Set("Content-Type", "application/gzip")
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+
+	out := &countingWriter{w: w}
+	manifest, err := index.I.Backup(out, opts)
+	if err != nil {
+		log.RWarn(w, "backup failed: %s", err.Error())
+		if out.written == 0 {
+			w.Header().Del("Content-Disposition")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(serverErrorStatus)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		// the stream is already under way, cut it off so the client
+		// can't mistake it for a complete backup
+		panic(http.ErrAbortHandler)
+	}
+	auditedAdmin(w, r, "%s backup streamed at lsn %d", manifest.Type, manifest.LSN)
+	log.RInfo(w, "backup streamed at lsn %d", manifest.LSN)
+}
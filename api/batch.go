@@ -0,0 +1,241 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/audit"
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/cluster"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// MaxBatchItems caps the keys a single batch request may name
+const MaxBatchItems = 1000
+
+// batchResult is the outcome of one item of a batch
+type batchResult struct {
+	Key    string      `json:"key"`
+	Status int         `json:"status"`
+	Value  interface{} `json:"value,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// marks the result failed with status
+func (res *batchResult) fail(status int, format string, args ...interface{}) {
+	res.Status = status
+	res.Error = fmt.Sprintf(format, args...)
+}
+
+// handles POST /batch/get
+// returns the content of several keys, each with its own status, references
+// are resolved up to the depth of the request or the depth query parameter
+func BatchGet(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req struct {
+		Keys  []string `json:"keys"`
+		Depth *int     `json:"depth"`
+	}
+	if !readBatch(w, r, &req, func() int { return len(req.Keys) }) {
+		return
+	}
+	log.RInfo(w, "batch get of %d keys", len(req.Keys))
+	depth := getMaxDepthParam(r)
+	if req.Depth != nil {
+		depth = *req.Depth
+	}
+
+	id := auth.FromContext(r.Context())
+	results := make([]batchResult, len(req.Keys))
+	for k, key := range req.Keys {
+		res := &results[k]
+		res.Key, res.Status = key, successStatus
+		if !checkBatchKey(res, id, acl.Read) {
+			continue
+		}
+		file, ok := index.R.Lookup(key)
+		if !ok {
+			res.fail(notFoundStatus, "key '%s' not found", key)
+			continue
+		}
+		jsonMap, err := file.ToMap()
+		if err != nil {
+			res.fail(badRequestStatus, "err key '%s' cannot be parsed into json: %s", key, err.Error())
+			continue
+		}
+		res.Value = resolveFor(r, jsonMap, depth)
+	}
+	writeBatch(w, successStatus, results)
+}
+
+// handles POST /batch/put
+// creates or updates several keys under a single WAL record, items that
+// can't be written are reported and the others written unless the batch is
+// atomic, then nothing is written
+func BatchPut(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req struct {
+		Items []struct {
+			Key   string          `json:"key"`
+			Value json.RawMessage `json:"value"`
+		} `json:"items"`
+		Atomic bool `json:"atomic"`
+	}
+	if !readBatch(w, r, &req, func() int { return len(req.Items) }) {
+		return
+	}
+	log.RInfo(w, "batch put of %d keys", len(req.Items))
+
+	id := auth.FromContext(r.Context())
+	results := make([]batchResult, len(req.Items))
+	var ops []index.BatchOp
+	var applied []int
+	for k, item := range req.Items {
+		res := &results[k]
+		res.Key, res.Status = item.Key, successStatus
+		if !checkBatchKey(res, id, acl.Write) {
+			continue
+		}
+		if len(item.Value) == 0 {
+			res.fail(badRequestStatus, "err key '%s' has no value", item.Key)
+			continue
+		}
+		ops = append(ops, index.BatchOp{Op: index.BatchPut, Key: item.Key, Body: string(item.Value)})
+		applied = append(applied, k)
+	}
+	commitBatch(w, r, results, ops, applied, req.Atomic, audit.OpPut)
+}
+
+// handles POST /batch/delete
+// removes several keys under a single WAL record, missing keys are
+// reported and the others removed unless the batch is atomic, then nothing
+// is removed
+func BatchDelete(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req struct {
+		Keys   []string `json:"keys"`
+		Atomic bool     `json:"atomic"`
+	}
+	if !readBatch(w, r, &req, func() int { return len(req.Keys) }) {
+		return
+	}
+	log.RInfo(w, "batch delete of %d keys", len(req.Keys))
+
+	id := auth.FromContext(r.Context())
+	results := make([]batchResult, len(req.Keys))
+	var ops []index.BatchOp
+	var applied []int
+	deleted := map[string]bool{}
+	for k, key := range req.Keys {
+		res := &results[k]
+		res.Key, res.Status = key, successStatus
+		if !checkBatchKey(res, id, acl.Delete) {
+			continue
+		}
+		if _, ok := index.R.Lookup(key); !ok || deleted[key] {
+			res.fail(notFoundStatus, "key '%s' does not exist", key)
+			continue
+		}
+		deleted[key] = true
+		ops = append(ops, index.BatchOp{Op: index.BatchDelete, Key: key})
+		applied = append(applied, k)
+	}
+	commitBatch(w, r, results, ops, applied, req.Atomic, audit.OpDelete)
+}
+
+// decodes the JSON body of a batch request into req, count returns the
+// number of items it names. An unreadable or too large batch is answered
+// with 400
+func readBatch(w http.ResponseWriter, r *http.Request, req interface{}, count func() int) bool {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(badRequestStatus)
+		log.WWarn(w, "err invalid batch: %s", err.Error())
+		return false
+	}
+	if n := count(); n > MaxBatchItems {
+		w.WriteHeader(badRequestStatus)
+		log.WWarn(w, "err batch of %d items exceeds the limit of %d", n, MaxBatchItems)
+		return false
+	}
+	return true
+}
+
+// checks that the key of res names a document and that id may perform op
+// on it, fails res otherwise. Keys in the body aren't confined to a path
+// segment like the ones in routes, so they are checked the same way
+func checkBatchKey(res *batchResult, id *auth.Identity, op string) bool {
+	key := res.Key
+	if !index.ValidKey(key) {
+		res.fail(badRequestStatus, "err invalid key '%s'", key)
+		return false
+	}
+	if !acl.Allowed(id, op, key) {
+		res.fail(http.StatusForbidden, "forbidden: '%s' may not %s key '%s'", acl.Name(id), op, key)
+		return false
+	}
+	return true
+}
+
+// writes ops, the items of results at the indexes in applied, and answers
+// with every result. An atomic batch with a failed item, or one that
+// conflicts with a concurrent write, is answered with 409 and the items
+// that would have been written with 424. One spanning shards gets 400
+func commitBatch(w http.ResponseWriter, r *http.Request, results []batchResult, ops []index.BatchOp, applied []int, atomic bool, op string) {
+	abort := func() {
+		for _, k := range applied {
+			results[k].fail(http.StatusFailedDependency, "not applied, the batch failed")
+		}
+		log.RWarn(w, "atomic batch not applied")
+		writeBatch(w, http.StatusConflict, results)
+	}
+	if atomic && len(applied) < len(results) {
+		abort()
+		return
+	}
+	if len(ops) == 0 {
+		writeBatch(w, successStatus, results)
+		return
+	}
+
+	err := applyBatch(w, r, ops, atomic, op)
+	if errors.Is(err, index.ErrBatchConflict) {
+		abort()
+		return
+	}
+	if errors.Is(err, index.ErrBatchShards) {
+		w.WriteHeader(badRequestStatus)
+		log.WWarn(w, "err %s, send its keys in one batch per shard or without atomic", err.Error())
+		return
+	}
+	if err != nil {
+		w.WriteHeader(writeErrorStatus(err))
+		log.WWarn(w, "err applying batch: %s", err.Error())
+		return
+	}
+	writeBatch(w, successStatus, results)
+}
+
+// writes ops, through the cluster when there is one, and records every key
+// they change as op in the audit log
+func applyBatch(w http.ResponseWriter, r *http.Request, ops []index.BatchOp, atomic bool, op string) error {
+	body, _ := json.Marshal(ops)
+	changes, err := commit(w, r, cluster.Command{Op: cluster.OpBatch, Body: string(body), Atomic: atomic}, func() ([]index.Change, error) {
+		return index.R.BatchChanges(ops, atomic)
+	})
+	if err != nil {
+		return err
+	}
+	audited(w, r, op, changes...)
+	return nil
+}
+
+// answers with the results of a batch
+func writeBatch(w http.ResponseWriter, status int, results []batchResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Results []batchResult `json:"results"`
+	}{Results: results})
+}
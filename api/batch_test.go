@@ -0,0 +1,133 @@
+// provides tests for the batch endpoints
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+// verifies that batches report every item and apply all or nothing when
+// asked to
+func TestBatch(t *testing.T) {
+	index.I.SetFileSystem(af.NewMemMapFs())
+	router := httprouter.New()
+	router.POST("/batch/get", BatchGet)
+	router.POST("/batch/put", BatchPut)
+	router.POST("/batch/delete", BatchDelete)
+	handler := Middleware(router)
+
+	// serves a batch and returns the status and item statuses and values
+	type result struct {
+		Key    string
+		Status int
+		Value  map[string]interface{}
+	}
+	serve := func(path, body, key string) (int, []result) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		handler.ServeHTTP(rr, req)
+		var res struct{ Results []result }
+		json.Unmarshal(rr.Body.Bytes(), &res)
+		return rr.Code, res.Results
+	}
+	statuses := func(results []result) []int {
+		var res []int
+		for _, r := range results {
+			res = append(res, r.Status)
+		}
+		return res
+	}
+
+	// Test Case 1: valid items are written, the others reported
+	t.Run("put and get", func(t *testing.T) {
+		code, results := serve("/batch/put", `{"items": [
+			{"key": "a", "value": {"v": 1}},
+			{"key": "b", "value": {"ref": "REF::a"}},
+			{"key": "../escape", "value": {}},
+			{"key": "c"}
+		]}`, "")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []int{200, 200, 400, 400}, statuses(results))
+		_, ok := index.I.Lookup("c")
+		assert.False(t, ok)
+
+		code, results = serve("/batch/get?depth=0", `{"keys": ["b", "a", "missing"], "depth": 1}`, "")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []int{200, 200, 404}, statuses(results))
+		assert.Equal(t, map[string]interface{}{"ref": map[string]interface{}{"v": 1.0}}, results[0].Value)
+
+		_, results = serve("/batch/get?depth=0", `{"keys": ["b"]}`, "")
+		assert.Equal(t, map[string]interface{}{"ref": "REF::a"}, results[0].Value)
+	})
+
+	// Test Case 2: an atomic batch with a failing item writes nothing
+	t.Run("atomic", func(t *testing.T) {
+		code, results := serve("/batch/put", `{"atomic": true, "items": [
+			{"key": "d", "value": {}},
+			{"key": "", "value": {}}
+		]}`, "")
+		assert.Equal(t, http.StatusConflict, code)
+		assert.Equal(t, []int{424, 400}, statuses(results))
+		_, ok := index.I.Lookup("d")
+		assert.False(t, ok)
+
+		code, results = serve("/batch/delete", `{"atomic": true, "keys": ["a", "missing"]}`, "")
+		assert.Equal(t, http.StatusConflict, code)
+		assert.Equal(t, []int{424, 404}, statuses(results))
+		_, ok = index.I.Lookup("a")
+		assert.True(t, ok)
+
+		code, results = serve("/batch/delete", `{"keys": ["a", "missing", "a"]}`, "")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []int{200, 404, 404}, statuses(results))
+		_, ok = index.I.Lookup("a")
+		assert.False(t, ok)
+	})
+
+	// Test Case 3: the policy is checked for every item
+	t.Run("acl", func(t *testing.T) {
+		keys, err := auth.NewAPIKeys("", "alice:a-secret")
+		assert.NoError(t, err)
+		SetAuth(keys, DefaultPublic)
+		defer SetAuth(nil, nil)
+		path := filepath.Join(t.TempDir(), "acl.json")
+		assert.NoError(t, os.WriteFile(path, []byte(`{
+			"roles": {"team-a": [{"prefix": "team-a-", "allow": ["read", "write"]}]},
+			"identities": {"alice": ["team-a"]}
+		}`), 0o600))
+		policy, err := acl.Load(path)
+		assert.NoError(t, err)
+		acl.Set(policy)
+		defer acl.Set(nil)
+
+		_, results := serve("/batch/put", `{"items": [{"key": "team-a-x", "value": {}}, {"key": "b", "value": {}}]}`, "a-secret")
+		assert.Equal(t, []int{200, 403}, statuses(results))
+		_, results = serve("/batch/get", `{"keys": ["team-a-x", "b"]}`, "a-secret")
+		assert.Equal(t, []int{200, 403}, statuses(results))
+		_, results = serve("/batch/delete", `{"keys": ["team-a-x"]}`, "a-secret")
+		assert.Equal(t, []int{403}, statuses(results))
+	})
+
+	// Test Case 4: unreadable and oversized batches are refused
+	t.Run("invalid", func(t *testing.T) {
+		code, _ := serve("/batch/get", `{"keys": "a"}`, "")
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = serve("/batch/delete", `{"keys": [`+strings.Repeat(`"k",`, MaxBatchItems)+`"k"]}`, "")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+}
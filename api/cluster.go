@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/cluster"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// WriteTimeout is how long a write waits to be committed by the cluster
+var WriteTimeout = 10 * time.Second
+
+// node is set when this server is a member of a cluster
+var node *cluster.Node
+
+// SetCluster makes writes go through the given cluster node
+func SetCluster(n *cluster.Node) {
+	node = n
+}
+
+// applies a write, in cluster mode it is committed by a majority of the
+// nodes and applied by the node itself instead of calling local. Returns
+// the changes local made, in cluster mode the nodes audit them as they
+// apply the write
+func commit(w http.ResponseWriter, r *http.Request, cmd cluster.Command, local func() ([]index.Change, error)) ([]index.Change, error) {
+	if node == nil {
+		return local()
+	}
+	cmd.Client = clientOf(r)
+	cmd.RequestID = w.Header().Get(log.RequestIDHeader)
+	ctx, cancel := context.WithTimeout(r.Context(), WriteTimeout)
+	defer cancel()
+	return nil, node.Propose(ctx, cmd)
+}
+
+// maps a failed write to the status it is answered with
+func writeErrorStatus(err error) int {
+	var notLeader *cluster.NotLeaderError
+	switch {
+	case errors.Is(err, cluster.ErrKeyNotFound):
+		return notFoundStatus
+	case errors.Is(err, cluster.ErrMembershipChange):
+		return http.StatusConflict
+	case errors.As(err, &notLeader), errors.Is(err, cluster.ErrLeadershipLost), errors.Is(err, context.DeadlineExceeded), errors.Is(err, index.ErrClosed):
+		return http.StatusServiceUnavailable
+	}
+	return serverErrorStatus
+}
+
+// LeaderOnly wraps a handler that modifies the database, in cluster mode
+// followers redirect the request to the leader with 307 so clients resend it
+// there, 503 while no leader is known
+func LeaderOnly(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if node == nil {
+			h(w, r, ps)
+			return
+		}
+		s := node.Status()
+		if s.Role == cluster.RoleLeader.String() {
+			h(w, r, ps)
+			return
+		}
+		if s.LeaderAddr == "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			log.WWarn(w, "no cluster leader elected, try again later")
+			return
+		}
+		http.Redirect(w, r, s.LeaderAddr+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}
+}
+
+// decodes the JSON body of a raft RPC into req, answers 400 on failure
+func decodeRPC(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(badRequestStatus)
+		log.WWarn(w, "invalid raft request: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+// answers a raft RPC with resp, or 500 if the node failed to handle it
+func answerRPC(w http.ResponseWriter, resp interface{}, err error) {
+	if err != nil {
+		w.WriteHeader(serverErrorStatus)
+		log.WWarn(w, "raft: %s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handles POST /cluster/raft/vote, like every /cluster route it is only
+// registered in cluster mode
+func ClusterVote(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !permitted(w, r, acl.Admin, "") {
+		return
+	}
+	req := &cluster.VoteRequest{}
+	if decodeRPC(w, r, req) {
+		resp, err := node.HandleRequestVote(req)
+		answerRPC(w, resp, err)
+	}
+}
+
+// handles POST /cluster/raft/append
+func ClusterAppend(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !permitted(w, r, acl.Admin, "") {
+		return
+	}
+	req := &cluster.AppendRequest{}
+	if decodeRPC(w, r, req) {
+		resp, err := node.HandleAppendEntries(req)
+		answerRPC(w, resp, err)
+	}
+}
+
+// handles POST /cluster/raft/snapshot
+func ClusterSnapshot(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !permitted(w, r, acl.Admin, "") {
+		return
+	}
+	req := &cluster.SnapshotRequest{}
+	if decodeRPC(w, r, req) {
+		resp, err := node.HandleInstallSnapshot(req)
+		answerRPC(w, resp, err)
+	}
+}
+
+// handles GET /cluster/status
+// reports the role, term, leader and log positions of this node
+func ClusterStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !permitted(w, r, acl.Admin, "") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(node.Status())
+}
+
+// handles POST /cluster/members
+// adds the node {"id": ..., "addr": ...} to the cluster, answered once the
+// change is committed
+func ClusterJoin(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !permitted(w, r, acl.Admin, "") {
+		return
+	}
+	var m cluster.Member
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil || m.ID == "" || m.Addr == "" {
+		w.WriteHeader(badRequestStatus)
+		log.WWarn(w, "expected a member as {\"id\": ..., \"addr\": ...}")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), WriteTimeout)
+	defer cancel()
+	if err := node.AddMember(ctx, m); err != nil {
+		w.WriteHeader(writeErrorStatus(err))
+		log.WWarn(w, "err adding member '%s': %s", m.ID, err.Error())
+		return
+	}
+	log.WInfo(w, "added member '%s' at %s", m.ID, m.Addr)
+}
+
+// handles DELETE /cluster/members/:id
+// removes a node from the cluster, answered once the change is committed
+func ClusterLeave(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !permitted(w, r, acl.Admin, "") {
+		return
+	}
+	id := ps.ByName("id")
+	ctx, cancel := context.WithTimeout(r.Context(), WriteTimeout)
+	defer cancel()
+	if err := node.RemoveMember(ctx, id); err != nil {
+		w.WriteHeader(writeErrorStatus(err))
+		log.WWarn(w, "err removing member '%s': %s", id, err.Error())
+		return
+	}
+	log.WInfo(w, "removed member '%s'", id)
+}
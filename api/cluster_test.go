@@ -0,0 +1,154 @@
+// provides tests for the cluster endpoints and write routing in cluster mode
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/themillenniumfalcon/smolDB/cluster"
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+// opens a fresh database in a temporary directory as the global index and
+// creates a cluster node on it
+func newClusterNode(t *testing.T, id string) *cluster.Node {
+	t.Helper()
+
+	dir := t.TempDir()
+	index.I = index.NewFileIndex(dir)
+	if err := index.I.InitWAL(index.DurabilityNone); err != nil {
+		t.Fatal(err)
+	}
+	n, err := cluster.NewNode(cluster.Config{
+		ID:                id,
+		Addr:              "http://" + id,
+		Dir:               dir,
+		HeartbeatInterval: 20 * time.Millisecond,
+		ElectionTimeout:   300 * time.Millisecond,
+	}, index.I)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// verifies that writes in cluster mode go through the leader
+func TestCluster(t *testing.T) {
+	defer func(i *index.FileIndex) { index.I = i }(index.I)
+	defer SetCluster(nil)
+
+	router := httprouter.New()
+	router.GET("/key/:key", GetKey)
+	router.PUT("/key/:key", LeaderOnly(UpdateKey))
+	router.DELETE("/key/:key", LeaderOnly(DeleteKey))
+	router.PATCH("/key/:key/field/:field", LeaderOnly(PatchKeyField))
+	router.GET("/cluster/status", ClusterStatus)
+	router.POST("/cluster/members", LeaderOnly(ClusterJoin))
+	router.POST("/cluster/raft/vote", ClusterVote)
+	router.POST("/cluster/raft/append", ClusterAppend)
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return rr
+	}
+
+	// Test Case 1: the leader of a single node cluster commits writes before applying them
+	t.Run("writes on the leader", func(t *testing.T) {
+		n := newClusterNode(t, "n1")
+		SetCluster(n)
+		if err := n.Bootstrap(); err != nil {
+			t.Fatal(err)
+		}
+		n.Start()
+		defer n.Stop()
+		waitFor(t, "n1 to lead", func() bool {
+			return n.Status().Role == "leader"
+		})
+
+		assertHTTPStatus(t, serve("PUT", "/key/a", `{"field":"value"}`), http.StatusOK)
+		assertHTTPStatus(t, serve("PATCH", "/key/a/field/other", `1`), http.StatusOK)
+		assertJSONFileContents(t, index.I, "a", map[string]interface{}{"field": "value", "other": "1"})
+		assertHTTPStatus(t, serve("PUT", "/key/b", `{}`), http.StatusOK)
+		assertHTTPStatus(t, serve("DELETE", "/key/b", ""), http.StatusOK)
+		assertHTTPStatus(t, serve("GET", "/key/b", ""), http.StatusNotFound)
+
+		rr := serve("GET", "/cluster/status", "")
+		var status cluster.Status
+		if err := json.NewDecoder(rr.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		if status.Role != "leader" || status.Applied != status.Commit || status.Applied < 5 {
+			t.Errorf("unexpected status %+v", status)
+		}
+
+		// a node that never comes up can't be added, the majority would be lost
+		WriteTimeout = 50 * time.Millisecond
+		defer func() { WriteTimeout = 10 * time.Second }()
+		assertHTTPStatus(t, serve("POST", "/cluster/members", `{"id":"n2","addr":"http://n2"}`), http.StatusServiceUnavailable)
+		assertHTTPStatus(t, serve("POST", "/cluster/members", `{"id":"n3","addr":"http://n3"}`), http.StatusConflict)
+		assertHTTPStatus(t, serve("POST", "/cluster/members", `{"id":"n3"}`), http.StatusBadRequest)
+	})
+
+	// Test Case 2: followers redirect writes to the leader and serve reads themselves
+	t.Run("writes on a follower", func(t *testing.T) {
+		n := newClusterNode(t, "n2")
+		defer n.Stop()
+		SetCluster(n)
+
+		rr := serve("PUT", "/key/a?depth=1", `{}`)
+		assertHTTPStatus(t, rr, http.StatusServiceUnavailable)
+
+		// a heartbeat tells the follower who leads
+		_, err := n.HandleAppendEntries(&cluster.AppendRequest{Term: 1, Leader: "n1", LeaderAddr: "http://leader:8080"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = serve("PUT", "/key/a?depth=1", `{}`)
+		assertHTTPStatus(t, rr, http.StatusTemporaryRedirect)
+		if got := rr.Header().Get("Location"); got != "http://leader:8080/key/a?depth=1" {
+			t.Errorf("redirected to %s", got)
+		}
+		assertHTTPStatus(t, serve("DELETE", "/key/a", ""), http.StatusTemporaryRedirect)
+		assertHTTPStatus(t, serve("PATCH", "/key/a/field/f", "1"), http.StatusTemporaryRedirect)
+		assertHTTPStatus(t, serve("GET", "/key/a", ""), http.StatusNotFound)
+	})
+
+	// Test Case 3: raft messages travel over HTTP
+	t.Run("http transport", func(t *testing.T) {
+		n := newClusterNode(t, "n2")
+		defer n.Stop()
+		SetCluster(n)
+		server := httptest.NewServer(router)
+		defer server.Close()
+
+		transport := cluster.NewHTTPTransport()
+		ctx := context.Background()
+		entries := []cluster.Entry{{Index: 1, Term: 1, Type: "config", Members: []cluster.Member{{ID: "n1", Addr: "http://n1"}}}}
+		appended, err := transport.AppendEntries(ctx, server.URL, &cluster.AppendRequest{Term: 1, Leader: "n1", Entries: entries, Commit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !appended.Success || appended.LastIndex != 1 {
+			t.Errorf("append wasn't accepted: %+v", appended)
+		}
+
+		// the follower still hears from its leader and doesn't vote
+		vote, err := transport.RequestVote(ctx, server.URL, &cluster.VoteRequest{Term: 2, Candidate: "n3", LastIndex: 1, LastTerm: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vote.Granted || vote.Term != 1 {
+			t.Errorf("unexpected vote %+v", vote)
+		}
+
+		if _, err := transport.AppendEntries(ctx, server.URL+"/nope", &cluster.AppendRequest{}); err == nil {
+			t.Errorf("expected an error from a missing endpoint")
+		}
+	})
+}
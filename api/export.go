@@ -0,0 +1,170 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/audit"
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// errForbidden refuses an imported key the client may not write
+var errForbidden = errors.New("forbidden")
+
+// importProblem is a line an import couldn't take
+type importProblem struct {
+	Line  int    `json:"line"`
+	Key   string `json:"key,omitempty"`
+	Error string `json:"error"`
+}
+
+// importSummary reports the progress or the outcome of an import
+type importSummary struct {
+	Lines    int             `json:"lines"`
+	Imported int             `json:"imported"`
+	Skipped  int             `json:"skipped"`
+	Failed   int             `json:"failed"`
+	Batches  int             `json:"batches"`
+	DryRun   bool            `json:"dry_run"`
+	Done     bool            `json:"done"`
+	Errors   []importProblem `json:"errors,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// handles GET /export?prefix=<prefix>
+// streams the documents the client may read as NDJSON ordered by key, one
+// {"key", "doc", "meta"} object per line, only keys starting with prefix
+// when it is set
+func Export(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	prefix := r.URL.Query().Get("prefix")
+	log.RInfo(w, "export of keys with prefix '%s'", prefix)
+	id := auth.FromContext(r.Context())
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	out := &countingWriter{w: w}
+	stats, err := index.R.Export(out, prefix, func(key string) bool {
+		return acl.Allowed(id, acl.Read, key)
+	})
+	if err != nil {
+		log.RWarn(w, "export failed: %s", err.Error())
+		if out.written == 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(serverErrorStatus)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		// the stream is already under way, cut it off so the client
+		// can't mistake it for a complete export
+		panic(http.ErrAbortHandler)
+	}
+	log.RInfo(w, "exported %d documents, skipped %d", stats.Exported, stats.Skipped)
+}
+
+// handles POST /import?conflict=skip|overwrite|fail&batch=<n>&dry_run=true&progress=true
+// writes the documents of an NDJSON body as produced by GET /export in
+// batches, keys that exist are skipped, overwritten or stop the import.
+// An import stops at the first line it can't take, batches written before
+// it stay written. A dry run validates every line and reports the problems
+// without writing. With progress set a summary line is streamed after every
+// batch, the last one has done set
+func Import(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query()
+	opts := index.ImportOptions{Conflict: query.Get("conflict")}
+	if s := query.Get("batch"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MaxBatchItems {
+			w.WriteHeader(badRequestStatus)
+			log.WWarn(w, "err invalid batch size '%s', expected 1 to %d", s, MaxBatchItems)
+			return
+		}
+		opts.BatchSize = n
+	}
+	opts.DryRun, _ = strconv.ParseBool(query.Get("dry_run"))
+	progress, _ := strconv.ParseBool(query.Get("progress"))
+	log.RInfo(w, "import with conflict mode '%s', dry run %t", opts.Conflict, opts.DryRun)
+
+	id := auth.FromContext(r.Context())
+	opts.Allow = func(key string) error {
+		if !acl.Allowed(id, acl.Write, key) {
+			return errForbidden
+		}
+		return nil
+	}
+	var applyErr error
+	opts.Apply = func(ops []index.BatchOp) error {
+		applyErr = applyBatch(w, r, ops, false, audit.OpPut)
+		return applyErr
+	}
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	streaming := false
+	if progress {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		opts.Progress = func(stats index.ImportStats) {
+			streaming = true
+			enc.Encode(summarize(stats, opts.DryRun))
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	stats, err := index.R.Import(r.Body, opts)
+	var summary importSummary
+	if stats != nil {
+		summary = summarize(*stats, opts.DryRun)
+	}
+	summary.Done = true
+	status := successStatus
+	if err != nil {
+		summary.Error = err.Error()
+		status = importErrorStatus(err, applyErr)
+		log.RWarn(w, "import failed: %s", err.Error())
+	} else {
+		log.RInfo(w, "import of %d lines: %d imported, %d skipped, %d failed", summary.Lines, summary.Imported, summary.Skipped, summary.Failed)
+	}
+	// once progress was streamed the status is already sent
+	if !streaming {
+		w.WriteHeader(status)
+	}
+	enc.Encode(summary)
+}
+
+// maps a failed import to the status it is answered with
+func importErrorStatus(err error, applyErr error) int {
+	switch {
+	case applyErr != nil && err == applyErr:
+		return writeErrorStatus(err)
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, index.ErrImportConflict):
+		return http.StatusConflict
+	}
+	// an invalid line, an unknown conflict mode or an unreadable body
+	return badRequestStatus
+}
+
+// converts the stats of an import into its summary
+func summarize(stats index.ImportStats, dryRun bool) importSummary {
+	res := importSummary{
+		Lines:    stats.Lines,
+		Imported: stats.Imported,
+		Skipped:  stats.Skipped,
+		Failed:   stats.Failed,
+		Batches:  stats.Batches,
+		DryRun:   dryRun,
+	}
+	for _, e := range stats.Errors {
+		res.Errors = append(res.Errors, importProblem{Line: e.Line, Key: e.Key, Error: e.Err.Error()})
+	}
+	return res
+}
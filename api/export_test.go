@@ -0,0 +1,128 @@
+// provides tests for the export and import endpoints
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+// verifies that exports stream what the client may read and imports write
+// it back in batches
+func TestExport(t *testing.T) {
+	index.I.SetFileSystem(af.NewMemMapFs())
+	router := httprouter.New()
+	router.GET("/export", Export)
+	router.POST("/import", Import)
+	handler := Middleware(router)
+	serve := func(method, path, body, key string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	// decodes every line of an NDJSON answer
+	summaries := func(rr *httptest.ResponseRecorder) []importSummary {
+		var res []importSummary
+		dec := json.NewDecoder(rr.Body)
+		for dec.More() {
+			var s importSummary
+			assert.NoError(t, dec.Decode(&s))
+			res = append(res, s)
+		}
+		return res
+	}
+
+	// Test Case 1: an import streams its progress and an export gives back
+	// what was imported
+	t.Run("round trip", func(t *testing.T) {
+		rr := serve("POST", "/import?batch=2&progress=true", `{"key":"team-a-1","doc":{"v":1}}
+{"key":"team-a-2","doc":{"v":2}}
+{"key":"team-b-1","doc":{"v":3}}
+`, "")
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assert.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"))
+		res := summaries(rr)
+		assert.Len(t, res, 3)
+		assert.Equal(t, 2, res[0].Imported)
+		assert.False(t, res[0].Done)
+		assert.Equal(t, 3, res[2].Imported)
+		assert.Equal(t, 2, res[2].Batches)
+		assert.True(t, res[2].Done)
+
+		rr = serve("GET", "/export?prefix=team-a-", "", "")
+		assertHTTPStatus(t, rr, http.StatusOK)
+		lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+		assert.Len(t, lines, 2)
+		var rec index.ExportRecord
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &rec))
+		assert.Equal(t, "team-a-2", rec.Key)
+		assert.JSONEq(t, `{"v":2}`, string(rec.Doc))
+	})
+
+	// Test Case 2: conflicts and invalid lines are reported, a dry run
+	// writes nothing
+	t.Run("conflicts", func(t *testing.T) {
+		rr := serve("POST", "/import?conflict=fail", `{"key":"team-a-1","doc":{"v":9}}`, "")
+		assertHTTPStatus(t, rr, http.StatusConflict)
+		res := summaries(rr)
+		assert.Equal(t, 1, res[0].Errors[0].Line)
+		assert.Contains(t, res[0].Error, "key already exists")
+
+		rr = serve("POST", "/import?dry_run=true&conflict=overwrite", `{"key":"team-a-1","doc":{"v":9}}
+{"key":"","doc":{}}
+`, "")
+		assertHTTPStatus(t, rr, http.StatusOK)
+		res = summaries(rr)
+		assert.True(t, res[0].DryRun)
+		assert.Equal(t, 1, res[0].Imported)
+		assert.Equal(t, 1, res[0].Failed)
+		file, _ := index.I.Lookup("team-a-1")
+		body, err := file.GetByteArray()
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"v":1}`, string(body))
+
+		assertHTTPStatus(t, serve("POST", "/import", "not json", ""), http.StatusBadRequest)
+		assertHTTPStatus(t, serve("POST", "/import?batch=0", "", ""), http.StatusBadRequest)
+		assertHTTPStatus(t, serve("POST", "/import?conflict=merge", "", ""), http.StatusBadRequest)
+	})
+
+	// Test Case 3: the policy limits what is exported and imported
+	t.Run("acl", func(t *testing.T) {
+		keys, err := auth.NewAPIKeys("", "alice:a-secret")
+		assert.NoError(t, err)
+		SetAuth(keys, DefaultPublic)
+		defer SetAuth(nil, nil)
+		path := filepath.Join(t.TempDir(), "acl.json")
+		assert.NoError(t, os.WriteFile(path, []byte(`{
+			"roles": {"team-a": [{"prefix": "team-a-", "allow": ["read", "write"]}]},
+			"identities": {"alice": ["team-a"]}
+		}`), 0o600))
+		policy, err := acl.Load(path)
+		assert.NoError(t, err)
+		acl.Set(policy)
+		defer acl.Set(nil)
+
+		rr := serve("GET", "/export", "", "a-secret")
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assert.Contains(t, rr.Body.String(), "team-a-1")
+		assert.NotContains(t, rr.Body.String(), "team-b-1")
+
+		rr = serve("POST", "/import?conflict=overwrite", `{"key":"team-b-1","doc":{}}`, "a-secret")
+		assertHTTPStatus(t, rr, http.StatusForbidden)
+	})
+}
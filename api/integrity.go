@@ -5,6 +5,8 @@ import (
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/audit"
 	"github.com/themillenniumfalcon/smolDB/index"
 	"github.com/themillenniumfalcon/smolDB/log"
 )
@@ -12,9 +14,12 @@ import (
 // CheckKeyIntegrity verifies the integrity of a specific key
 func CheckKeyIntegrity(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	key := ps.ByName("key")
-	log.Info("checking integrity for key: %s", key)
+	log.RInfo(w, "checking integrity for key: %s", key)
+	if !permitted(w, r, acl.Read, key) {
+		return
+	}
 
-	file, ok := index.I.Lookup(key)
+	file, ok := index.R.Lookup(key)
 	if !ok {
 		http.Error(w, fmt.Sprintf("key '%s' not found", key), http.StatusNotFound)
 		return
@@ -33,19 +38,23 @@ func CheckKeyIntegrity(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 // RepairKeyIntegrity updates the checksum for a specific key
 func RepairKeyIntegrity(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	key := ps.ByName("key")
-	log.Info("repairing integrity for key: %s", key)
+	log.RInfo(w, "repairing integrity for key: %s", key)
+	if !permitted(w, r, acl.Admin, key) {
+		return
+	}
 
-	file, ok := index.I.Lookup(key)
+	file, ok := index.R.Lookup(key)
 	if !ok {
 		http.Error(w, fmt.Sprintf("key '%s' not found", key), http.StatusNotFound)
 		return
 	}
 
-	err := file.RepairChecksum()
+	change, err := file.RepairChecksumChange()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("integrity repair failed: %v", err), http.StatusInternalServerError)
 		return
 	}
+	audited(w, r, audit.OpRepair, change)
 
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "integrity repaired for key '%s'", key)
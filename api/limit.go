@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/limit"
+	"github.com/themillenniumfalcon/smolDB/log"
+	"github.com/themillenniumfalcon/smolDB/metrics"
+)
+
+// DefaultUnlimited are the routes never limited unless configured
+// otherwise: the health check and the traffic between the nodes of a
+// cluster or replica set, which would otherwise stall under load
+var DefaultUnlimited = []string{"GET /", "GET /replication/stream", "/cluster/raft/vote", "/cluster/raft/append", "/cluster/raft/snapshot"}
+
+// limiter limits requests when set, routes in unlimited skip it
+var (
+	limiter   *limit.Limiter
+	unlimited map[string]bool
+)
+
+// SetLimits makes every request count against the limits of l, except for
+// the unlimited routes, given like the public routes of SetAuth. A nil l
+// turns limiting off
+func SetLimits(l *limit.Limiter, routes []string) {
+	limiter = l
+	unlimited = map[string]bool{}
+	for _, route := range routes {
+		if route = strings.TrimSpace(route); route != "" {
+			unlimited[route] = true
+		}
+	}
+}
+
+// takes r from the rate limit of its client and waits for a slot to serve
+// it in, release is called once it is served. A client over its limit is
+// answered with 429 and a request finding no slot with 503, both tell when
+// to retry
+func admit(w http.ResponseWriter, r *http.Request, route string) (release func(), ok bool) {
+	if limiter == nil || unlimited[route] || unlimited[r.Method+" "+route] {
+		return func() {}, true
+	}
+	client, class := limitedAs(r), classOf(r.Method, route)
+	if ok, wait := limiter.Allow(client, class); !ok {
+		rateLimited.Inc(class)
+		w.Header().Set("Retry-After", retryAfter(wait))
+		w.WriteHeader(http.StatusTooManyRequests)
+		log.WWarn(w, "too many requests: '%s' is over its %s rate limit", client, class)
+		return nil, false
+	}
+
+	start := time.Now()
+	release, err := limiter.Admit(r.Context())
+	if err != nil {
+		reason := "queue_full"
+		switch {
+		case errors.Is(err, limit.ErrQueueTimeout):
+			reason = "timeout"
+		case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+			reason = "canceled"
+		}
+		admissionRejected.Inc(reason)
+		w.Header().Set("Retry-After", retryAfter(limiter.Config().QueueTimeout))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		log.WWarn(w, "service unavailable: %s", err.Error())
+		return nil, false
+	}
+	admissionWait.Observe(metrics.Since(start))
+	return release, true
+}
+
+// returns who r is limited as: the identity it authenticated as, the
+// address it came from otherwise
+func limitedAs(r *http.Request) string {
+	if id := auth.FromContext(r.Context()); id != nil {
+		return id.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// returns the budget a request of method to route is taken from
+func classOf(method, route string) string {
+	switch {
+	case method == http.MethodGet, method == http.MethodHead, method == http.MethodOptions:
+		return limit.Read
+	case route == "/batch/get":
+		return limit.Read
+	}
+	return limit.Write
+}
+
+// formats a wait as the whole seconds of a Retry-After header, at least one
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds()))))
+}
@@ -0,0 +1,95 @@
+// provides tests for rate limits and admission control
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/limit"
+)
+
+// verifies that clients over their limits and requests finding no slot
+// are turned away with a time to retry
+func TestLimits(t *testing.T) {
+	index.I.SetFileSystem(af.NewMemMapFs())
+	keys, err := auth.NewAPIKeys("", "alice:a-secret,bob:b-secret")
+	assert.NoError(t, err)
+	SetAuth(keys, DefaultPublic)
+	defer SetAuth(nil, nil)
+	l := limit.New(limit.Config{ReadRate: 1, WriteRate: 1})
+	SetLimits(l, DefaultUnlimited)
+	defer SetLimits(nil, nil)
+
+	blocked, unblock := make(chan struct{}), make(chan struct{})
+	router := httprouter.New()
+	router.GET("/", Health)
+	router.GET("/key/:key", GetKey)
+	router.PUT("/key/:key", UpdateKey)
+	router.GET("/slow", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		blocked <- struct{}{}
+		<-unblock
+	})
+	handler := Middleware(router)
+	serve := func(method, path, key string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"a":1}`))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test Case 1: every identity has its own read and write budget
+	t.Run("rate", func(t *testing.T) {
+		assertHTTPStatus(t, serve("PUT", "/key/limited", "a-secret"), http.StatusOK)
+		rr := serve("PUT", "/key/limited", "a-secret")
+		assertHTTPStatus(t, rr, http.StatusTooManyRequests)
+		assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+		assertHTTPContains(t, rr, []string{"'alice' is over its write rate limit"})
+
+		assertHTTPStatus(t, serve("GET", "/key/limited", "a-secret"), http.StatusOK)
+		assertHTTPStatus(t, serve("PUT", "/key/limited", "b-secret"), http.StatusOK)
+
+		// requests that didn't authenticate are limited by address
+		assertHTTPStatus(t, serve("GET", "/", ""), http.StatusOK)
+		assertHTTPStatus(t, serve("GET", "/", ""), http.StatusOK)
+		SetLimits(l, nil)
+		assertHTTPStatus(t, serve("GET", "/", ""), http.StatusOK)
+		assertHTTPStatus(t, serve("GET", "/", ""), http.StatusTooManyRequests)
+		SetLimits(l, DefaultUnlimited)
+	})
+
+	// Test Case 2: requests beyond the cap are queued, then turned away
+	t.Run("admission", func(t *testing.T) {
+		l.Configure(limit.Config{MaxInFlight: 1, MaxQueue: 0})
+		done := make(chan struct{})
+		go func() {
+			serve("GET", "/slow", "a-secret")
+			close(done)
+		}()
+		<-blocked
+
+		rr := serve("GET", "/key/limited", "b-secret")
+		assertHTTPStatus(t, rr, http.StatusServiceUnavailable)
+		assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+		assertHTTPStatus(t, serve("GET", "/", ""), http.StatusOK)
+
+		l.Configure(limit.Config{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: time.Minute})
+		queued := make(chan *httptest.ResponseRecorder)
+		go func() { queued <- serve("GET", "/key/limited", "b-secret") }()
+		assert.Eventually(t, func() bool { return l.Queued() == 1 }, time.Second, time.Millisecond)
+		unblock <- struct{}{}
+		<-done
+		assertHTTPStatus(t, <-queued, http.StatusOK)
+		assert.Equal(t, 0, l.InFlight())
+	})
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// MerkleDocument is the raw content and metadata of a document, as served
+// to a peer repairing its copy
+type MerkleDocument struct {
+	Key  string          `json:"key"`
+	Body string          `json:"body"`
+	Meta *index.MetaData `json:"meta,omitempty"`
+}
+
+// handles GET /merkle
+// returns the Merkle tree over the checksums of every document
+func GetMerkleTree(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !permitted(w, r, acl.Admin, "") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(index.R.MerkleTree())
+}
+
+// handles GET /merkle/buckets/:bucket
+// returns the key, checksum, modification time and LSN of every document
+// in a leaf bucket of the tree
+func GetMerkleBucket(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !permitted(w, r, acl.Admin, "") {
+		return
+	}
+	bucket, err := strconv.Atoi(ps.ByName("bucket"))
+	if err != nil {
+		w.WriteHeader(badRequestStatus)
+		log.WWarn(w, "invalid bucket '%s'", ps.ByName("bucket"))
+		return
+	}
+	entries, err := index.R.MerkleBucket(bucket)
+	if err != nil {
+		w.WriteHeader(badRequestStatus)
+		log.WWarn(w, "%s", err.Error())
+		return
+	}
+
+	data := struct {
+		Bucket  int                 `json:"bucket"`
+		Entries []index.MerkleEntry `json:"entries"`
+	}{
+		Bucket:  bucket,
+		Entries: entries,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// handles GET /merkle/docs/:key
+// returns the document exactly as stored, references aren't resolved
+func GetMerkleDocument(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := ps.ByName("key")
+	if !permitted(w, r, acl.Read, key) {
+		return
+	}
+	body, meta, ok, err := index.R.Document(key)
+	if err != nil {
+		w.WriteHeader(serverErrorStatus)
+		log.WWarn(w, "err reading key '%s': %s", key, err.Error())
+		return
+	}
+	if !ok {
+		w.WriteHeader(notFoundStatus)
+		log.WWarn(w, "key '%s' not found", key)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MerkleDocument{Key: key, Body: string(body), Meta: meta})
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/limit"
+	"github.com/themillenniumfalcon/smolDB/metrics"
+)
+
+// metrics of the HTTP server, labelled by the route pattern so keys don't
+// each get their own series
+var (
+	httpRequests = metrics.NewCounter("smoldb_http_requests_total",
+		"HTTP requests served.", "method", "route", "status")
+	httpSeconds = metrics.NewHistogram("smoldb_http_request_duration_seconds",
+		"Time to serve an HTTP request.", metrics.DefBuckets, "method", "route", "status")
+
+	rateLimited = metrics.NewCounter("smoldb_http_rate_limited_total",
+		"Requests rejected because their client was over its rate limit.", "class")
+	admissionRejected = metrics.NewCounter("smoldb_http_admission_rejected_total",
+		"Requests rejected because no slot to serve them in was free.", "reason")
+	admissionWait = metrics.NewHistogram("smoldb_http_admission_wait_seconds",
+		"Time requests waited for a slot to be served in.", metrics.DefBuckets)
+
+	_ = metrics.NewGauge("smoldb_http_requests_in_flight", "Requests being served.", func() float64 {
+		return limitValue(func(l *limit.Limiter) float64 { return float64(l.InFlight()) })
+	})
+	_ = metrics.NewGauge("smoldb_http_requests_queued", "Requests waiting for a slot to be served in.", func() float64 {
+		return limitValue(func(l *limit.Limiter) float64 { return float64(l.Queued()) })
+	})
+	_ = metrics.NewGauge("smoldb_http_max_in_flight", "Requests served at once at most, 0 for no limit.", func() float64 {
+		return limitValue(func(l *limit.Limiter) float64 { return float64(l.Config().MaxInFlight) })
+	})
+	_ = metrics.NewGauge("smoldb_rate_limit_read_per_second", "Reads allowed per client and second, 0 for no limit.", func() float64 {
+		return limitValue(func(l *limit.Limiter) float64 { return l.Config().ReadRate })
+	})
+	_ = metrics.NewGauge("smoldb_rate_limit_write_per_second", "Writes allowed per client and second, 0 for no limit.", func() float64 {
+		return limitValue(func(l *limit.Limiter) float64 { return l.Config().WriteRate })
+	})
+)
+
+// returns fn of the limiter, 0 without one
+func limitValue(fn func(l *limit.Limiter) float64) float64 {
+	if limiter == nil {
+		return 0
+	}
+	return fn(limiter)
+}
+
+// handles GET /metrics
+// returns every metric in the Prometheus text format
+func Metrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !permitted(w, r, acl.Admin, "") {
+		return
+	}
+	metrics.Handler().ServeHTTP(w, r)
+}
@@ -0,0 +1,64 @@
+// provides tests for recording and serving metrics
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/metrics"
+)
+
+// verifies that requests are recorded by route and the metrics are served
+func TestMetrics(t *testing.T) {
+	index.I.SetFileSystem(af.NewMemMapFs())
+	metrics.Enable()
+
+	router := httprouter.New()
+	router.GET("/key/:key", GetKey)
+	router.PUT("/key/:key", UpdateKey)
+	router.GET("/key/:key/field/:field", GetKeyField)
+	router.GET("/metrics", Metrics)
+	handler := Middleware(router)
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return rr
+	}
+
+	// Test Case 1: requests are counted by route pattern and status
+	t.Run("requests", func(t *testing.T) {
+		assertHTTPStatus(t, serve("PUT", "/key/metrics1", `{"ref":"REF::metrics2"}`), http.StatusOK)
+		assertHTTPStatus(t, serve("PUT", "/key/metrics2", `{"field":"value"}`), http.StatusOK)
+		assertHTTPStatus(t, serve("GET", "/key/metrics1?depth=2", ""), http.StatusOK)
+		assertHTTPStatus(t, serve("GET", "/key/missing", ""), http.StatusNotFound)
+		assertHTTPStatus(t, serve("GET", "/key/metrics2/field/field", ""), http.StatusOK)
+		assertHTTPStatus(t, serve("GET", "/nope", ""), http.StatusNotFound)
+
+		rr := serve("GET", "/metrics", "")
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertHTTPContains(t, rr, []string{
+			`smoldb_http_requests_total{method="PUT",route="/key/:key",status="200"} 2`,
+			`smoldb_http_requests_total{method="GET",route="/key/:key",status="404"} 1`,
+			`smoldb_http_requests_total{method="GET",route="/key/:key/field/:field",status="200"} 1`,
+			`smoldb_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+			`smoldb_http_request_duration_seconds_count{method="GET",route="/key/:key",status="200"} 1`,
+		})
+	})
+
+	// Test Case 2: the storage engine reports its metrics too
+	t.Run("storage", func(t *testing.T) {
+		rr := serve("GET", "/metrics", "")
+		assertHTTPContains(t, rr, []string{
+			"# TYPE smoldb_keys gauge",
+			"# TYPE smoldb_wal_append_duration_seconds histogram",
+			"smoldb_document_size_bytes_count",
+			`smoldb_reference_resolution_depth_bucket{le="1"}`,
+			`smoldb_index_lock_wait_seconds_count{mode="read"}`,
+		})
+	})
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// Middleware wraps router: every request gets an ID, taken from its
+// X-Request-ID header when it has a usable one, which is sent back and
+// tagged on the log lines about the request. With authentication set the
+// request is then checked, see SetAuth, and held to the limits, see
+// SetLimits. Once served an access line is
+// logged and, with metrics enabled, its count and latency are recorded
+func Middleware(router *httprouter.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(log.RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			// requests forwarded to other nodes carry it along
+			r.Header.Set(log.RequestIDHeader, id)
+		}
+		w.Header().Set(log.RequestIDHeader, id)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		route, key := routeOf(router, r)
+		if authed, ok := authenticate(rec, r, route); ok {
+			r = authed
+			if release, ok := admit(rec, r, route); ok {
+				func() {
+					defer release()
+					router.ServeHTTP(rec, r)
+				}()
+			}
+		}
+		elapsed := time.Since(start)
+
+		identity := ""
+		if id := auth.FromContext(r.Context()); id != nil {
+			identity = id.Name
+		}
+		status := strconv.Itoa(rec.status)
+		httpRequests.Inc(r.Method, route, status)
+		httpSeconds.Observe(elapsed.Seconds(), r.Method, route, status)
+
+		log.InfoFields(log.Fields{
+			"request_id":  id,
+			"method":      r.Method,
+			"route":       route,
+			"key":         key,
+			"identity":    identity,
+			"status":      rec.status,
+			"bytes":       rec.bytes,
+			"duration_ms": float64(elapsed.Microseconds()) / 1000,
+		}, "%s %s %d %dB %s", r.Method, r.URL.Path, rec.status, rec.bytes, elapsed)
+	})
+}
+
+// request IDs from clients are kept when they are short and plain
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// returns a random request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// returns the pattern of the route serving r, e.g. /key/:key, and the key
+// it names, requests no route matches are grouped as unmatched
+func routeOf(router *httprouter.Router, r *http.Request) (string, string) {
+	handle, ps, _ := router.Lookup(r.Method, r.URL.Path)
+	if handle == nil {
+		return "unmatched", ""
+	}
+
+	// parameters are whole segments in the order they appear, a value can
+	// equal a static segment though, so a placement is only taken when the
+	// route still matches with the parameters replaced
+	segments := strings.Split(r.URL.Path, "/")
+	var place func(p, from int) bool
+	place = func(p, from int) bool {
+		if p == len(ps) {
+			_, found, _ := router.Lookup(r.Method, strings.Join(segments, "/"))
+			return len(found) == len(ps)
+		}
+		for k := from; k < len(segments); k++ {
+			if segments[k] != ps[p].Value {
+				continue
+			}
+			segments[k] = ":" + ps[p].Key
+			if place(p+1, k+1) {
+				return true
+			}
+			segments[k] = ps[p].Value
+		}
+		return false
+	}
+	if !place(0, 0) {
+		return "unmatched", ps.ByName("key")
+	}
+	return strings.Join(segments, "/"), ps.ByName("key")
+}
+
+// statusRecorder remembers the status a handler answered with and how
+// many bytes it wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// streaming handlers flush through the recorder
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,86 @@
+// provides tests for request IDs and access logging
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// verifies that requests get an ID which tags their log lines
+func TestMiddleware(t *testing.T) {
+	index.I.SetFileSystem(af.NewMemMapFs())
+	var out bytes.Buffer
+	logrus.SetOutput(&out)
+	assert.NoError(t, log.SetFormat("json"))
+	defer func() {
+		logrus.SetOutput(os.Stderr)
+		log.SetFormat("text")
+	}()
+
+	router := httprouter.New()
+	router.GET("/key/:key", GetKey)
+	router.PUT("/key/:key", UpdateKey)
+	handler := Middleware(router)
+
+	// returns the log lines written while serving a request
+	serve := func(req *http.Request) (*httptest.ResponseRecorder, []map[string]interface{}) {
+		out.Reset()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var lines []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var fields map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(line), &fields), line)
+			lines = append(lines, fields)
+		}
+		return rr, lines
+	}
+
+	// Test Case 1: an incoming request ID is kept and tags every line
+	t.Run("incoming id", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "/key/logged", strings.NewReader(`{"a":1}`))
+		req.Header.Set(log.RequestIDHeader, "client-id.1")
+		rr, lines := serve(req)
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assert.Equal(t, "client-id.1", rr.Header().Get(log.RequestIDHeader))
+		assert.Len(t, lines, 3, "handler, response and access lines")
+		for _, line := range lines {
+			assert.Equal(t, "client-id.1", line["request_id"])
+		}
+
+		access := lines[len(lines)-1]
+		assert.Equal(t, "PUT", access["method"])
+		assert.Equal(t, "/key/:key", access["route"])
+		assert.Equal(t, "logged", access["key"])
+		assert.Equal(t, float64(http.StatusOK), access["status"])
+		assert.Equal(t, float64(rr.Body.Len()), access["bytes"])
+		assert.Contains(t, access, "duration_ms")
+	})
+
+	// Test Case 2: requests without a usable ID get a fresh one
+	t.Run("generated id", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/key/missing", nil)
+		req.Header.Set(log.RequestIDHeader, "bad id\n")
+		rr, lines := serve(req)
+		assertHTTPStatus(t, rr, http.StatusNotFound)
+		id := rr.Header().Get(log.RequestIDHeader)
+		assert.Len(t, id, 32)
+		assert.Equal(t, id, lines[len(lines)-1]["request_id"])
+		assert.Equal(t, "warning", lines[len(lines)-2]["level"])
+
+		rr, _ = serve(httptest.NewRequest("GET", "/key/missing", nil))
+		assert.NotEqual(t, id, rr.Header().Get(log.RequestIDHeader))
+	})
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/log"
+	"github.com/themillenniumfalcon/smolDB/replica"
+)
+
+// ReplicationHeartbeat is how often an idle replication stream sends a heartbeat
+var ReplicationHeartbeat = time.Second
+
+// follower is set when this node replicates from a leader
+var follower *replica.Follower
+
+// SetFollower makes GET /replication/status report the follower's state
+func SetFollower(f *replica.Follower) {
+	follower = f
+}
+
+// streamsDone is closed once the server shuts down
+var (
+	streamsDone = make(chan struct{})
+	stopStreams sync.Once
+)
+
+// StopStreams ends every replication stream, which would otherwise keep a
+// shutting down server from draining, followers reconnect elsewhere or later
+func StopStreams() {
+	stopStreams.Do(func() { close(streamsDone) })
+}
+
+// handles GET /replication/stream?from=<lsn>
+// streams every WAL record after lsn and keeps the connection open for new
+// ones, answers 410 when those records were already pruned
+func ReplicationStream(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !permitted(w, r, acl.Admin, "") {
+		return
+	}
+	from := uint64(0)
+	if s := r.URL.Query().Get("from"); s != "" {
+		lsn, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			w.WriteHeader(badRequestStatus)
+			log.WWarn(w, "invalid lsn '%s'", s)
+			return
+		}
+		from = lsn
+	}
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	out := &countingWriter{w: w}
+	log.RInfo(w, "replication: follower %s streaming after lsn %d", r.RemoteAddr, from)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-streamsDone:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := index.I.StreamWAL(ctx, out, from, ReplicationHeartbeat, func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err == nil {
+		log.RInfo(w, "replication: follower %s disconnected", r.RemoteAddr)
+		return
+	}
+	if out.written > 0 {
+		// the follower notices the stream ending and reconnects
+		log.RWarn(w, "replication: stream to %s failed: %s", r.RemoteAddr, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if errors.Is(err, index.ErrWALTruncated) {
+		w.WriteHeader(http.StatusGone)
+	} else {
+		w.WriteHeader(serverErrorStatus)
+	}
+	log.WWarn(w, "replication: %s", err.Error())
+}
+
+// handles GET /replication/status
+// reports the last and oldest available LSN and, on a follower, how far
+// behind its leader it is
+func ReplicationStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !permitted(w, r, acl.Admin, "") {
+		return
+	}
+	data := struct {
+		Role      string          `json:"role"`
+		LSN       uint64          `json:"lsn"`
+		OldestLSN uint64          `json:"oldestLsn"`
+		Follower  *replica.Status `json:"follower,omitempty"`
+	}{
+		Role:      "leader",
+		LSN:       index.I.LastLSN(),
+		OldestLSN: index.I.OldestLSN(),
+	}
+	if follower != nil {
+		status := follower.Status()
+		data.Role = "follower"
+		data.Follower = &status
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
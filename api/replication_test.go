@@ -0,0 +1,284 @@
+// provides tests for WAL streaming between a leader process and a follower
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/replica"
+)
+
+// not a test on its own, run by TestReplication as the leader process
+// serving SMOLDB_LEADER_DIR on SMOLDB_LEADER_ADDR
+func TestReplicationLeaderChild(t *testing.T) {
+	dir, addr := os.Getenv("SMOLDB_LEADER_DIR"), os.Getenv("SMOLDB_LEADER_ADDR")
+	if dir == "" {
+		t.Skip("only run as a child of TestReplication")
+	}
+
+	index.I = index.NewFileIndex(dir)
+	if err := index.I.RestoreFromCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.I.InitWAL(index.DurabilityCommit); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.I.WALReplay(); err != nil {
+		t.Fatal(err)
+	}
+	index.I.Regenerate()
+	index.I.SetSnapshotRetention(1)
+	ReplicationHeartbeat = 50 * time.Millisecond
+
+	router := httprouter.New()
+	router.PUT("/key/:key", UpdateKey)
+	router.DELETE("/key/:key", DeleteKey)
+	router.PATCH("/key/:key/field/:field", PatchKeyField)
+	router.GET("/replication/stream", ReplicationStream)
+	router.GET("/replication/status", ReplicationStatus)
+	router.POST("/admin/backup", Backup)
+	router.POST("/checkpoint", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if err := index.I.CreateCheckpoint(); err != nil {
+			w.WriteHeader(serverErrorStatus)
+		}
+	})
+	t.Fatal(http.ListenAndServe(addr, router))
+}
+
+// verifies that a follower process keeps up with a leader process across
+// leader restarts, its own restarts and pruned leader WAL
+func TestReplication(t *testing.T) {
+	defer func(i *index.FileIndex) { index.I = i }(index.I)
+
+	leaderDir := filepath.Join(t.TempDir(), "leader")
+	followerDir := filepath.Join(t.TempDir(), "follower")
+	if err := os.MkdirAll(leaderDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// pick a port the leader keeps across restarts
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	leader := "http://" + addr
+
+	var cmd *exec.Cmd
+	startLeader := func() {
+		cmd = exec.Command(os.Args[0], "-test.run=^TestReplicationLeaderChild$")
+		cmd.Env = append(os.Environ(), "SMOLDB_LEADER_DIR="+leaderDir, "SMOLDB_LEADER_ADDR="+addr)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "leader to start", func() bool {
+			resp, err := http.Get(leader + "/replication/status")
+			if err != nil {
+				return false
+			}
+			resp.Body.Close()
+			return true
+		})
+	}
+	stopLeader := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	startLeader()
+	defer func() { stopLeader() }()
+
+	request := func(method, path, body string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, leader+path, bytes.NewBufferString(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s answered %s", method, path, resp.Status)
+		}
+	}
+	leaderLSN := func() uint64 {
+		resp, err := http.Get(leader + "/replication/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var status struct {
+			LSN uint64 `json:"lsn"`
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		return status.LSN
+	}
+
+	// opens the follower database and starts replicating into it
+	var follower *replica.Follower
+	var stop context.CancelFunc
+	var done chan error
+	startFollower := func() {
+		index.I = index.NewFileIndex(followerDir)
+		if err := index.I.RestoreFromCheckpoint(); err != nil {
+			t.Fatal(err)
+		}
+		if err := index.I.InitWAL(index.DurabilityCommit); err != nil {
+			t.Fatal(err)
+		}
+		if err := index.I.WALReplay(); err != nil {
+			t.Fatal(err)
+		}
+		index.I.Regenerate()
+
+		follower = replica.NewFollower(leader, index.I, followerDir)
+		follower.Idle = 500 * time.Millisecond
+		var ctx context.Context
+		ctx, stop = context.WithCancel(context.Background())
+		done = make(chan error, 1)
+		go func() { done <- follower.Run(ctx) }()
+	}
+	stopFollower := func() {
+		stop()
+		<-done
+	}
+	caughtUp := func() {
+		t.Helper()
+		want := leaderLSN()
+		waitFor(t, "follower to catch up", func() bool {
+			return follower.Status().AppliedLSN == want
+		})
+		compareDirs(t, leaderDir, followerDir)
+	}
+
+	// Test Case 1: a fresh follower is seeded from a backup and then streams
+	request("PUT", "/key/a", `{"v":1}`)
+	request("PATCH", "/key/a/field/w", `true`)
+	request("PUT", "/key/b", `{"v":1}`)
+	seed, err := replica.NeedsSeed(af.NewOsFs(), followerDir, leader)
+	if err != nil || !seed {
+		t.Fatalf("fresh follower doesn't need seeding: %v", err)
+	}
+	if _, err := replica.Seed(af.NewOsFs(), followerDir, leader); err != nil {
+		t.Fatal(err)
+	}
+	startFollower()
+	request("DELETE", "/key/b", "")
+	request("PUT", "/key/c", `{"v":1}`)
+	caughtUp()
+
+	// Test Case 2: the follower serves reads and reports its lag
+	SetFollower(follower)
+	defer SetFollower(nil)
+	rr := httptest.NewRecorder()
+	ReplicationStatus(rr, httptest.NewRequest("GET", "/replication/status", nil), nil)
+	var status struct {
+		Role     string         `json:"role"`
+		Follower replica.Status `json:"follower"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Role != "follower" || !status.Follower.Connected || status.Follower.LagRecords != 0 {
+		t.Errorf("unexpected follower status %+v", status)
+	}
+
+	// Test Case 3: the follower reconnects to a restarted leader
+	stopLeader()
+	waitFor(t, "follower to notice the leader is gone", func() bool {
+		return !follower.Status().Connected
+	})
+	startLeader()
+	request("PUT", "/key/d", `{"v":1}`)
+	caughtUp()
+	if follower.Status().Reconnects == 0 {
+		t.Errorf("follower didn't count the reconnect")
+	}
+
+	// Test Case 4: a restarted follower resumes from its applied position
+	stopFollower()
+	applied := follower.Status().AppliedLSN
+	request("PUT", "/key/a", `{"v":2}`)
+	startFollower()
+	if got := index.I.LastLSN(); got != applied {
+		t.Errorf("follower restarted at lsn %d, applied %d", got, applied)
+	}
+	if seed, err := replica.NeedsSeed(af.NewOsFs(), followerDir, leader); err != nil || seed {
+		t.Errorf("follower within the leader's WAL asks for seeding: %v", err)
+	}
+	caughtUp()
+
+	// Test Case 5: a follower behind the pruned WAL has to be seeded again
+	stopFollower()
+	for _, key := range []string{"e", "f"} {
+		request("PUT", "/key/"+key, `{"v":1}`)
+		request("POST", "/checkpoint", "")
+	}
+	startFollower()
+	if err := <-done; err != replica.ErrReseed {
+		t.Fatalf("follower behind the pruned WAL returned %v", err)
+	}
+	if seed, err := replica.NeedsSeed(af.NewOsFs(), followerDir, leader); err != nil || !seed {
+		t.Fatalf("follower behind the pruned WAL doesn't ask for seeding: %v", err)
+	}
+	if _, err := replica.Seed(af.NewOsFs(), followerDir, leader); err != nil {
+		t.Fatal(err)
+	}
+	startFollower()
+	caughtUp()
+	stopFollower()
+}
+
+// polls cond until it holds, fails the test after 10 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// fails the test unless both directories hold the same documents
+func compareDirs(t *testing.T, a, b string) {
+	t.Helper()
+
+	read := func(dir string) map[string]string {
+		docs := map[string]string{}
+		matches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range matches {
+			body, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			docs[filepath.Base(path)] = string(body)
+		}
+		return docs
+	}
+	got, want := read(b), read(a)
+	if len(got) != len(want) {
+		t.Fatalf("follower has %d documents, leader %d", len(got), len(want))
+	}
+	for name, body := range want {
+		if got[name] != body {
+			t.Errorf("%s differs: leader %s, follower %s", name, body, got[name])
+		}
+	}
+}
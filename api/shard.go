@@ -0,0 +1,22 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// Unsharded wraps a handler that works on the WAL of a single FileIndex,
+// such as backups and replication, a sharded database answers it with 501
+func Unsharded(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if n := len(index.R.Shards()); n > 1 {
+			w.WriteHeader(http.StatusNotImplemented)
+			log.WWarn(w, "not supported on a database split into %d shards", n)
+			return
+		}
+		h(w, r, ps)
+	}
+}
@@ -0,0 +1,73 @@
+// provides tests for serving a database split into shards
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+// verifies that the handlers route keys to their shards
+func TestSharded(t *testing.T) {
+	defer func(i *index.FileIndex) { index.I, index.R = i, nil }(index.I)
+
+	fs := af.NewMemMapFs()
+	var shards []*index.FileIndex
+	for _, dir := range index.ShardDirs("db", 4) {
+		shard := index.NewFileIndex(dir)
+		shard.SetFileSystem(fs)
+		shards = append(shards, shard)
+	}
+	index.R = index.NewRouter(shards)
+	index.I = nil
+
+	router := httprouter.New()
+	router.GET("/keys", GetKeys)
+	router.GET("/key/:key", GetKey)
+	router.PUT("/key/:key", UpdateKey)
+	router.DELETE("/key/:key", DeleteKey)
+	router.PATCH("/key/:key/field/:field", PatchKeyField)
+	router.POST("/admin/backup", Unsharded(Backup))
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return rr
+	}
+
+	// Test Case 1: writes land on the shard of their key, reads find them
+	t.Run("route keys", func(t *testing.T) {
+		for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+			assertHTTPStatus(t, serve("PUT", "/key/"+key, `{"ref":"REF::a"}`), http.StatusOK)
+			assertJSONFileContents(t, index.R.Shard(key), key, map[string]interface{}{"ref": "REF::a"})
+		}
+		assertHTTPStatus(t, serve("PATCH", "/key/a/field/ref", `done`), http.StatusOK)
+		assertHTTPStatus(t, serve("DELETE", "/key/f", ""), http.StatusOK)
+
+		// references resolve across shards
+		rr := serve("GET", "/key/e?depth=1", "")
+		assertHTTPStatus(t, rr, http.StatusOK)
+		assertHTTPBody(t, rr, map[string]interface{}{"ref": map[string]interface{}{"ref": "done"}})
+
+		var keys struct {
+			Files []string `json:"files"`
+		}
+		if err := json.NewDecoder(serve("GET", "/keys", "").Body).Decode(&keys); err != nil {
+			t.Fatal(err)
+		}
+		assertSliceContains(t, keys.Files, "e")
+		if len(keys.Files) != 5 {
+			t.Errorf("expected 5 keys, got %v", keys.Files)
+		}
+	})
+
+	// Test Case 2: backups of a single WAL aren't available
+	t.Run("unsharded only", func(t *testing.T) {
+		assertHTTPStatus(t, serve("POST", "/admin/backup", ""), http.StatusNotImplemented)
+	})
+}
@@ -0,0 +1,302 @@
+// provides an append-only log of every change made to a database, who made
+// it and when, kept under .smoldb/audit/ and rotated by size
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// operations recorded
+const (
+	OpPut        = "put"
+	OpPatch      = "patch"
+	OpDelete     = "delete"
+	OpRegenerate = "regenerate"
+	OpRepair     = "repair"
+	OpAdmin      = "admin"
+)
+
+// MaxSize is the size in bytes the active audit file is rotated at, 0
+// never rotates
+var MaxSize int64 = 64 << 20
+
+// Entry is one record of the audit log, checksums are empty when the key
+// didn't exist before or doesn't after
+type Entry struct {
+	Time      time.Time `json:"ts"`
+	Client    string    `json:"client"`
+	Op        string    `json:"op"`
+	Key       string    `json:"key,omitempty"`
+	Before    string    `json:"before,omitempty"`
+	After     string    `json:"after,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// Log appends entries to the active file .smoldb/audit/audit.log, a full
+// file is sealed as audit-<rotation time>.log
+type Log struct {
+	mu   sync.Mutex
+	fs   af.Fs
+	dir  string
+	file af.File
+	size int64
+}
+
+// L is the audit log of the database being served, nothing is recorded
+// while it is nil
+var L *Log
+
+// Dir returns the directory the audit log of the database in dir is kept in
+func Dir(dir string) string {
+	return filepath.Join(dir, ".smoldb", "audit")
+}
+
+// path of the active file
+func (l *Log) activePath() string {
+	return filepath.Join(l.dir, "audit.log")
+}
+
+// Open opens the audit log of the database in dir for appending
+func Open(fs af.Fs, dir string) (*Log, error) {
+	l := &Log{fs: fs, dir: Dir(dir)}
+	if err := fs.MkdirAll(l.dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// opens the active file and picks up its size
+func (l *Log) open() error {
+	f, err := l.fs.OpenFile(l.activePath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// Record appends e to the log and syncs it, the time is set when missing
+func (l *Log) Record(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return fmt.Errorf("audit log is closed")
+	}
+	if MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > MaxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %v", err)
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// seals the active file under the current time and starts a new one
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	sealed := filepath.Join(l.dir, fmt.Sprintf("audit-%019d.log", time.Now().UnixNano()))
+	if err := l.fs.Rename(l.activePath(), sealed); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Close closes the active file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Record appends e to L, failures are logged rather than failing the
+// change, which has already been made
+func Record(e Entry) {
+	if L == nil {
+		return
+	}
+	if err := L.Record(e); err != nil {
+		log.Warn("failed to write audit entry for %s of '%s': %s", e.Op, e.Key, err.Error())
+	}
+}
+
+// OpOf maps the op of a replicated write, PUT, PATCH, DELETE or BATCH, to
+// the op it is recorded as, after is the checksum of a key once written so
+// the keys of a batch are recorded as deleted or put
+func OpOf(op string, after string) string {
+	switch op {
+	case "PATCH":
+		return OpPatch
+	case "DELETE":
+		return OpDelete
+	case "BATCH":
+		if after == "" {
+			return OpDelete
+		}
+	}
+	return OpPut
+}
+
+// RecordAdmin appends an admin action to the audit log of the offline
+// database in dir
+func RecordAdmin(fs af.Fs, dir string, format string, args ...interface{}) {
+	l, err := Open(fs, dir)
+	if err == nil {
+		err = l.Record(Entry{Client: LocalUser(), Op: OpAdmin, Detail: fmt.Sprintf(format, args...)})
+		l.Close()
+	}
+	if err != nil {
+		log.Warn("failed to write audit entry for admin action: %s", err.Error())
+	}
+}
+
+// LocalUser identifies whoever runs this process, as user@host
+func LocalUser() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return name + "@" + host
+}
+
+// Carry moves the audit log of the database in from into to, used when a
+// database directory is replaced by a rebuilt one so its history stays
+func Carry(fs af.Fs, from, to string) error {
+	if _, err := fs.Stat(Dir(from)); os.IsNotExist(err) {
+		return nil
+	}
+	if err := fs.MkdirAll(filepath.Dir(Dir(to)), 0o755); err != nil {
+		return err
+	}
+	if err := fs.RemoveAll(Dir(to)); err != nil {
+		return err
+	}
+	return fs.Rename(Dir(from), Dir(to))
+}
+
+// Filter selects entries, empty fields match everything
+type Filter struct {
+	Key   string
+	Since time.Time
+	Until time.Time
+}
+
+// matches reports whether e passes the filter
+func (f Filter) matches(e Entry) bool {
+	if f.Key != "" && e.Key != f.Key {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Query returns the entries of the audit log of the database in dir that
+// pass the filter, oldest first
+func Query(fs af.Fs, dir string, filter Filter) ([]Entry, error) {
+	names, err := af.ReadDir(fs, Dir(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// sealed files sort by rotation time, the active one holds the latest
+	var files []string
+	active := false
+	for _, info := range names {
+		name := info.Name()
+		switch {
+		case name == "audit.log":
+			active = true
+		case strings.HasPrefix(name, "audit-") && strings.HasSuffix(name, ".log"):
+			// a file sealed before since only holds older entries
+			ns, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, "audit-"), ".log"), 10, 64)
+			if err == nil && !filter.Since.IsZero() && time.Unix(0, ns).Before(filter.Since) {
+				continue
+			}
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	if active {
+		files = append(files, "audit.log")
+	}
+
+	var res []Entry
+	for _, name := range files {
+		f, err := fs.Open(filepath.Join(Dir(dir), name))
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16<<20)
+		for scanner.Scan() {
+			var e Entry
+			// a line torn by a crash is skipped
+			if json.Unmarshal(scanner.Bytes(), &e) != nil {
+				continue
+			}
+			if filter.matches(e) {
+				res = append(res, e)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", name, err)
+		}
+	}
+	return res, nil
+}
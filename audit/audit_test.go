@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	fs := af.NewMemMapFs()
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	l, err := Open(fs, "db")
+	assert.NoError(t, err)
+	for k, key := range []string{"a", "b", "a", "c"} {
+		assert.NoError(t, l.Record(Entry{Time: base.Add(time.Duration(k) * time.Hour), Client: "127.0.0.1:1", Op: OpPut, Key: key}))
+	}
+
+	// Test Case 1: entries are filtered by key and time range
+	t.Run("query", func(t *testing.T) {
+		all, err := Query(fs, "db", Filter{})
+		assert.NoError(t, err)
+		assert.Len(t, all, 4)
+
+		a, err := Query(fs, "db", Filter{Key: "a"})
+		assert.NoError(t, err)
+		assert.Len(t, a, 2)
+		assert.True(t, a[0].Time.Equal(base))
+
+		ranged, err := Query(fs, "db", Filter{Since: base.Add(time.Hour), Until: base.Add(2 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Len(t, ranged, 2)
+		assert.Equal(t, "b", ranged[0].Key)
+
+		none, err := Query(fs, "missing", Filter{})
+		assert.NoError(t, err)
+		assert.Empty(t, none)
+	})
+
+	// Test Case 2: a full file is sealed and queries read every file in order
+	t.Run("rotate", func(t *testing.T) {
+		defer func(size int64) { MaxSize = size }(MaxSize)
+		MaxSize = 300
+		for k := 0; k < 10; k++ {
+			assert.NoError(t, l.Record(Entry{Time: base.Add(time.Duration(4+k) * time.Hour), Client: "shell", Op: OpDelete, Key: "d"}))
+		}
+		names, err := af.ReadDir(fs, Dir("db"))
+		assert.NoError(t, err)
+		assert.Greater(t, len(names), 2)
+
+		all, err := Query(fs, "db", Filter{})
+		assert.NoError(t, err)
+		assert.Len(t, all, 14)
+		for k := 1; k < len(all); k++ {
+			assert.True(t, all[k-1].Time.Before(all[k].Time))
+		}
+
+		// a torn last line is skipped
+		f, err := fs.OpenFile(filepath.Join(Dir("db"), "audit.log"), os.O_WRONLY|os.O_APPEND, 0644)
+		assert.NoError(t, err)
+		f.WriteString(`{"ts":"2024-05`)
+		f.Close()
+		all, err = Query(fs, "db", Filter{Key: "d"})
+		assert.NoError(t, err)
+		assert.Len(t, all, 10)
+	})
+
+	// Test Case 3: the log moves along with a replaced database
+	t.Run("carry", func(t *testing.T) {
+		assert.NoError(t, l.Close())
+		assert.Error(t, l.Record(Entry{Op: OpPut}))
+		assert.NoError(t, Carry(fs, "db", "db2"))
+		all, err := Query(fs, "db2", Filter{})
+		assert.NoError(t, err)
+		assert.Len(t, all, 14)
+		assert.NoError(t, Carry(fs, "nothing", "db2"))
+	})
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// APIKeys authenticates requests by a static key, sent as a bearer token
+// or in the X-API-Key header. Only hashes of the keys are kept
+type APIKeys struct {
+	names map[[sha256.Size]byte]string
+}
+
+// NewAPIKeys parses keys given as name:key entries, one per line in the
+// file at path and comma separated in list, either may be empty. Lines
+// starting with # are comments
+func NewAPIKeys(path string, list string) (*APIKeys, error) {
+	a := &APIKeys{names: map[[sha256.Size]byte]string{}}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read api keys: %v", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if err := a.add(line); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read api keys: %v", err)
+		}
+	}
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			if err := a.add(entry); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(a.names) == 0 {
+		return nil, fmt.Errorf("no api keys configured")
+	}
+	return a, nil
+}
+
+// adds a name:key entry
+func (a *APIKeys) add(entry string) error {
+	name, key, ok := strings.Cut(entry, ":")
+	name, key = strings.TrimSpace(name), strings.TrimSpace(key)
+	if !ok || name == "" || key == "" {
+		return fmt.Errorf("api keys are given as name:key")
+	}
+	sum := sha256.Sum256([]byte(key))
+	if _, dup := a.names[sum]; dup {
+		return fmt.Errorf("api key of '%s' is used twice", name)
+	}
+	a.names[sum] = name
+	return nil
+}
+
+// Authenticate looks up the key of r
+func (a *APIKeys) Authenticate(r *http.Request) (*Identity, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = bearer(r)
+	}
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	name, ok := a.names[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, fmt.Errorf("unknown api key")
+	}
+	return &Identity{Name: name, Method: "apikey"}, nil
+}
@@ -0,0 +1,121 @@
+// provides authentication of HTTP requests, by static API keys or by JSON
+// web tokens checked against a local key
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrNoCredentials is returned for a request that carries no credentials
+var ErrNoCredentials = errors.New("no credentials")
+
+// Identity is who a request was authenticated as
+type Identity struct {
+	Name   string                 // API key name or token subject
+	Method string                 // "apikey" or "jwt"
+	Claims map[string]interface{} // claims of a token, nil for API keys
+}
+
+// Authenticator checks the credentials of a request
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying id
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity a request was authenticated as, nil
+// when authentication is off or the route is public
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
+
+// returns the bearer token of the Authorization header
+func bearer(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// Token is the credential this node presents to other nodes, such as the
+// leader it replicates or the members of its ring or cluster
+var Token string
+
+// Attach adds Token to a request sent to another node, unless the request
+// carries credentials already
+func Attach(req *http.Request) {
+	if Token != "" && req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "Bearer "+Token)
+	}
+}
+
+// Config selects how requests are authenticated
+type Config struct {
+	Mode        string // none, apikey, jwt or mtls, or several separated by commas
+	APIKeysFile string // name:key lines
+	APIKeys     string // comma separated name:key entries
+	JWTAlg      string // HS256 or RS256
+	JWTKeyFile  string // secret or PEM public key
+}
+
+// New returns the authenticator c describes, nil for mode none. With
+// several modes a request is authenticated by the first one that accepts
+// its credentials
+func New(c Config) (Authenticator, error) {
+	var any Any
+	for _, mode := range strings.Split(c.Mode, ",") {
+		a, err := newMode(strings.TrimSpace(mode), c)
+		if err != nil {
+			return nil, err
+		}
+		if a != nil {
+			any = append(any, a)
+		}
+	}
+	switch len(any) {
+	case 0:
+		return nil, nil
+	case 1:
+		return any[0], nil
+	default:
+		return any, nil
+	}
+}
+
+// returns the authenticator of a single mode
+func newMode(mode string, c Config) (Authenticator, error) {
+	switch mode {
+	case "", "none":
+		return nil, nil
+	case "apikey":
+		keys, err := NewAPIKeys(c.APIKeysFile, c.APIKeys)
+		if err != nil {
+			return nil, err
+		}
+		return keys, nil
+	case "jwt":
+		if c.JWTKeyFile == "" {
+			return nil, fmt.Errorf("jwt authentication needs a key file")
+		}
+		j, err := NewJWT(c.JWTAlg, c.JWTKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return j, nil
+	case "mtls":
+		return ClientCert{}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth mode '%s', use none, apikey, jwt or mtls", mode)
+	}
+}
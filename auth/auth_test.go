@@ -0,0 +1,264 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// signs claims as a token, with the given algorithm in its header
+func sign(t *testing.T, alg string, claims map[string]interface{}, signer func([]byte) []byte) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	assert.NoError(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signer([]byte(signed)))
+}
+
+func TestAPIKeys(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys")
+	assert.NoError(t, os.WriteFile(path, []byte("# operators\nalice:a-secret\n\nbob: b-secret\n"), 0o600))
+
+	keys, err := NewAPIKeys(path, "ci:c-secret")
+	assert.NoError(t, err)
+
+	// Test Case 1: keys are accepted as a bearer token or in X-API-Key
+	t.Run("valid", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/key/a", nil)
+		req.Header.Set("Authorization", "Bearer a-secret")
+		id, err := keys.Authenticate(req)
+		assert.NoError(t, err)
+		assert.Equal(t, &Identity{Name: "alice", Method: "apikey"}, id)
+
+		req = httptest.NewRequest("GET", "/key/a", nil)
+		req.Header.Set("X-API-Key", "b-secret")
+		id, err = keys.Authenticate(req)
+		assert.NoError(t, err)
+		assert.Equal(t, "bob", id.Name)
+
+		req = httptest.NewRequest("GET", "/key/a", nil)
+		req.Header.Set("Authorization", "bearer c-secret")
+		id, err = keys.Authenticate(req)
+		assert.NoError(t, err)
+		assert.Equal(t, "ci", id.Name)
+	})
+
+	// Test Case 2: unknown and missing keys are rejected
+	t.Run("invalid", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/key/a", nil)
+		req.Header.Set("X-API-Key", "alice")
+		_, err := keys.Authenticate(req)
+		assert.Error(t, err)
+
+		_, err = keys.Authenticate(httptest.NewRequest("GET", "/key/a", nil))
+		assert.ErrorIs(t, err, ErrNoCredentials)
+	})
+
+	// Test Case 3: malformed or duplicate entries fail to load
+	t.Run("config", func(t *testing.T) {
+		_, err := NewAPIKeys("", "")
+		assert.Error(t, err)
+		_, err = NewAPIKeys("", "nokey")
+		assert.Error(t, err)
+		_, err = NewAPIKeys(path, "carol:a-secret")
+		assert.Error(t, err)
+		_, err = NewAPIKeys(filepath.Join(dir, "missing"), "")
+		assert.Error(t, err)
+	})
+}
+
+func TestJWT(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	secretPath := filepath.Join(dir, "secret")
+	assert.NoError(t, os.WriteFile(secretPath, append(secret, '\n'), 0o600))
+	hs := func(b []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(b)
+		return mac.Sum(nil)
+	}
+
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	assert.NoError(t, err)
+	publicPath := filepath.Join(dir, "public.pem")
+	assert.NoError(t, os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+	rs := func(b []byte) []byte {
+		digest := sha256.Sum256(b)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:])
+		assert.NoError(t, err)
+		return sig
+	}
+
+	valid := map[string]interface{}{"sub": "alice", "exp": now.Add(time.Hour).Unix(), "role": "writer"}
+
+	// Test Case 1: HS256 tokens signed with the secret are accepted
+	t.Run("hs256", func(t *testing.T) {
+		j, err := NewJWT("HS256", secretPath)
+		assert.NoError(t, err)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+sign(t, "HS256", valid, hs))
+		id, err := j.Authenticate(req)
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", id.Name)
+		assert.Equal(t, "jwt", id.Method)
+		assert.Equal(t, "writer", id.Claims["role"])
+
+		forged := sign(t, "HS256", valid, func(b []byte) []byte {
+			mac := hmac.New(sha256.New, []byte("another secret of thirty-two bytes"))
+			mac.Write(b)
+			return mac.Sum(nil)
+		})
+		_, err = j.Verify(forged, now)
+		assert.Error(t, err)
+	})
+
+	// Test Case 2: RS256 tokens are checked against the public key
+	t.Run("rs256", func(t *testing.T) {
+		j, err := NewJWT("RS256", publicPath)
+		assert.NoError(t, err)
+		claims, err := j.Verify(sign(t, "RS256", valid, rs), now)
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", claims["sub"])
+
+		// a token switching algorithms is refused
+		_, err = j.Verify(sign(t, "HS256", valid, hs), now)
+		assert.Error(t, err)
+		_, err = j.Verify(sign(t, "none", valid, func([]byte) []byte { return nil }), now)
+		assert.Error(t, err)
+	})
+
+	// Test Case 3: the validity period and subject are enforced
+	t.Run("claims", func(t *testing.T) {
+		j, err := NewJWT("HS256", secretPath)
+		assert.NoError(t, err)
+		_, err = j.Verify(sign(t, "HS256", map[string]interface{}{"sub": "a", "exp": now.Add(-time.Hour).Unix()}, hs), now)
+		assert.Error(t, err)
+		_, err = j.Verify(sign(t, "HS256", map[string]interface{}{"sub": "a", "nbf": now.Add(time.Hour).Unix()}, hs), now)
+		assert.Error(t, err)
+		_, err = j.Verify(sign(t, "HS256", map[string]interface{}{"sub": "a", "exp": now.Add(-10 * time.Second).Unix()}, hs), now)
+		assert.NoError(t, err, "within leeway")
+		_, err = j.Verify("not.a-token", now)
+		assert.Error(t, err)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+sign(t, "HS256", map[string]interface{}{"exp": now.Add(time.Hour).Unix()}, hs))
+		_, err = j.Authenticate(req)
+		assert.Error(t, err)
+	})
+
+	// Test Case 4: keys that can't be used are rejected at startup
+	t.Run("config", func(t *testing.T) {
+		short := filepath.Join(dir, "short")
+		assert.NoError(t, os.WriteFile(short, []byte("tooshort"), 0o600))
+		_, err := NewJWT("HS256", short)
+		assert.Error(t, err)
+		_, err = NewJWT("RS256", secretPath)
+		assert.Error(t, err)
+		_, err = NewJWT("ES256", publicPath)
+		assert.Error(t, err)
+		_, err = New(Config{Mode: "jwt", JWTAlg: "HS256"})
+		assert.Error(t, err)
+		a, err := New(Config{Mode: "none"})
+		assert.NoError(t, err)
+		assert.Nil(t, a)
+	})
+}
+
+func TestAttach(t *testing.T) {
+	defer func(token string) { Token = token }(Token)
+
+	// Test Case 1: the peer token is added unless credentials are present
+	t.Run("attach", func(t *testing.T) {
+		Token = ""
+		req := httptest.NewRequest("GET", "/", nil)
+		Attach(req)
+		assert.Empty(t, req.Header.Get("Authorization"))
+
+		Token = "peer"
+		Attach(req)
+		assert.Equal(t, "Bearer peer", req.Header.Get("Authorization"))
+
+		req.Header.Set("Authorization", "Bearer client")
+		Attach(req)
+		assert.Equal(t, "Bearer client", req.Header.Get("Authorization"))
+	})
+}
+
+func TestModes(t *testing.T) {
+	a, err := New(Config{Mode: "mtls,apikey", APIKeys: "ci:c-secret"})
+	assert.NoError(t, err)
+
+	// Test Case 1: the first mode that accepts a request decides
+	t.Run("any", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-API-Key", "c-secret")
+		id, err := a.Authenticate(req)
+		assert.NoError(t, err)
+		assert.Equal(t, "ci", id.Name)
+
+		req.Header.Set("X-API-Key", "wrong")
+		_, err = a.Authenticate(req)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrNoCredentials)
+
+		_, err = a.Authenticate(httptest.NewRequest("GET", "/", nil))
+		assert.ErrorIs(t, err, ErrNoCredentials)
+	})
+
+	// Test Case 2: bearer tokens of every mode are accepted, whichever
+	// mode comes first
+	t.Run("bearer", func(t *testing.T) {
+		secret := []byte("0123456789abcdef0123456789abcdef")
+		secretPath := filepath.Join(t.TempDir(), "secret")
+		assert.NoError(t, os.WriteFile(secretPath, secret, 0o600))
+		token := sign(t, "HS256", map[string]interface{}{"sub": "alice"}, func(b []byte) []byte {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(b)
+			return mac.Sum(nil)
+		})
+
+		for _, mode := range []string{"apikey,jwt", "jwt,apikey"} {
+			a, err := New(Config{Mode: mode, APIKeys: "ci:c-secret", JWTAlg: "HS256", JWTKeyFile: secretPath})
+			assert.NoError(t, err)
+			for credential, want := range map[string]string{"c-secret": "ci", token: "alice"} {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set("Authorization", "Bearer "+credential)
+				id, err := a.Authenticate(req)
+				if assert.NoError(t, err, mode) {
+					assert.Equal(t, want, id.Name, mode)
+				}
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer wrong")
+			_, err = a.Authenticate(req)
+			assert.Error(t, err, mode)
+			assert.NotErrorIs(t, err, ErrNoCredentials, mode)
+		}
+	})
+
+	// Test Case 3: unknown modes are rejected
+	t.Run("unknown", func(t *testing.T) {
+		_, err := New(Config{Mode: "apikey,kerberos", APIKeys: "ci:c-secret"})
+		assert.Error(t, err)
+		_, ok := a.(Any)
+		assert.True(t, ok)
+	})
+}
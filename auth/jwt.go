@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Leeway is the clock skew allowed when checking exp and nbf
+var Leeway = 30 * time.Second
+
+// JWT authenticates requests by a bearer JSON web token signed with HS256
+// or RS256. Only the configured algorithm is accepted, the subject of the
+// token becomes the identity
+type JWT struct {
+	alg    string
+	secret []byte
+	public *rsa.PublicKey
+}
+
+// NewJWT reads the key tokens are checked against from the file at path,
+// the shared secret for HS256 or a PEM public key or certificate for RS256
+func NewJWT(alg string, path string) (*JWT, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwt key: %v", err)
+	}
+	switch alg {
+	case "HS256":
+		secret := []byte(strings.TrimSpace(string(data)))
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("HS256 secret must be at least 32 bytes")
+		}
+		return &JWT{alg: alg, secret: secret}, nil
+	case "RS256":
+		key, err := parseRSAPublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse jwt key: %v", err)
+		}
+		return &JWT{alg: alg, public: key}, nil
+	default:
+		return nil, fmt.Errorf("unsupported jwt algorithm '%s', use HS256 or RS256", alg)
+	}
+}
+
+// parses a PKIX or PKCS #1 public key, or the key of a certificate
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	var pub interface{}
+	var err error
+	switch block.Type {
+	case "PUBLIC KEY":
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			pub = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("unexpected PEM block '%s'", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA public key")
+	}
+	return key, nil
+}
+
+// Authenticate verifies the bearer token of r
+func (j *JWT) Authenticate(r *http.Request) (*Identity, error) {
+	token := bearer(r)
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+	claims, err := j.Verify(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+	return &Identity{Name: sub, Method: "jwt", Claims: claims}, nil
+}
+
+// Verify checks the signature and validity period of token at now and
+// returns its claims
+func (j *JWT) Verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	if header.Alg != j.alg {
+		return nil, fmt.Errorf("token is signed with '%s', expected %s", header.Alg, j.alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if j.public != nil {
+		digest := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(j.public, crypto.SHA256, digest[:], sig) != nil {
+			return nil, fmt.Errorf("invalid token signature")
+		}
+	} else {
+		mac := hmac.New(sha256.New, j.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, fmt.Errorf("invalid token signature")
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(Leeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+	return claims, nil
+}
+
+// decodes a base64url JSON segment of a token into v
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ClientCert authenticates requests by the certificate the client
+// presented over mutual TLS, the common name of its subject, or the whole
+// subject when it has none, becomes the identity
+type ClientCert struct{}
+
+// Authenticate returns the subject of the verified client certificate
+func (ClientCert) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	name := cert.Subject.CommonName
+	if name == "" {
+		name = cert.Subject.String()
+	}
+	return &Identity{Name: name, Method: "mtls"}, nil
+}
+
+// Any authenticates a request with the first authenticator that accepts
+// it, bearer tokens of several modes look alike so each one is tried
+type Any []Authenticator
+
+// Authenticate tries each authenticator in order, when all of them reject
+// the request the first error about its credentials is returned
+func (a Any) Authenticate(r *http.Request) (*Identity, error) {
+	first := ErrNoCredentials
+	for _, authenticator := range a {
+		id, err := authenticator.Authenticate(r)
+		if err == nil {
+			return id, nil
+		}
+		if !errors.Is(err, ErrNoCredentials) && errors.Is(first, ErrNoCredentials) {
+			first = err
+		}
+	}
+	return nil, first
+}
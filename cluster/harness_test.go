@@ -0,0 +1,410 @@
+// provides an in-process cluster for tests, nodes talk over an in-memory
+// network that can be partitioned and nodes can be killed and restarted
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+// timings used by every harness node
+const (
+	testHeartbeat       = 20 * time.Millisecond
+	testElectionTimeout = 150 * time.Millisecond
+)
+
+// network routes RPCs between the nodes of a harness
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*Node // running nodes by address
+	group map[string]int   // partition of each node, nodes only reach their own
+	dead  map[string]bool  // killed nodes
+	mute  bool             // AppendEntries are lost while set, votes still get through
+}
+
+// transport is the Transport of a single node on the network
+type transport struct {
+	net  *network
+	from string
+}
+
+// finds the node at addr if the sender can reach it
+func (n *network) route(from, addr string) (*Node, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	node, ok := n.nodes[addr]
+	if !ok || n.dead[addr] || n.dead[from] || n.group[from] != n.group[addr] {
+		return nil, fmt.Errorf("%s unreachable from %s", addr, from)
+	}
+	return node, nil
+}
+
+// copies a message the way the wire would
+func roundTrip(in, out interface{}) {
+	data, _ := json.Marshal(in)
+	json.Unmarshal(data, out)
+}
+
+func (t *transport) RequestVote(ctx context.Context, addr string, req *VoteRequest) (*VoteResponse, error) {
+	node, err := t.net.route(t.from, addr)
+	if err != nil {
+		return nil, err
+	}
+	var in VoteRequest
+	roundTrip(req, &in)
+	resp, err := node.HandleRequestVote(&in)
+	if err != nil {
+		return nil, err
+	}
+	// the answer is lost if the network split while the request was handled
+	if _, err := t.net.route(addr, t.from); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (t *transport) AppendEntries(ctx context.Context, addr string, req *AppendRequest) (*AppendResponse, error) {
+	node, err := t.net.route(t.from, addr)
+	if err != nil {
+		return nil, err
+	}
+	t.net.mu.Lock()
+	mute := t.net.mute
+	t.net.mu.Unlock()
+	if mute {
+		return nil, fmt.Errorf("appends to %s are muted", addr)
+	}
+	var in AppendRequest
+	roundTrip(req, &in)
+	resp, err := node.HandleAppendEntries(&in)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.net.route(addr, t.from); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (t *transport) InstallSnapshot(ctx context.Context, addr string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	node, err := t.net.route(t.from, addr)
+	if err != nil {
+		return nil, err
+	}
+	var in SnapshotRequest
+	roundTrip(req, &in)
+	resp, err := node.HandleInstallSnapshot(&in)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.net.route(addr, t.from); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// harness is a cluster of nodes running in the test process, each with its
+// own directory and FileIndex
+type harness struct {
+	t         *testing.T
+	net       *network
+	root      string
+	threshold uint64
+	nodes     map[string]*Node
+	members   map[string]bool // nodes that are part of the cluster
+
+	mu      sync.Mutex
+	changes map[string][]index.Change // changes each node reported through OnApply
+}
+
+// starts a cluster of size nodes named n1, n2, ... n1 bootstraps it and
+// adds the others
+func newHarness(t *testing.T, size int, threshold uint64) *harness {
+	t.Helper()
+
+	h := &harness{
+		t:         t,
+		net:       &network{nodes: map[string]*Node{}, group: map[string]int{}, dead: map[string]bool{}},
+		root:      t.TempDir(),
+		threshold: threshold,
+		nodes:     map[string]*Node{},
+		members:   map[string]bool{"n1": true},
+		changes:   map[string][]index.Change{},
+	}
+	t.Cleanup(h.stop)
+
+	h.start("n1")
+	if err := h.nodes["n1"].Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	h.waitLeader()
+	for k := 2; k <= size; k++ {
+		h.join(fmt.Sprintf("n%d", k))
+	}
+	return h
+}
+
+// the address of a node on the in-memory network
+func addr(id string) string {
+	return "mem://" + id
+}
+
+// opens the directory of id the way serve does and starts a node on it
+func (h *harness) start(id string) *Node {
+	h.t.Helper()
+
+	dir := filepath.Join(h.root, id)
+	idx := index.NewFileIndex(dir)
+	if err := idx.FileSystem.MkdirAll(dir, 0755); err != nil {
+		h.t.Fatal(err)
+	}
+	if err := idx.RestoreFromCheckpoint(); err != nil {
+		h.t.Fatal(err)
+	}
+	if err := idx.InitWAL(index.DurabilityNone); err != nil {
+		h.t.Fatal(err)
+	}
+	if err := idx.WALReplay(); err != nil {
+		h.t.Fatal(err)
+	}
+	idx.Regenerate()
+
+	node, err := NewNode(Config{
+		ID:                id,
+		Addr:              addr(id),
+		Dir:               dir,
+		Transport:         &transport{net: h.net, from: addr(id)},
+		HeartbeatInterval: testHeartbeat,
+		ElectionTimeout:   testElectionTimeout,
+		SnapshotThreshold: h.threshold,
+		OnApply: func(cmd *Command, changes []index.Change) {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			h.changes[id] = append(h.changes[id], changes...)
+		},
+	}, idx)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	h.net.mu.Lock()
+	h.net.nodes[addr(id)] = node
+	delete(h.net.dead, addr(id))
+	h.net.mu.Unlock()
+	h.nodes[id] = node
+	node.Start()
+	return node
+}
+
+// the changes a node reported for the commands it applied
+func (h *harness) applied(id string) []index.Change {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]index.Change(nil), h.changes[id]...)
+}
+
+// starts a new node and adds it to the cluster through the leader
+func (h *harness) join(id string) {
+	h.t.Helper()
+
+	h.start(id)
+	h.retry("add "+id, func(leader *Node) error {
+		return leader.AddMember(context.Background(), Member{ID: id, Addr: addr(id)})
+	})
+	h.members[id] = true
+}
+
+// removes a node from the cluster through the leader, it keeps running
+func (h *harness) leave(id string) {
+	h.t.Helper()
+
+	h.retry("remove "+id, func(leader *Node) error {
+		return leader.RemoveMember(context.Background(), id)
+	})
+	delete(h.members, id)
+}
+
+// stops a node as if its process died, its directory is kept
+func (h *harness) kill(id string) {
+	h.net.mu.Lock()
+	h.net.dead[addr(id)] = true
+	h.net.mu.Unlock()
+	h.nodes[id].Stop()
+}
+
+// splits the network, nodes only reach the nodes in their own group
+func (h *harness) partition(groups ...[]string) {
+	h.net.mu.Lock()
+	defer h.net.mu.Unlock()
+	for g, ids := range groups {
+		for _, id := range ids {
+			h.net.group[addr(id)] = g + 1
+		}
+	}
+}
+
+// lets every node reach every other one again
+func (h *harness) heal() {
+	h.net.mu.Lock()
+	defer h.net.mu.Unlock()
+	h.net.group = map[string]int{}
+}
+
+// loses every AppendEntries while muted, leaders can be elected but
+// can't commit anything
+func (h *harness) muteAppends(mute bool) {
+	h.net.mu.Lock()
+	defer h.net.mu.Unlock()
+	h.net.mute = mute
+}
+
+func (h *harness) stop() {
+	for _, node := range h.nodes {
+		node.Stop()
+	}
+}
+
+// waits until one of the given nodes leads and every one of them it can
+// reach follows it, all running members when none are given. A cut off
+// leader that hasn't noticed yet is ignored in favour of the newer one
+func (h *harness) waitLeader(ids ...string) *Node {
+	h.t.Helper()
+
+	if len(ids) == 0 {
+		ids = h.running()
+	}
+	var leader *Node
+	waitFor(h.t, "a leader", func() bool {
+		leader = nil
+		for _, id := range ids {
+			s := h.nodes[id].Status()
+			if s.Role == "leader" && (leader == nil || s.Term > leader.Status().Term) {
+				leader = h.nodes[id]
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, id := range ids {
+			if _, err := h.net.route(leader.cfg.Addr, addr(id)); err != nil && id != leader.cfg.ID {
+				continue
+			}
+			if h.nodes[id].Status().Leader != leader.cfg.ID {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+// ids of the members that weren't killed
+func (h *harness) running() []string {
+	h.net.mu.Lock()
+	defer h.net.mu.Unlock()
+
+	var ids []string
+	for id := range h.members {
+		if !h.net.dead[addr(id)] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// runs fn against the current leader until it succeeds, leaders change
+// while the cluster settles
+func (h *harness) retry(what string, fn func(leader *Node) error) {
+	h.t.Helper()
+
+	var err error
+	defer func() {
+		if h.t.Failed() && err != nil {
+			h.t.Logf("last attempt to %s failed: %v", what, err)
+		}
+	}()
+	waitFor(h.t, what, func() bool {
+		err = fn(h.waitLeader())
+		return err == nil
+	})
+}
+
+// writes a document through the leader
+func (h *harness) put(key, body string) {
+	h.t.Helper()
+	h.retry("put "+key, func(leader *Node) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return leader.Propose(ctx, Command{Op: OpPut, Key: key, Body: body})
+	})
+}
+
+// returns the documents of a node, nil if one disappeared while reading
+func docs(node *Node) map[string]string {
+	res := map[string]string{}
+	for _, key := range node.idx.ListKeys() {
+		file, _ := node.idx.Lookup(key)
+		body, err := file.ReadContent()
+		if err != nil {
+			return nil
+		}
+		res[key] = body
+	}
+	return res
+}
+
+// waits until the given nodes applied everything the leader committed and
+// hold the same documents, returns them
+func (h *harness) converged(ids ...string) map[string]string {
+	h.t.Helper()
+
+	if len(ids) == 0 {
+		ids = h.running()
+	}
+	var want map[string]string
+	waitFor(h.t, fmt.Sprintf("%v to converge", ids), func() bool {
+		commit := h.waitLeader(ids...).Status().Commit
+		want = nil
+		for _, id := range ids {
+			if h.nodes[id].Status().Applied < commit {
+				return false
+			}
+			got := docs(h.nodes[id])
+			if got == nil {
+				return false
+			}
+			if want == nil {
+				want = got
+				continue
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				return false
+			}
+		}
+		return true
+	})
+	return want
+}
+
+// polls cond until it holds, fails the test after 10 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,1142 @@
+// provides cluster mode, a small group of smolDB nodes that agree on the
+// order of writes through Raft consensus. Writes go to the leader, which
+// replicates them as log entries, an entry is applied to the FileIndex of
+// each node only once a majority of the nodes has stored it
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// operations a Command can carry, they mirror the WAL operations
+const (
+	OpPut    = "PUT"
+	OpDelete = "DELETE"
+	OpPatch  = "PATCH" // Field holds the field name, Body its JSON value
+	OpBatch  = "BATCH" // Body holds the JSON list of index.BatchOps
+)
+
+// log entry types
+const (
+	entryNoop    = "noop"    // appended by every new leader to commit earlier entries
+	entryCommand = "command" // a write to apply to the FileIndex
+	entryConfig  = "config"  // the new member list, in effect as soon as it is in the log
+)
+
+// defaults for the zero values of Config
+const (
+	defaultHeartbeat         = 100 * time.Millisecond
+	defaultElectionTimeout   = time.Second
+	defaultSnapshotThreshold = 1024
+)
+
+// how many entries a single AppendRequest carries at most
+const maxAppendEntries = 256
+
+var (
+	// ErrStopped is returned by a node that was stopped
+	ErrStopped = errors.New("cluster: node stopped")
+	// ErrLeadershipLost is returned for writes whose entry was replaced by a new leader
+	ErrLeadershipLost = errors.New("cluster: leadership lost before the write was committed")
+	// ErrMembershipChange is returned while an earlier membership change, or
+	// the no-op of a new leader, isn't committed yet
+	ErrMembershipChange = errors.New("cluster: another membership change is in progress")
+	// ErrKeyNotFound is returned when patching a key that doesn't exist
+	ErrKeyNotFound = errors.New("cluster: key not found")
+)
+
+// NotLeaderError is returned for writes sent to a node that isn't the
+// leader, Leader is the address of the current leader if one is known
+type NotLeaderError struct {
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "cluster: no leader elected"
+	}
+	return fmt.Sprintf("cluster: not the leader, the leader is %s", e.Leader)
+}
+
+// Role is the part a node currently plays in the cluster
+type Role int
+
+const (
+	RoleFollower Role = iota
+	RoleCandidate
+	RoleLeader
+)
+
+// String returns the name of the role as reported by the status endpoint
+func (r Role) String() string {
+	switch r {
+	case RoleCandidate:
+		return "candidate"
+	case RoleLeader:
+		return "leader"
+	}
+	return "follower"
+}
+
+// Member is a voting node of the cluster
+type Member struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"` // base URL other nodes and clients reach it at
+}
+
+// Command is a write replicated through the log
+type Command struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Field string `json:"field,omitempty"`
+	Body  string `json:"body,omitempty"`
+
+	// Atomic makes a batch fail as a whole, see index.FileIndex.Batch
+	Atomic bool `json:"atomic,omitempty"`
+
+	// the client that asked for the write and its request, every node
+	// records them in its audit log
+	Client    string `json:"client,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Entry is a single record of the replicated log
+type Entry struct {
+	Index   uint64   `json:"index"`
+	Term    uint64   `json:"term"`
+	Type    string   `json:"type"`
+	Command *Command `json:"command,omitempty"`
+	Members []Member `json:"members,omitempty"`
+}
+
+// Config configures a node, zero durations and thresholds use the defaults
+type Config struct {
+	ID                string        // unique and stable name of the node
+	Addr              string        // base URL of the node
+	Dir               string        // database directory, raft state lives in .smoldb/raft
+	Transport         Transport     // carries RPCs to the other nodes
+	HeartbeatInterval time.Duration // how often the leader contacts followers
+	ElectionTimeout   time.Duration // followers campaign after 1-2x this long without a leader
+	SnapshotThreshold uint64        // compact the log after this many applied entries
+
+	// OnApply is called with the documents every applied command changed,
+	// on every node, while no other command is applied
+	OnApply func(cmd *Command, changes []index.Change)
+}
+
+// Status describes the state of a node
+type Status struct {
+	ID            string   `json:"id"`
+	Addr          string   `json:"addr"`
+	Role          string   `json:"role"`
+	Term          uint64   `json:"term"`
+	Leader        string   `json:"leader,omitempty"`
+	LeaderAddr    string   `json:"leaderAddr,omitempty"`
+	LastIndex     uint64   `json:"lastIndex"`
+	Commit        uint64   `json:"commit"`
+	Applied       uint64   `json:"applied"`
+	SnapshotIndex uint64   `json:"snapshotIndex"`
+	Members       []Member `json:"members"`
+}
+
+// waiter is a write waiting for its entry to be applied
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// Node is a single member of a cluster applying committed entries to a FileIndex
+type Node struct {
+	cfg     Config
+	idx     *index.FileIndex
+	storage *storage
+
+	mu          sync.Mutex
+	role        Role
+	term        uint64
+	votedFor    string
+	log         []Entry // entries after the snapshot
+	snapIndex   uint64
+	snapTerm    uint64
+	snapMembers []Member
+	members     []Member // latest member list in the log
+	commit      uint64
+	applied     uint64
+	leader      string
+	leaderAddr  string
+	lastContact time.Time // last message from the leader
+	deadline    time.Time // campaign when no leader was heard from by then
+	broadcastAt time.Time
+	next        map[string]uint64    // next entry to send to each peer
+	match       map[string]uint64    // highest entry known to be stored on each peer
+	lastAck     map[string]time.Time // last successful response of each peer
+	inflight    map[string]bool
+	waiters     map[uint64]waiter
+	stopped     bool
+
+	applyMu sync.Mutex // held while entries are applied or snapshots taken
+	applyCh chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewNode opens the raft state in cfg.Dir, idx must already be recovered
+// from its own checkpoint and WAL. The node does nothing until Start
+func NewNode(cfg Config, idx *index.FileIndex) (*Node, error) {
+	if cfg.ID == "" {
+		return nil, fmt.Errorf("cluster: node id is required")
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = defaultHeartbeat
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = defaultElectionTimeout
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = defaultSnapshotThreshold
+	}
+	if cfg.Transport == nil {
+		cfg.Transport = NewHTTPTransport()
+	}
+
+	s, err := openStorage(idx.FileSystem, cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	hs, entries, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		cfg:         cfg,
+		idx:         idx,
+		storage:     s,
+		term:        hs.Term,
+		votedFor:    hs.Vote,
+		log:         entries,
+		snapIndex:   hs.SnapIndex,
+		snapTerm:    hs.SnapTerm,
+		snapMembers: hs.SnapMembers,
+		applied:     hs.Applied,
+		next:        map[string]uint64{},
+		match:       map[string]uint64{},
+		lastAck:     map[string]time.Time{},
+		inflight:    map[string]bool{},
+		waiters:     map[uint64]waiter{},
+		applyCh:     make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	if n.applied < n.snapIndex {
+		n.applied = n.snapIndex
+	}
+	if n.applied > n.lastIndex() {
+		n.applied = n.lastIndex()
+	}
+	n.commit = n.applied
+	n.members = n.configAt(n.lastIndex())
+	return n, nil
+}
+
+// Bootstrap makes a node that has never been part of a cluster the single
+// member of a new one, it is a no-op for nodes that already have state
+func (n *Node) Bootstrap() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.lastIndex() > 0 || n.term > 0 {
+		return nil
+	}
+	n.term = 1
+	if err := n.persistState(); err != nil {
+		return err
+	}
+	_, err := n.appendLocked(Entry{Type: entryConfig, Members: []Member{{ID: n.cfg.ID, Addr: n.cfg.Addr}}})
+	if err == nil {
+		log.Info("cluster: bootstrapped a new cluster with %s as its only member", n.cfg.ID)
+	}
+	return err
+}
+
+// Start runs elections, replication and the apply loop in the background.
+// The node starts as a follower and only campaigns after a randomized
+// election timeout without hearing from a leader. It appends nothing
+// itself, the leader that comes out of an election appends the no-op that
+// commits the entries of earlier terms
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetDeadline()
+	n.mu.Unlock()
+
+	n.wg.Add(2)
+	go n.run()
+	go n.applyLoop()
+	// the commit index restarts at the applied one, entries after it are
+	// only applied once a leader commits again
+	n.signalApply()
+}
+
+// Stop halts the node and fails every write still waiting
+func (n *Node) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.stop)
+	n.mu.Unlock()
+
+	n.wg.Wait()
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.persistState()
+	n.storage.close()
+	for i, w := range n.waiters {
+		w.done <- ErrStopped
+		delete(n.waiters, i)
+	}
+}
+
+// Status returns the current state of the node
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return Status{
+		ID:            n.cfg.ID,
+		Addr:          n.cfg.Addr,
+		Role:          n.role.String(),
+		Term:          n.term,
+		Leader:        n.leader,
+		LeaderAddr:    n.leaderAddr,
+		LastIndex:     n.lastIndex(),
+		Commit:        n.commit,
+		Applied:       n.applied,
+		SnapshotIndex: n.snapIndex,
+		Members:       append([]Member(nil), n.members...),
+	}
+}
+
+// Propose replicates a write and waits until it is applied to the local
+// FileIndex, returns a NotLeaderError on followers
+func (n *Node) Propose(ctx context.Context, cmd Command) error {
+	n.mu.Lock()
+	if n.role != RoleLeader {
+		leader := n.leaderAddr
+		n.mu.Unlock()
+		return &NotLeaderError{Leader: leader}
+	}
+	i, err := n.appendLocked(Entry{Type: entryCommand, Command: &cmd})
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	done := n.wait(i)
+	n.broadcast()
+	n.mu.Unlock()
+
+	return n.await(ctx, done)
+}
+
+// AddMember adds a node to the cluster, it catches up from the leader
+// before it counts towards the majority of later entries
+func (n *Node) AddMember(ctx context.Context, m Member) error {
+	return n.changeMembers(ctx, func(members []Member) ([]Member, error) {
+		for _, existing := range members {
+			if existing.ID == m.ID {
+				if existing.Addr == m.Addr {
+					return nil, nil
+				}
+				return nil, fmt.Errorf("cluster: %s is already a member at %s", m.ID, existing.Addr)
+			}
+		}
+		return append(members, m), nil
+	})
+}
+
+// RemoveMember removes a node from the cluster, a leader removing itself
+// steps down once the change is committed
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, func(members []Member) ([]Member, error) {
+		for k, existing := range members {
+			if existing.ID == id {
+				if len(members) == 1 {
+					return nil, fmt.Errorf("cluster: can't remove the last member")
+				}
+				return append(members[:k:k], members[k+1:]...), nil
+			}
+		}
+		return nil, nil
+	})
+}
+
+// appends a new member list, one change at a time so the old and the new
+// majority always overlap
+func (n *Node) changeMembers(ctx context.Context, change func([]Member) ([]Member, error)) error {
+	n.mu.Lock()
+	if n.role != RoleLeader {
+		leader := n.leaderAddr
+		n.mu.Unlock()
+		return &NotLeaderError{Leader: leader}
+	}
+	// a new leader only knows which member list is committed once an
+	// entry of its own term is, until then a change could overlap with
+	// an uncommitted one of an earlier leader it never received
+	if n.configIndex() > n.commit || n.termAt(n.commit) != n.term {
+		n.mu.Unlock()
+		return ErrMembershipChange
+	}
+	members, err := change(append([]Member(nil), n.members...))
+	if err != nil || members == nil {
+		n.mu.Unlock()
+		return err
+	}
+	i, err := n.appendLocked(Entry{Type: entryConfig, Members: members})
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	done := n.wait(i)
+	n.broadcast()
+	n.mu.Unlock()
+
+	return n.await(ctx, done)
+}
+
+// registers a waiter for the entry at index i of the current term
+func (n *Node) wait(i uint64) chan error {
+	done := make(chan error, 1)
+	n.waiters[i] = waiter{term: n.term, done: done}
+	return done
+}
+
+func (n *Node) await(ctx context.Context, done chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.stop:
+		return ErrStopped
+	}
+}
+
+// drives elections and heartbeats
+func (n *Node) run() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+			n.mu.Lock()
+			n.tick()
+			n.mu.Unlock()
+		}
+	}
+}
+
+func (n *Node) tick() {
+	now := time.Now()
+	if n.role == RoleLeader {
+		// a leader cut off from the majority can't commit anything, stepping
+		// down lets clients find the new one
+		if !n.quorumContact(now) {
+			log.Warn("cluster: %s lost contact with the majority, stepping down", n.cfg.ID)
+			n.becomeFollower(n.term)
+			return
+		}
+		if now.Sub(n.broadcastAt) >= n.cfg.HeartbeatInterval {
+			n.broadcast()
+		}
+		return
+	}
+	if now.After(n.deadline) && n.isMember(n.cfg.ID) {
+		n.campaign()
+	}
+}
+
+// reports whether the majority answered the leader within an election timeout
+func (n *Node) quorumContact(now time.Time) bool {
+	count := 0
+	for _, m := range n.members {
+		if m.ID == n.cfg.ID || now.Sub(n.lastAck[m.ID]) < n.cfg.ElectionTimeout {
+			count++
+		}
+	}
+	return count > len(n.members)/2
+}
+
+func (n *Node) resetDeadline() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.deadline = time.Now().Add(timeout)
+}
+
+// starts an election for the next term
+func (n *Node) campaign() {
+	n.role = RoleCandidate
+	n.term++
+	n.votedFor = n.cfg.ID
+	n.leader, n.leaderAddr = "", ""
+	n.resetDeadline()
+	if err := n.persistState(); err != nil {
+		log.Warn("cluster: failed to save state: %v", err)
+		return
+	}
+	log.Info("cluster: %s campaigning in term %d", n.cfg.ID, n.term)
+
+	term, votes := n.term, 1
+	if votes > len(n.members)/2 {
+		n.becomeLeader()
+		return
+	}
+	req := &VoteRequest{Term: term, Candidate: n.cfg.ID, LastIndex: n.lastIndex(), LastTerm: n.termAt(n.lastIndex())}
+	for _, m := range n.members {
+		if m.ID == n.cfg.ID {
+			continue
+		}
+		go func(m Member) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+			resp, err := n.cfg.Transport.RequestVote(ctx, m.Addr, req)
+			cancel()
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if n.stopped {
+				return
+			}
+			if resp.Term > n.term {
+				n.becomeFollower(resp.Term)
+				return
+			}
+			if n.role != RoleCandidate || n.term != term || !resp.Granted {
+				return
+			}
+			if votes++; votes > len(n.members)/2 {
+				n.becomeLeader()
+			}
+		}(m)
+	}
+}
+
+func (n *Node) becomeLeader() {
+	n.role = RoleLeader
+	n.leader, n.leaderAddr = n.cfg.ID, n.cfg.Addr
+	n.next, n.match = map[string]uint64{}, map[string]uint64{}
+	n.lastAck, n.inflight = map[string]time.Time{}, map[string]bool{}
+	n.trackPeers()
+	log.Info("cluster: %s is the leader of term %d", n.cfg.ID, n.term)
+
+	// entries of earlier terms only commit together with one of this term
+	if _, err := n.appendLocked(Entry{Type: entryNoop}); err != nil {
+		log.Warn("cluster: failed to append to the log: %v", err)
+		n.becomeFollower(n.term)
+		return
+	}
+	n.broadcast()
+}
+
+// moves to term as a follower, forgetting the vote of an older term
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		if err := n.persistState(); err != nil {
+			log.Warn("cluster: failed to save state: %v", err)
+		}
+	}
+	if n.role == RoleLeader {
+		n.leader, n.leaderAddr = "", ""
+	}
+	n.role = RoleFollower
+	n.resetDeadline()
+}
+
+// starts tracking replication to members the leader doesn't know yet
+func (n *Node) trackPeers() {
+	now := time.Now()
+	for _, m := range n.members {
+		if _, ok := n.next[m.ID]; !ok && m.ID != n.cfg.ID {
+			n.next[m.ID] = n.lastIndex() + 1
+			n.match[m.ID] = 0
+			n.lastAck[m.ID] = now
+		}
+	}
+}
+
+// sends entries or a heartbeat to every peer without a request in flight
+func (n *Node) broadcast() {
+	n.broadcastAt = time.Now()
+	for _, m := range n.members {
+		if m.ID != n.cfg.ID {
+			n.send(m)
+		}
+	}
+	n.advanceCommit()
+}
+
+func (n *Node) send(m Member) {
+	if n.inflight[m.ID] || n.stopped {
+		return
+	}
+	n.inflight[m.ID] = true
+
+	next := n.next[m.ID]
+	if next <= n.snapIndex {
+		go n.sendSnapshot(m, n.term)
+		return
+	}
+	req := &AppendRequest{
+		Term:       n.term,
+		Leader:     n.cfg.ID,
+		LeaderAddr: n.cfg.Addr,
+		PrevIndex:  next - 1,
+		PrevTerm:   n.termAt(next - 1),
+		Commit:     n.commit,
+	}
+	if last := n.lastIndex(); next <= last {
+		end := last + 1
+		if end-next > maxAppendEntries {
+			end = next + maxAppendEntries
+		}
+		req.Entries = n.entries(next, end)
+	}
+	go n.sendAppend(m, req)
+}
+
+func (n *Node) sendAppend(m Member, req *AppendRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+	resp, err := n.cfg.Transport.AppendEntries(ctx, m.Addr, req)
+	cancel()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.inflight[m.ID] = false
+	if err != nil || n.stopped {
+		return
+	}
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term)
+		return
+	}
+	if n.role != RoleLeader || n.term != req.Term {
+		return
+	}
+	n.lastAck[m.ID] = time.Now()
+
+	if resp.Success {
+		if match := req.PrevIndex + uint64(len(req.Entries)); match > n.match[m.ID] {
+			n.match[m.ID] = match
+		}
+		n.next[m.ID] = n.match[m.ID] + 1
+		n.advanceCommit()
+	} else {
+		// step back, straight to the end of a follower's shorter log
+		next := req.PrevIndex
+		if resp.LastIndex+1 < next {
+			next = resp.LastIndex + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.next[m.ID] = next
+	}
+	if n.isMember(m.ID) && (!resp.Success || n.next[m.ID] <= n.lastIndex()) {
+		n.send(m)
+	}
+}
+
+// sends a checkpoint to a peer that is behind the compacted log
+func (n *Node) sendSnapshot(m Member, term uint64) {
+	req, err := n.snapshotRequest(term)
+	var resp *SnapshotResponse
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*n.cfg.ElectionTimeout)
+		resp, err = n.cfg.Transport.InstallSnapshot(ctx, m.Addr, req)
+		cancel()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.inflight[m.ID] = false
+	if err != nil || n.stopped {
+		if err != nil {
+			log.Warn("cluster: failed to send snapshot to %s: %v", m.ID, err)
+		}
+		return
+	}
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term)
+		return
+	}
+	if n.role != RoleLeader || n.term != term {
+		return
+	}
+	n.lastAck[m.ID] = time.Now()
+	if req.LastIndex > n.match[m.ID] {
+		n.match[m.ID] = req.LastIndex
+	}
+	n.next[m.ID] = n.match[m.ID] + 1
+	log.Info("cluster: sent snapshot at index %d to %s", req.LastIndex, m.ID)
+}
+
+// takes a checkpoint of everything applied so far
+func (n *Node) snapshotRequest(term uint64) (*SnapshotRequest, error) {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	if err := n.idx.CreateCheckpoint(); err != nil {
+		return nil, err
+	}
+	path, err := n.idx.LatestCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	data, err := af.ReadFile(n.idx.FileSystem, path)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return &SnapshotRequest{
+		Term:       term,
+		Leader:     n.cfg.ID,
+		LeaderAddr: n.cfg.Addr,
+		LastIndex:  n.applied,
+		LastTerm:   n.termAt(n.applied),
+		Members:    n.configAt(n.applied),
+		Data:       data,
+	}, nil
+}
+
+// commits the newest entry of this term stored on a majority
+func (n *Node) advanceCommit() {
+	if n.role != RoleLeader {
+		return
+	}
+	for i := n.lastIndex(); i > n.commit && i > n.snapIndex; i-- {
+		if n.termAt(i) != n.term {
+			return
+		}
+		count := 0
+		for _, m := range n.members {
+			if m.ID == n.cfg.ID || n.match[m.ID] >= i {
+				count++
+			}
+		}
+		if count > len(n.members)/2 {
+			n.commit = i
+			n.signalApply()
+			return
+		}
+	}
+}
+
+// HandleRequestVote answers a candidate asking for this node's vote
+func (n *Node) HandleRequestVote(req *VoteRequest) (*VoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return nil, ErrStopped
+	}
+	resp := &VoteResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	// nodes that still hear from their leader ignore candidates, so removed
+	// or briefly cut off nodes can't depose a working leader
+	if n.role == RoleLeader || (n.leader != "" && time.Since(n.lastContact) < n.cfg.ElectionTimeout) {
+		return resp, nil
+	}
+	if req.Term > n.term {
+		n.becomeFollower(req.Term)
+		resp.Term = n.term
+	}
+
+	lastTerm := n.termAt(n.lastIndex())
+	upToDate := req.LastTerm > lastTerm || (req.LastTerm == lastTerm && req.LastIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate {
+		n.votedFor = req.Candidate
+		if err := n.persistState(); err != nil {
+			return nil, err
+		}
+		n.resetDeadline()
+		resp.Granted = true
+	}
+	return resp, nil
+}
+
+// HandleAppendEntries stores entries sent by the leader and learns how far
+// the log is committed
+func (n *Node) HandleAppendEntries(req *AppendRequest) (*AppendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return nil, ErrStopped
+	}
+	if req.Term < n.term {
+		return &AppendResponse{Term: n.term, LastIndex: n.lastIndex()}, nil
+	}
+	n.heardFromLeader(req.Term, req.Leader, req.LeaderAddr)
+
+	resp := &AppendResponse{Term: n.term, LastIndex: n.lastIndex()}
+	if req.PrevIndex > n.lastIndex() {
+		return resp, nil
+	}
+	// entries covered by the snapshot are committed and therefore match
+	if req.PrevIndex > n.snapIndex && n.termAt(req.PrevIndex) != req.PrevTerm {
+		resp.LastIndex = req.PrevIndex - 1
+		return resp, nil
+	}
+
+	var fresh []Entry
+	for k, e := range req.Entries {
+		if e.Index <= n.snapIndex {
+			continue
+		}
+		if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue
+			}
+			if err := n.truncate(e.Index); err != nil {
+				return nil, err
+			}
+		}
+		fresh = req.Entries[k:]
+		break
+	}
+	if len(fresh) > 0 {
+		if err := n.storage.append(fresh); err != nil {
+			return nil, err
+		}
+		n.log = append(n.log, fresh...)
+		n.members = n.configAt(n.lastIndex())
+	}
+
+	if last := req.PrevIndex + uint64(len(req.Entries)); req.Commit > n.commit && last > n.commit {
+		n.commit = req.Commit
+		if last < n.commit {
+			n.commit = last
+		}
+		n.signalApply()
+	}
+	resp.Success = true
+	resp.LastIndex = n.lastIndex()
+	return resp, nil
+}
+
+// HandleInstallSnapshot replaces the documents and the log with a snapshot
+// of the leader
+func (n *Node) HandleInstallSnapshot(req *SnapshotRequest) (*SnapshotResponse, error) {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil, ErrStopped
+	}
+	if req.Term < n.term {
+		defer n.mu.Unlock()
+		return &SnapshotResponse{Term: n.term}, nil
+	}
+	n.heardFromLeader(req.Term, req.Leader, req.LeaderAddr)
+	if req.LastIndex <= n.applied {
+		defer n.mu.Unlock()
+		return &SnapshotResponse{Term: n.term}, nil
+	}
+	n.mu.Unlock()
+
+	count, err := n.idx.InstallCheckpoint(bytes.NewReader(req.Data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to install snapshot: %v", err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// entries after the snapshot survive if they agree with it
+	if n.lastIndex() > req.LastIndex && n.termAt(req.LastIndex) == req.LastTerm {
+		n.log = n.entries(req.LastIndex+1, n.lastIndex()+1)
+	} else {
+		n.failWaiters(n.snapIndex + 1)
+		n.log = nil
+	}
+	n.snapIndex, n.snapTerm, n.snapMembers = req.LastIndex, req.LastTerm, req.Members
+	n.applied = req.LastIndex
+	if n.commit < n.applied {
+		n.commit = n.applied
+	}
+	n.members = n.configAt(n.lastIndex())
+	if err := n.persistState(); err != nil {
+		return nil, err
+	}
+	if err := n.storage.rewrite(n.log); err != nil {
+		return nil, err
+	}
+	log.Info("cluster: installed snapshot of %d documents at index %d from %s", count, req.LastIndex, req.Leader)
+	return &SnapshotResponse{Term: n.term}, nil
+}
+
+// follows the leader of term, which just contacted this node
+func (n *Node) heardFromLeader(term uint64, leader, addr string) {
+	if term > n.term || n.role != RoleFollower {
+		n.becomeFollower(term)
+	}
+	n.leader, n.leaderAddr = leader, addr
+	n.lastContact = time.Now()
+	n.resetDeadline()
+}
+
+// drops the entries from index i on, they conflict with the leader's log
+func (n *Node) truncate(i uint64) error {
+	n.failWaiters(i)
+	n.log = n.entries(n.snapIndex+1, i)
+	n.members = n.configAt(n.lastIndex())
+	return n.storage.rewrite(n.log)
+}
+
+// fails the writes waiting for entries from index i on
+func (n *Node) failWaiters(i uint64) {
+	for k, w := range n.waiters {
+		if k >= i {
+			w.done <- ErrLeadershipLost
+			delete(n.waiters, k)
+		}
+	}
+}
+
+func (n *Node) signalApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// applies committed entries to the FileIndex as they come in
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.applyCh:
+			n.applyCommitted()
+		}
+	}
+}
+
+func (n *Node) applyCommitted() {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	var entries []Entry
+	if n.commit > n.applied {
+		entries = n.entries(n.applied+1, n.commit+1)
+	}
+	n.mu.Unlock()
+	if len(entries) == 0 {
+		return
+	}
+
+	for _, e := range entries {
+		var err error
+		if e.Type == entryCommand {
+			var changes []index.Change
+			changes, err = n.apply(e.Command)
+			if err == nil && n.cfg.OnApply != nil {
+				n.cfg.OnApply(e.Command, changes)
+			}
+		}
+
+		n.mu.Lock()
+		n.applied = e.Index
+		if w, ok := n.waiters[e.Index]; ok {
+			delete(n.waiters, e.Index)
+			if w.term != e.Term {
+				err = ErrLeadershipLost
+			}
+			w.done <- err
+		}
+		if e.Type == entryConfig && !n.isMember(n.cfg.ID) && n.role == RoleLeader {
+			log.Info("cluster: %s was removed from the cluster, stepping down", n.cfg.ID)
+			n.becomeFollower(n.term)
+		}
+		n.mu.Unlock()
+	}
+
+	n.mu.Lock()
+	if err := n.persistState(); err != nil {
+		log.Warn("cluster: failed to save state: %v", err)
+	}
+	compact := n.applied-n.snapIndex >= n.cfg.SnapshotThreshold
+	n.mu.Unlock()
+	if compact {
+		n.compact()
+	}
+}
+
+// applies a committed write to the FileIndex, the same writes produce the
+// same documents on every node, returns the changes it made
+func (n *Node) apply(cmd *Command) ([]index.Change, error) {
+	file, ok := n.idx.Lookup(cmd.Key)
+	var change index.Change
+	var err error
+	switch cmd.Op {
+	case OpPut:
+		change, err = n.idx.PutChange(file, []byte(cmd.Body))
+	case OpDelete:
+		if !ok {
+			return nil, nil
+		}
+		change, err = n.idx.DeleteChange(file)
+	case OpPatch:
+		if !ok {
+			return nil, ErrKeyNotFound
+		}
+		change, err = n.idx.PatchFieldChange(file, cmd.Field, json.RawMessage(cmd.Body))
+	case OpBatch:
+		var ops []index.BatchOp
+		if err := json.Unmarshal([]byte(cmd.Body), &ops); err != nil {
+			return nil, fmt.Errorf("cluster: invalid batch: %v", err)
+		}
+		return n.idx.BatchChanges(ops, cmd.Atomic)
+	default:
+		return nil, fmt.Errorf("cluster: unknown op '%s'", cmd.Op)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []index.Change{change}, nil
+}
+
+// takes a checkpoint and drops the log entries it covers, callers must
+// hold applyMu so the checkpoint matches the applied index
+func (n *Node) compact() {
+	if err := n.idx.CreateCheckpoint(); err != nil {
+		log.Warn("cluster: failed to checkpoint before compacting the log: %v", err)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	i := n.applied
+	n.snapTerm, n.snapMembers = n.termAt(i), n.configAt(i)
+	n.log = n.entries(i+1, n.lastIndex()+1)
+	n.snapIndex = i
+	if err := n.persistState(); err != nil {
+		log.Warn("cluster: failed to save state: %v", err)
+		return
+	}
+	if err := n.storage.rewrite(n.log); err != nil {
+		log.Warn("cluster: failed to compact the log: %v", err)
+		return
+	}
+	log.Info("cluster: compacted the log up to index %d", i)
+}
+
+// appends an entry of the current term to the log, callers must hold mu
+func (n *Node) appendLocked(e Entry) (uint64, error) {
+	e.Index = n.lastIndex() + 1
+	e.Term = n.term
+	if err := n.storage.append([]Entry{e}); err != nil {
+		return 0, fmt.Errorf("failed to append to the raft log: %v", err)
+	}
+	n.log = append(n.log, e)
+	if e.Type == entryConfig {
+		n.members = e.Members
+		if n.role == RoleLeader {
+			n.trackPeers()
+		}
+	}
+	n.advanceCommit()
+	return e.Index, nil
+}
+
+func (n *Node) persistState() error {
+	return n.storage.saveState(hardState{
+		Term:        n.term,
+		Vote:        n.votedFor,
+		Applied:     n.applied,
+		SnapIndex:   n.snapIndex,
+		SnapTerm:    n.snapTerm,
+		SnapMembers: n.snapMembers,
+	})
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.snapIndex + uint64(len(n.log))
+}
+
+// returns the term of the entry at index i, 0 if it isn't known
+func (n *Node) termAt(i uint64) uint64 {
+	if i == n.snapIndex {
+		return n.snapTerm
+	}
+	if i < n.snapIndex || i > n.lastIndex() {
+		return 0
+	}
+	return n.log[i-n.snapIndex-1].Term
+}
+
+// returns a copy of the entries from index from up to but excluding to
+func (n *Node) entries(from, to uint64) []Entry {
+	if to <= from {
+		return nil
+	}
+	return append([]Entry(nil), n.log[from-n.snapIndex-1:to-n.snapIndex-1]...)
+}
+
+// returns the member list in effect at index i
+func (n *Node) configAt(i uint64) []Member {
+	for k := len(n.log) - 1; k >= 0; k-- {
+		if n.log[k].Index <= i && n.log[k].Type == entryConfig {
+			return n.log[k].Members
+		}
+	}
+	return n.snapMembers
+}
+
+// returns the index of the latest member list in the log
+func (n *Node) configIndex() uint64 {
+	for k := len(n.log) - 1; k >= 0; k-- {
+		if n.log[k].Type == entryConfig {
+			return n.log[k].Index
+		}
+	}
+	return n.snapIndex
+}
+
+func (n *Node) isMember(id string) bool {
+	for _, m := range n.members {
+		if m.ID == id {
+			return true
+		}
+	}
+	return false
+}
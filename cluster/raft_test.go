@@ -0,0 +1,263 @@
+// provides tests for leader election, log replication, snapshots and
+// membership changes on an in-process cluster
+package cluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+// the other nodes of a three node harness
+func others(leader *Node) []string {
+	var ids []string
+	for _, id := range []string{"n1", "n2", "n3"} {
+		if id != leader.cfg.ID {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func TestCluster(t *testing.T) {
+	// Test Case 1: writes are committed to every node in order
+	t.Run("replicate writes", func(t *testing.T) {
+		h := newHarness(t, 3, 0)
+		leader := h.waitLeader()
+		ctx := context.Background()
+
+		assert.NoError(t, leader.Propose(ctx, Command{Op: OpPut, Key: "a", Body: `{"v":1}`}))
+		assert.NoError(t, leader.Propose(ctx, Command{Op: OpPatch, Key: "a", Field: "w", Body: `true`}))
+		assert.NoError(t, leader.Propose(ctx, Command{Op: OpPut, Key: "b", Body: `{"v":1}`}))
+		assert.NoError(t, leader.Propose(ctx, Command{Op: OpDelete, Key: "b"}))
+		assert.ErrorIs(t, leader.Propose(ctx, Command{Op: OpPatch, Key: "c", Field: "w", Body: `1`}), ErrKeyNotFound)
+		assert.NoError(t, leader.Propose(ctx, Command{Op: OpBatch, Body: `[{"op":"PUT","key":"d","body":"{}"},{"op":"DELETE","key":"d"}]`, Atomic: true}))
+		assert.ErrorIs(t, leader.Propose(ctx, Command{Op: OpBatch, Body: `[{"op":"PUT","key":"d","body":"{}"},{"op":"DELETE","key":"e"}]`, Atomic: true}), index.ErrBatchConflict)
+
+		// a write is applied on the leader by the time Propose returns
+		file, ok := leader.idx.Lookup("a")
+		assert.True(t, ok)
+		body, _ := file.ReadContent()
+		assert.Equal(t, `{"v":1,"w":true}`, body)
+
+		assert.Equal(t, map[string]string{"a": `{"v":1,"w":true}`}, h.converged())
+		for _, id := range []string{"n1", "n2", "n3"} {
+			assert.Len(t, h.nodes[id].Status().Members, 3)
+		}
+
+		// every node reports the changes it applied, followers included
+		for _, id := range []string{"n1", "n2", "n3"} {
+			changes := h.applied(id)
+			if assert.Len(t, changes, 5, id) {
+				assert.Equal(t, "a", changes[0].Key, id)
+				assert.Empty(t, changes[0].Before, id)
+				assert.Equal(t, changes[0].After, changes[1].Before, id)
+				assert.NotEmpty(t, changes[1].After, id)
+				assert.Empty(t, changes[3].After, id)
+			}
+			assert.Equal(t, h.applied("n1"), changes, id)
+		}
+	})
+
+	// Test Case 2: followers refuse writes and name the leader
+	t.Run("writes on followers", func(t *testing.T) {
+		h := newHarness(t, 3, 0)
+		leader := h.waitLeader()
+		follower := h.nodes[others(leader)[0]]
+
+		err := follower.Propose(context.Background(), Command{Op: OpPut, Key: "a", Body: `{}`})
+		var notLeader *NotLeaderError
+		assert.True(t, errors.As(err, &notLeader))
+		assert.Equal(t, leader.cfg.Addr, notLeader.Leader)
+		assert.Error(t, follower.AddMember(context.Background(), Member{ID: "n4", Addr: addr("n4")}))
+	})
+
+	// Test Case 3: a partitioned leader is replaced and its uncommitted writes are dropped
+	t.Run("partition leader", func(t *testing.T) {
+		h := newHarness(t, 3, 0)
+		h.put("a", `{"v":1}`)
+		old := h.waitLeader()
+		rest := others(old)
+
+		h.partition([]string{old.cfg.ID}, rest)
+		// the old leader can't reach a majority, the write never commits
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		err := old.Propose(ctx, Command{Op: OpPut, Key: "lost", Body: `{}`})
+		cancel()
+		assert.Error(t, err)
+
+		leader := h.waitLeader(rest...)
+		assert.NotEqual(t, old.cfg.ID, leader.cfg.ID)
+		assert.NoError(t, leader.Propose(context.Background(), Command{Op: OpPut, Key: "b", Body: `{"v":2}`}))
+		waitFor(t, "the old leader to step down", func() bool {
+			return old.Status().Role != "leader"
+		})
+
+		h.heal()
+		assert.Equal(t, map[string]string{"a": `{"v":1}`, "b": `{"v":2}`}, h.converged())
+	})
+
+	// Test Case 4: a minority can't elect a leader or commit
+	t.Run("partition minority", func(t *testing.T) {
+		h := newHarness(t, 3, 0)
+		leader := h.waitLeader()
+		lone := others(leader)[0]
+
+		h.partition([]string{lone})
+		time.Sleep(5 * testElectionTimeout)
+		assert.NotEqual(t, "leader", h.nodes[lone].Status().Role)
+		h.put("a", `{"v":1}`)
+
+		// the cut off node campaigned for higher terms, it must not depose the leader
+		h.heal()
+		assert.Equal(t, map[string]string{"a": `{"v":1}`}, h.converged())
+	})
+
+	// Test Case 5: killed nodes restart from disk and catch up
+	t.Run("kill and restart", func(t *testing.T) {
+		h := newHarness(t, 3, 0)
+		h.put("a", `{"v":1}`)
+		leader := h.waitLeader()
+		follower := others(leader)[0]
+
+		h.kill(follower)
+		h.put("b", `{"v":1}`)
+		h.kill(leader.cfg.ID)
+		// two of three nodes are down, nothing can be committed
+		time.Sleep(3 * testElectionTimeout)
+		h.start(follower)
+		h.put("c", `{"v":1}`)
+		h.start(leader.cfg.ID)
+
+		want := map[string]string{"a": `{"v":1}`, "b": `{"v":1}`, "c": `{"v":1}`}
+		assert.Equal(t, want, h.converged())
+		// nothing was applied twice or lost on the restarted nodes
+		for _, id := range []string{"n1", "n2", "n3"} {
+			s := h.nodes[id].Status()
+			assert.Equal(t, s.Commit, s.Applied, id)
+		}
+	})
+
+	// Test Case 6: a node behind the compacted log is sent a snapshot
+	t.Run("snapshot", func(t *testing.T) {
+		h := newHarness(t, 3, 5)
+		leader := h.waitLeader()
+		lagging := others(leader)[0]
+
+		h.kill(lagging)
+		for _, key := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+			h.put(key, `{"v":1}`)
+		}
+		assert.NoError(t, h.waitLeader().Propose(context.Background(), Command{Op: OpDelete, Key: "a"}))
+		waitFor(t, "the leader to compact its log", func() bool {
+			return h.waitLeader().Status().SnapshotIndex > 5
+		})
+
+		h.start(lagging)
+		docs := h.converged()
+		assert.Len(t, docs, 6)
+		assert.NotContains(t, docs, "a")
+		assert.Greater(t, h.nodes[lagging].Status().SnapshotIndex, uint64(5))
+
+		// the installed snapshot survives a restart
+		h.kill(lagging)
+		h.put("h", `{"v":1}`)
+		h.start(lagging)
+		assert.Len(t, h.converged(), 7)
+	})
+
+	// Test Case 7: nodes join and leave, a removed leader hands over
+	t.Run("membership", func(t *testing.T) {
+		h := newHarness(t, 3, 0)
+		h.put("a", `{"v":1}`)
+
+		h.join("n4")
+		assert.Equal(t, map[string]string{"a": `{"v":1}`}, h.converged())
+		assert.Len(t, h.waitLeader().Status().Members, 4)
+
+		// one change at a time, the next waits until the first is committed
+		leader := h.waitLeader()
+		var victims []string
+		for _, id := range []string{"n1", "n2", "n3", "n4"} {
+			if id != leader.cfg.ID && len(victims) < 2 {
+				victims = append(victims, id)
+			}
+		}
+		h.kill(victims[0])
+		h.kill(victims[1])
+		// five members need three nodes for a majority, only two are up
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		assert.ErrorIs(t, leader.AddMember(ctx, Member{ID: "n5", Addr: addr("n5")}), context.DeadlineExceeded)
+		cancel()
+		assert.ErrorIs(t, leader.RemoveMember(context.Background(), victims[0]), ErrMembershipChange)
+		h.start(victims[0])
+		h.start(victims[1])
+		h.join("n5")
+		assert.Len(t, h.converged(), 1)
+
+		old := h.waitLeader()
+		h.leave(old.cfg.ID)
+		waitFor(t, "the removed leader to step down", func() bool {
+			return old.Status().Role != "leader"
+		})
+		leader = h.waitLeader()
+		assert.NotEqual(t, old.cfg.ID, leader.cfg.ID)
+		assert.Len(t, leader.Status().Members, 4)
+		h.put("b", `{"v":2}`)
+		assert.Len(t, h.converged(), 2)
+		assert.NotContains(t, h.waitLeader().Status().Members, Member{ID: old.cfg.ID, Addr: old.cfg.Addr})
+		assert.NotEqual(t, "leader", old.Status().Role)
+	})
+
+	// Test Case 8: a new leader changes members only once its no-op is
+	// committed, not while an earlier leader's change may still be around
+	t.Run("membership after failover", func(t *testing.T) {
+		h := newHarness(t, 3, 0)
+		h.put("a", `{"v":1}`)
+		old := h.waitLeader()
+		rest := others(old)
+
+		// the add only reaches the old leader's log before it dies
+		h.partition([]string{old.cfg.ID}, rest)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		assert.ErrorIs(t, old.AddMember(ctx, Member{ID: "n4", Addr: addr("n4")}), context.DeadlineExceeded)
+		cancel()
+		h.kill(old.cfg.ID)
+		h.heal()
+
+		// a leader is elected but its no-op can't be replicated
+		h.muteAppends(true)
+		waitFor(t, "a leader that can't commit", func() bool {
+			for _, id := range rest {
+				node := h.nodes[id]
+				if node.Status().Role != "leader" {
+					continue
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				err := node.AddMember(ctx, Member{ID: "n5", Addr: addr("n5")})
+				cancel()
+				var notLeader *NotLeaderError
+				if errors.As(err, &notLeader) {
+					return false
+				}
+				assert.ErrorIs(t, err, ErrMembershipChange)
+				return true
+			}
+			return false
+		})
+		h.muteAppends(false)
+
+		h.start(old.cfg.ID)
+		h.join("n5")
+		assert.Equal(t, map[string]string{"a": `{"v":1}`}, h.converged())
+		var ids []string
+		for _, m := range h.waitLeader().Status().Members {
+			ids = append(ids, m.ID)
+		}
+		assert.ElementsMatch(t, []string{"n1", "n2", "n3", "n5"}, ids)
+	})
+}
@@ -0,0 +1,186 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	af "github.com/spf13/afero"
+)
+
+// hardState is what a node has to remember across restarts besides its
+// log, kept in .smoldb/raft/state.json
+type hardState struct {
+	Term        uint64   `json:"term"`
+	Vote        string   `json:"vote,omitempty"`
+	Applied     uint64   `json:"applied"` // may lag behind, reapplying committed entries is harmless
+	SnapIndex   uint64   `json:"snapIndex"`
+	SnapTerm    uint64   `json:"snapTerm"`
+	SnapMembers []Member `json:"snapMembers,omitempty"`
+}
+
+// storage keeps the hard state and the log entries after the last snapshot
+// on disk, the log is line-delimited JSON that is only ever appended to
+// except when a conflicting suffix is dropped or the log is compacted
+type storage struct {
+	fs  af.Fs
+	dir string
+	log af.File
+}
+
+// opens the raft directory under dir, creating it if needed
+func openStorage(fs af.Fs, dir string) (*storage, error) {
+	s := &storage{fs: fs, dir: filepath.Join(dir, ".smoldb", "raft")}
+	if err := fs.MkdirAll(s.dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create raft directory: %v", err)
+	}
+	return s, nil
+}
+
+func (s *storage) statePath() string {
+	return filepath.Join(s.dir, "state.json")
+}
+
+func (s *storage) logPath() string {
+	return filepath.Join(s.dir, "log.jsonl")
+}
+
+// reads the hard state and the log, a torn last line left by a crash is
+// dropped, entries already covered by the snapshot are skipped
+func (s *storage) load() (hardState, []Entry, error) {
+	var hs hardState
+	data, err := af.ReadFile(s.fs, s.statePath())
+	if err != nil && !os.IsNotExist(err) {
+		return hs, nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &hs); err != nil {
+			return hs, nil, fmt.Errorf("failed to decode %s: %v", s.statePath(), err)
+		}
+	}
+
+	data, err = af.ReadFile(s.fs, s.logPath())
+	if err != nil && !os.IsNotExist(err) {
+		return hs, nil, err
+	}
+	var entries []Entry
+	torn := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1<<30)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			torn = true
+			break
+		}
+		if e.Index <= hs.SnapIndex {
+			continue
+		}
+		// a rewrite that didn't finish may leave a gap, nothing after it counts
+		if len(entries) > 0 && e.Index != entries[len(entries)-1].Index+1 {
+			torn = true
+			break
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) > 0 && entries[0].Index != hs.SnapIndex+1 {
+		entries, torn = nil, true
+	}
+
+	if torn {
+		if err := s.rewrite(entries); err != nil {
+			return hs, nil, err
+		}
+	} else if err := s.openLog(); err != nil {
+		return hs, nil, err
+	}
+	return hs, entries, nil
+}
+
+// writes the hard state atomically and syncs it
+func (s *storage) saveState(hs hardState) error {
+	data, err := json.Marshal(hs)
+	if err != nil {
+		return err
+	}
+	tmp := s.statePath() + ".tmp"
+	f, err := s.fs.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return s.fs.Rename(tmp, s.statePath())
+}
+
+func (s *storage) openLog() error {
+	f, err := s.fs.OpenFile(s.logPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open raft log: %v", err)
+	}
+	s.log = f
+	return nil
+}
+
+// appends entries to the log and syncs them
+func (s *storage) append(entries []Entry) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if _, err := s.log.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// replaces the whole log with entries
+func (s *storage) rewrite(entries []Entry) error {
+	if s.log != nil {
+		s.log.Close()
+		s.log = nil
+	}
+	tmp := s.logPath() + ".tmp"
+	f, err := s.fs.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err := s.fs.Rename(tmp, s.logPath()); err != nil {
+		return err
+	}
+	return s.openLog()
+}
+
+func (s *storage) close() error {
+	if s.log == nil {
+		return nil
+	}
+	err := s.log.Close()
+	s.log = nil
+	return err
+}
@@ -0,0 +1,150 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/themillenniumfalcon/smolDB/auth"
+)
+
+// Transport carries the raft RPCs from one node to another, addressed by
+// the Addr of the receiving member
+type Transport interface {
+	RequestVote(ctx context.Context, addr string, req *VoteRequest) (*VoteResponse, error)
+	AppendEntries(ctx context.Context, addr string, req *AppendRequest) (*AppendResponse, error)
+	InstallSnapshot(ctx context.Context, addr string, req *SnapshotRequest) (*SnapshotResponse, error)
+}
+
+// VoteRequest asks for a vote in an election
+type VoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"lastIndex"`
+	LastTerm  uint64 `json:"lastTerm"`
+}
+
+// VoteResponse answers a VoteRequest
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest replicates log entries and doubles as the leader heartbeat
+type AppendRequest struct {
+	Term       uint64  `json:"term"`
+	Leader     string  `json:"leader"`
+	LeaderAddr string  `json:"leaderAddr"`
+	PrevIndex  uint64  `json:"prevIndex"`
+	PrevTerm   uint64  `json:"prevTerm"`
+	Entries    []Entry `json:"entries,omitempty"`
+	Commit     uint64  `json:"commit"`
+}
+
+// AppendResponse answers an AppendRequest, LastIndex tells the leader where
+// to continue after a rejection
+type AppendResponse struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex uint64 `json:"lastIndex"`
+}
+
+// SnapshotRequest replaces the state of a follower that is behind the
+// leader's compacted log, Data is a checkpoint snapshot of the documents
+type SnapshotRequest struct {
+	Term       uint64   `json:"term"`
+	Leader     string   `json:"leader"`
+	LeaderAddr string   `json:"leaderAddr"`
+	LastIndex  uint64   `json:"lastIndex"`
+	LastTerm   uint64   `json:"lastTerm"`
+	Members    []Member `json:"members"`
+	Data       []byte   `json:"data"`
+}
+
+// SnapshotResponse answers a SnapshotRequest
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// HTTPTransport sends the RPCs as JSON to the /cluster/raft/ endpoints of
+// the other nodes
+type HTTPTransport struct {
+	Client *http.Client
+}
+
+// NewHTTPTransport creates a transport using a default HTTP client, request
+// timeouts come from the contexts passed by the node
+func NewHTTPTransport() *HTTPTransport {
+	return &HTTPTransport{Client: &http.Client{}}
+}
+
+// RequestVote implements Transport
+func (t *HTTPTransport) RequestVote(ctx context.Context, addr string, req *VoteRequest) (*VoteResponse, error) {
+	resp := &VoteResponse{}
+	return resp, t.call(ctx, addr, "vote", req, resp)
+}
+
+// AppendEntries implements Transport
+func (t *HTTPTransport) AppendEntries(ctx context.Context, addr string, req *AppendRequest) (*AppendResponse, error) {
+	resp := &AppendResponse{}
+	return resp, t.call(ctx, addr, "append", req, resp)
+}
+
+// InstallSnapshot implements Transport
+func (t *HTTPTransport) InstallSnapshot(ctx context.Context, addr string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	resp := &SnapshotResponse{}
+	return resp, t.call(ctx, addr, "snapshot", req, resp)
+}
+
+// posts req to the given rpc endpoint of addr and decodes the answer into resp
+func (t *HTTPTransport) call(ctx context.Context, addr, rpc string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(addr, "/") + "/cluster/raft/" + rpc
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	auth.Attach(r)
+	res, err := t.Client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s answered %s: %s", addr, res.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// Join asks the cluster member at addr to add m to the cluster, followers
+// redirect the request to the leader
+func Join(ctx context.Context, addr string, m Member) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(addr, "/")+"/cluster/members", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	auth.Attach(r)
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s answered %s: %s", addr, res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
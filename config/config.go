@@ -0,0 +1,218 @@
+// provides configuration files, every setting in a file sets the command
+// line flag of the same meaning unless that flag was given on the command
+// line or through the environment
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Setting ties a key of a configuration file to the flag it sets, Command
+// limits it to one command when several define a flag of that name. Only
+// List settings take a list of values, Check rejects invalid ones
+type Setting struct {
+	Key     string
+	Flag    string
+	Command string
+	List    bool
+	Check   func(string) error
+}
+
+// Settings lists every key a configuration file may contain
+var Settings = []Setting{
+	{Key: "dir", Flag: "dir"},
+	{Key: "port", Flag: "port"},
+
+	{Key: "wal.durability", Flag: "durability", Check: func(v string) error {
+		_, err := index.ParseDurability(v)
+		return err
+	}},
+	{Key: "wal.group_commit_ms", Flag: "group-commit-ms"},
+	{Key: "wal.group_commit_batch", Flag: "group-commit-batch"},
+	{Key: "wal.sync_mode", Flag: "sync-mode", Check: func(v string) error {
+		_, err := index.ParseSyncMode(v)
+		return err
+	}},
+	{Key: "wal.format", Flag: "wal-format", Check: func(v string) error {
+		_, err := index.ParseWALFormat(v)
+		return err
+	}},
+	{Key: "wal.compress", Flag: "wal-compress"},
+
+	{Key: "checkpoint.interval", Flag: "checkpoint-interval"},
+	{Key: "checkpoint.retain", Flag: "checkpoint-retain"},
+
+	{Key: "log.format", Flag: "log-format"},
+	{Key: "log.level", Flag: "log-level", Check: func(v string) error {
+		_, err := log.ParseLevel(v)
+		return err
+	}},
+	{Key: "audit.max_size_mb", Flag: "audit-max-size"},
+	{Key: "metrics", Flag: "metrics"},
+
+	{Key: "shutdown.drain_timeout", Flag: "drain-timeout"},
+	{Key: "shutdown.final_checkpoint", Flag: "final-checkpoint"},
+
+	{Key: "auth.mode", Flag: "auth"},
+	{Key: "auth.api_keys_file", Flag: "api-keys-file"},
+	{Key: "auth.api_keys", Flag: "api-keys"},
+	{Key: "auth.jwt_alg", Flag: "jwt-alg"},
+	{Key: "auth.jwt_key_file", Flag: "jwt-key-file"},
+	{Key: "auth.public", Flag: "auth-public", List: true},
+	{Key: "auth.peer_token", Flag: "peer-token"},
+	{Key: "acl", Flag: "acl"},
+
+	{Key: "limits.read_rate", Flag: "rate-limit-read"},
+	{Key: "limits.read_burst", Flag: "rate-limit-read-burst"},
+	{Key: "limits.write_rate", Flag: "rate-limit-write"},
+	{Key: "limits.write_burst", Flag: "rate-limit-write-burst"},
+	{Key: "limits.max_in_flight", Flag: "max-in-flight"},
+	{Key: "limits.max_queue", Flag: "max-queue"},
+	{Key: "limits.queue_timeout", Flag: "queue-timeout"},
+	{Key: "limits.exempt", Flag: "limit-exempt", List: true},
+
+	{Key: "tls.cert", Flag: "tls-cert"},
+	{Key: "tls.key", Flag: "tls-key"},
+	{Key: "tls.client_ca", Flag: "tls-client-ca"},
+	{Key: "tls.peer_ca", Flag: "tls-peer-ca"},
+
+	{Key: "read_only.enabled", Flag: "read-only"},
+	{Key: "read_only.refresh_interval", Flag: "refresh-interval"},
+
+	{Key: "replicate.from", Flag: "from", Command: "replicate"},
+
+	{Key: "cluster.id", Flag: "id", Command: "cluster"},
+	{Key: "cluster.addr", Flag: "addr", Command: "cluster"},
+	{Key: "cluster.bootstrap", Flag: "bootstrap", Command: "cluster"},
+	{Key: "cluster.join", Flag: "join", Command: "cluster"},
+	{Key: "cluster.snapshot_threshold", Flag: "snapshot-threshold", Command: "cluster"},
+
+	{Key: "ring.config", Flag: "config", Command: "ring"},
+	{Key: "ring.id", Flag: "id", Command: "ring"},
+}
+
+// Value is a setting as given in a file, lists have one value per element
+type Value struct {
+	Setting
+	Values []string
+}
+
+// File is a loaded configuration file
+type File struct {
+	Path   string
+	Values []Value
+}
+
+// Load reads the YAML configuration file at path, unknown keys and values
+// of the wrong shape are errors
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	return Parse(path, data)
+}
+
+// Parse reads a configuration file from data, path names it in errors
+func Parse(path string, data []byte) (*File, error) {
+	var root map[string]interface{}
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&root); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	known := map[string]Setting{}
+	for _, s := range Settings {
+		known[s.Key] = s
+	}
+	f := &File{Path: path}
+	if err := f.flatten("", root, known); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	sort.Slice(f.Values, func(a, b int) bool { return f.Values[a].Key < f.Values[b].Key })
+	return f, nil
+}
+
+// collects the settings below prefix
+func (f *File) flatten(prefix string, m map[string]interface{}, known map[string]Setting) error {
+	for name, v := range m {
+		key := prefix + name
+		if section, ok := v.(map[string]interface{}); ok {
+			if _, ok := known[key]; ok {
+				return fmt.Errorf("%s expects a value, not a section", key)
+			}
+			if err := f.flatten(key+".", section, known); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := known[key]
+		if !ok {
+			for k := range known {
+				if strings.HasPrefix(k, key+".") {
+					return fmt.Errorf("%s is a section, not a value", key)
+				}
+			}
+			return fmt.Errorf("unknown setting '%s'", key)
+		}
+		values, err := scalars(s, v)
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			if s.Check == nil {
+				break
+			}
+			if err := s.Check(value); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+		}
+		f.Values = append(f.Values, Value{Setting: s, Values: values})
+	}
+	return nil
+}
+
+// returns a value, or the elements of a list, as strings
+func scalars(s Setting, v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, fmt.Errorf("%s has no value", s.Key)
+	case []interface{}:
+		if !s.List {
+			return nil, fmt.Errorf("%s expects a single value, not a list", s.Key)
+		}
+		res := make([]string, 0, len(v))
+		for _, e := range v {
+			switch e.(type) {
+			case nil, []interface{}, map[string]interface{}:
+				return nil, fmt.Errorf("%s expects a list of values", s.Key)
+			}
+			res = append(res, fmt.Sprint(e))
+		}
+		return res, nil
+	}
+	return []string{fmt.Sprint(v)}, nil
+}
+
+// Get returns the value the file gives the flag of a command, command is
+// empty for the global flags
+func (f *File) Get(flag string, command string) (Value, bool) {
+	if f == nil {
+		return Value{}, false
+	}
+	for _, v := range f.Values {
+		if v.Flag == flag && (v.Command == "" || v.Command == command) {
+			return v, true
+		}
+	}
+	return Value{}, false
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	// Test Case 1: nested keys set their flags, lists only where allowed
+	t.Run("values", func(t *testing.T) {
+		f, err := Parse("smoldb.yaml", []byte(`
+dir: data
+port: 9090
+wal:
+  durability: grouped
+  group_commit_ms: 5
+checkpoint:
+  interval: 5m
+auth:
+  public: ["GET /", "GET /metrics"]
+limits:
+  write_rate: 2.5
+cluster:
+  id: n1
+ring:
+  id: r1
+`))
+		assert.NoError(t, err)
+
+		v, ok := f.Get("durability", "")
+		assert.True(t, ok)
+		assert.Equal(t, "wal.durability", v.Key)
+		assert.Equal(t, []string{"grouped"}, v.Values)
+		v, _ = f.Get("port", "")
+		assert.Equal(t, []string{"9090"}, v.Values)
+		v, _ = f.Get("checkpoint-interval", "start")
+		assert.Equal(t, []string{"5m"}, v.Values)
+		v, _ = f.Get("auth-public", "")
+		assert.Equal(t, []string{"GET /", "GET /metrics"}, v.Values)
+		v, _ = f.Get("rate-limit-write", "")
+		assert.Equal(t, []string{"2.5"}, v.Values)
+
+		// flags of the same name belong to their command
+		v, _ = f.Get("id", "cluster")
+		assert.Equal(t, []string{"n1"}, v.Values)
+		v, _ = f.Get("id", "ring")
+		assert.Equal(t, []string{"r1"}, v.Values)
+		_, ok = f.Get("id", "")
+		assert.False(t, ok)
+		_, ok = f.Get("sync-mode", "")
+		assert.False(t, ok)
+	})
+
+	// Test Case 2: mistakes are errors naming the file and the key
+	t.Run("invalid", func(t *testing.T) {
+		for data, msg := range map[string]string{
+			"wal:\n  durabilty: commit\n":   "smoldb.yaml: unknown setting 'wal.durabilty'",
+			"wal:\n  durability: grouppd\n": "smoldb.yaml: wal.durability: unknown durability 'grouppd' (want none|commit|grouped)",
+			"wal: commit\n":                 "smoldb.yaml: wal is a section, not a value",
+			"port:\n  number: 1\n":          "smoldb.yaml: port expects a value, not a section",
+			"port: [1, 2]\n":                "smoldb.yaml: port expects a single value, not a list",
+			"dir:\n":                        "smoldb.yaml: dir has no value",
+		} {
+			_, err := Parse("smoldb.yaml", []byte(data))
+			assert.EqualError(t, err, msg, data)
+		}
+		_, err := Parse("smoldb.yaml", []byte("port: 1\nport: 2\n"))
+		assert.Error(t, err)
+	})
+
+	// Test Case 3: an empty file sets nothing
+	t.Run("empty", func(t *testing.T) {
+		f, err := Parse("smoldb.yaml", nil)
+		assert.NoError(t, err)
+		assert.Empty(t, f.Values)
+	})
+}
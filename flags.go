@@ -0,0 +1,293 @@
+package main
+
+import (
+	"time"
+
+	"github.com/themillenniumfalcon/smolDB/api"
+	"github.com/urfave/cli/v2"
+)
+
+// returns the flags every command understands
+func globalFlags() []cli.Flag {
+	flags := []cli.Flag{
+		portFlag(),
+		&cli.StringFlag{
+			Name:        "dir",
+			Aliases:     []string{"d"},
+			Value:       "db",
+			Usage:       "directory to look for keys",
+			DefaultText: "db",
+		},
+		&cli.StringFlag{
+			Name:    "settings",
+			Usage:   "YAML file of settings, flags and environment variables override it",
+			EnvVars: []string{"SMOLDB_CONFIG_FILE"},
+		},
+	}
+	flags = append(flags, walFlags()...)
+	flags = append(flags, limitFlags()...)
+	return append(flags,
+		&cli.StringFlag{
+			Name:        "log-format",
+			Usage:       "log line format: text|json",
+			Value:       "text",
+			DefaultText: "text",
+			EnvVars:     []string{"SMOLDB_LOG_FORMAT"},
+		},
+		&cli.StringFlag{
+			Name:        "log-level",
+			Usage:       "minimum level logged: fatal|warn|info",
+			Value:       "info",
+			DefaultText: "info",
+			EnvVars:     []string{"SMOLDB_LOG_LEVEL"},
+		},
+		&cli.Int64Flag{
+			Name:        "audit-max-size",
+			Usage:       "size in MB the audit log is rotated at",
+			Value:       64,
+			DefaultText: "64",
+			EnvVars:     []string{"SMOLDB_AUDIT_MAX_SIZE"},
+		},
+		&cli.BoolFlag{
+			Name:    "metrics",
+			Usage:   "record metrics and serve them in the Prometheus format at /metrics",
+			EnvVars: []string{"SMOLDB_METRICS"},
+		},
+		&cli.DurationFlag{
+			Name:        "drain-timeout",
+			Usage:       "how long shutting down waits for requests in flight",
+			Value:       30 * time.Second,
+			DefaultText: "30s",
+			EnvVars:     []string{"SMOLDB_DRAIN_TIMEOUT"},
+		},
+		&cli.BoolFlag{
+			Name:    "final-checkpoint",
+			Usage:   "take a checkpoint when shutting down",
+			EnvVars: []string{"SMOLDB_FINAL_CHECKPOINT"},
+		},
+		&cli.StringFlag{
+			Name:        "auth",
+			Usage:       "how requests authenticate: none|apikey|jwt|mtls, several separated by commas",
+			Value:       "none",
+			DefaultText: "none",
+			EnvVars:     []string{"SMOLDB_AUTH"},
+		},
+		&cli.StringFlag{
+			Name:    "api-keys-file",
+			Usage:   "file of name:key lines accepted with --auth apikey",
+			EnvVars: []string{"SMOLDB_API_KEYS_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "api-keys",
+			Usage:   "comma separated name:key entries accepted with --auth apikey",
+			EnvVars: []string{"SMOLDB_API_KEYS"},
+		},
+		&cli.StringFlag{
+			Name:        "jwt-alg",
+			Usage:       "algorithm tokens are signed with: HS256|RS256",
+			Value:       "HS256",
+			DefaultText: "HS256",
+			EnvVars:     []string{"SMOLDB_JWT_ALG"},
+		},
+		&cli.StringFlag{
+			Name:    "jwt-key-file",
+			Usage:   "HS256 secret or RS256 PEM public key tokens are checked against",
+			EnvVars: []string{"SMOLDB_JWT_KEY_FILE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "auth-public",
+			Usage:   "routes served without credentials, as [METHOD ]/pattern",
+			Value:   cli.NewStringSlice(api.DefaultPublic...),
+			EnvVars: []string{"SMOLDB_AUTH_PUBLIC"},
+		},
+		&cli.StringFlag{
+			Name:    "tls-cert",
+			Usage:   "PEM certificate to serve TLS with, reloaded on SIGHUP or change",
+			EnvVars: []string{"SMOLDB_TLS_CERT"},
+		},
+		&cli.StringFlag{
+			Name:    "tls-key",
+			Usage:   "PEM private key of --tls-cert",
+			EnvVars: []string{"SMOLDB_TLS_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "tls-client-ca",
+			Usage:   "PEM CA certificates clients must present a certificate signed by",
+			EnvVars: []string{"SMOLDB_TLS_CLIENT_CA"},
+		},
+		&cli.StringFlag{
+			Name:    "tls-peer-ca",
+			Usage:   "PEM CA certificates other nodes are verified against, the system's by default",
+			EnvVars: []string{"SMOLDB_TLS_PEER_CA"},
+		},
+		&cli.StringFlag{
+			Name:    "acl",
+			Usage:   "policy file granting identities operations on key prefixes",
+			EnvVars: []string{"SMOLDB_ACL"},
+		},
+		&cli.StringFlag{
+			Name:    "peer-token",
+			Usage:   "API key or token presented to other nodes",
+			EnvVars: []string{"SMOLDB_PEER_TOKEN"},
+		},
+	)
+}
+
+// returns the port flag
+func portFlag() cli.Flag {
+	return &cli.IntFlag{
+		Name:        "port",
+		Aliases:     []string{"p"},
+		Value:       8080,
+		Usage:       "port to run smoldb on",
+		DefaultText: "8080",
+	}
+}
+
+// returns the flags configuring the WAL
+func walFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "durability",
+			Usage:       "durability level: none|commit|grouped",
+			Value:       "commit",
+			DefaultText: "commit",
+			EnvVars:     []string{"SMOLDB_DURABILITY"},
+		},
+		&cli.IntFlag{
+			Name:        "group-commit-ms",
+			Usage:       "group commit fsync interval in ms (used when durability=grouped)",
+			Value:       0,
+			DefaultText: "0",
+			EnvVars:     []string{"SMOLDB_GROUP_COMMIT_MS"},
+		},
+		&cli.IntFlag{
+			Name:        "group-commit-batch",
+			Usage:       "group commit fsync after this many appends (used when durability=grouped)",
+			Value:       0,
+			DefaultText: "0",
+			EnvVars:     []string{"SMOLDB_GROUP_COMMIT_BATCH"},
+		},
+		&cli.StringFlag{
+			Name:        "sync-mode",
+			Usage:       "sync mode: none|fsync|dsync (dsync best-effort)",
+			Value:       "fsync",
+			DefaultText: "fsync",
+			EnvVars:     []string{"SMOLDB_SYNC_MODE"},
+		},
+		&cli.StringFlag{
+			Name:        "wal-format",
+			Usage:       "record format for new WAL appends: json|binary",
+			Value:       "json",
+			DefaultText: "json",
+			EnvVars:     []string{"SMOLDB_WAL_FORMAT"},
+		},
+		&cli.BoolFlag{
+			Name:    "wal-compress",
+			Usage:   "compress large WAL bodies (binary format only)",
+			EnvVars: []string{"SMOLDB_WAL_COMPRESS"},
+		},
+	}
+}
+
+// returns the flag setting how often checkpoints are taken
+func checkpointIntervalFlag() cli.Flag {
+	return &cli.DurationFlag{
+		Name:        "checkpoint-interval",
+		Usage:       "take a checkpoint this often, e.g. 5m (0 disables)",
+		Value:       0,
+		DefaultText: "0",
+		EnvVars:     []string{"SMOLDB_CHECKPOINT_INTERVAL"},
+	}
+}
+
+// returns the flag setting how many checkpoints are kept
+func checkpointRetainFlag() cli.Flag {
+	return &cli.IntFlag{
+		Name:        "checkpoint-retain",
+		Usage:       "number of checkpoint snapshots to keep (0 keeps all)",
+		Value:       3,
+		DefaultText: "3",
+		EnvVars:     []string{"SMOLDB_CHECKPOINT_RETAIN"},
+	}
+}
+
+// returns the flags of opening a database read-only
+func readOnlyFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "read-only",
+			Usage:   "open the database next to the server writing it: take a shared lock, leave the WAL alone and reject writes",
+			EnvVars: []string{"SMOLDB_READ_ONLY"},
+		},
+		&cli.DurationFlag{
+			Name:        "refresh-interval",
+			Usage:       "how often a read-only database picks up changes from disk (0 disables)",
+			Value:       time.Second,
+			DefaultText: "1s",
+			EnvVars:     []string{"SMOLDB_REFRESH_INTERVAL"},
+		},
+	}
+}
+
+// returns the flags limiting requests, reloaded on SIGHUP from the
+// configuration file
+func limitFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.Float64Flag{
+			Name:        "rate-limit-read",
+			Usage:       "reads per second allowed per client, by identity or else address (0 disables)",
+			Value:       0,
+			DefaultText: "0",
+			EnvVars:     []string{"SMOLDB_RATE_LIMIT_READ"},
+		},
+		&cli.IntFlag{
+			Name:        "rate-limit-read-burst",
+			Usage:       "reads a client may send at once (0 for the rate)",
+			Value:       0,
+			DefaultText: "0",
+			EnvVars:     []string{"SMOLDB_RATE_LIMIT_READ_BURST"},
+		},
+		&cli.Float64Flag{
+			Name:        "rate-limit-write",
+			Usage:       "writes per second allowed per client, by identity or else address (0 disables)",
+			Value:       0,
+			DefaultText: "0",
+			EnvVars:     []string{"SMOLDB_RATE_LIMIT_WRITE"},
+		},
+		&cli.IntFlag{
+			Name:        "rate-limit-write-burst",
+			Usage:       "writes a client may send at once (0 for the rate)",
+			Value:       0,
+			DefaultText: "0",
+			EnvVars:     []string{"SMOLDB_RATE_LIMIT_WRITE_BURST"},
+		},
+		&cli.IntFlag{
+			Name:        "max-in-flight",
+			Usage:       "requests served at once at most (0 disables)",
+			Value:       0,
+			DefaultText: "0",
+			EnvVars:     []string{"SMOLDB_MAX_IN_FLIGHT"},
+		},
+		&cli.IntFlag{
+			Name:        "max-queue",
+			Usage:       "requests waiting for a slot at most when --max-in-flight are served",
+			Value:       64,
+			DefaultText: "64",
+			EnvVars:     []string{"SMOLDB_MAX_QUEUE"},
+		},
+		&cli.DurationFlag{
+			Name:        "queue-timeout",
+			Usage:       "how long a request waits for a slot (0 waits as long as the client does)",
+			Value:       time.Second,
+			DefaultText: "1s",
+			EnvVars:     []string{"SMOLDB_QUEUE_TIMEOUT"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "limit-exempt",
+			Usage:   "routes never limited, as [METHOD ]/pattern",
+			Value:   cli.NewStringSlice(api.DefaultUnlimited...),
+			EnvVars: []string{"SMOLDB_LIMIT_EXEMPT"},
+		},
+	}
+}
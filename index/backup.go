@@ -0,0 +1,786 @@
+package index
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// backups are tar streams holding documents/<key>.json with their .meta
+// files, wal.log with the records written while the documents were copied
+// and manifest.json last, restoring the documents and replaying wal.log
+// gives the database as of the manifest LSN. An incremental backup only
+// holds the documents that changed since its parent plus tombstones for
+// the ones that were deleted and is restored on top of its parent
+const backupVersion = 1
+
+// backup types
+const (
+	BackupFull        = "full"
+	BackupIncremental = "incremental"
+)
+
+// BackupManifest describes the contents of a backup
+type BackupManifest struct {
+	Version    int           `json:"version"`
+	ID         string        `json:"id"`
+	Type       string        `json:"type"`
+	Parent     string        `json:"parent,omitempty"`    // ID of the backup an incremental builds on
+	ParentLSN  uint64        `json:"parentLsn,omitempty"` // LSN of that backup
+	LSN        uint64        `json:"lsn"`                 // a restore ends up at this LSN
+	Since      uint64        `json:"since"`               // wal.log holds the records after this LSN
+	Created    string        `json:"created"`
+	Documents  []BackupEntry `json:"documents"`         // documents stored in this backup
+	Deleted    []string      `json:"deleted,omitempty"` // keys deleted since the parent
+	State      []BackupEntry `json:"state"`             // every key at LSN, the next incremental compares against it
+	WALRecords int           `json:"walRecords"`
+}
+
+// BackupEntry describes a single document in a backup, state entries last
+// changed by a PATCH record have no checksum
+type BackupEntry struct {
+	Key      string `json:"key"`
+	Checksum string `json:"checksum,omitempty"`
+	LSN      uint64 `json:"lsn,omitempty"`
+	Modified string `json:"modified,omitempty"`
+}
+
+// BackupOptions controls how a backup is taken
+type BackupOptions struct {
+	Compress bool            // gzip the tar stream
+	Parent   *BackupManifest // take an incremental backup on top of this one
+}
+
+// BackupRestoreStats reports the outcome of restoring a backup chain
+type BackupRestoreStats struct {
+	Backups    int
+	Documents  int
+	Deleted    int
+	WALRecords int
+	LSN        uint64
+	Previous   string // where the replaced directory was moved to, empty if there was none
+}
+
+// reports whether a document differs from its entry in the parent state,
+// LSNs decide when either side has one
+func (e BackupEntry) changedFrom(prev BackupEntry) bool {
+	if e.LSN != 0 || prev.LSN != 0 {
+		return e.LSN != prev.LSN
+	}
+	return e.Checksum != prev.Checksum || e.Modified != prev.Modified
+}
+
+// returns the entries of a state keyed by key
+func stateMap(entries []BackupEntry) map[string]BackupEntry {
+	m := make(map[string]BackupEntry, len(entries))
+	for _, e := range entries {
+		m[e.Key] = e
+	}
+	return m
+}
+
+// returns the entries of a state sorted by key
+func stateList(m map[string]BackupEntry) []BackupEntry {
+	entries := make([]BackupEntry, 0, len(m))
+	for _, e := range m {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Key < entries[b].Key })
+	return entries
+}
+
+// Backup writes a consistent backup of every document to w as a tar stream.
+// Writers aren't blocked: documents are copied one at a time and the WAL
+// records written meanwhile go into the backup so a restore lands on a
+// single LSN. With a parent only documents whose LSN or modification time
+// changed since it are copied
+func (i *FileIndex) Backup(w io.Writer, opts BackupOptions) (*BackupManifest, error) {
+	if opts.Parent != nil && opts.Parent.State == nil {
+		return nil, fmt.Errorf("backup %s has no state to build an incremental on", opts.Parent.ID)
+	}
+
+	// keep checkpoints from archiving the segments read below, they go on
+	// meanwhile so a slow client doesn't hold them up
+	defer i.pinSegments()()
+
+	i.rlock()
+	since := i.checkpointLSN
+	offline := i.wal == nil
+	keys := make([]string, 0, len(i.index))
+	for key := range i.index {
+		keys = append(keys, key)
+	}
+	i.mu.RUnlock()
+	sort.Strings(keys)
+
+	if offline {
+		// the WAL left behind starts after the latest checkpoint
+		since = latestCheckpointLSN(i.FileSystem, i.dir)
+	}
+	// records up to the parent LSN are covered by the parent
+	if opts.Parent != nil && opts.Parent.LSN > since {
+		if last := i.LastLSN(); !offline && opts.Parent.LSN > last {
+			return nil, fmt.Errorf("backup %s is at lsn %d, ahead of the last lsn %d", opts.Parent.ID, opts.Parent.LSN, last)
+		}
+		since = opts.Parent.LSN
+	}
+
+	out := w
+	var gz *gzip.Writer
+	if opts.Compress {
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+	tw := tar.NewWriter(out)
+
+	now := time.Now()
+	manifest := &BackupManifest{Version: backupVersion, Type: BackupFull, Since: since, Created: now.UTC().Format(time.RFC3339)}
+	var prev map[string]BackupEntry
+	if opts.Parent != nil {
+		prev = stateMap(opts.Parent.State)
+		manifest.Type = BackupIncremental
+		manifest.Parent = opts.Parent.ID
+		manifest.ParentLSN = opts.Parent.LSN
+	}
+
+	current := map[string]BackupEntry{}
+	for _, key := range keys {
+		file, ok := i.Lookup(key)
+		if !ok {
+			continue
+		}
+
+		// unchanged documents are recognised from their metadata alone
+		if old, ok := prev[key]; ok {
+			if meta, err := file.readMetadata(); err == nil {
+				entry := BackupEntry{Key: key, Checksum: meta.Checksum, LSN: meta.LSN, Modified: meta.Modified}
+				if !entry.changedFrom(old) {
+					current[key] = entry
+					continue
+				}
+			}
+		}
+
+		entry, err := backupDocument(tw, file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// deleted since the key set was taken, wal.log has the delete
+				continue
+			}
+			return nil, err
+		}
+		current[key] = *entry
+		manifest.Documents = append(manifest.Documents, *entry)
+	}
+	for key := range prev {
+		if n := sort.SearchStrings(keys, key); n == len(keys) || keys[n] != key {
+			manifest.Deleted = append(manifest.Deleted, key)
+		}
+	}
+	sort.Strings(manifest.Deleted)
+
+	// every copied document reflects at most this LSN and every record up
+	// to it is fully written, offline the WAL on disk is all there is
+	until := i.LastLSN()
+	if offline {
+		until = math.MaxUint64
+	}
+	paths, err := walSegments(i.FileSystem, i.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WAL segments: %v", err)
+	}
+
+	// the records are walked once to size wal.log and add them to the
+	// state, then once more to stream them into the tar
+	state := make(map[string]BackupEntry, len(current))
+	for key, e := range current {
+		state[key] = e
+	}
+	var size int64
+	count, last, err := walkWALRange(i.FileSystem, paths, since, until, func(e walEntry, rec []byte) error {
+		size += int64(len(rec))
+		applyBackupRecord(state, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	manifest.LSN = since
+	if last > since {
+		manifest.LSN = last
+	}
+	manifest.WALRecords = count
+	manifest.ID = fmt.Sprintf("%x-%x", manifest.LSN, now.UnixNano())
+	manifest.State = stateList(state)
+
+	header := &tar.Header{Name: "wal.log", Mode: 0644, Size: size, ModTime: time.Now()}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, fmt.Errorf("failed to write backup entry wal.log: %v", err)
+	}
+	_, _, err = walkWALRange(i.FileSystem, paths, since, manifest.LSN, func(_ walEntry, rec []byte) error {
+		_, err := tw.Write(rec)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write backup entry wal.log: %v", err)
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(tw, "manifest.json", manifestBytes); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Info("backup: wrote %s backup of %d documents and %d WAL records at lsn %d", manifest.Type, len(manifest.Documents), count, manifest.LSN)
+	return manifest, nil
+}
+
+// copies a document and its metadata into the tar stream
+func backupDocument(tw *tar.Writer, file *File) (*BackupEntry, error) {
+	key := file.FileName
+	body, meta, err := file.readWithMetadata()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to read key %s: %v", key, err)
+	}
+	if meta == nil {
+		now := time.Now().UTC().Format(time.RFC3339)
+		meta = &MetaData{Checksum: calculateChecksum(body), Created: now, Modified: now}
+	}
+	if meta.Checksum != calculateChecksum(body) {
+		return nil, fmt.Errorf("key %s doesn't match its checksum, repair it before backing up", key)
+	}
+
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(tw, "documents/"+key+".json", body); err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(tw, "documents/"+key+".json.meta", metaBytes); err != nil {
+		return nil, err
+	}
+	return &BackupEntry{Key: key, Checksum: meta.Checksum, LSN: meta.LSN, Modified: meta.Modified}, nil
+}
+
+// applies the records of a backup's wal.log to the state it starts from,
+// giving every key at the backup LSN, returns the number of records
+func backupState(base map[string]BackupEntry, wal io.ReadSeeker, since, until uint64) (map[string]BackupEntry, int, error) {
+	state := make(map[string]BackupEntry, len(base))
+	for key, e := range base {
+		state[key] = e
+	}
+	count, err := walkBackupWAL(wal, since, until, func(e walEntry) {
+		applyBackupRecord(state, e)
+	})
+	if err != nil {
+		return nil, count, err
+	}
+	return state, count, nil
+}
+
+// applies a single WAL record to the version of every key
+func applyBackupRecord(state map[string]BackupEntry, e walEntry) {
+	switch e.Op {
+	case opPut:
+		state[e.Key] = BackupEntry{Key: e.Key, Checksum: calculateChecksum([]byte(e.Body)), LSN: e.LSN}
+	case opPatch:
+		state[e.Key] = BackupEntry{Key: e.Key, LSN: e.LSN}
+	case opDelete:
+		delete(state, e.Key)
+	case opBatch:
+		var ops []BatchOp
+		json.Unmarshal([]byte(e.Body), &ops)
+		for _, op := range ops {
+			if op.Op == BatchDelete {
+				delete(state, op.Key)
+				continue
+			}
+			state[op.Key] = BackupEntry{Key: op.Key, Checksum: calculateChecksum([]byte(op.Body)), LSN: e.LSN}
+		}
+	}
+}
+
+// writes a single regular file entry to a tar stream
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write backup entry %s: %v", name, err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write backup entry %s: %v", name, err)
+	}
+	return nil
+}
+
+// returns the redo LSN of the newest valid snapshot of dir, 0 if there is none
+func latestCheckpointLSN(fs af.Fs, dir string) uint64 {
+	snaps, err := listSnapshots(fs, dir)
+	if err != nil {
+		return 0
+	}
+	for n := len(snaps) - 1; n >= 0; n-- {
+		if header, _, err := verifySnapshot(fs, snaps[n].Path); err == nil {
+			return header.LSN
+		}
+	}
+	return 0
+}
+
+// passes the records of the given segments with since < LSN <= until to
+// fn along with their encoding, they have to run without gaps from since.
+// Returns their count and the last LSN among them
+func walkWALRange(fs af.Fs, paths []string, since, until uint64, fn func(e walEntry, rec []byte) error) (int, uint64, error) {
+	next := since + 1
+	for _, path := range paths {
+		f, err := fs.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, 0, err
+		}
+
+		reader := newWALReader(f, 0)
+		for {
+			e, err := reader.Next()
+			if err != nil {
+				// records past a torn one were never acknowledged
+				break
+			}
+			if e.Op == opCommit || e.LSN < next || e.LSN > until {
+				continue
+			}
+			if e.LSN != next {
+				f.Close()
+				return 0, 0, fmt.Errorf("wal is missing records %d to %d", next, e.LSN-1)
+			}
+			rec, err := encodeWALEntry(e, false)
+			if err == nil {
+				err = fn(e, rec)
+			}
+			if err != nil {
+				f.Close()
+				return 0, 0, err
+			}
+			next++
+		}
+		f.Close()
+	}
+	return int(next - since - 1), next - 1, nil
+}
+
+// walks the records of a backup's wal.log, which must run without gaps
+// from since up to until, returns the number of records
+func walkBackupWAL(wal io.ReadSeeker, since, until uint64, fn func(e walEntry)) (int, error) {
+	if _, err := wal.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to read backup WAL: %v", err)
+	}
+	next := since + 1
+	count := 0
+	reader := newWALReader(bufio.NewReader(wal), 0)
+	for {
+		e, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, fmt.Errorf("backup WAL is corrupt at offset %d", reader.offset)
+		}
+		if e.LSN != next {
+			return count, fmt.Errorf("backup WAL is missing records %d to %d", next, e.LSN-1)
+		}
+		fn(e)
+		count++
+		next++
+	}
+	if next-1 != until {
+		return count, fmt.Errorf("backup WAL ends at lsn %d, manifest says %d", next-1, until)
+	}
+	return count, nil
+}
+
+// ReadBackupManifest reads a manifest on its own or out of a whole,
+// possibly compressed, backup
+func ReadBackupManifest(r io.Reader) (*BackupManifest, error) {
+	br := bufio.NewReader(r)
+	if first, err := br.Peek(1); err == nil && first[0] == '{' {
+		manifest := &BackupManifest{}
+		if err := json.NewDecoder(br).Decode(manifest); err != nil {
+			return nil, fmt.Errorf("failed to decode backup manifest: %v", err)
+		}
+		return manifest, nil
+	}
+	manifest, wal, err := readBackup(br, func(string, []byte, *MetaData) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	removeSpool(wal)
+	return manifest, nil
+}
+
+// reads a possibly gzip compressed backup, passing every document to fn
+// once its body matched its metadata, returns the manifest and wal.log
+// spooled to a temporary file, which the caller removes with removeSpool
+func readBackup(r io.Reader, fn func(key string, body []byte, meta *MetaData) error) (_ *BackupManifest, _ *os.File, err error) {
+	wal, err := os.CreateTemp("", "smoldb-backup-wal-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to spool backup WAL: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			removeSpool(wal)
+		}
+	}()
+
+	br := bufio.NewReader(r)
+	var in io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open compressed backup: %v", err)
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	var manifest *BackupManifest
+	bodies := map[string][]byte{}
+	tr := tar.NewReader(in)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read backup: %v", err)
+		}
+
+		name := header.Name
+		if name == "wal.log" {
+			if _, err := io.Copy(wal, tr); err != nil {
+				return nil, nil, fmt.Errorf("failed to read backup entry %s: %v", name, err)
+			}
+			continue
+		}
+		data, err := readTarEntry(tr, header)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch {
+		case name == "manifest.json":
+			manifest = &BackupManifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return nil, nil, fmt.Errorf("failed to decode backup manifest: %v", err)
+			}
+		case strings.HasPrefix(name, "documents/") && strings.HasSuffix(name, ".json.meta"):
+			key := strings.TrimSuffix(strings.TrimPrefix(name, "documents/"), ".json.meta")
+			body, ok := bodies[key]
+			if !ok {
+				return nil, nil, fmt.Errorf("backup holds metadata without a document for key %s", key)
+			}
+			var meta MetaData
+			if err := json.Unmarshal(data, &meta); err != nil {
+				return nil, nil, fmt.Errorf("failed to decode metadata of key %s: %v", key, err)
+			}
+			if meta.Checksum != calculateChecksum(body) {
+				return nil, nil, fmt.Errorf("key %s doesn't match its checksum", key)
+			}
+			if err := fn(key, body, &meta); err != nil {
+				return nil, nil, err
+			}
+			delete(bodies, key)
+		case strings.HasPrefix(name, "documents/") && strings.HasSuffix(name, ".json"):
+			bodies[strings.TrimSuffix(strings.TrimPrefix(name, "documents/"), ".json")] = data
+		default:
+			log.Warn("backup: ignoring unknown entry %s", name)
+		}
+	}
+
+	if manifest == nil {
+		return nil, nil, fmt.Errorf("backup has no manifest, it is incomplete")
+	}
+	if manifest.Version != backupVersion {
+		return nil, nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+	for key := range bodies {
+		return nil, nil, fmt.Errorf("backup holds a document without metadata for key %s", key)
+	}
+	return manifest, wal, nil
+}
+
+// reads a document, its metadata or the manifest out of a tar stream, no
+// entry can be larger than a WAL record
+func readTarEntry(tr *tar.Reader, header *tar.Header) ([]byte, error) {
+	if header.Size < 0 || header.Size > maxRecordSize {
+		return nil, fmt.Errorf("backup entry %s is too large", header.Name)
+	}
+	data := make([]byte, header.Size)
+	if _, err := io.ReadFull(tr, data); err != nil {
+		return nil, fmt.Errorf("failed to read backup entry %s: %v", header.Name, err)
+	}
+	return data, nil
+}
+
+// closes and removes a WAL spooled by readBackup
+func removeSpool(wal *os.File) {
+	wal.Close()
+	os.Remove(wal.Name())
+}
+
+// checks one backup of a chain: that it follows parent, that the documents
+// read from it match the manifest and that the parent state, its documents,
+// tombstones and WAL add up to the manifest state. base is the state of the
+// parent, nil for the full backup starting the chain. Returns the state the
+// backup ends in and the number of WAL records
+func checkBackup(manifest, parent *BackupManifest, base map[string]BackupEntry, docs map[string]string, wal io.ReadSeeker) (map[string]BackupEntry, int, error) {
+	if parent == nil {
+		if manifest.Type != BackupFull {
+			return nil, 0, fmt.Errorf("backup %s is %s, a chain starts with a full backup", manifest.ID, manifest.Type)
+		}
+	} else if manifest.Type != BackupIncremental || manifest.Parent != parent.ID || manifest.ParentLSN != parent.LSN {
+		return nil, 0, fmt.Errorf("backup %s doesn't follow backup %s", manifest.ID, parent.ID)
+	}
+
+	if len(docs) != len(manifest.Documents) {
+		return nil, 0, fmt.Errorf("backup %s holds %d documents, manifest lists %d", manifest.ID, len(docs), len(manifest.Documents))
+	}
+	start := map[string]BackupEntry{}
+	for key, e := range base {
+		start[key] = e
+	}
+	for _, entry := range manifest.Documents {
+		if sum, ok := docs[entry.Key]; !ok || sum != entry.Checksum {
+			return nil, 0, fmt.Errorf("backup %s: key %s doesn't match the manifest", manifest.ID, entry.Key)
+		}
+		start[entry.Key] = entry
+	}
+	for _, key := range manifest.Deleted {
+		delete(start, key)
+	}
+
+	state, count, err := backupState(start, wal, manifest.Since, manifest.LSN)
+	if err != nil {
+		return nil, count, fmt.Errorf("backup %s: %v", manifest.ID, err)
+	}
+	if len(state) != len(manifest.State) {
+		return nil, count, fmt.Errorf("backup %s adds up to %d keys, manifest lists %d", manifest.ID, len(state), len(manifest.State))
+	}
+	for _, want := range manifest.State {
+		if got, ok := state[want.Key]; !ok || !sameVersion(got, want) {
+			return nil, count, fmt.Errorf("backup %s: key %s doesn't add up to the manifest state", manifest.ID, want.Key)
+		}
+	}
+	return stateMap(manifest.State), count, nil
+}
+
+// reports whether two entries describe the same version of a document,
+// checksums are only compared when both sides have one
+func sameVersion(a, b BackupEntry) bool {
+	if a.LSN != b.LSN {
+		return false
+	}
+	return a.Checksum == "" || b.Checksum == "" || a.Checksum == b.Checksum
+}
+
+// VerifyBackupChain checks a full backup followed by its incrementals
+// without restoring anything, returns their manifests
+func VerifyBackupChain(backups []io.Reader) ([]*BackupManifest, error) {
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("no backups to verify")
+	}
+
+	var manifests []*BackupManifest
+	var parent *BackupManifest
+	var state map[string]BackupEntry
+	for _, r := range backups {
+		docs := map[string]string{}
+		manifest, wal, err := readBackup(r, func(key string, _ []byte, meta *MetaData) error {
+			docs[key] = meta.Checksum
+			return nil
+		})
+		if err != nil {
+			return manifests, err
+		}
+		state, _, err = checkBackup(manifest, parent, state, docs, wal)
+		removeSpool(wal)
+		if err != nil {
+			return manifests, err
+		}
+		manifests = append(manifests, manifest)
+		parent = manifest
+	}
+	return manifests, nil
+}
+
+// RestoreBackup restores a full backup and the incrementals taken after it,
+// in order, into dir. The chain is unpacked, replayed and verified in a
+// staging directory next to dir first, dir is only replaced once every
+// checksum matched and is moved aside rather than deleted. The index over
+// dir becomes the global index
+func RestoreBackup(fs af.Fs, backups []io.Reader, dir string) (*BackupRestoreStats, error) {
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("no backups to restore")
+	}
+
+	dir = filepath.Clean(dir)
+	staging := dir + ".restore"
+	if err := fs.RemoveAll(staging); err != nil {
+		return nil, fmt.Errorf("failed to clear staging directory: %v", err)
+	}
+	if err := fs.MkdirAll(staging, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %v", err)
+	}
+
+	stats, err := stageBackups(fs, backups, staging)
+	if err != nil {
+		fs.RemoveAll(staging)
+		return nil, err
+	}
+
+	if _, err := fs.Stat(dir); err == nil {
+		stats.Previous = fmt.Sprintf("%s.pre-restore-%d", dir, time.Now().Unix())
+		if err := fs.Rename(dir, stats.Previous); err != nil {
+			fs.RemoveAll(staging)
+			return nil, fmt.Errorf("failed to move %s aside: %v", dir, err)
+		}
+	}
+	if err := fs.Rename(staging, dir); err != nil {
+		if stats.Previous != "" {
+			fs.Rename(stats.Previous, dir)
+		}
+		return nil, fmt.Errorf("failed to move restored database into place: %v", err)
+	}
+
+	I = NewFileIndex(dir)
+	I.FileSystem = fs
+	I.Regenerate()
+
+	log.Info("backup: restored %d backups at lsn %d into %s", stats.Backups, stats.LSN, dir)
+	return stats, nil
+}
+
+// unpacks, replays and verifies a backup chain in the staging directory
+func stageBackups(fs af.Fs, backups []io.Reader, staging string) (*BackupRestoreStats, error) {
+	idx := NewFileIndex(staging)
+	idx.FileSystem = fs
+	I = idx
+
+	stats := &BackupRestoreStats{}
+	var parent *BackupManifest
+	var state map[string]BackupEntry
+	for _, r := range backups {
+		manifest, next, err := idx.applyBackup(r, parent, state, stats)
+		if err != nil {
+			return nil, err
+		}
+		parent, state = manifest, next
+		stats.Backups++
+		stats.LSN = manifest.LSN
+	}
+	if err := idx.verifyRestored(state, stats.LSN); err != nil {
+		return nil, err
+	}
+
+	// a snapshot carries the LSN over to the restored database
+	if err := idx.CreateCheckpoint(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// applies one backup of a chain to the index: its documents, then its
+// tombstones, then its WAL records, returns its manifest and the state
+// it ends in
+func (i *FileIndex) applyBackup(r io.Reader, parent *BackupManifest, base map[string]BackupEntry, stats *BackupRestoreStats) (*BackupManifest, map[string]BackupEntry, error) {
+	i.lock()
+	defer i.mu.Unlock()
+
+	docs := map[string]string{}
+	manifest, wal, err := readBackup(r, func(key string, body []byte, meta *MetaData) error {
+		file, ok := i.index[key]
+		if !ok {
+			file = i.newFile(key)
+		}
+		if _, err := file.restoreFromSnapshot(string(body), meta); err != nil {
+			return fmt.Errorf("failed to restore key %s: %v", key, err)
+		}
+		i.index[key] = file
+		docs[key] = meta.Checksum
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer removeSpool(wal)
+	state, _, err := checkBackup(manifest, parent, base, docs, wal)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, key := range manifest.Deleted {
+		if file, ok := i.index[key]; ok {
+			if err := file.Delete(); err != nil && !os.IsNotExist(err) {
+				return nil, nil, fmt.Errorf("failed to delete key %s: %v", key, err)
+			}
+			delete(i.index, key)
+		}
+	}
+	count, err := walkBackupWAL(wal, manifest.Since, manifest.LSN, i.applyEntry)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stats.Documents += len(manifest.Documents)
+	stats.Deleted += len(manifest.Deleted)
+	stats.WALRecords += count
+	return manifest, state, nil
+}
+
+// checks the restored documents against the state the chain ended in
+func (i *FileIndex) verifyRestored(state map[string]BackupEntry, lsn uint64) error {
+	i.lock()
+	defer i.mu.Unlock()
+
+	if len(i.index) != len(state) {
+		return fmt.Errorf("restored %d keys, backup state lists %d", len(i.index), len(state))
+	}
+	for key, file := range i.index {
+		if err := file.ValidateChecksum(); err != nil {
+			return fmt.Errorf("restored key %s failed verification: %v", key, err)
+		}
+		want, ok := state[key]
+		meta, err := file.readMetadata()
+		if !ok || err != nil || !sameVersion(BackupEntry{LSN: meta.LSN, Checksum: meta.Checksum}, want) {
+			return fmt.Errorf("restored key %s doesn't match the backup state", key)
+		}
+	}
+	i.checkpointLSN = lsn
+	return nil
+}
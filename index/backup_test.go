@@ -0,0 +1,452 @@
+// provides tests for online backups and restoring them
+package index
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// reads every document of an OS directory into a map
+func readDocuments(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	docs := map[string]string{}
+	files, err := os.ReadDir(dir)
+	assertNilErr(t, err)
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		body, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		assertNilErr(t, err)
+		docs[f.Name()] = string(body)
+	}
+	return docs
+}
+
+// rewrites a tar backup, passing every entry through edit, entries
+// for which edit returns nil are dropped
+func editBackup(t *testing.T, backup []byte, edit func(name string, data []byte) []byte) []byte {
+	t.Helper()
+
+	var out bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(backup))
+	tw := tar.NewWriter(&out)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assertNilErr(t, err)
+		data, err := io.ReadAll(tr)
+		assertNilErr(t, err)
+
+		if data = edit(header.Name, data); data == nil {
+			continue
+		}
+		assertNilErr(t, writeTarFile(tw, header.Name, data))
+	}
+	assertNilErr(t, tw.Close())
+	return out.Bytes()
+}
+
+// verifies that backups restore to the state at their LSN
+func TestBackup(t *testing.T) {
+	// Test Case 1: plain and compressed backups round trip
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("backup and restore compress=%v", compress), func(t *testing.T) {
+			defer setup()
+			dir := filepath.Join(t.TempDir(), "db")
+			I = NewFileIndex(dir)
+			assertNilErr(t, I.InitWAL(DurabilityNone))
+
+			assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+			assertNilErr(t, I.CreateCheckpoint())
+			assertNilErr(t, I.Put(&File{FileName: "b"}, []byte(`{"v":1}`)))
+			assertNilErr(t, I.PatchField(mustFile(t, "a"), "w", true))
+			want := readDocuments(t, dir)
+			lsn := I.LastLSN()
+
+			var buf bytes.Buffer
+			manifest, err := I.Backup(&buf, BackupOptions{Compress: compress})
+			assertNilErr(t, err)
+			checkDeepEquals(t, manifest.LSN, lsn)
+			checkDeepEquals(t, len(manifest.Documents), 2)
+
+			// writes after the backup are gone after restoring it
+			assertNilErr(t, I.Put(&File{FileName: "c"}, []byte(`{"v":1}`)))
+			assertNilErr(t, I.wal.Close())
+
+			stats, err := RestoreBackup(af.NewOsFs(), []io.Reader{&buf}, dir)
+			assertNilErr(t, err)
+			checkDeepEquals(t, stats.LSN, lsn)
+			checkDeepEquals(t, readDocuments(t, dir), want)
+			assertFileExists(t, filepath.Join(stats.Previous, "c"))
+
+			// the restored database carries on after the backup LSN
+			I = NewFileIndex(dir)
+			assertNilErr(t, I.RestoreFromCheckpoint())
+			assertNilErr(t, I.InitWAL(DurabilityNone))
+			checkDeepEquals(t, I.LastLSN(), lsn)
+			assertNilErr(t, I.wal.Close())
+		})
+	}
+
+	// Test Case 2: a backup taken under concurrent writes matches the
+	// database at its LSN
+	t.Run("backup with concurrent writers", func(t *testing.T) {
+		defer setup()
+		dir := filepath.Join(t.TempDir(), "db")
+		I = NewFileIndex(dir)
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		for n := 0; n < 40; n++ {
+			assertNilErr(t, I.Put(&File{FileName: fmt.Sprintf("k%d", n)}, []byte(`{"round":0}`)))
+		}
+
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for n := w; n < 40; n += 4 {
+					body := fmt.Sprintf(`{"round":%d}`, n)
+					assertNilErr(t, I.Put(&File{FileName: fmt.Sprintf("k%d", n)}, []byte(body)))
+				}
+			}(w)
+		}
+		var buf bytes.Buffer
+		manifest, err := I.Backup(&buf, BackupOptions{})
+		assertNilErr(t, err)
+		wg.Wait()
+		assertNilErr(t, I.wal.Close())
+
+		// rebuild the same LSN from the WAL alone to compare against
+		expected := filepath.Join(t.TempDir(), "expected")
+		_, err = RestoreToPoint(af.NewOsFs(), dir, expected, RecoveryTarget{LSN: manifest.LSN})
+		assertNilErr(t, err)
+
+		restored := filepath.Join(t.TempDir(), "restored")
+		_, err = RestoreBackup(af.NewOsFs(), []io.Reader{&buf}, restored)
+		assertNilErr(t, err)
+		checkDeepEquals(t, readDocuments(t, restored), readDocuments(t, expected))
+	})
+
+	// Test Case 3: checkpoints go on while a backup is stuck on its client
+	// and the segments it reads stay until it is done
+	t.Run("checkpoints during a stalled backup", func(t *testing.T) {
+		defer setup()
+		dir := filepath.Join(t.TempDir(), "db")
+		I = NewFileIndex(dir)
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+
+		pr, pw := io.Pipe()
+		type result struct {
+			manifest *BackupManifest
+			err      error
+		}
+		done := make(chan result, 1)
+		go func() {
+			manifest, err := I.Backup(pw, BackupOptions{})
+			pw.CloseWithError(err)
+			done <- result{manifest, err}
+		}()
+		// the backup is under way and blocked on its next write
+		first := make([]byte, 1)
+		_, err := io.ReadFull(pr, first)
+		assertNilErr(t, err)
+
+		checkpointed := make(chan error, 1)
+		go func() {
+			for n := 0; n < 2; n++ {
+				if err := I.Put(&File{FileName: fmt.Sprintf("k%d", n)}, []byte(`{"v":1}`)); err != nil {
+					checkpointed <- err
+					return
+				}
+				if err := I.CreateCheckpoint(); err != nil {
+					checkpointed <- err
+					return
+				}
+			}
+			checkpointed <- nil
+		}()
+		select {
+		case err := <-checkpointed:
+			assertNilErr(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("a checkpoint waited for the backup client")
+		}
+
+		rest, err := io.ReadAll(pr)
+		assertNilErr(t, err)
+		res := <-done
+		assertNilErr(t, res.err)
+		assertNilErr(t, I.wal.Close())
+
+		expected := filepath.Join(t.TempDir(), "expected")
+		_, err = RestoreToPoint(af.NewOsFs(), dir, expected, RecoveryTarget{LSN: res.manifest.LSN})
+		assertNilErr(t, err)
+		restored := filepath.Join(t.TempDir(), "restored")
+		_, err = RestoreBackup(af.NewOsFs(), []io.Reader{bytes.NewReader(append(first, rest...))}, restored)
+		assertNilErr(t, err)
+		checkDeepEquals(t, readDocuments(t, restored), readDocuments(t, expected))
+	})
+}
+
+// verifies that damaged backups never replace the database
+func TestRestoreBackupRejects(t *testing.T) {
+	cases := []struct {
+		name string
+		edit func(name string, data []byte) []byte
+	}{
+		{"corrupt document", func(name string, data []byte) []byte {
+			if name == "documents/a.json" {
+				return []byte(`{"v":2}`)
+			}
+			return data
+		}},
+		{"missing manifest", func(name string, data []byte) []byte {
+			if name == "manifest.json" {
+				return nil
+			}
+			return data
+		}},
+		{"missing document", func(name string, data []byte) []byte {
+			if name == "documents/a.json" || name == "documents/a.json.meta" {
+				return nil
+			}
+			return data
+		}},
+		{"missing wal record", func(name string, data []byte) []byte {
+			if name == "wal.log" {
+				return nil
+			}
+			return data
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			defer setup()
+			dir := filepath.Join(t.TempDir(), "db")
+			I = NewFileIndex(dir)
+			assertNilErr(t, I.InitWAL(DurabilityNone))
+			assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+			assertNilErr(t, I.CreateCheckpoint())
+			assertNilErr(t, I.Put(&File{FileName: "b"}, []byte(`{"v":1}`)))
+
+			var buf bytes.Buffer
+			_, err := I.Backup(&buf, BackupOptions{})
+			assertNilErr(t, err)
+			assertNilErr(t, I.wal.Close())
+			want := readDocuments(t, dir)
+
+			_, err = RestoreBackup(af.NewOsFs(), []io.Reader{bytes.NewReader(editBackup(t, buf.Bytes(), c.edit))}, dir)
+			assertErr(t, err)
+
+			checkDeepEquals(t, readDocuments(t, dir), want)
+			_, err = os.Stat(dir + ".restore")
+			assert.True(t, os.IsNotExist(err), "staging directory left behind")
+		})
+	}
+}
+
+// returns the keys of a manifest's document entries
+func entryKeys(entries []BackupEntry) []string {
+	keys := []string{}
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	return keys
+}
+
+// verifies that incremental backups chain onto a full backup
+func TestIncrementalBackup(t *testing.T) {
+	// takes a backup of the global index on top of parent
+	backup := func(t *testing.T, parent *BackupManifest) (*BackupManifest, []byte) {
+		t.Helper()
+		var buf bytes.Buffer
+		manifest, err := I.Backup(&buf, BackupOptions{Parent: parent})
+		assertNilErr(t, err)
+		return manifest, buf.Bytes()
+	}
+
+	// builds a database with a full backup and two incrementals, returns
+	// the backups and the database as of each of them
+	chain := func(t *testing.T, dir string) ([]*BackupManifest, [][]byte, []map[string]string) {
+		t.Helper()
+		I = NewFileIndex(dir)
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		var manifests []*BackupManifest
+		var backups [][]byte
+		var states []map[string]string
+		take := func(parent *BackupManifest) *BackupManifest {
+			m, b := backup(t, parent)
+			manifests, backups = append(manifests, m), append(backups, b)
+			states = append(states, readDocuments(t, dir))
+			return m
+		}
+
+		for _, key := range []string{"a", "b", "c", "d"} {
+			assertNilErr(t, I.Put(&File{FileName: key}, []byte(`{"v":1}`)))
+		}
+		assertNilErr(t, I.CreateCheckpoint())
+		full := take(nil)
+
+		// changed, created, deleted, and created then deleted again
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":2}`)))
+		assertNilErr(t, I.PatchField(mustFile(t, "b"), "w", true))
+		assertNilErr(t, I.Put(&File{FileName: "e"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.Delete(mustFile(t, "c")))
+		assertNilErr(t, I.Put(&File{FileName: "tmp"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.Delete(mustFile(t, "tmp")))
+		assertNilErr(t, I.CreateCheckpoint())
+		first := take(full)
+
+		// deleted and recreated, changed only in the WAL after the checkpoint
+		assertNilErr(t, I.Delete(mustFile(t, "d")))
+		assertNilErr(t, I.Put(&File{FileName: "d"}, []byte(`{"v":3}`)))
+		assertNilErr(t, I.CreateCheckpoint())
+		assertNilErr(t, I.Delete(mustFile(t, "e")))
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":3}`)))
+		take(first)
+		return manifests, backups, states
+	}
+
+	// Test Case 1: incrementals hold only what changed since their parent
+	t.Run("incrementals hold changes only", func(t *testing.T) {
+		defer setup()
+		manifests, _, _ := chain(t, filepath.Join(t.TempDir(), "db"))
+		assertNilErr(t, I.wal.Close())
+
+		checkDeepEquals(t, manifests[0].Type, BackupFull)
+		checkDeepEquals(t, entryKeys(manifests[0].Documents), []string{"a", "b", "c", "d"})
+		checkDeepEquals(t, manifests[1].Type, BackupIncremental)
+		checkDeepEquals(t, manifests[1].Parent, manifests[0].ID)
+		checkDeepEquals(t, entryKeys(manifests[1].Documents), []string{"a", "b", "e"})
+		checkDeepEquals(t, manifests[1].Deleted, []string{"c"})
+		checkDeepEquals(t, entryKeys(manifests[2].Documents), []string{"a", "d"})
+		checkDeepEquals(t, entryKeys(manifests[2].State), []string{"a", "b", "d"})
+	})
+
+	// Test Case 2: restoring any prefix of the chain gives the database as
+	// of its last backup
+	t.Run("restore chain", func(t *testing.T) {
+		defer setup()
+		dir := filepath.Join(t.TempDir(), "db")
+		manifests, backups, states := chain(t, dir)
+		assertNilErr(t, I.wal.Close())
+
+		for n := range backups {
+			readers := []io.Reader{}
+			for _, b := range backups[:n+1] {
+				readers = append(readers, bytes.NewReader(b))
+			}
+			restored := filepath.Join(t.TempDir(), "restored")
+			stats, err := RestoreBackup(af.NewOsFs(), readers, restored)
+			assertNilErr(t, err)
+			checkDeepEquals(t, stats.LSN, manifests[n].LSN)
+			checkDeepEquals(t, readDocuments(t, restored), states[n])
+		}
+	})
+
+	// Test Case 3: verify accepts the chain and rejects broken ones
+	t.Run("verify chain", func(t *testing.T) {
+		defer setup()
+		_, backups, _ := chain(t, filepath.Join(t.TempDir(), "db"))
+		assertNilErr(t, I.wal.Close())
+
+		readers := func(bs ...[]byte) []io.Reader {
+			var rs []io.Reader
+			for _, b := range bs {
+				rs = append(rs, bytes.NewReader(b))
+			}
+			return rs
+		}
+		manifests, err := VerifyBackupChain(readers(backups...))
+		assertNilErr(t, err)
+		checkDeepEquals(t, len(manifests), 3)
+
+		// a missing link, a chain not starting with a full backup and a
+		// corrupt document are all caught
+		_, err = VerifyBackupChain(readers(backups[0], backups[2]))
+		assertErr(t, err)
+		_, err = VerifyBackupChain(readers(backups[1], backups[2]))
+		assertErr(t, err)
+		corrupt := editBackup(t, backups[1], func(name string, data []byte) []byte {
+			if name == "documents/e.json" {
+				return []byte(`{"v":9}`)
+			}
+			return data
+		})
+		_, err = VerifyBackupChain(readers(backups[0], corrupt, backups[2]))
+		assertErr(t, err)
+
+		// a broken chain never replaces the database
+		dir := filepath.Join(t.TempDir(), "restored")
+		_, err = RestoreBackup(af.NewOsFs(), readers(backups[0], backups[2]), dir)
+		assertErr(t, err)
+		_, err = os.Stat(dir)
+		assert.True(t, os.IsNotExist(err), "database created from a broken chain")
+	})
+
+	// Test Case 4: an incremental can be taken from the manifest alone
+	t.Run("parent from manifest", func(t *testing.T) {
+		defer setup()
+		dir := filepath.Join(t.TempDir(), "db")
+		I = NewFileIndex(dir)
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+		full, data := backup(t, nil)
+
+		fromBackup, err := ReadBackupManifest(bytes.NewReader(data))
+		assertNilErr(t, err)
+		checkDeepEquals(t, fromBackup, full)
+		manifestJSON, err := json.Marshal(full)
+		assertNilErr(t, err)
+		fromJSON, err := ReadBackupManifest(bytes.NewReader(manifestJSON))
+		assertNilErr(t, err)
+		checkDeepEquals(t, fromJSON, full)
+
+		incr, _ := backup(t, fromJSON)
+		checkDeepEquals(t, len(incr.Documents), 0)
+		assertNilErr(t, I.wal.Close())
+	})
+
+	// Test Case 5: without a checkpoint since the parent an incremental's
+	// WAL starts at the parent LSN rather than at the last checkpoint
+	t.Run("wal starts at the parent", func(t *testing.T) {
+		defer setup()
+		dir := filepath.Join(t.TempDir(), "db")
+		I = NewFileIndex(dir)
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.Put(&File{FileName: "b"}, []byte(`{"v":1}`)))
+		full, fullData := backup(t, nil)
+		checkDeepEquals(t, full.WALRecords, 2)
+
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":2}`)))
+		want := readDocuments(t, dir)
+		incr, incrData := backup(t, full)
+		checkDeepEquals(t, incr.Since, full.LSN)
+		checkDeepEquals(t, incr.WALRecords, 1)
+		assertNilErr(t, I.wal.Close())
+
+		restored := filepath.Join(t.TempDir(), "restored")
+		_, err := RestoreBackup(af.NewOsFs(), []io.Reader{bytes.NewReader(fullData), bytes.NewReader(incrData)}, restored)
+		assertNilErr(t, err)
+		checkDeepEquals(t, readDocuments(t, restored), want)
+	})
+}
@@ -0,0 +1,445 @@
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	af "github.com/spf13/afero"
+
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// operations of a batch
+const (
+	BatchPut    = opPut
+	BatchDelete = opDelete
+)
+
+// ErrBatchConflict is returned by an atomic batch deleting a key that
+// doesn't exist, nothing of the batch is applied
+var ErrBatchConflict = errors.New("batch deletes a key that doesn't exist")
+
+// ErrBatchShards is returned by an atomic batch whose keys live on more than
+// one shard, every shard logs its own record so they can't be applied all
+// or not at all
+var ErrBatchShards = errors.New("atomic batch spans several shards")
+
+// BatchOp is a single write of a batch, Body is the content of a put
+type BatchOp struct {
+	Op   string `json:"op"`
+	Key  string `json:"key"`
+	Body string `json:"body,omitempty"`
+}
+
+// Batch applies ops in order under one WAL record, so they are synced
+// together and recovered all or not at all. An atomic batch deleting a key
+// that doesn't exist fails with ErrBatchConflict and changes nothing,
+// otherwise such deletes are skipped. An atomic batch is written next to
+// its documents before it is logged, a write that fails then changes
+// nothing. Other batches apply what they can
+func (i *FileIndex) Batch(ops []BatchOp, atomic bool) error {
+	return NewRouter([]*FileIndex{i}).Batch(ops, atomic)
+}
+
+// BatchChanges is Batch that also returns the changes it made, one per
+// key in key order
+func (i *FileIndex) BatchChanges(ops []BatchOp, atomic bool) ([]Change, error) {
+	return NewRouter([]*FileIndex{i}).BatchChanges(ops, atomic)
+}
+
+// Batch applies ops to the shards of their keys, see FileIndex.Batch. The
+// keys are locked in order so concurrent batches can't deadlock, then the
+// shards involved to append the records, every one of them logs its part
+// of the batch as one record. Atomic batches must keep to one shard and
+// fail with ErrBatchShards otherwise
+func (r *Router) Batch(ops []BatchOp, atomic bool) error {
+	return r.batch(ops, atomic, nil)
+}
+
+// BatchChanges is Batch that also returns the changes it made, one per
+// key in key order
+func (r *Router) BatchChanges(ops []BatchOp, atomic bool) ([]Change, error) {
+	var changes []Change
+	err := r.batch(ops, atomic, &changes)
+	return changes, err
+}
+
+// applies a batch, fills in changes when it isn't nil
+func (r *Router) batch(ops []BatchOp, atomic bool, changes *[]Change) error {
+	for _, op := range ops {
+		if op.Op != BatchPut && op.Op != BatchDelete {
+			return fmt.Errorf("unknown batch op '%s'", op.Op)
+		}
+	}
+
+	parts := map[*FileIndex][]BatchOp{}
+	var keys []string
+	for _, op := range ops {
+		shard := r.Shard(op.Key)
+		if !containsKey(parts[shard], op.Key) {
+			keys = append(keys, op.Key)
+		}
+		parts[shard] = append(parts[shard], op)
+	}
+	sort.Strings(keys)
+	if atomic && len(parts) > 1 {
+		return ErrBatchShards
+	}
+	var shards []*FileIndex
+	for _, shard := range r.Shards() {
+		if _, ok := parts[shard]; ok {
+			shards = append(shards, shard)
+		}
+	}
+
+	files, err := r.lockBatch(keys, shards)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.mu.Unlock()
+		}
+	}()
+	var before []string
+	if changes != nil {
+		for _, key := range keys {
+			before = append(before, files[key].checksumLocked())
+		}
+	}
+
+	staged := map[*FileIndex][]stagedWrite{}
+	if atomic {
+		for _, shard := range shards {
+			if !shard.batchApplies(parts[shard]) {
+				unlockShards(shards)
+				return ErrBatchConflict
+			}
+			writes, err := shard.stageBatch(parts[shard], files)
+			if err != nil {
+				unlockShards(shards)
+				return err
+			}
+			staged[shard] = writes
+		}
+	}
+	lsns := map[*FileIndex]uint64{}
+	for _, shard := range shards {
+		lsn, err := shard.logBatch(parts[shard], files)
+		if err != nil {
+			for _, writes := range staged {
+				discardStaged(writes)
+			}
+			unlockShards(shards)
+			return err
+		}
+		lsns[shard] = lsn
+	}
+	unlockShards(shards)
+
+	var first error
+	for _, shard := range shards {
+		var err error
+		if atomic {
+			err = shard.commitStaged(staged[shard])
+		} else {
+			err = shard.applyBatch(parts[shard], files, lsns[shard])
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	if changes != nil {
+		for k, key := range keys {
+			*changes = append(*changes, Change{Key: key, Before: before[k], After: files[key].checksumLocked()})
+		}
+	}
+	return first
+}
+
+// reports whether ops already hold a write to key
+func containsKey(ops []BatchOp, key string) bool {
+	for _, op := range ops {
+		if op.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// locks the files of keys in order and then shards, retried while a key
+// was deleted and written again in between. Returns the locked files by key
+// with the shards locked, the caller unlocks both
+func (r *Router) lockBatch(keys []string, shards []*FileIndex) (map[string]*File, error) {
+	for {
+		files := make(map[string]*File, len(keys))
+		for _, key := range keys {
+			shard := r.Shard(key)
+			files[key] = shard.lockFile(shard.newFile(key))
+		}
+		for _, shard := range shards {
+			shard.lock()
+		}
+		var err error
+		for _, f := range files {
+			if err = f.owner().current(f); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			return files, nil
+		}
+		unlockShards(shards)
+		for _, f := range files {
+			f.mu.Unlock()
+		}
+		if err != errReindexed {
+			return nil, err
+		}
+	}
+}
+
+// releases the index locks of shards
+func unlockShards(shards []*FileIndex) {
+	for _, shard := range shards {
+		shard.mu.Unlock()
+	}
+}
+
+// reports whether every delete of ops finds its key, counting the writes
+// before it, callers must hold the index lock
+func (i *FileIndex) batchApplies(ops []BatchOp) bool {
+	exists := map[string]bool{}
+	for _, op := range ops {
+		found, seen := exists[op.Key]
+		if !seen {
+			_, found = i.index[op.Key]
+		}
+		if op.Op == BatchDelete && !found {
+			return false
+		}
+		exists[op.Key] = op.Op == BatchPut
+	}
+	return true
+}
+
+// logs ops as one record and indexes the keys they put, callers must hold
+// the index lock and the locks of files
+func (i *FileIndex) logBatch(ops []BatchOp, files map[string]*File) (uint64, error) {
+	var lsn uint64
+	if i.wal != nil {
+		body, err := json.Marshal(ops)
+		if err != nil {
+			return 0, err
+		}
+		if lsn, err = i.wal.Append(walEntry{Op: opBatch, Body: string(body)}); err != nil {
+			return 0, fmt.Errorf("failed to log batch: %v", err)
+		}
+	}
+	for _, op := range ops {
+		if op.Op == BatchPut {
+			i.index[op.Key] = files[op.Key]
+		}
+	}
+	return lsn, nil
+}
+
+// applies ops logged under lsn to their files, callers must hold the locks
+// of files but not the index lock
+func (i *FileIndex) applyBatch(ops []BatchOp, files map[string]*File, lsn uint64) error {
+	var first error
+	for _, op := range ops {
+		if err := applyBatchOp(files[op.Key], op, lsn); err != nil && first == nil {
+			first = err
+		}
+	}
+	i.unindexMissing(files)
+	return first
+}
+
+// unindexes the keys of files left without a document, deleted or never
+// written, callers must hold the locks of files but not the index lock
+func (i *FileIndex) unindexMissing(files map[string]*File) {
+	missing := map[string]bool{}
+	for key, file := range files {
+		if file.owner() != i {
+			continue
+		}
+		if _, err := i.FileSystem.Stat(file.ResolvePath()); err != nil {
+			missing[key] = true
+		}
+	}
+	i.lock()
+	for key := range missing {
+		if i.index[key] == files[key] {
+			delete(i.index, key)
+		}
+	}
+	i.mu.Unlock()
+}
+
+// stagedWrite is the last write of a key in an atomic batch, a put has its
+// content and metadata written next to the document under stagedSuffix
+type stagedWrite struct {
+	file *File
+	put  bool
+	size int // length of the content of a put
+}
+
+// suffix of the files an atomic batch is staged in
+const stagedSuffix = ".batch"
+
+// writes the last write of every key of ops next to its document, so only
+// renames are left once the batch is logged. Nothing is left behind when a
+// write fails. Callers must hold the index lock and the locks of files
+func (i *FileIndex) stageBatch(ops []BatchOp, files map[string]*File) ([]stagedWrite, error) {
+	last := map[string]BatchOp{}
+	var keys []string
+	for _, op := range ops {
+		if _, ok := last[op.Key]; !ok {
+			keys = append(keys, op.Key)
+		}
+		last[op.Key] = op
+	}
+	// the record is appended next, under the index lock still held
+	var lsn uint64
+	if i.wal != nil {
+		lsn = i.wal.lsn + 1
+	}
+
+	var writes []stagedWrite
+	for _, key := range keys {
+		w := stagedWrite{file: files[key], put: last[key].Op == BatchPut, size: len(last[key].Body)}
+		if w.put {
+			if err := w.file.stage(last[key].Body, lsn); err != nil {
+				discardStaged(append(writes, w))
+				return nil, err
+			}
+		}
+		writes = append(writes, w)
+	}
+	return writes, nil
+}
+
+// writes body and its metadata next to the document, callers must hold
+// f.mu
+func (f *File) stage(body string, lsn uint64) error {
+	fs, path := f.owner().FileSystem, f.ResolvePath()
+	now := time.Now().UTC().Format(time.RFC3339)
+	meta := &MetaData{Checksum: calculateChecksum([]byte(body)), Created: now, Modified: now, LSN: lsn}
+	if existing, err := f.loadMetadata(); err == nil {
+		meta.Created = existing.Created
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %v", err)
+	}
+	if err := af.WriteFile(fs, path+stagedSuffix, []byte(body), 0644); err != nil {
+		return err
+	}
+	if err := af.WriteFile(fs, f.resolveMetaPath()+stagedSuffix, data, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata file: %v", err)
+	}
+	return nil
+}
+
+// removes the files writes were staged in
+func discardStaged(writes []stagedWrite) {
+	for _, w := range writes {
+		fs, path := w.file.owner().FileSystem, w.file.ResolvePath()
+		fs.Remove(path + stagedSuffix)
+		fs.Remove(w.file.resolveMetaPath() + stagedSuffix)
+	}
+}
+
+// moves the staged writes of a logged batch into place, callers must hold
+// the locks of their files but not the index lock. A rename that fails
+// doesn't stop the others, replay finishes the batch from its record
+func (i *FileIndex) commitStaged(writes []stagedWrite) error {
+	var first error
+	files := map[string]*File{}
+	for _, w := range writes {
+		files[w.file.FileName] = w.file
+		fs, path := i.FileSystem, w.file.ResolvePath()
+		var err error
+		if w.put {
+			err = fs.Rename(path+stagedSuffix, path)
+			if err == nil {
+				documentBytes.Observe(float64(w.size))
+				err = fs.Rename(w.file.resolveMetaPath()+stagedSuffix, w.file.resolveMetaPath())
+			}
+		} else if err = w.file.deleteLocked(); os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	i.unindexMissing(files)
+	return first
+}
+
+// applies a single write of a batch logged under lsn, callers must hold
+// the file's lock
+func applyBatchOp(file *File, op BatchOp, lsn uint64) error {
+	switch op.Op {
+	case BatchPut:
+		return file.replaceContentLocked(op.Body, lsn)
+	case BatchDelete:
+		if err := file.deleteLocked(); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// applies a batch record found in the WAL, callers must hold the index
+// write lock
+func (i *FileIndex) applyBatchEntry(e walEntry) {
+	var ops []BatchOp
+	if err := json.Unmarshal([]byte(e.Body), &ops); err != nil {
+		log.Warn("wal: batch at lsn %d is corrupt: %s", e.LSN, err.Error())
+		return
+	}
+	// documents whose metadata already reflects the batch are done, decided
+	// up front as the batch may write a key more than once
+	done := map[string]bool{}
+	for _, op := range ops {
+		file, ok := i.index[op.Key]
+		if !ok {
+			file = i.newFile(op.Key)
+		}
+		if e.LSN != 0 && file.appliedLSN() >= e.LSN {
+			done[op.Key] = true
+			i.index[op.Key] = file
+		}
+	}
+	for _, op := range ops {
+		if done[op.Key] {
+			continue
+		}
+		file, ok := i.index[op.Key]
+		if !ok {
+			if op.Op == BatchDelete {
+				continue
+			}
+			file = i.newFile(op.Key)
+		}
+		file.mu.Lock()
+		err := applyBatchOp(file, op, e.LSN)
+		file.mu.Unlock()
+		if err != nil {
+			log.Warn("wal: batch apply failed for key '%s': %s", op.Key, err.Error())
+			continue
+		}
+		if op.Op == BatchPut {
+			i.index[op.Key] = file
+		} else {
+			delete(i.index, op.Key)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// provides tests for applying batches of writes
+package index
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch(t *testing.T) {
+	// Test Case 1: a batch is applied in order under a single WAL record
+	// which replay applies again, in either record format
+	for _, format := range []WALFormat{WALFormatJSON, WALFormatBinary} {
+		t.Run("replay "+format.String(), func(t *testing.T) {
+			setup()
+			assertNilErr(t, I.InitWAL(DurabilityCommit))
+			I.SetWALFormat(format, true)
+			createAndReturnFile(t, "gone")
+
+			assertNilErr(t, I.Batch([]BatchOp{
+				{Op: BatchPut, Key: "a", Body: `{"v":1}`},
+				{Op: BatchPut, Key: "b", Body: `{"v":2}`},
+				{Op: BatchPut, Key: "a", Body: `{"v":3}`},
+				{Op: BatchDelete, Key: "gone"},
+			}, true))
+			checkContentEqual(t, "a", map[string]interface{}{"v": 3})
+			checkKeyNotInIndex(t, "gone")
+
+			entries := readWAL(t)
+			ops := []string{}
+			for _, e := range entries {
+				ops = append(ops, e.Op)
+			}
+			// synced once after the put and once after the whole batch
+			assert.Equal(t, []string{opPut, opCommit, opBatch, opCommit}, ops)
+			assert.Equal(t, uint64(2), entries[2].LSN)
+
+			forgetDocuments("a", "b")
+			makeNewFile("gone.json", "test")
+			I.index = I.buildIndexMap()
+			assertNilErr(t, I.WALReplay())
+			checkContentEqual(t, "a", map[string]interface{}{"v": 3})
+			checkContentEqual(t, "b", map[string]interface{}{"v": 2})
+			assertFileDoesNotExist(t, "gone")
+			checkKeyNotInIndex(t, "gone")
+		})
+	}
+
+	// Test Case 2: an atomic batch deleting a missing key changes nothing,
+	// otherwise the delete is skipped
+	t.Run("atomic", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		ops := []BatchOp{
+			{Op: BatchPut, Key: "a", Body: `{"v":1}`},
+			{Op: BatchDelete, Key: "missing"},
+		}
+		assert.ErrorIs(t, I.Batch(ops, true), ErrBatchConflict)
+		checkKeyNotInIndex(t, "a")
+		assert.Empty(t, readWAL(t))
+
+		assertNilErr(t, I.Batch(ops, false))
+		checkContentEqual(t, "a", map[string]interface{}{"v": 1})
+
+		// writes earlier in the batch count
+		assertNilErr(t, I.Batch([]BatchOp{
+			{Op: BatchPut, Key: "b", Body: `{}`},
+			{Op: BatchDelete, Key: "b"},
+		}, true))
+		checkKeyNotInIndex(t, "b")
+		assert.ErrorIs(t, I.Batch([]BatchOp{
+			{Op: BatchDelete, Key: "a"},
+			{Op: BatchDelete, Key: "a"},
+		}, true), ErrBatchConflict)
+
+		err := I.Batch([]BatchOp{{Op: "PATCH", Key: "a"}}, false)
+		assert.Error(t, err)
+		assert.False(t, errors.Is(err, ErrBatchConflict))
+	})
+
+	// Test Case 3: a batch over several shards writes each its part, an
+	// atomic one must keep to one shard as their records are synced apart
+	t.Run("sharded", func(t *testing.T) {
+		setupShards(t, 3)
+		var ops []BatchOp
+		keys := []string{"a", "b", "c", "d", "e", "f"}
+		for _, key := range keys {
+			ops = append(ops, BatchOp{Op: BatchPut, Key: key, Body: `{"key":"` + key + `"}`})
+		}
+		assert.ErrorIs(t, R.Batch(ops, true), ErrBatchShards)
+		checkDeepEquals(t, len(R.ListKeys()), 0)
+
+		assertNilErr(t, R.Batch(ops, false))
+		checkDeepEquals(t, len(R.ListKeys()), len(keys))
+		for _, key := range keys {
+			_, ok := R.Shard(key).Lookup(key)
+			checkDeepEquals(t, ok, true)
+		}
+
+		// two keys of the same shard
+		var same []string
+		for _, key := range keys {
+			if R.Shard(key) == R.Shard(keys[0]) {
+				same = append(same, key)
+			}
+		}
+		if len(same) < 2 {
+			t.Fatal("no two keys share a shard")
+		}
+		assert.ErrorIs(t, R.Batch([]BatchOp{{Op: BatchDelete, Key: same[0]}, {Op: BatchDelete, Key: "z"}}, true), ErrBatchConflict)
+		checkDeepEquals(t, len(R.ListKeys()), len(keys))
+		assertNilErr(t, R.Batch([]BatchOp{{Op: BatchDelete, Key: same[0]}, {Op: BatchDelete, Key: same[1]}}, true))
+		checkDeepEquals(t, len(R.ListKeys()), len(keys)-2)
+	})
+
+	// Test Case 4: an atomic batch with a write that fails changes nothing,
+	// before or after replay, others apply the rest
+	t.Run("failed write", func(t *testing.T) {
+		ops := []BatchOp{
+			{Op: BatchPut, Key: "a", Body: `{"v":1}`},
+			{Op: BatchPut, Key: "b", Body: `{"v":2}`},
+			{Op: BatchDelete, Key: "c"},
+		}
+		for _, atomic := range []bool{true, false} {
+			setup()
+			assertNilErr(t, I.InitWAL(DurabilityCommit))
+			assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":0}`)))
+			assertNilErr(t, I.Put(&File{FileName: "c"}, []byte(`{"v":0}`)))
+			fs := I.FileSystem
+			I.FileSystem = &failingFs{Fs: fs, name: "b.json"}
+			assert.Error(t, I.Batch(ops, atomic))
+			I.FileSystem = fs
+
+			// replay writes what a batch that was logged couldn't
+			check := func(replayed bool) {
+				if atomic {
+					checkKeyNotInIndex(t, "b")
+					checkContentEqual(t, "a", map[string]interface{}{"v": 0})
+					checkContentEqual(t, "c", map[string]interface{}{"v": 0})
+					return
+				}
+				if replayed {
+					checkContentEqual(t, "b", map[string]interface{}{"v": 2})
+				} else {
+					checkKeyNotInIndex(t, "b")
+				}
+				checkContentEqual(t, "a", map[string]interface{}{"v": 1})
+				checkKeyNotInIndex(t, "c")
+			}
+			check(false)
+			if atomic {
+				for _, name := range []string{"a.json", "a.json.meta", "b.json", "b.json.meta"} {
+					_, err := fs.Stat(name + stagedSuffix)
+					assert.True(t, os.IsNotExist(err), name)
+				}
+			}
+			reopen(t)
+			check(true)
+		}
+	})
+}
+
+// failingFs fails writes to files whose path contains name
+type failingFs struct {
+	af.Fs
+	name string
+}
+
+func (f *failingFs) OpenFile(name string, flag int, perm os.FileMode) (af.File, error) {
+	if strings.Contains(name, f.name) && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, errors.New("disk full")
+	}
+	return f.Fs.OpenFile(name, flag, perm)
+}
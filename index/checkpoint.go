@@ -1,156 +1,505 @@
 package index
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	af "github.com/spf13/afero"
 	"github.com/themillenniumfalcon/smolDB/log"
+	"github.com/themillenniumfalcon/smolDB/metrics"
 )
 
-// checkpointMeta contains metadata about a checkpoint
-type checkpointMeta struct {
-	Timestamp int64             `json:"ts"`
-	Keys      map[string]string `json:"keys"`      // key -> content hash map
-	WalOffset int64             `json:"walOffset"` // offset in WAL file where this checkpoint was taken
+// snapshots are line-delimited JSON: a header, one line per document and a
+// trailer, a snapshot without its trailer is incomplete and never used
+const snapshotVersion = 2
+
+// snapshotHeader is the first line of a snapshot
+type snapshotHeader struct {
+	Version int    `json:"version"`
+	LSN     uint64 `json:"lsn"` // redo point, WAL records after it must be replayed on top
+	Ts      int64  `json:"ts"`
+}
+
+// snapshotEntry is a document line, or the trailer when End is set
+type snapshotEntry struct {
+	Key    string    `json:"key,omitempty"`
+	Body   string    `json:"body,omitempty"`
+	Meta   *MetaData `json:"meta,omitempty"`
+	End    bool      `json:"end,omitempty"`
+	Count  int       `json:"count,omitempty"`  // number of documents, trailer only
+	EndLSN uint64    `json:"endLsn,omitempty"` // last LSN when the snapshot finished, trailer only
+	EndTs  int64     `json:"endTs,omitempty"`  // when the snapshot finished, trailer only
+}
+
+// snapshotInfo describes a snapshot file in the checkpoint directory
+type snapshotInfo struct {
+	Path string
+	Ts   int64
+}
+
+// returns the directory checkpoints are written to
+func checkpointDir(dir string) string {
+	return filepath.Join(dir, "checkpoint")
+}
+
+// returns the directory sealed WAL segments are archived to once a
+// checkpoint covers them, point-in-time restores replay them
+func archiveDir(dir string) string {
+	return filepath.Join(dir, ".smoldb", "archive")
 }
 
-// CreateCheckpoint creates a new checkpoint file with current state
+// CreateCheckpoint writes a snapshot of every document without blocking
+// writers, the index lock is only held to seal the active WAL segment and
+// copy the key set, documents are then streamed one at a time under their
+// own lock, the snapshot only becomes visible once fully synced
 func (i *FileIndex) CreateCheckpoint() error {
-	i.mu.RLock()
-	defer i.mu.RUnlock()
+	i.checkpointMu.Lock()
+	defer i.checkpointMu.Unlock()
+
+	start := time.Now()
+
+	// seal the WAL so everything after the redo point lives in new segments
+	i.lock()
+	lsn := i.checkpointLSN
+	var sealed []string
+	if i.wal != nil {
+		if err := i.wal.rotate(); err != nil {
+			i.mu.Unlock()
+			return fmt.Errorf("failed to rotate WAL: %v", err)
+		}
+		lsn = i.wal.lsn
+		var err error
+		if sealed, err = i.wal.sealedSegments(); err != nil {
+			i.mu.Unlock()
+			return fmt.Errorf("failed to list WAL segments: %v", err)
+		}
+	}
+	keys := make([]string, 0, len(i.index))
+	for key := range i.index {
+		keys = append(keys, key)
+	}
+	i.mu.Unlock()
+	sort.Strings(keys)
 
 	// Create checkpoint directory if it doesn't exist
-	checkpointDir := filepath.Join(i.dir, "checkpoint")
-	if err := i.FileSystem.MkdirAll(checkpointDir, 0755); err != nil {
+	dir := checkpointDir(i.dir)
+	if err := i.FileSystem.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("failed to create checkpoint directory: %v", err)
 	}
 
 	// Generate checkpoint filename with timestamp
 	ts := time.Now().UnixNano()
-	filename := filepath.Join(checkpointDir, fmt.Sprintf("%09d.snap", ts))
+	filename := filepath.Join(dir, fmt.Sprintf("%019d.snap", ts))
+	tmpName := filename + ".tmp"
 
-	// Create metadata with current state
-	meta := &checkpointMeta{
-		Timestamp: ts,
-		Keys:      make(map[string]string),
-		WalOffset: 0, // Will be set after copying files
+	f, err := i.FileSystem.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint file: %v", err)
 	}
 
-	// Create a new checkpoint file
-	f, err := i.FileSystem.Create(filename)
+	count, err := i.writeSnapshot(f, snapshotHeader{Version: snapshotVersion, LSN: lsn, Ts: ts}, keys)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
 	if err != nil {
-		return fmt.Errorf("failed to create checkpoint file: %v", err)
+		i.FileSystem.Remove(tmpName)
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+
+	if err := i.FileSystem.Rename(tmpName, filename); err != nil {
+		i.FileSystem.Remove(tmpName)
+		return fmt.Errorf("failed to publish checkpoint: %v", err)
+	}
+
+	i.lock()
+	i.checkpointLSN = lsn
+	i.mu.Unlock()
+
+	// segments sealed above only hold records up to the redo point, while
+	// they are being read they stay where they are until a later checkpoint
+	if i.segmentPins.Load() == 0 {
+		i.archiveSegments(sealed)
+	} else if len(sealed) > 0 {
+		log.Info("checkpoint: WAL segments are being read, archiving them later")
+	}
+	i.pruneSnapshots()
+
+	checkpointSeconds.Observe(metrics.Since(start))
+	if info, err := i.FileSystem.Stat(filename); err == nil {
+		checkpointBytes.Observe(float64(info.Size()))
+	}
+	log.Info("checkpoint: wrote %d documents at lsn %d in %d ms", count, lsn, time.Since(start).Milliseconds())
+	return nil
+}
+
+// streams the header, the given documents and the trailer to w,
+// returns the number of documents written
+func (i *FileIndex) writeSnapshot(w io.Writer, header snapshotHeader, keys []string) (int, error) {
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	if err := enc.Encode(header); err != nil {
+		return 0, err
 	}
-	defer f.Close()
 
-	// Copy all current files to checkpoint
-	for key, file := range i.index {
-		content, err := file.ReadContent()
+	count := 0
+	for _, key := range keys {
+		file, ok := i.Lookup(key)
+		if !ok {
+			// deleted since the key set was taken, replay takes care of it
+			continue
+		}
+
+		body, meta, err := file.readWithMetadata()
 		if err != nil {
-			log.Warn("checkpoint: failed to read key %s: %v", key, err)
+			if !os.IsNotExist(err) {
+				log.Warn("checkpoint: failed to read key %s: %v", key, err)
+			}
 			continue
 		}
-		meta.Keys[key] = content
+
+		if err := enc.Encode(snapshotEntry{Key: key, Body: string(body), Meta: meta}); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	trailer := snapshotEntry{End: true, Count: count, EndLSN: i.LastLSN(), EndTs: time.Now().UnixNano()}
+	if err := enc.Encode(trailer); err != nil {
+		return count, err
 	}
+	return count, buf.Flush()
+}
 
-	// If WAL exists, get current offset
-	if i.wal != nil && i.wal.file != nil {
-		if info, err := i.wal.file.Stat(); err == nil {
-			meta.WalOffset = info.Size()
+// keeps checkpoints from archiving or pruning WAL segments until the
+// returned func is called, so they can be listed and read meanwhile
+// without holding checkpointMu
+func (i *FileIndex) pinSegments() func() {
+	i.checkpointMu.Lock()
+	i.segmentPins.Add(1)
+	i.checkpointMu.Unlock()
+	return func() { i.segmentPins.Add(-1) }
+}
+
+// moves sealed segments out of the WAL directory into the archive,
+// crash recovery no longer needs them once a checkpoint covers them
+func (i *FileIndex) archiveSegments(paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	dir := archiveDir(i.dir)
+	if err := i.FileSystem.MkdirAll(dir, 0755); err != nil {
+		log.Warn("checkpoint: failed to create WAL archive: %v", err)
+		return
+	}
+	for _, path := range paths {
+		if err := i.FileSystem.Rename(path, filepath.Join(dir, filepath.Base(path))); err != nil {
+			log.Warn("checkpoint: failed to archive WAL segment %s: %v", path, err)
 		}
 	}
+}
 
-	// Write metadata to checkpoint file
-	encoder := json.NewEncoder(f)
-	if err := encoder.Encode(meta); err != nil {
-		return fmt.Errorf("failed to write checkpoint metadata: %v", err)
+// removes all but the newest retained snapshots along with leftovers of
+// checkpoints that never finished, archived WAL segments that end before
+// the oldest retained snapshot go with them unless they are being read
+func (i *FileIndex) pruneSnapshots() {
+	dir := checkpointDir(i.dir)
+	if files, err := af.ReadDir(i.FileSystem, dir); err == nil {
+		for _, f := range files {
+			if strings.HasSuffix(f.Name(), ".snap.tmp") {
+				i.FileSystem.Remove(filepath.Join(dir, f.Name()))
+			}
+		}
 	}
 
-	// After successful checkpoint creation, truncate WAL
-	if i.wal != nil && meta.WalOffset > 0 {
-		if err := i.wal.TruncateAt(meta.WalOffset); err != nil {
-			log.Warn("checkpoint: failed to truncate WAL: %v", err)
-			// Don't fail the checkpoint creation if truncation fails
+	if i.retainSnapshots <= 0 {
+		return
+	}
+	snaps, err := listSnapshots(i.FileSystem, i.dir)
+	if err != nil || len(snaps) <= i.retainSnapshots {
+		return
+	}
+	for _, snap := range snaps[:len(snaps)-i.retainSnapshots] {
+		if err := i.FileSystem.Remove(snap.Path); err != nil {
+			log.Warn("checkpoint: failed to remove old snapshot %s: %v", snap.Path, err)
 		}
 	}
 
-	return nil
+	if i.segmentPins.Load() > 0 {
+		return
+	}
+	oldest, err := readSnapshotHeader(i.FileSystem, snaps[len(snaps)-i.retainSnapshots].Path)
+	if err != nil {
+		return
+	}
+	archived, err := archivedSegments(i.FileSystem, i.dir)
+	if err != nil {
+		return
+	}
+	// a segment ends right before the next one starts, the newest archived
+	// segment is always kept
+	for n := 0; n+1 < len(archived); n++ {
+		next, _ := segmentFirstLSN(archived[n+1])
+		if next > oldest.LSN+1 {
+			break
+		}
+		if err := i.FileSystem.Remove(archived[n]); err != nil {
+			log.Warn("checkpoint: failed to remove archived WAL segment %s: %v", archived[n], err)
+		}
+	}
 }
 
-// RestoreFromCheckpoint restores the database state from the latest checkpoint
-func (i *FileIndex) RestoreFromCheckpoint() error {
-	i.mu.Lock()
-	defer i.mu.Unlock()
-
-	// Find latest checkpoint file
-	checkpointDir := filepath.Join(i.dir, "checkpoint")
-	files, err := af.ReadDir(i.FileSystem, checkpointDir)
+// archivedSegments returns the archived WAL segments of dir in LSN order
+func archivedSegments(fs af.Fs, dir string) ([]string, error) {
+	files, err := af.ReadDir(fs, archiveDir(dir))
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil // No checkpoints exist
+			return nil, nil
 		}
-		return fmt.Errorf("failed to read checkpoint directory: %v", err)
+		return nil, err
 	}
 
-	var latestTs int64
-	var latestFile string
+	var paths []string
 	for _, f := range files {
-		if f.IsDir() {
-			continue
+		if _, ok := segmentFirstLSN(f.Name()); ok && !f.IsDir() {
+			paths = append(paths, filepath.Join(archiveDir(dir), f.Name()))
 		}
+	}
+	// zero padded names sort in LSN order
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// listSnapshots returns the snapshots in the checkpoint directory, oldest first
+func listSnapshots(fs af.Fs, dir string) ([]snapshotInfo, error) {
+	files, err := af.ReadDir(fs, checkpointDir(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // No checkpoints exist
+		}
+		return nil, fmt.Errorf("failed to read checkpoint directory: %v", err)
+	}
+
+	var snaps []snapshotInfo
+	for _, f := range files {
 		name := f.Name()
-		if len(name) < 13 || name[len(name)-5:] != ".snap" { // "000000000.snap"
+		if f.IsDir() || !strings.HasSuffix(name, ".snap") {
 			continue
 		}
-		ts, err := strconv.ParseInt(name[:len(name)-5], 10, 64)
+		ts, err := strconv.ParseInt(strings.TrimSuffix(name, ".snap"), 10, 64)
 		if err != nil {
 			continue
 		}
-		if ts > latestTs {
-			latestTs = ts
-			latestFile = filepath.Join(checkpointDir, name)
-		}
+		snaps = append(snaps, snapshotInfo{Path: filepath.Join(checkpointDir(dir), name), Ts: ts})
 	}
 
-	if latestFile == "" {
-		return nil // No valid checkpoints found
+	sort.Slice(snaps, func(a, b int) bool { return snaps[a].Ts < snaps[b].Ts })
+	return snaps, nil
+}
+
+// decodes and checks the header line of a snapshot
+func decodeSnapshotHeader(dec *json.Decoder) (*snapshotHeader, error) {
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint header: %v", err)
 	}
+	if header.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported checkpoint version %d", header.Version)
+	}
+	return &header, nil
+}
 
-	// Read checkpoint file
-	f, err := i.FileSystem.Open(latestFile)
+// readSnapshotHeader reads only the header of a snapshot
+func readSnapshotHeader(fs af.Fs, path string) (*snapshotHeader, error) {
+	f, err := fs.Open(path)
 	if err != nil {
-		return fmt.Errorf("failed to open checkpoint file: %v", err)
+		return nil, fmt.Errorf("failed to open checkpoint file: %v", err)
 	}
 	defer f.Close()
+	return decodeSnapshotHeader(json.NewDecoder(bufio.NewReader(f)))
+}
 
-	var meta checkpointMeta
-	decoder := json.NewDecoder(f)
-	if err := decoder.Decode(&meta); err != nil {
-		return fmt.Errorf("failed to decode checkpoint metadata: %v", err)
+// readSnapshot streams the documents of a snapshot to fn and returns its
+// header and trailer, it fails if the snapshot is malformed or truncated
+func readSnapshot(fs af.Fs, path string, fn func(e snapshotEntry) error) (*snapshotHeader, *snapshotEntry, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open checkpoint file: %v", err)
 	}
+	defer f.Close()
 
-	// Clear current index
-	i.index = make(map[string]*File)
+	dec := json.NewDecoder(bufio.NewReader(f))
+	header, err := decodeSnapshotHeader(dec)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	// Restore files from checkpoint
-	for key, content := range meta.Keys {
-		file := &File{FileName: key}
-		if err := file.ReplaceContent(content); err != nil {
-			log.Warn("checkpoint: failed to restore key %s: %v", key, err)
-			continue
+	count := 0
+	for {
+		var e snapshotEntry
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF {
+				return nil, nil, fmt.Errorf("checkpoint %s is incomplete", filepath.Base(path))
+			}
+			return nil, nil, fmt.Errorf("failed to decode checkpoint entry: %v", err)
+		}
+		if e.End {
+			if e.Count != count {
+				return nil, nil, fmt.Errorf("checkpoint %s holds %d documents, trailer says %d", filepath.Base(path), count, e.Count)
+			}
+			return header, &e, nil
+		}
+		if err := fn(e); err != nil {
+			return nil, nil, err
 		}
-		i.index[key] = file
+		count++
 	}
+}
 
-	// Return the WAL offset where we need to resume replay
-	if i.wal != nil {
-		i.wal.lastCheckpointOffset = meta.WalOffset
+// recovery stages reported to recoveryHook
+const (
+	stageRestoreDoc  = "restore-doc"  // after each document restored from a snapshot
+	stageRestoreDone = "restore-done" // after the snapshot has been applied
+	stageReplayEntry = "replay-entry" // after each WAL record applied
+	stageReplayDone  = "replay-done"  // after the WAL has been replayed
+)
+
+// recoveryHook is called at each stage of startup recovery, tests use it to
+// kill the process part way through
+var recoveryHook = func(stage string) {}
+
+// RestoreFromCheckpoint brings the documents on disk up to at least the state
+// of the latest valid checkpoint, only documents that are missing, torn or
+// older than their snapshot copy are written, newer documents and keys that
+// aren't in the snapshot are left alone for WAL replay to settle
+func (i *FileIndex) RestoreFromCheckpoint() error {
+	i.lock()
+	defer i.mu.Unlock()
+
+	snaps, err := listSnapshots(i.FileSystem, i.dir)
+	if err != nil {
+		return err
+	}
+
+	// newest first, falling back to older snapshots if one doesn't verify
+	for n := len(snaps) - 1; n >= 0; n-- {
+		path := snaps[n].Path
+		if _, _, err := verifySnapshot(i.FileSystem, path); err != nil {
+			log.Warn("checkpoint: skipping %s: %v", filepath.Base(path), err)
+			continue
+		}
+
+		total, restored := 0, 0
+		header, _, err := readSnapshot(i.FileSystem, path, func(e snapshotEntry) error {
+			total++
+			file, ok := i.index[e.Key]
+			if !ok {
+				file = i.newFile(e.Key)
+			}
+
+			wrote, err := file.restoreFromSnapshot(e.Body, e.Meta)
+			if err != nil {
+				return fmt.Errorf("failed to restore key %s: %v", e.Key, err)
+			}
+			if wrote {
+				restored++
+				recoveryHook(stageRestoreDoc)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// disk now holds the snapshot keys plus anything written after it
+		i.index = i.buildIndexMap()
+		// WAL replay resumes after the redo point
+		i.checkpointLSN = header.LSN
+		log.Info("checkpoint: restored %d of %d documents from %s", restored, total, filepath.Base(path))
+		recoveryHook(stageRestoreDone)
+		return nil
 	}
 
 	return nil
 }
+
+// verifySnapshot reads a whole snapshot and checks every document against
+// its stored checksum, nothing is applied from a snapshot that fails
+func verifySnapshot(fs af.Fs, path string) (*snapshotHeader, *snapshotEntry, error) {
+	return readSnapshot(fs, path, func(e snapshotEntry) error {
+		if e.Meta != nil && e.Meta.Checksum != calculateChecksum([]byte(e.Body)) {
+			return fmt.Errorf("checksum mismatch for key %s", e.Key)
+		}
+		return nil
+	})
+}
+
+// LatestCheckpoint returns the path of the newest checkpoint snapshot,
+// empty if none was taken yet
+func (i *FileIndex) LatestCheckpoint() (string, error) {
+	snaps, err := listSnapshots(i.FileSystem, i.dir)
+	if err != nil || len(snaps) == 0 {
+		return "", err
+	}
+	return snaps[len(snaps)-1].Path, nil
+}
+
+// InstallCheckpoint replaces every document with the contents of a snapshot
+// read from r, as written by CreateCheckpoint on another node. The snapshot
+// is verified before anything is applied, documents are then written through
+// the WAL like any other write. Returns the number of documents installed
+func (i *FileIndex) InstallCheckpoint(r io.Reader) (int, error) {
+	dir := checkpointDir(i.dir)
+	if err := i.FileSystem.MkdirAll(dir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create checkpoint directory: %v", err)
+	}
+	tmpName := filepath.Join(dir, fmt.Sprintf("install-%d.snap.tmp", time.Now().UnixNano()))
+	defer i.FileSystem.Remove(tmpName)
+
+	f, err := i.FileSystem.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create checkpoint file: %v", err)
+	}
+	_, err = io.Copy(f, r)
+	f.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to receive checkpoint: %v", err)
+	}
+	if _, _, err := verifySnapshot(i.FileSystem, tmpName); err != nil {
+		return 0, err
+	}
+
+	keep := map[string]bool{}
+	_, _, err = readSnapshot(i.FileSystem, tmpName, func(e snapshotEntry) error {
+		keep[e.Key] = true
+		file, _ := i.Lookup(e.Key)
+		if err := i.Put(file, []byte(e.Body)); err != nil {
+			return fmt.Errorf("failed to install key %s: %v", e.Key, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// keys the snapshot doesn't know about were deleted on the other node
+	for _, key := range i.ListKeys() {
+		if keep[key] {
+			continue
+		}
+		if file, ok := i.Lookup(key); ok {
+			if err := i.Delete(file); err != nil && !os.IsNotExist(err) {
+				return 0, fmt.Errorf("failed to remove key %s: %v", key, err)
+			}
+		}
+	}
+	return len(keep), nil
+}
@@ -0,0 +1,229 @@
+// provides tests for checkpoint creation, retention and restore
+package index
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// simulates a restart: a fresh index over the same filesystem that restores
+// the latest checkpoint and replays the WAL like sh.Setup does
+func reopen(t *testing.T) {
+	t.Helper()
+
+	fs := I.FileSystem
+	if I.wal != nil {
+		I.wal.Close()
+	}
+	I = NewFileIndex("")
+	I.SetFileSystem(fs)
+
+	assertNilErr(t, I.RestoreFromCheckpoint())
+	assertNilErr(t, I.InitWAL(DurabilityNone))
+	assertNilErr(t, I.WALReplay())
+	I.Regenerate()
+}
+
+// returns the names of files in the checkpoint directory
+func checkpointFiles(t *testing.T) []string {
+	t.Helper()
+
+	files, err := af.ReadDir(I.FileSystem, checkpointDir(""))
+	assertNilErr(t, err)
+
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	return names
+}
+
+// verifies checkpoint creation and recovery on top of it
+func TestCreateCheckpoint(t *testing.T) {
+	// Test Case 1: snapshot holds documents and replaces sealed WAL segments
+	t.Run("checkpoint then recover with later writes", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.Put(&File{FileName: "b"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.CreateCheckpoint())
+
+		// only the fresh active segment is left
+		segments, err := walSegments(I.FileSystem, "")
+		assertNilErr(t, err)
+		checkDeepEquals(t, segments, []string{filepath.Join(".smoldb", "wal.log")})
+
+		// writes after the checkpoint live in the WAL only
+		b, _ := I.Lookup("b")
+		assertNilErr(t, I.PatchField(b, "v", 2))
+		assertNilErr(t, I.Put(&File{FileName: "c"}, []byte(`{"v":1}`)))
+		a, _ := I.Lookup("a")
+		assertNilErr(t, I.Delete(a))
+		lsn := I.LastLSN()
+
+		// lose every document, recovery must rebuild them
+		forgetDocuments("a", "b", "c")
+		reopen(t)
+
+		assertFileDoesNotExist(t, "a")
+		checkContentEqual(t, "b", map[string]interface{}{"v": 2})
+		checkContentEqual(t, "c", map[string]interface{}{"v": 1})
+		checkDeepEquals(t, I.LastLSN(), lsn)
+	})
+
+	// Test Case 2: LSNs keep increasing after the WAL was emptied
+	t.Run("lsn continues after checkpoint", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{}`)))
+		assertNilErr(t, I.CreateCheckpoint())
+		before := I.LastLSN()
+
+		reopen(t)
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":2}`)))
+		assert.Greater(t, I.LastLSN(), before)
+	})
+
+	// Test Case 3: writers keep going while a checkpoint runs
+	t.Run("checkpoint with concurrent writers", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		for n := 0; n < 50; n++ {
+			assertNilErr(t, I.Put(&File{FileName: fmt.Sprintf("k%d", n)}, []byte(`{"round":0}`)))
+		}
+
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for n := w; n < 50; n += 4 {
+					body := fmt.Sprintf(`{"round":%d}`, n)
+					assertNilErr(t, I.Put(&File{FileName: fmt.Sprintf("k%d", n)}, []byte(body)))
+				}
+			}(w)
+		}
+		assertNilErr(t, I.CreateCheckpoint())
+		wg.Wait()
+
+		keys := I.ListKeys()
+		checkDeepEquals(t, len(keys), 50)
+		forgetDocuments(keys...)
+		reopen(t)
+
+		for n := 0; n < 50; n++ {
+			checkContentEqual(t, fmt.Sprintf("k%d", n), map[string]interface{}{"round": n})
+		}
+	})
+}
+
+// verifies snapshot retention and handling of unfinished snapshots
+func TestCheckpointRetention(t *testing.T) {
+	// Test Case 1: only the newest snapshots are kept
+	t.Run("keep last n snapshots", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		I.SetSnapshotRetention(2)
+
+		for n := 0; n < 4; n++ {
+			assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(fmt.Sprintf(`{"v":%d}`, n))))
+			assertNilErr(t, I.CreateCheckpoint())
+		}
+
+		snaps, err := listSnapshots(I.FileSystem, "")
+		assertNilErr(t, err)
+		checkDeepEquals(t, len(snaps), 2)
+	})
+
+	// Test Case 2: a truncated snapshot is skipped in favour of an older one
+	t.Run("truncated snapshot falls back", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.CreateCheckpoint())
+
+		// a newer snapshot that lost its trailer
+		broken := filepath.Join(checkpointDir(""), "9999999999999999999.snap")
+		makeNewFile(broken, `{"version":2,"lsn":99,"ts":1}`+"\n"+`{"key":"a","body":"{}"}`+"\n")
+		// and a leftover of a checkpoint that never finished
+		makeNewFile(filepath.Join(checkpointDir(""), "1.snap.tmp"), "partial")
+
+		forgetDocuments("a")
+		reopen(t)
+		checkContentEqual(t, "a", map[string]interface{}{"v": 1})
+
+		// the next checkpoint cleans up the unfinished one
+		assertNilErr(t, I.CreateCheckpoint())
+		for _, name := range checkpointFiles(t) {
+			assert.False(t, strings.HasSuffix(name, ".tmp"), "found leftover %s", name)
+		}
+	})
+}
+
+// verifies that a checkpoint of one index can replace the documents of another
+func TestInstallCheckpoint(t *testing.T) {
+	// builds a second index with its own filesystem and returns its latest checkpoint
+	source := func(t *testing.T) []byte {
+		t.Helper()
+		other := NewFileIndex("")
+		other.SetFileSystem(af.NewMemMapFs())
+		assertNilErr(t, other.InitWAL(DurabilityNone))
+		assertNilErr(t, other.Put(other.newFile("a"), []byte(`{"v":1}`)))
+		assertNilErr(t, other.Put(other.newFile("b"), []byte(`{"v":1}`)))
+		assertNilErr(t, other.CreateCheckpoint())
+
+		path, err := other.LatestCheckpoint()
+		assertNilErr(t, err)
+		data, err := af.ReadFile(other.FileSystem, path)
+		assertNilErr(t, err)
+		return data
+	}
+
+	// Test Case 1: documents are replaced and survive a restart
+	t.Run("install snapshot", func(t *testing.T) {
+		data := source(t)
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		assertNilErr(t, I.Put(&File{FileName: "b"}, []byte(`{"v":2}`)))
+		assertNilErr(t, I.Put(&File{FileName: "c"}, []byte(`{"v":2}`)))
+
+		count, err := I.InstallCheckpoint(strings.NewReader(string(data)))
+		assertNilErr(t, err)
+		checkDeepEquals(t, count, 2)
+		checkContentEqual(t, "a", map[string]interface{}{"v": 1})
+		checkContentEqual(t, "b", map[string]interface{}{"v": 1})
+		checkKeyNotInIndex(t, "c")
+
+		// the install went through the WAL, not the checkpoint directory
+		path, err := I.LatestCheckpoint()
+		assertNilErr(t, err)
+		checkDeepEquals(t, path, "")
+		reopen(t)
+		checkContentEqual(t, "b", map[string]interface{}{"v": 1})
+		checkKeyNotInIndex(t, "c")
+	})
+
+	// Test Case 2: a damaged snapshot changes nothing
+	t.Run("truncated snapshot", func(t *testing.T) {
+		data := source(t)
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		assertNilErr(t, I.Put(&File{FileName: "c"}, []byte(`{"v":2}`)))
+
+		_, err := I.InstallCheckpoint(strings.NewReader(string(data[:len(data)-10])))
+		assertErr(t, err)
+		checkContentEqual(t, "c", map[string]interface{}{"v": 2})
+		checkKeyNotInIndex(t, "a")
+		checkDeepEquals(t, len(checkpointFiles(t)), 0)
+	})
+}
@@ -3,6 +3,7 @@ package index
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/cespare/xxhash/v2"
 	af "github.com/spf13/afero"
@@ -10,9 +11,10 @@ import (
 
 // MetaData represents the metadata stored alongside each JSON file
 type MetaData struct {
-	Checksum string `json:"checksum"` // xxHash checksum of the JSON content
-	Created  string `json:"created"`  // ISO timestamp when file was created
-	Modified string `json:"modified"` // ISO timestamp of last modification
+	Checksum string `json:"checksum"`      // xxHash checksum of the JSON content
+	Created  string `json:"created"`       // ISO timestamp when file was created
+	Modified string `json:"modified"`      // ISO timestamp of last modification
+	LSN      uint64 `json:"lsn,omitempty"` // LSN of the WAL record that last wrote the file
 }
 
 // calculateChecksum computes the xxHash checksum of the given bytes
@@ -21,18 +23,15 @@ func calculateChecksum(data []byte) string {
 	return fmt.Sprintf("%016x", hash)
 }
 
-// writeMetadata stores the metadata for a file
-func (f *File) writeMetadata(meta *MetaData) error {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-
+// storeMetadata writes the metadata file, callers must hold f.mu
+func (f *File) storeMetadata(meta *MetaData) error {
 	bytes, err := json.Marshal(meta)
 	if err != nil {
 		return fmt.Errorf("failed to marshal metadata: %v", err)
 	}
 
 	metaPath := f.resolveMetaPath()
-	err = af.WriteFile(I.FileSystem, metaPath, bytes, 0644)
+	err = af.WriteFile(f.owner().FileSystem, metaPath, bytes, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to write metadata file: %v", err)
 	}
@@ -45,8 +44,13 @@ func (f *File) readMetadata() (*MetaData, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
+	return f.loadMetadata()
+}
+
+// loadMetadata reads the metadata file, callers must hold f.mu
+func (f *File) loadMetadata() (*MetaData, error) {
 	metaPath := f.resolveMetaPath()
-	bytes, err := af.ReadFile(I.FileSystem, metaPath)
+	bytes, err := af.ReadFile(f.owner().FileSystem, metaPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read metadata file: %v", err)
 	}
@@ -60,6 +64,89 @@ func (f *File) readMetadata() (*MetaData, error) {
 	return &meta, nil
 }
 
+// returns the checksum recorded for the document, computed from its
+// content when it has no metadata, empty when it doesn't exist. Callers
+// must hold f.mu
+func (f *File) checksumLocked() string {
+	fs, path := f.owner().FileSystem, f.ResolvePath()
+	if _, err := fs.Stat(path); err != nil {
+		return ""
+	}
+	if meta, err := f.loadMetadata(); err == nil {
+		return meta.Checksum
+	}
+	body, err := af.ReadFile(fs, path)
+	if err != nil {
+		return ""
+	}
+	return calculateChecksum(body)
+}
+
+// readWithMetadata reads the content and metadata of the file as one
+// consistent pair, meta is nil when the file has no metadata
+func (f *File) readWithMetadata() ([]byte, *MetaData, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	bytes, err := af.ReadFile(f.owner().FileSystem, f.ResolvePath())
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, _ := f.loadMetadata()
+	return bytes, meta, nil
+}
+
+// appliedLSN returns the LSN recorded in the file's metadata, 0 when the
+// file or its metadata is missing or the content doesn't match the checksum
+func (f *File) appliedLSN() uint64 {
+	body, meta, err := f.readWithMetadata()
+	if err != nil || meta == nil || meta.Checksum != calculateChecksum(body) {
+		return 0
+	}
+	return meta.LSN
+}
+
+// restoreFromSnapshot writes the snapshot copy of the document unless the
+// copy on disk is intact and not older, see snapshotNewer. Snapshot
+// metadata is kept so timestamps and LSN survive, reports whether anything
+// was written
+func (f *File) restoreFromSnapshot(body string, meta *MetaData) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if current, err := af.ReadFile(f.owner().FileSystem, f.ResolvePath()); err == nil {
+		if existing, err := f.loadMetadata(); err == nil && existing.Checksum == calculateChecksum(current) {
+			if meta == nil || existing.Checksum == meta.Checksum || !snapshotNewer(meta, existing) {
+				return false, nil
+			}
+		}
+	}
+
+	if err := af.WriteFile(f.owner().FileSystem, f.ResolvePath(), []byte(body), 0644); err != nil {
+		return false, err
+	}
+	if meta == nil {
+		now := time.Now().UTC().Format(time.RFC3339)
+		meta = &MetaData{Checksum: calculateChecksum([]byte(body)), Created: now, Modified: now}
+	}
+	if err := f.storeMetadata(meta); err != nil {
+		return false, fmt.Errorf("failed to update metadata: %v", err)
+	}
+	return true, nil
+}
+
+// reports whether the snapshot copy described by meta is newer than the one
+// on disk, by LSN when both have one and by modification time otherwise, as
+// writes made without a WAL carry no LSN
+func snapshotNewer(meta *MetaData, existing *MetaData) bool {
+	if meta.LSN != 0 && existing.LSN != 0 {
+		return meta.LSN > existing.LSN
+	}
+	snapshot, _ := time.Parse(time.RFC3339, meta.Modified)
+	current, _ := time.Parse(time.RFC3339, existing.Modified)
+	return snapshot.After(current)
+}
+
 // resolveMetaPath returns the path to the metadata file
 func (f *File) resolveMetaPath() string {
 	return f.ResolvePath() + ".meta"
@@ -87,17 +174,42 @@ func (f *File) ValidateChecksum() error {
 
 // RepairChecksum updates the stored checksum to match the current file content
 func (f *File) RepairChecksum() error {
-	bytes, err := f.GetByteArray()
+	_, err := f.RepairChecksumChange()
+	return err
+}
+
+// RepairChecksumChange is RepairChecksum that also returns the change it
+// made, read and written under the file's lock
+func (f *File) RepairChecksumChange() (Change, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bytes, err := af.ReadFile(f.owner().FileSystem, f.ResolvePath())
 	if err != nil {
-		return fmt.Errorf("failed to read file content: %v", err)
+		return Change{}, fmt.Errorf("failed to read file content: %v", err)
 	}
+	change := Change{Key: f.FileName, Before: f.checksumLocked(), After: calculateChecksum(bytes)}
 
-	meta, err := f.readMetadata()
+	meta, err := f.loadMetadata()
 	if err != nil {
 		// If metadata doesn't exist, create a new one
 		meta = &MetaData{}
 	}
 
-	meta.Checksum = calculateChecksum(bytes)
-	return f.writeMetadata(meta)
+	meta.Checksum = change.After
+	return change, f.storeMetadata(meta)
+}
+
+// Checksum returns the checksum recorded for the document key, computed
+// from its content when it has no metadata, empty when it doesn't exist
+func (r *Router) Checksum(key string) string {
+	file, ok := r.Lookup(key)
+	if !ok {
+		return ""
+	}
+	entry, err := file.merkleEntry()
+	if err != nil {
+		return ""
+	}
+	return entry.Checksum
 }
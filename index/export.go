@@ -0,0 +1,248 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// conflict modes of an import, what happens to a document whose key exists
+const (
+	ImportSkip      = "skip"      // the existing document is kept
+	ImportOverwrite = "overwrite" // the imported document replaces it
+	ImportFail      = "fail"      // the import stops
+)
+
+// DefaultImportBatch is how many documents an import writes per batch
+const DefaultImportBatch = 100
+
+// maxImportLine caps a single line of an import
+const maxImportLine = 64 << 20
+
+// maxImportErrors caps the problems a dry run reports, the others are only
+// counted
+const maxImportErrors = 100
+
+// ErrImportConflict is returned by an import in fail mode for a key that
+// already exists
+var ErrImportConflict = errors.New("key already exists")
+
+// ExportRecord is a line of an export, Meta is informational and ignored
+// by imports, which write fresh metadata
+type ExportRecord struct {
+	Key  string          `json:"key"`
+	Doc  json.RawMessage `json:"doc"`
+	Meta *MetaData       `json:"meta,omitempty"`
+}
+
+// ExportStats describes what Export wrote
+type ExportStats struct {
+	Exported int
+	Skipped  int // documents that couldn't be read or aren't valid JSON
+}
+
+// ImportOptions configures an import
+type ImportOptions struct {
+	Conflict  string                    // ImportSkip when empty
+	BatchSize int                       // DefaultImportBatch when 0
+	DryRun    bool                      // validate every line but write nothing
+	Allow     func(key string) error    // refuses a key with an error, nil allows every key
+	Apply     func(ops []BatchOp) error // writes a batch, Router.Batch when nil
+	Progress  func(stats ImportStats)   // called after every batch
+}
+
+// ImportStats describes what Import wrote, or would have with DryRun
+type ImportStats struct {
+	Lines    int // lines read, blank ones included
+	Imported int
+	Skipped  int // documents whose key existed, kept as they were
+	Failed   int // invalid or conflicting lines, only a dry run counts past one
+	Batches  int
+	Errors   []*ImportError // the first problems found
+}
+
+// ImportError is a line an import can't take
+type ImportError struct {
+	Line int
+	Key  string
+	Err  error
+}
+
+func (e *ImportError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: key '%s': %v", e.Line, e.Key, e.Err)
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// ValidKey reports whether key can name a document. Keys are file names so
+// they can't be empty, a path element or contain a path separator
+func ValidKey(key string) bool {
+	return key != "" && key != "." && key != ".." && !strings.ContainsAny(key, "/\\\x00")
+}
+
+// Export writes the documents whose keys start with prefix as NDJSON, one
+// ExportRecord per line ordered by key. allow filters the keys, nil exports
+// every one. Documents that can't be read or aren't valid JSON are skipped
+// with a warning
+func (r *Router) Export(w io.Writer, prefix string, allow func(key string) bool) (*ExportStats, error) {
+	var keys []string
+	for _, key := range r.ListKeys() {
+		if strings.HasPrefix(key, prefix) && (allow == nil || allow(key)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	stats := &ExportStats{}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, key := range keys {
+		body, meta, ok, err := r.Document(key)
+		if !ok && err == nil {
+			// deleted since it was listed
+			continue
+		}
+		if err == nil && !json.Valid(body) {
+			err = fmt.Errorf("content is not valid json")
+		}
+		if err != nil {
+			log.Warn("export: skipping key '%s': %s", key, err.Error())
+			stats.Skipped++
+			continue
+		}
+		// the encoder compacts the document so it fits on one line
+		if err := enc.Encode(ExportRecord{Key: key, Doc: body, Meta: meta}); err != nil {
+			return stats, err
+		}
+		stats.Exported++
+	}
+	return stats, nil
+}
+
+// Import reads NDJSON lines of ExportRecords from rd and writes their
+// documents in batches, keys that exist are handled by the conflict mode
+// and a key repeated in rd conflicts with its earlier line. An import stops
+// at the first line it can't take with an ImportError, batches written
+// before it stay written. A dry run reads every line and reports the
+// problems in the stats instead
+func (r *Router) Import(rd io.Reader, opts ImportOptions) (*ImportStats, error) {
+	switch opts.Conflict {
+	case "":
+		opts.Conflict = ImportSkip
+	case ImportSkip, ImportOverwrite, ImportFail:
+	default:
+		return nil, fmt.Errorf("unknown conflict mode '%s', expected skip, overwrite or fail", opts.Conflict)
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultImportBatch
+	}
+	if opts.Apply == nil {
+		opts.Apply = func(ops []BatchOp) error { return r.Batch(ops, false) }
+	}
+
+	stats := &ImportStats{}
+	seen := map[string]bool{}
+	var batch []BatchOp
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if !opts.DryRun {
+			if err := opts.Apply(batch); err != nil {
+				return err
+			}
+		}
+		stats.Imported += len(batch)
+		stats.Batches++
+		batch = nil
+		if opts.Progress != nil {
+			opts.Progress(*stats)
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLine)
+	for scanner.Scan() {
+		stats.Lines++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		op, skip, err := r.importLine(line, opts, seen)
+		if err != nil {
+			err.Line = stats.Lines
+			stats.Failed++
+			if len(stats.Errors) < maxImportErrors {
+				stats.Errors = append(stats.Errors, err)
+			}
+			if opts.DryRun {
+				continue
+			}
+			return stats, err
+		}
+		if skip {
+			stats.Skipped++
+			continue
+		}
+		if batch = append(batch, op); len(batch) >= opts.BatchSize {
+			if err := flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, fmt.Errorf("failed to read line %d: %v", stats.Lines+1, err)
+	}
+	return stats, flush()
+}
+
+// decodes and checks a line of an import, returns the write it asks for or
+// whether its document is skipped
+func (r *Router) importLine(line []byte, opts ImportOptions, seen map[string]bool) (BatchOp, bool, *ImportError) {
+	var rec ExportRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return BatchOp{}, false, &ImportError{Err: fmt.Errorf("invalid json: %v", err)}
+	}
+	fail := func(err error) (BatchOp, bool, *ImportError) {
+		return BatchOp{}, false, &ImportError{Key: rec.Key, Err: err}
+	}
+	if !ValidKey(rec.Key) {
+		return fail(fmt.Errorf("invalid key"))
+	}
+	if len(rec.Doc) == 0 || rec.Doc[0] != '{' {
+		return fail(fmt.Errorf("document is not a json object"))
+	}
+	if opts.Allow != nil {
+		if err := opts.Allow(rec.Key); err != nil {
+			return fail(err)
+		}
+	}
+
+	exists := seen[rec.Key]
+	if !exists {
+		_, exists = r.Lookup(rec.Key)
+	}
+	seen[rec.Key] = true
+	if exists {
+		switch opts.Conflict {
+		case ImportSkip:
+			return BatchOp{}, true, nil
+		case ImportFail:
+			return fail(ErrImportConflict)
+		}
+	}
+	return BatchOp{Op: BatchPut, Key: rec.Key, Body: string(rec.Doc)}, false, nil
+}
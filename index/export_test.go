@@ -0,0 +1,145 @@
+// provides tests for NDJSON exports and imports
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// returns the content of key on R
+func documentOf(t *testing.T, key string) string {
+	t.Helper()
+	body, _, ok, err := R.Document(key)
+	assertNilErr(t, err)
+	assert.True(t, ok, "key '%s' missing", key)
+	return string(body)
+}
+
+func TestExport(t *testing.T) {
+	// Test Case 1: the export of a prefix imports into another database as
+	// it was, one document per line
+	t.Run("round trip", func(t *testing.T) {
+		setupShards(t, 2)
+		for key, body := range map[string]string{
+			"user-1":  "{\n  \"name\": \"a\"\n}",
+			"user-2":  `{"name":"b","tags":["<x>"]}`,
+			"order-1": `{"total":3}`,
+		} {
+			file, _ := R.Lookup(key)
+			assertNilErr(t, R.Put(file, []byte(body)))
+		}
+
+		var out bytes.Buffer
+		stats, err := R.Export(&out, "user-", nil)
+		assertNilErr(t, err)
+		assert.Equal(t, 2, stats.Exported)
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		assert.Len(t, lines, 2)
+		var rec ExportRecord
+		assertNilErr(t, json.Unmarshal([]byte(lines[0]), &rec))
+		assert.Equal(t, "user-1", rec.Key)
+		assert.JSONEq(t, `{"name":"a"}`, string(rec.Doc))
+		assert.NotEmpty(t, rec.Meta.Checksum)
+
+		var filtered bytes.Buffer
+		stats, err = R.Export(&filtered, "", func(key string) bool { return key != "user-1" })
+		assertNilErr(t, err)
+		assert.Equal(t, 2, stats.Exported)
+		assert.NotContains(t, filtered.String(), `"user-1"`)
+
+		setupShards(t, 3)
+		var progress []int
+		imported, err := R.Import(&out, ImportOptions{BatchSize: 1, Progress: func(s ImportStats) {
+			progress = append(progress, s.Imported)
+		}})
+		assertNilErr(t, err)
+		assert.Equal(t, 2, imported.Imported)
+		assert.Equal(t, []int{1, 2}, progress)
+		assert.JSONEq(t, `{"name":"a"}`, documentOf(t, "user-1"))
+		assert.JSONEq(t, `{"name":"b","tags":["<x>"]}`, documentOf(t, "user-2"))
+		_, ok := R.Lookup("order-1")
+		assert.False(t, ok)
+	})
+
+	// Test Case 2: keys that exist, or appeared earlier in the import, are
+	// skipped, overwritten or stop the import
+	t.Run("conflicts", func(t *testing.T) {
+		input := `{"key":"b","doc":{"v":1}}
+{"key":"a","doc":{"v":1}}
+{"key":"b","doc":{"v":2}}
+`
+		reset := func() {
+			setupShards(t, 1)
+			file, _ := R.Lookup("a")
+			assertNilErr(t, R.Put(file, []byte(`{"v":0}`)))
+		}
+
+		reset()
+		stats, err := R.Import(strings.NewReader(input), ImportOptions{})
+		assertNilErr(t, err)
+		assert.Equal(t, 1, stats.Imported)
+		assert.Equal(t, 2, stats.Skipped)
+		assert.JSONEq(t, `{"v":0}`, documentOf(t, "a"))
+		assert.JSONEq(t, `{"v":1}`, documentOf(t, "b"))
+
+		reset()
+		stats, err = R.Import(strings.NewReader(input), ImportOptions{Conflict: ImportOverwrite})
+		assertNilErr(t, err)
+		assert.Equal(t, 3, stats.Imported)
+		assert.JSONEq(t, `{"v":1}`, documentOf(t, "a"))
+		assert.JSONEq(t, `{"v":2}`, documentOf(t, "b"))
+
+		// batches before the conflict stay written
+		reset()
+		stats, err = R.Import(strings.NewReader(input), ImportOptions{Conflict: ImportFail, BatchSize: 1})
+		assert.ErrorIs(t, err, ErrImportConflict)
+		var lineErr *ImportError
+		assert.True(t, errors.As(err, &lineErr))
+		assert.Equal(t, 2, lineErr.Line)
+		assert.Equal(t, "a", lineErr.Key)
+		assert.Equal(t, 1, stats.Imported)
+		assert.JSONEq(t, `{"v":0}`, documentOf(t, "a"))
+
+		_, err = R.Import(strings.NewReader(input), ImportOptions{Conflict: "merge"})
+		assert.Error(t, err)
+	})
+
+	// Test Case 3: a dry run reports every line it can't take and writes
+	// nothing, an import stops at the first one
+	t.Run("dry run", func(t *testing.T) {
+		setupShards(t, 1)
+		input := `not json
+{"key":"../x","doc":{}}
+{"key":"c","doc":[1]}
+
+{"key":"c","doc":{"v":1}}
+`
+		stats, err := R.Import(strings.NewReader(input), ImportOptions{DryRun: true})
+		assertNilErr(t, err)
+		assert.Equal(t, 5, stats.Lines)
+		assert.Equal(t, 1, stats.Imported)
+		assert.Equal(t, 3, stats.Failed)
+		var lines []int
+		for _, e := range stats.Errors {
+			lines = append(lines, e.Line)
+		}
+		assert.Equal(t, []int{1, 2, 3}, lines)
+		assert.Equal(t, 0, R.Len())
+
+		_, err = R.Import(strings.NewReader(input), ImportOptions{})
+		var lineErr *ImportError
+		assert.True(t, errors.As(err, &lineErr))
+		assert.Equal(t, 1, lineErr.Line)
+		assert.Equal(t, 0, R.Len())
+
+		// refused keys stop the import like invalid ones
+		refused := errors.New("refused")
+		_, err = R.Import(strings.NewReader(`{"key":"c","doc":{}}`), ImportOptions{Allow: func(string) error { return refused }})
+		assert.ErrorIs(t, err, refused)
+	})
+}
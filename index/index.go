@@ -3,8 +3,11 @@
 package index
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	af "github.com/spf13/afero"
@@ -15,6 +18,7 @@ import (
 type File struct {
 	FileName string       // name of the file without extension
 	mu       sync.RWMutex // mutex for thread-safe file operations
+	idx      *FileIndex   // index the file belongs to, the global index when nil
 }
 
 // the main index structure that manages all files in the database
@@ -25,11 +29,21 @@ type FileIndex struct {
 	FileSystem      af.Fs            // abstract filesystem interface for testing and flexibility
 	wal             *WAL             // write-ahead log for durability
 	durability      DurabilityLevel  // durability level for fsync behavior
-	checkpointTimer *time.Timer      // timer for periodic checkpoints
+	checkpointStop  chan struct{}    // stops periodic checkpoints when closed
+	checkpointMu    sync.Mutex       // serializes checkpoint creation
+	segmentPins     atomic.Int32     // readers of WAL segments, checkpoints don't archive them meanwhile
+	checkpointLSN   uint64           // redo point of the checkpoint restored at startup
+	retainSnapshots int              // number of snapshots kept, 0 keeps all
 	groupBatch      int              // fsync after this many appends when grouped
 	syncMode        SyncMode         // sync mode for WAL
+	walFormat       WALFormat        // record format for new WAL appends
+	walCompress     bool             // compress large WAL bodies (binary format only)
+	closed          bool             // set by Close, writes fail afterwards
 }
 
+// ErrClosed is returned for writes to a FileIndex after Close
+var ErrClosed = errors.New("index is closed")
+
 // global instance of FileIndex used throughout the application
 var I *FileIndex
 
@@ -51,6 +65,11 @@ func (i *FileIndex) InitWAL(level DurabilityLevel) error {
 		return err
 	}
 	i.wal = w
+	// records up to the restored checkpoint may have been dropped with their segments
+	if w.lsn < i.checkpointLSN {
+		w.lsn = i.checkpointLSN
+	}
+	i.applyWALFormat()
 	return nil
 }
 
@@ -63,6 +82,11 @@ func (i *FileIndex) InitWALWithOptions(level DurabilityLevel, groupCommitMs int,
 		return err
 	}
 	i.wal = w
+	// records up to the restored checkpoint may have been dropped with their segments
+	if w.lsn < i.checkpointLSN {
+		w.lsn = i.checkpointLSN
+	}
+	i.applyWALFormat()
 	return nil
 }
 
@@ -74,71 +98,280 @@ func (i *FileIndex) SetSyncMode(mode SyncMode) {
 	}
 }
 
+// SetWALFormat sets the record format used for new WAL appends, existing
+// records keep their format and are still understood by replay
+func (i *FileIndex) SetWALFormat(format WALFormat, compress bool) {
+	i.walFormat = format
+	i.walCompress = compress
+	i.applyWALFormat()
+}
+
+// pushes the configured record format down to an open WAL
+func (i *FileIndex) applyWALFormat() {
+	if i.wal == nil {
+		return
+	}
+	if i.walFormat != 0 {
+		i.wal.format = i.walFormat
+	}
+	i.wal.compress = i.walCompress
+}
+
 // allows injection of a different filesystem implementation,
-// primarily used for testing purposes
+// primarily used for testing purposes, entries pointing at the
+// previous filesystem are dropped from the index
 func (i *FileIndex) SetFileSystem(fs af.Fs) {
+	i.lock()
+	defer i.mu.Unlock()
+
 	i.FileSystem = fs
+	i.index = map[string]*File{}
 }
 
-// StartPeriodicCheckpoints starts a timer to create checkpoints periodically
+// StartPeriodicCheckpoints creates a checkpoint every interval until
+// StopPeriodicCheckpoints is called
 func (i *FileIndex) StartPeriodicCheckpoints(interval time.Duration) {
-	if i.checkpointTimer != nil {
-		i.checkpointTimer.Stop()
-	}
+	i.StopPeriodicCheckpoints()
 
-	i.checkpointTimer = time.NewTimer(interval)
+	stop := make(chan struct{})
+	i.checkpointStop = stop
 	go func() {
-		for range i.checkpointTimer.C {
-			if err := i.CreateCheckpoint(); err != nil {
-				log.Warn("failed to create periodic checkpoint: %v", err)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := i.CreateCheckpoint(); err != nil {
+					log.Warn("failed to create periodic checkpoint: %v", err)
+				}
+			case <-stop:
+				return
 			}
-			i.checkpointTimer.Reset(interval)
 		}
 	}()
 }
 
+// StopPeriodicCheckpoints stops checkpoints started by StartPeriodicCheckpoints
+func (i *FileIndex) StopPeriodicCheckpoints() {
+	if i.checkpointStop != nil {
+		close(i.checkpointStop)
+		i.checkpointStop = nil
+	}
+}
+
+// SetSnapshotRetention sets how many checkpoint snapshots are kept,
+// older ones are removed after each successful checkpoint, 0 keeps all
+func (i *FileIndex) SetSnapshotRetention(n int) {
+	i.retainSnapshots = n
+}
+
 // retrieves a File object from the index by its key,
 // returns the File and true if found, a new File and false if not found
 // thread-safe through read lock
 func (i *FileIndex) Lookup(key string) (*File, bool) {
-	i.mu.RLock()
+	i.rlock()
 	defer i.mu.RUnlock()
 
 	if file, ok := i.index[key]; ok {
 		return file, true
 	}
 
-	return &File{FileName: key}, false
+	return i.newFile(key), false
+}
+
+// returns a file of this index that isn't indexed yet
+func (i *FileIndex) newFile(key string) *File {
+	return &File{FileName: key, idx: i}
+}
+
+// adopts a file created outside the index, such as &File{FileName: key}
+func (i *FileIndex) own(file *File) *File {
+	if file.idx == nil {
+		file.idx = i
+	}
+	return file
+}
+
+// returns the index the file belongs to
+func (f *File) owner() *FileIndex {
+	if f.idx != nil {
+		return f.idx
+	}
+	return I
+}
+
+// errReindexed reports that the key of a locked file was deleted and
+// written again while waiting for its lock, the write starts over
+var errReindexed = errors.New("key was indexed again")
+
+// locks the file indexed under the key of file for writing, a key that
+// isn't indexed uses file. The index lock isn't held while waiting for the
+// file, so writes to other keys go on, callers check with current that the
+// key still has this file once they hold the index lock
+func (i *FileIndex) lockFile(file *File) *File {
+	i.lock()
+	f, ok := i.index[file.FileName]
+	if !ok {
+		f = i.own(file)
+	}
+	i.mu.Unlock()
+	f.mu.Lock()
+	return f
+}
+
+// checks that f is still the file of its key and the index is open,
+// callers must hold the index lock
+func (i *FileIndex) current(f *File) error {
+	if i.closed {
+		return ErrClosed
+	}
+	if cur, ok := i.index[f.FileName]; ok && cur != f {
+		return errReindexed
+	}
+	return nil
+}
+
+// locks the file of the key of file and then the index. Every write to a
+// key appends its WAL record and writes the document holding the key's
+// lock, so the log and the documents see a key's writes in the same order,
+// while the index lock is only held to append. Callers release both
+func (i *FileIndex) lockForWrite(file *File) (*File, error) {
+	for {
+		f := i.lockFile(file)
+		i.lock()
+		err := i.current(f)
+		if err == nil {
+			return f, nil
+		}
+		i.mu.Unlock()
+		f.mu.Unlock()
+		if err != errReindexed {
+			return nil, err
+		}
+	}
+}
+
+// Change describes a document changed by a write, Before and After are
+// its checksums around the write, empty where there was no document. Both
+// are read under the key's lock so they belong to that write alone
+type Change struct {
+	Key    string
+	Before string
+	After  string
 }
 
 // put adds or updates a file in the index with the provided content
-// thread-safe through write lock
+// thread-safe through the per-key lock
 func (i *FileIndex) Put(file *File, bytes []byte) error {
-	i.mu.Lock()
-	defer i.mu.Unlock()
+	return i.put(file, bytes, nil)
+}
+
+// PutChange is Put that also returns the change it made
+func (i *FileIndex) PutChange(file *File, bytes []byte) (Change, error) {
+	var c Change
+	err := i.put(file, bytes, &c)
+	return c, err
+}
+
+// writes a document, fills in change when it isn't nil
+func (i *FileIndex) put(file *File, bytes []byte, change *Change) error {
+	file, err := i.lockForWrite(file)
+	if err != nil {
+		return err
+	}
+	defer file.mu.Unlock()
+	if change != nil {
+		*change = Change{Key: file.FileName, Before: file.checksumLocked(), After: calculateChecksum(bytes)}
+	}
 
 	i.index[file.FileName] = file
 	// append to WAL before applying mutation
+	var lsn uint64
 	if i.wal != nil {
-		_ = i.wal.Append(walEntry{Op: opPut, Key: file.FileName, Body: string(bytes)})
+		lsn, _ = i.wal.Append(walEntry{Op: opPut, Key: file.FileName, Body: string(bytes)})
+	}
+	i.mu.Unlock()
+	return file.replaceContentLocked(string(bytes), lsn)
+}
+
+// PatchField sets a single top-level field of an existing document,
+// the per-key lock is held across the read and the write so concurrent
+// patches to different fields don't lose each other's updates, the index
+// lock only to append the WAL record
+func (i *FileIndex) PatchField(file *File, field string, value interface{}) error {
+	return i.patchField(file, field, value, nil)
+}
+
+// PatchFieldChange is PatchField that also returns the change it made
+func (i *FileIndex) PatchFieldChange(file *File, field string, value interface{}) (Change, error) {
+	var c Change
+	err := i.patchField(file, field, value, &c)
+	return c, err
+}
+
+// patches a document, fills in change when it isn't nil
+func (i *FileIndex) patchField(file *File, field string, value interface{}, change *Change) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode value for field '%s': %v", field, err)
+	}
+
+	for {
+		f := i.lockFile(file)
+		content, err := f.patchedContent(field, body)
+		if err != nil {
+			f.mu.Unlock()
+			return err
+		}
+
+		i.lock()
+		if err := i.current(f); err != nil {
+			i.mu.Unlock()
+			f.mu.Unlock()
+			if err == errReindexed {
+				continue
+			}
+			return err
+		}
+		if change != nil {
+			*change = Change{Key: f.FileName, Before: f.checksumLocked(), After: calculateChecksum(content)}
+		}
+		i.index[f.FileName] = f
+		// append only the changed field to WAL before applying mutation
+		var lsn uint64
+		if i.wal != nil {
+			lsn, _ = i.wal.Append(walEntry{Op: opPatch, Key: f.FileName, Field: field, Body: string(body)})
+		}
+		i.mu.Unlock()
+		err = f.replaceContentLocked(string(content), lsn)
+		f.mu.Unlock()
+		return err
 	}
-	err := file.ReplaceContent(string(bytes))
-	return err
 }
 
 // rebuilds the entire index by scanning the database directory
 // thread-safe through write lock
 func (i *FileIndex) Regenerate() {
-	i.mu.Lock()
+	i.lock()
 	defer i.mu.Unlock()
 
 	start := time.Now()
-	log.Info("building index for directory %s...", I.dir)
+	log.Info("building index for directory %s...", i.dir)
 
 	i.index = i.buildIndexMap()
 	log.Success("built index of %d files in %d ms", len(i.index), time.Since(start).Milliseconds())
 }
 
+// Refresh rebuilds the index from the directory without logging, read-only
+// processes call it periodically to see what the server writing the
+// database changed
+func (i *FileIndex) Refresh() {
+	fresh := i.buildIndexMap()
+	i.lock()
+	defer i.mu.Unlock()
+	i.index = fresh
+}
+
 // changes the database directory and regenerates the index,
 // used when switching to a different database directory
 func (i *FileIndex) RegenerateNew(dir string) {
@@ -150,30 +383,82 @@ func (i *FileIndex) RegenerateNew(dir string) {
 func (i *FileIndex) buildIndexMap() map[string]*File {
 	newIndexMap := make(map[string]*File)
 
-	files := crawlDirectory(i.dir)
+	files := crawlDirectory(i.FileSystem, i.dir)
 	for _, f := range files {
-		newIndexMap[f] = &File{FileName: f}
+		newIndexMap[f] = i.newFile(f)
 	}
 
 	return newIndexMap
 }
 
 // removes a file from both the filesystem and the index
-// thread-safe through write lock
+// thread-safe through the per-key lock
 func (i *FileIndex) Delete(file *File) error {
-	i.mu.Lock()
-	defer i.mu.Unlock()
+	return i.delete(file, nil)
+}
+
+// DeleteChange is Delete that also returns the change it made
+func (i *FileIndex) DeleteChange(file *File) (Change, error) {
+	var c Change
+	err := i.delete(file, &c)
+	return c, err
+}
+
+// deletes a document, fills in change when it isn't nil
+func (i *FileIndex) delete(file *File, change *Change) error {
+	file, err := i.lockForWrite(file)
+	if err != nil {
+		return err
+	}
+	defer file.mu.Unlock()
+	if change != nil {
+		*change = Change{Key: file.FileName, Before: file.checksumLocked()}
+	}
 
 	// append to WAL before applying mutation
 	if i.wal != nil {
-		_ = i.wal.Append(walEntry{Op: opDelete, Key: file.FileName})
+		_, _ = i.wal.Append(walEntry{Op: opDelete, Key: file.FileName})
+	}
+	i.mu.Unlock()
+	if err := file.deleteLocked(); err != nil {
+		return err
 	}
-	err := file.Delete()
-	if err == nil {
+	// the key stays indexed until its document is gone, so a write to it
+	// waits for the delete instead of racing it with a new file
+	i.lock()
+	if i.index[file.FileName] == file {
 		delete(i.index, file.FileName)
 	}
+	i.mu.Unlock()
+	return nil
+}
+
+// Close stops periodic checkpoints, waits for running writes and a running
+// checkpoint, then syncs and closes the WAL. Writes fail with ErrClosed
+// afterwards
+func (i *FileIndex) Close() error {
+	i.StopPeriodicCheckpoints()
+	i.checkpointMu.Lock()
+	defer i.checkpointMu.Unlock()
+	i.lock()
+	defer i.mu.Unlock()
+	if i.closed {
+		return nil
+	}
+	i.closed = true
+	return i.wal.Close()
+}
+
+// LastLSN returns the LSN of the most recent WAL append
+// thread-safe through read lock
+func (i *FileIndex) LastLSN() uint64 {
+	i.rlock()
+	defer i.mu.RUnlock()
 
-	return err
+	if i.wal == nil {
+		return i.checkpointLSN
+	}
+	return i.wal.LastLSN()
 }
 
 // WALAvailable reports whether WAL is initialized
@@ -186,15 +471,19 @@ func (i *FileIndex) WALReplay() error {
 	if i == nil || i.wal == nil {
 		return nil
 	}
-	i.mu.Lock()
+	i.lock()
 	defer i.mu.Unlock()
-	return i.wal.Replay(i)
+	if err := i.wal.Replay(i); err != nil {
+		return err
+	}
+	recoveryHook(stageReplayDone)
+	return nil
 }
 
 // returns a slice of all keys (filenames) in the index
 // thread-safe through read lock
 func (i *FileIndex) ListKeys() (res []string) {
-	i.mu.RLock()
+	i.rlock()
 	defer i.mu.RUnlock()
 
 	for k := range i.index {
@@ -204,14 +493,22 @@ func (i *FileIndex) ListKeys() (res []string) {
 	return res
 }
 
+// returns the number of keys in the index
+func (i *FileIndex) Len() int {
+	i.rlock()
+	defer i.mu.RUnlock()
+	return len(i.index)
+}
+
 // returns the full filesystem path for a file
 // handles both root directory and subdirectory cases
 func (f *File) ResolvePath() string {
-	if I.dir == "" {
+	dir := f.owner().dir
+	if dir == "" {
 		return fmt.Sprintf("%s.json", f.FileName)
 	}
 
-	return fmt.Sprintf("%s/%s.json", I.dir, f.FileName)
+	return fmt.Sprintf("%s/%s.json", dir, f.FileName)
 }
 
 // ReadContent reads and returns the content of the file
@@ -220,7 +517,7 @@ func (f *File) ReadContent() (string, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	bytes, err := af.ReadFile(I.FileSystem, f.ResolvePath())
+	bytes, err := af.ReadFile(f.owner().FileSystem, f.ResolvePath())
 	if err != nil {
 		return "", fmt.Errorf("failed to read file content: %v", err)
 	}
@@ -3,7 +3,10 @@ package index
 
 import (
 	"encoding/json"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -204,3 +207,102 @@ func TestFileIndex_Put(t *testing.T) {
 		checkContentEqual(t, key, newContent)
 	})
 }
+
+// tests the field patch functionality verifying that other fields are kept
+// and that concurrent patches to different fields don't lose updates
+func TestFileIndex_PatchField(t *testing.T) {
+	// Test Case 1: patching adds the field and keeps the rest
+	t.Run("patch keeps other fields", func(t *testing.T) {
+		setup()
+
+		file := makeNewJSON("patch", map[string]interface{}{"a": "b"})
+		err := I.PatchField(file, "nested", map[string]interface{}{"c": "d"})
+		assertNilErr(t, err)
+
+		checkContentEqual(t, "patch", map[string]interface{}{
+			"a":      "b",
+			"nested": map[string]interface{}{"c": "d"},
+		})
+	})
+
+	// Test Case 2: concurrent patches of different fields
+	t.Run("concurrent patches of different fields", func(t *testing.T) {
+		setup()
+
+		file := makeNewJSON("patch", map[string]interface{}{})
+		I.Regenerate()
+		file, _ = I.Lookup(file.FileName)
+
+		var wg sync.WaitGroup
+		for n := 0; n < 20; n++ {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				assertNilErr(t, I.PatchField(file, fmt.Sprintf("f%d", n), n))
+			}(n)
+		}
+		wg.Wait()
+
+		got, err := file.ToMap()
+		assertNilErr(t, err)
+		checkDeepEquals(t, len(got), 20)
+	})
+
+	// Test Case 3: patching a document that isn't an object
+	t.Run("patch non-object document", func(t *testing.T) {
+		setup()
+
+		makeNewFile("patch.json", "[1,2]")
+		err := I.PatchField(&File{FileName: "patch"}, "a", "b")
+		assert.ErrorIs(t, err, ErrNotJSONObject)
+	})
+
+	// Test Case 4: a patch waiting for its key holds up no other key, and
+	// puts racing patches of the same key are logged in the order applied
+	t.Run("per-key lock", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{}`)))
+		file, _ := I.Lookup("a")
+
+		file.mu.Lock()
+		patched := make(chan error)
+		go func() { patched <- I.PatchField(file, "x", 1) }()
+		// let the patch reach the key's lock
+		time.Sleep(50 * time.Millisecond)
+		put := make(chan error)
+		go func() { put <- I.Put(&File{FileName: "b"}, []byte(`{}`)) }()
+		select {
+		case err := <-put:
+			assertNilErr(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("a put of another key waited for the patch")
+		}
+		file.mu.Unlock()
+		assertNilErr(t, <-patched)
+
+		var wg sync.WaitGroup
+		for n := 0; n < 20; n++ {
+			wg.Add(2)
+			go func(n int) {
+				defer wg.Done()
+				assertNilErr(t, I.PatchField(file, "v", n))
+			}(n)
+			go func(n int) {
+				defer wg.Done()
+				assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(fmt.Sprintf(`{"p":%d}`, n))))
+			}(n)
+		}
+		wg.Wait()
+		want, err := file.GetByteArray()
+		assertNilErr(t, err)
+
+		forgetDocuments("a", "b")
+		assertNilErr(t, I.WALReplay())
+		got, ok := I.Lookup("a")
+		assert.True(t, ok)
+		body, err := got.GetByteArray()
+		assertNilErr(t, err)
+		assert.JSONEq(t, string(want), string(body))
+	})
+}
@@ -4,6 +4,7 @@ package index
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -14,10 +15,14 @@ import (
 	"github.com/themillenniumfalcon/smolDB/log"
 )
 
+// ErrNotJSONObject is returned when a field level operation targets a
+// document that isn't a JSON object
+var ErrNotJSONObject = errors.New("document is not a JSON object")
+
 // scans a directory and returns a list of JSON file names without their extension,
 // filters for .json files only and returns their base names
-func crawlDirectory(directory string) []string {
-	files, err := af.ReadDir(I.FileSystem, directory)
+func crawlDirectory(fs af.Fs, directory string) []string {
+	files, err := af.ReadDir(fs, directory)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -41,41 +46,58 @@ func (f *File) ReplaceContent(str string) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// create (or truncate) the file
-	_, err := I.FileSystem.Create(f.ResolvePath())
-	if err != nil {
-		return err
-	}
+	return f.replaceContentLocked(str, 0)
+}
+
+// writeContent is like ReplaceContent but records the LSN of the WAL record
+// that produced the content in the file's metadata
+func (f *File) writeContent(str string, lsn uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.replaceContentLocked(str, lsn)
+}
 
-	// open the file for writing
-	file, err := I.FileSystem.OpenFile(f.ResolvePath(), os.O_WRONLY, os.ModeAppend)
+// replaceContentLocked does the work of ReplaceContent, callers must hold f.mu
+func (f *File) replaceContentLocked(str string, lsn uint64) error {
+	// the new content is written next to the file and renamed over it, so
+	// read-only processes never see a partly written document
+	fs, path := f.owner().FileSystem, f.ResolvePath()
+	file, err := fs.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
 
-	defer file.Close()
-
 	// write the new content
 	_, err = file.WriteString(str)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fs.Rename(path+".tmp", path)
+	}
 	if err != nil {
+		fs.Remove(path + ".tmp")
 		return err
 	}
+	documentBytes.Observe(float64(len(str)))
 
 	// Update metadata with new checksum
 	meta := &MetaData{
 		Checksum: calculateChecksum([]byte(str)),
 		Modified: time.Now().UTC().Format(time.RFC3339),
+		LSN:      lsn,
 	}
 
 	// Read existing metadata if it exists
-	existing, _ := f.readMetadata()
+	existing, _ := f.loadMetadata()
 	if existing != nil {
 		meta.Created = existing.Created
 	} else {
 		meta.Created = meta.Modified
 	}
 
-	err = f.writeMetadata(meta)
+	err = f.storeMetadata(meta)
 	if err != nil {
 		return fmt.Errorf("failed to update metadata: %v", err)
 	}
@@ -89,12 +111,12 @@ func (f *File) Delete() error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	err := I.FileSystem.Remove(f.ResolvePath())
-	if err != nil {
-		return err
-	}
+	return f.deleteLocked()
+}
 
-	return nil
+// deleteLocked does the work of Delete, callers must hold f.mu
+func (f *File) deleteLocked() error {
+	return f.owner().FileSystem.Remove(f.ResolvePath())
 }
 
 // reads the entire file content and returns it as a byte slice
@@ -103,7 +125,40 @@ func (f *File) GetByteArray() ([]byte, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	return af.ReadFile(I.FileSystem, f.ResolvePath())
+	return af.ReadFile(f.owner().FileSystem, f.ResolvePath())
+}
+
+// sets a single top-level field of the document to the given JSON encoded value
+// uses mutex locking to ensure thread safety
+func (f *File) applyPatch(field string, value []byte, lsn uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	content, err := f.patchedContent(field, value)
+	if err != nil {
+		return err
+	}
+	return f.replaceContentLocked(string(content), lsn)
+}
+
+// returns the document with a single top-level field set to the given
+// JSON encoded value, callers must hold f.mu
+func (f *File) patchedContent(field string, value []byte) ([]byte, error) {
+	bytes, err := af.ReadFile(f.owner().FileSystem, f.ResolvePath())
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(bytes, &doc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotJSONObject, err)
+	}
+	if doc == nil {
+		doc = map[string]json.RawMessage{}
+	}
+	doc[field] = value
+
+	return json.Marshal(doc)
 }
 
 // reads the file content and unmarshals it into a map
@@ -21,7 +21,7 @@ func TestCrawlDirectory(t *testing.T) {
 	t.Run("crawl empty directory", func(t *testing.T) {
 		setup()
 
-		checkDeepEquals(t, crawlDirectory(""), []string{})
+		checkDeepEquals(t, crawlDirectory(I.FileSystem, ""), []string{})
 	})
 
 	// Test Case 2: multiple JSON files
@@ -30,7 +30,7 @@ func TestCrawlDirectory(t *testing.T) {
 
 		makeNewFile("one.json", "one")
 		makeNewFile("two.json", "two")
-		checkDeepEquals(t, crawlDirectory(""), []string{"one", "two"})
+		checkDeepEquals(t, crawlDirectory(I.FileSystem, ""), []string{"one", "two"})
 	})
 
 	// Test Case 3: file type filtering
@@ -39,7 +39,7 @@ func TestCrawlDirectory(t *testing.T) {
 
 		makeNewFile("one.json", "one")
 		makeNewFile("test.txt", "test")
-		checkDeepEquals(t, crawlDirectory(""), []string{"one"})
+		checkDeepEquals(t, crawlDirectory(I.FileSystem, ""), []string{"one"})
 	})
 }
 
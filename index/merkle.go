@@ -0,0 +1,208 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// MerkleDepth is the depth of the Merkle tree, keys are spread over
+// 2^MerkleDepth leaf buckets by their hash
+const MerkleDepth = 8
+
+// MerkleTree is a binary hash tree over key -> checksum, Levels[0] holds the
+// root and Levels[d] the 2^d hashes of depth d, the last level are the
+// buckets. Two replicas holding the same documents have the same tree
+type MerkleTree struct {
+	Levels [][]string `json:"levels"`
+}
+
+// MerkleEntry describes a document in a bucket of the tree
+type MerkleEntry struct {
+	Key      string `json:"key"`
+	Checksum string `json:"checksum"`
+	Modified string `json:"modified,omitempty"`
+	LSN      uint64 `json:"lsn,omitempty"`
+}
+
+// MerkleBucket returns the leaf bucket key belongs to
+func MerkleBucket(key string) int {
+	return int(xxhash.Sum64String(key) >> (64 - MerkleDepth))
+}
+
+// returns the entry of a document, the checksum of the content is used
+// when it has no metadata
+func (f *File) merkleEntry() (MerkleEntry, error) {
+	body, meta, err := f.readWithMetadata()
+	if err != nil {
+		return MerkleEntry{}, err
+	}
+	if meta == nil {
+		return MerkleEntry{Key: f.FileName, Checksum: calculateChecksum(body)}, nil
+	}
+	return MerkleEntry{Key: f.FileName, Checksum: meta.Checksum, Modified: meta.Modified, LSN: meta.LSN}, nil
+}
+
+// returns the entries of every document of the router, bucket < 0 means
+// all buckets
+func (r *Router) merkleEntries(bucket int) []MerkleEntry {
+	var res []MerkleEntry
+	for _, key := range r.ListKeys() {
+		if bucket >= 0 && MerkleBucket(key) != bucket {
+			continue
+		}
+		file, ok := r.Lookup(key)
+		if !ok {
+			continue
+		}
+		entry, err := file.merkleEntry()
+		if err != nil {
+			// deleted since it was listed
+			continue
+		}
+		res = append(res, entry)
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].Key < res[b].Key })
+	return res
+}
+
+// MerkleTree builds the tree over every document of the router
+func (r *Router) MerkleTree() *MerkleTree {
+	entries := r.merkleEntries(-1)
+
+	leaves := make([]*xxhash.Digest, 1<<MerkleDepth)
+	for k := range leaves {
+		leaves[k] = xxhash.New()
+	}
+	for _, e := range entries {
+		// entries are sorted, every leaf hashes its keys in order
+		d := leaves[MerkleBucket(e.Key)]
+		d.WriteString(e.Key)
+		d.WriteString("\x00")
+		d.WriteString(e.Checksum)
+		d.WriteString("\n")
+	}
+
+	t := &MerkleTree{Levels: make([][]string, MerkleDepth+1)}
+	level := make([]string, len(leaves))
+	for k, d := range leaves {
+		level[k] = fmt.Sprintf("%016x", d.Sum64())
+	}
+	t.Levels[MerkleDepth] = level
+	for depth := MerkleDepth - 1; depth >= 0; depth-- {
+		below := t.Levels[depth+1]
+		level := make([]string, len(below)/2)
+		for k := range level {
+			level[k] = calculateChecksum([]byte(below[2*k] + below[2*k+1]))
+		}
+		t.Levels[depth] = level
+	}
+	return t
+}
+
+// MerkleBucket returns the entries of the documents in a leaf bucket
+func (r *Router) MerkleBucket(bucket int) ([]MerkleEntry, error) {
+	if bucket < 0 || bucket >= 1<<MerkleDepth {
+		return nil, fmt.Errorf("bucket %d out of range", bucket)
+	}
+	return r.merkleEntries(bucket), nil
+}
+
+// Root returns the root hash of the tree
+func (t *MerkleTree) Root() string {
+	return t.Levels[0][0]
+}
+
+// Diff walks both trees from the root and returns the buckets whose
+// hashes differ, subtrees with equal hashes are skipped
+func (t *MerkleTree) Diff(other *MerkleTree) ([]int, error) {
+	if len(t.Levels) != MerkleDepth+1 || len(other.Levels) != MerkleDepth+1 {
+		return nil, fmt.Errorf("trees must have depth %d", MerkleDepth)
+	}
+	for depth := range t.Levels {
+		if len(t.Levels[depth]) != 1<<depth || len(other.Levels[depth]) != 1<<depth {
+			return nil, fmt.Errorf("malformed tree at depth %d", depth)
+		}
+	}
+
+	var res []int
+	var walk func(depth, k int)
+	walk = func(depth, k int) {
+		if t.Levels[depth][k] == other.Levels[depth][k] {
+			return
+		}
+		if depth == MerkleDepth {
+			res = append(res, k)
+			return
+		}
+		walk(depth+1, 2*k)
+		walk(depth+1, 2*k+1)
+	}
+	walk(0, 0)
+	return res, nil
+}
+
+// Newer reports whether e should win over other when they differ, with
+// byLSN the higher LSN wins, otherwise the later modification. Ties are
+// broken by the other measure, ok is false when both are equal
+func (e MerkleEntry) Newer(other MerkleEntry, byLSN bool) (newer bool, ok bool) {
+	lsn := compareUint(e.LSN, other.LSN)
+	modified := compareTime(e.Modified, other.Modified)
+	first, second := modified, lsn
+	if byLSN {
+		first, second = lsn, modified
+	}
+	if first != 0 {
+		return first > 0, true
+	}
+	if second != 0 {
+		return second > 0, true
+	}
+	return false, false
+}
+
+// compares two LSNs
+func compareUint(a, b uint64) int {
+	switch {
+	case a > b:
+		return 1
+	case a < b:
+		return -1
+	}
+	return 0
+}
+
+// compares RFC3339 timestamps, a missing or invalid one is the oldest
+func compareTime(a, b string) int {
+	ta, errA := time.Parse(time.RFC3339, a)
+	tb, errB := time.Parse(time.RFC3339, b)
+	switch {
+	case errA != nil && errB != nil:
+		return 0
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	case ta.After(tb):
+		return 1
+	case ta.Before(tb):
+		return -1
+	}
+	return 0
+}
+
+// Document returns the raw content and metadata of key, the metadata is
+// nil when the document has none
+func (r *Router) Document(key string) ([]byte, *MetaData, bool, error) {
+	file, ok := r.Lookup(key)
+	if !ok {
+		return nil, nil, false, nil
+	}
+	body, meta, err := file.readWithMetadata()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return body, meta, true, nil
+}
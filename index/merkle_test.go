@@ -0,0 +1,92 @@
+// provides tests for the Merkle tree used to compare replicas
+package index
+
+import (
+	"testing"
+
+	af "github.com/spf13/afero"
+)
+
+// a router over a single in-memory index holding the given documents
+func merkleRouter(t *testing.T, docs map[string]string) *Router {
+	t.Helper()
+	idx := NewFileIndex("")
+	idx.SetFileSystem(af.NewMemMapFs())
+	for key, body := range docs {
+		assertNilErr(t, idx.Put(idx.newFile(key), []byte(body)))
+	}
+	return NewRouter([]*FileIndex{idx})
+}
+
+func TestMerkleTree(t *testing.T) {
+	docs := map[string]string{}
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		docs[key] = `{"key":"` + key + `"}`
+	}
+
+	// Test Case 1: replicas with the same documents have the same tree
+	t.Run("equal", func(t *testing.T) {
+		a, b := merkleRouter(t, docs), merkleRouter(t, docs)
+		ta, tb := a.MerkleTree(), b.MerkleTree()
+		checkDeepEquals(t, ta.Root(), tb.Root())
+		diff, err := ta.Diff(tb)
+		assertNilErr(t, err)
+		checkDeepEquals(t, len(diff), 0)
+		checkDeepEquals(t, len(ta.Levels[MerkleDepth]), 1<<MerkleDepth)
+	})
+
+	// Test Case 2: only the buckets of changed or missing keys differ
+	t.Run("differ", func(t *testing.T) {
+		a := merkleRouter(t, docs)
+		changed := map[string]string{}
+		for key, body := range docs {
+			changed[key] = body
+		}
+		changed["c"] = `{"key":"changed"}`
+		delete(changed, "f")
+		b := merkleRouter(t, changed)
+
+		diff, err := a.MerkleTree().Diff(b.MerkleTree())
+		assertNilErr(t, err)
+		want := map[int]bool{MerkleBucket("c"): true, MerkleBucket("f"): true}
+		checkDeepEquals(t, len(diff), len(want))
+		for _, bucket := range diff {
+			checkDeepEquals(t, want[bucket], true)
+		}
+
+		entries, err := b.MerkleBucket(MerkleBucket("c"))
+		assertNilErr(t, err)
+		checkDeepEquals(t, entries[0].Key <= entries[len(entries)-1].Key, true)
+		found := false
+		for _, e := range entries {
+			if e.Key == "c" {
+				found = true
+				checkDeepEquals(t, e.Checksum, calculateChecksum([]byte(`{"key":"changed"}`)))
+			}
+		}
+		checkDeepEquals(t, found, true)
+
+		_, err = b.MerkleBucket(1 << MerkleDepth)
+		assertErr(t, err)
+		_, err = a.MerkleTree().Diff(&MerkleTree{})
+		assertErr(t, err)
+	})
+
+	// Test Case 3: the newer copy wins by modification or by LSN
+	t.Run("precedence", func(t *testing.T) {
+		older := MerkleEntry{Modified: "2024-05-01T10:00:00Z", LSN: 9}
+		newer := MerkleEntry{Modified: "2024-05-01T11:00:00Z", LSN: 3}
+
+		won, ok := newer.Newer(older, false)
+		checkDeepEquals(t, []bool{won, ok}, []bool{true, true})
+		won, ok = newer.Newer(older, true)
+		checkDeepEquals(t, []bool{won, ok}, []bool{false, true})
+
+		// ties fall back to the other measure, then there's no winner
+		same := MerkleEntry{Modified: newer.Modified, LSN: 4}
+		won, ok = same.Newer(newer, false)
+		checkDeepEquals(t, []bool{won, ok}, []bool{true, true})
+		_, ok = newer.Newer(newer, true)
+		checkDeepEquals(t, ok, false)
+	})
+}
@@ -0,0 +1,57 @@
+package index
+
+import (
+	"time"
+
+	"github.com/themillenniumfalcon/smolDB/metrics"
+)
+
+// metrics of the storage engine, recorded once metrics are enabled
+var (
+	walAppendSeconds = metrics.NewHistogram("smoldb_wal_append_duration_seconds",
+		"Time to append a record to the WAL, including the sync its durability level asks for.", metrics.DefBuckets)
+	walFsyncSeconds = metrics.NewHistogram("smoldb_wal_fsync_duration_seconds",
+		"Time to sync the WAL to disk.", metrics.DefBuckets)
+	walBytes = metrics.NewCounter("smoldb_wal_written_bytes_total",
+		"Bytes written to the WAL, commit markers included.")
+	groupCommitBatch = metrics.NewHistogram("smoldb_wal_group_commit_batch_size",
+		"Records made durable by one sync when durability is grouped.", metrics.ExponentialBuckets(1, 2, 10))
+	checkpointSeconds = metrics.NewHistogram("smoldb_checkpoint_duration_seconds",
+		"Time to write a checkpoint.", []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300})
+	checkpointBytes = metrics.NewHistogram("smoldb_checkpoint_size_bytes",
+		"Size of the checkpoints written.", metrics.SizeBuckets)
+	documentBytes = metrics.NewHistogram("smoldb_document_size_bytes",
+		"Size of the documents written.", metrics.SizeBuckets)
+	resolveDepth = metrics.NewHistogram("smoldb_reference_resolution_depth",
+		"Longest chain of references followed while resolving a document.", []float64{0, 1, 2, 3, 5, 8, 13, 21})
+	resolveSeconds = metrics.NewHistogram("smoldb_reference_resolution_duration_seconds",
+		"Time to resolve the references of a document.", metrics.DefBuckets)
+	lockWaitSeconds = metrics.NewHistogram("smoldb_index_lock_wait_seconds",
+		"Time spent waiting for the lock of an index.", metrics.DefBuckets, "mode")
+
+	_ = metrics.NewGauge("smoldb_keys", "Number of keys stored.", func() float64 {
+		return float64(R.Len())
+	})
+)
+
+// takes the index lock for writing, recording the wait
+func (i *FileIndex) lock() {
+	if !metrics.Enabled() {
+		i.mu.Lock()
+		return
+	}
+	start := time.Now()
+	i.mu.Lock()
+	lockWaitSeconds.Observe(metrics.Since(start), "write")
+}
+
+// takes the index lock for reading, recording the wait
+func (i *FileIndex) rlock() {
+	if !metrics.Enabled() {
+		i.mu.RLock()
+		return
+	}
+	start := time.Now()
+	i.mu.RLock()
+	lockWaitSeconds.Observe(metrics.Since(start), "read")
+}
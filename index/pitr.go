@@ -0,0 +1,253 @@
+package index
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// RecoveryTarget is the point a point-in-time restore stops at, given
+// either as an LSN or as a wall clock time
+type RecoveryTarget struct {
+	LSN  uint64
+	Time time.Time
+}
+
+// layouts accepted for time targets besides RFC 3339, read as local time
+var targetLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// ParseRecoveryTarget accepts an LSN or a timestamp such as
+// 2024-05-01T14:03:00Z or "2024-05-01 14:03"
+func ParseRecoveryTarget(s string) (RecoveryTarget, error) {
+	if lsn, err := strconv.ParseUint(s, 10, 64); err == nil {
+		if lsn == 0 {
+			return RecoveryTarget{}, fmt.Errorf("restore target lsn must be greater than 0")
+		}
+		return RecoveryTarget{LSN: lsn}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return RecoveryTarget{Time: t}, nil
+	}
+	for _, layout := range targetLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return RecoveryTarget{Time: t}, nil
+		}
+	}
+	return RecoveryTarget{}, fmt.Errorf("invalid restore target '%s' (want an lsn or a timestamp)", s)
+}
+
+// String returns the target as given on the command line
+func (t RecoveryTarget) String() string {
+	if t.LSN != 0 {
+		return fmt.Sprintf("lsn %d", t.LSN)
+	}
+	return t.Time.Format(time.RFC3339)
+}
+
+// reports whether a record with the given LSN and timestamp is at or
+// before the target
+func (t RecoveryTarget) covers(lsn uint64, ts int64) bool {
+	if t.LSN != 0 {
+		return lsn <= t.LSN
+	}
+	return ts <= t.Time.UnixNano()
+}
+
+// reports whether everything a snapshot holds happened at or before the target
+func (t RecoveryTarget) coversSnapshot(header *snapshotHeader, trailer *snapshotEntry) bool {
+	end := trailer.EndTs
+	if end == 0 {
+		end = header.Ts
+	}
+	return t.covers(trailer.EndLSN, end)
+}
+
+// PITRStats reports the outcome of a point-in-time restore
+type PITRStats struct {
+	Snapshot  string // snapshot the restore started from, empty when replaying the whole WAL
+	Documents int    // documents taken from the snapshot
+	Records   int    // WAL records replayed on top of it
+	LSN       uint64 // LSN the restored database is at
+}
+
+// RestoreToPoint rebuilds the database in srcDir as it was at target into
+// dstDir, which must be empty or missing. It starts from the newest snapshot
+// that finished before the target and replays archived and live WAL segments
+// up to it, srcDir is only read. The index over dstDir becomes the global index
+func RestoreToPoint(fs af.Fs, srcDir, dstDir string, target RecoveryTarget) (*PITRStats, error) {
+	if entries, err := af.ReadDir(fs, dstDir); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("restore directory %s is not empty", dstDir)
+	}
+	if err := fs.MkdirAll(dstDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create restore directory: %v", err)
+	}
+
+	idx := NewFileIndex(dstDir)
+	idx.FileSystem = fs
+	I = idx
+
+	stats, err := idx.rebuildToPoint(srcDir, target)
+	if err != nil {
+		return nil, err
+	}
+
+	// a snapshot of the result carries the LSN over to the restored database
+	if err := idx.CreateCheckpoint(); err != nil {
+		return nil, err
+	}
+
+	log.Info("restore: %s rebuilt at lsn %d into %s", srcDir, stats.LSN, dstDir)
+	return stats, nil
+}
+
+// fills the empty index from the snapshot and WAL of srcDir and checks
+// every resulting document against its checksum
+func (i *FileIndex) rebuildToPoint(srcDir string, target RecoveryTarget) (*PITRStats, error) {
+	i.lock()
+	defer i.mu.Unlock()
+
+	stats := &PITRStats{}
+	snapshot, err := pickSnapshot(i.FileSystem, srcDir, target)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot != "" {
+		header, _, err := readSnapshot(i.FileSystem, snapshot, func(e snapshotEntry) error {
+			file := i.newFile(e.Key)
+			if _, err := file.restoreFromSnapshot(e.Body, e.Meta); err != nil {
+				return fmt.Errorf("failed to restore key %s: %v", e.Key, err)
+			}
+			i.index[e.Key] = file
+			stats.Documents++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		stats.Snapshot = filepath.Base(snapshot)
+		stats.LSN = header.LSN
+	}
+
+	if err := replayToTarget(i.FileSystem, srcDir, i, target, stats); err != nil {
+		return nil, err
+	}
+	if target.LSN != 0 && stats.LSN < target.LSN {
+		return nil, fmt.Errorf("WAL ends at lsn %d, before the target lsn %d", stats.LSN, target.LSN)
+	}
+
+	for key, file := range i.index {
+		if err := file.ValidateChecksum(); err != nil {
+			return nil, fmt.Errorf("restored key %s failed verification: %v", key, err)
+		}
+	}
+
+	i.checkpointLSN = stats.LSN
+	return stats, nil
+}
+
+// returns the newest valid snapshot of dir that finished at or before the
+// target, empty when the WAL has to be replayed from its start
+func pickSnapshot(fs af.Fs, dir string, target RecoveryTarget) (string, error) {
+	snaps, err := listSnapshots(fs, dir)
+	if err != nil {
+		return "", err
+	}
+	for n := len(snaps) - 1; n >= 0; n-- {
+		header, trailer, err := verifySnapshot(fs, snaps[n].Path)
+		if err != nil {
+			log.Warn("restore: skipping %s: %v", filepath.Base(snaps[n].Path), err)
+			continue
+		}
+		if target.coversSnapshot(header, trailer) {
+			return snaps[n].Path, nil
+		}
+	}
+	return "", nil
+}
+
+// replays archived then live WAL segments of dir onto idx from the record
+// after stats.LSN up to the target, a missing record is an error since the
+// result would silently lose writes
+func replayToTarget(fs af.Fs, dir string, idx *FileIndex, target RecoveryTarget, stats *PITRStats) error {
+	archived, err := archivedSegments(fs, dir)
+	if err != nil {
+		return fmt.Errorf("failed to list archived WAL segments: %v", err)
+	}
+	live, err := walSegments(fs, dir)
+	if err != nil {
+		return fmt.Errorf("failed to list WAL segments: %v", err)
+	}
+
+	for _, path := range append(archived, live...) {
+		done, err := replaySegment(fs, path, idx, target, stats)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	return nil
+}
+
+// replays a single segment, reports whether the target was reached
+func replaySegment(fs af.Fs, path string, idx *FileIndex, target RecoveryTarget, stats *PITRStats) (bool, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to open WAL segment: %v", err)
+	}
+	defer f.Close()
+
+	reader := newWALReader(f, 0)
+	for {
+		e, err := reader.Next()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			// records past a torn one were never acknowledged, a gap in
+			// the next segment is caught by the LSN check below
+			log.Warn("restore: stopping read of %s at offset %d: %s", filepath.Base(path), reader.offset, err.Error())
+			return false, nil
+		}
+
+		if e.Op == opCommit {
+			continue
+		}
+		if e.LSN == 0 {
+			// records that predate LSNs only matter when starting from scratch
+			if stats.Snapshot == "" && target.covers(0, e.Ts) {
+				idx.applyEntry(e)
+				stats.Records++
+			}
+			continue
+		}
+		if e.LSN <= stats.LSN {
+			continue
+		}
+		// checked before the target, the missing records may precede it
+		if e.LSN != stats.LSN+1 {
+			return false, fmt.Errorf("WAL is missing records %d to %d", stats.LSN+1, e.LSN-1)
+		}
+		if !target.covers(e.LSN, e.Ts) {
+			return true, nil
+		}
+
+		idx.applyEntry(e)
+		stats.Records++
+		stats.LSN = e.LSN
+	}
+}
@@ -0,0 +1,194 @@
+// provides tests for point-in-time restores from checkpoints and archived WAL
+package index
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// reads a restored document straight from the restore directory
+func restoredContent(t *testing.T, fs af.Fs, dir, key string) string {
+	t.Helper()
+
+	body, err := af.ReadFile(fs, filepath.Join(dir, key+".json"))
+	assertNilErr(t, err)
+	return string(body)
+}
+
+// verifies parsing of restore targets
+func TestParseRecoveryTarget(t *testing.T) {
+	// Test Case 1: plain numbers are LSNs
+	t.Run("lsn target", func(t *testing.T) {
+		target, err := ParseRecoveryTarget("42")
+		assertNilErr(t, err)
+		checkDeepEquals(t, target.LSN, uint64(42))
+	})
+
+	// Test Case 2: timestamps with and without a zone
+	t.Run("time target", func(t *testing.T) {
+		target, err := ParseRecoveryTarget("2024-05-01T14:03:00Z")
+		assertNilErr(t, err)
+		assert.True(t, target.Time.Equal(time.Date(2024, 5, 1, 14, 3, 0, 0, time.UTC)))
+
+		target, err = ParseRecoveryTarget("2024-05-01 14:03")
+		assertNilErr(t, err)
+		assert.True(t, target.Time.Equal(time.Date(2024, 5, 1, 14, 3, 0, 0, time.Local)))
+	})
+
+	// Test Case 3: anything else is rejected
+	t.Run("invalid target", func(t *testing.T) {
+		_, err := ParseRecoveryTarget("yesterday")
+		assertErr(t, err)
+		_, err = ParseRecoveryTarget("0")
+		assertErr(t, err)
+	})
+}
+
+// verifies rebuilding a database as it was at an earlier point
+func TestRestoreToPoint(t *testing.T) {
+	// Test Case 1: restore to an LSN between two checkpoints
+	t.Run("restore to lsn", func(t *testing.T) {
+		setup()
+		fs := I.FileSystem
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.CreateCheckpoint())
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":2}`)))
+		target := I.LastLSN()
+		assertNilErr(t, I.Put(&File{FileName: "b"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.CreateCheckpoint())
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":3}`)))
+
+		stats, err := RestoreToPoint(fs, "", "restored", RecoveryTarget{LSN: target})
+		assertNilErr(t, err)
+		checkDeepEquals(t, stats.LSN, target)
+		checkDeepEquals(t, stats.Records, 1)
+
+		checkDeepEquals(t, restoredContent(t, fs, "restored", "a"), `{"v":2}`)
+		_, err = fs.Stat(filepath.Join("restored", "b.json"))
+		assertErr(t, err)
+
+		// the live database is untouched
+		body, err := af.ReadFile(fs, "a.json")
+		assertNilErr(t, err)
+		checkDeepEquals(t, string(body), `{"v":3}`)
+	})
+
+	// Test Case 2: restore to a wall clock time
+	t.Run("restore to time", func(t *testing.T) {
+		setup()
+		fs := I.FileSystem
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.CreateCheckpoint())
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":2}`)))
+		time.Sleep(2 * time.Millisecond)
+		target := time.Now()
+		time.Sleep(2 * time.Millisecond)
+		assertNilErr(t, I.Delete(&File{FileName: "a"}))
+
+		_, err := RestoreToPoint(fs, "", "restored", RecoveryTarget{Time: target})
+		assertNilErr(t, err)
+		checkDeepEquals(t, restoredContent(t, fs, "restored", "a"), `{"v":2}`)
+	})
+
+	// Test Case 3: no checkpoint yet, the whole WAL is replayed
+	t.Run("restore without checkpoint", func(t *testing.T) {
+		setup()
+		fs := I.FileSystem
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.PatchField(mustFile(t, "a"), "w", 1))
+
+		stats, err := RestoreToPoint(fs, "", "restored", RecoveryTarget{LSN: 2})
+		assertNilErr(t, err)
+		checkDeepEquals(t, stats.Snapshot, "")
+		checkDeepEquals(t, restoredContent(t, fs, "restored", "a"), `{"v":1,"w":1}`)
+	})
+
+	// Test Case 4: the restored database carries on from the restored LSN
+	t.Run("restored database keeps lsn", func(t *testing.T) {
+		setup()
+		fs := I.FileSystem
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":2}`)))
+		_, err := RestoreToPoint(fs, "", "restored", RecoveryTarget{LSN: 2})
+		assertNilErr(t, err)
+
+		I = NewFileIndex("restored")
+		I.SetFileSystem(fs)
+		assertNilErr(t, I.RestoreFromCheckpoint())
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		checkDeepEquals(t, I.LastLSN(), uint64(2))
+	})
+
+	// Test Case 5: a missing archived segment is reported, not skipped
+	t.Run("missing wal segment", func(t *testing.T) {
+		setup()
+		fs := I.FileSystem
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.CreateCheckpoint())
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":2}`)))
+
+		archived, err := archivedSegments(fs, "")
+		assertNilErr(t, err)
+		checkDeepEquals(t, len(archived), 1)
+		assertNilErr(t, fs.Remove(archived[0]))
+		assertNilErr(t, fs.RemoveAll(checkpointDir("")))
+
+		_, err = RestoreToPoint(fs, "", "restored", RecoveryTarget{LSN: 2})
+		assertErr(t, err)
+	})
+
+	// Test Case 6: targets past the end of the WAL and non-empty destinations
+	t.Run("invalid restores", func(t *testing.T) {
+		setup()
+		fs := I.FileSystem
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+
+		_, err := RestoreToPoint(fs, "", "restored", RecoveryTarget{LSN: 10})
+		assertErr(t, err)
+
+		makeNewFile(filepath.Join("busy", "x.json"), "{}")
+		_, err = RestoreToPoint(fs, "", "busy", RecoveryTarget{LSN: 1})
+		assertErr(t, err)
+	})
+}
+
+// verifies that archived segments are pruned with the snapshots they precede
+func TestArchivePruning(t *testing.T) {
+	setup()
+	assertNilErr(t, I.InitWAL(DurabilityNone))
+	I.SetSnapshotRetention(2)
+
+	for n := 0; n < 5; n++ {
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{}`)))
+		assertNilErr(t, I.CreateCheckpoint())
+	}
+
+	// the oldest retained snapshot is at lsn 4, only the segment holding
+	// lsn 5 is still needed
+	archived, err := archivedSegments(I.FileSystem, "")
+	assertNilErr(t, err)
+	checkDeepEquals(t, archived, []string{filepath.Join(archiveDir(""), "wal-00000000000000000005.log")})
+
+	// every point covered by the retained snapshots can still be restored
+	fs := I.FileSystem
+	for lsn := uint64(4); lsn <= 5; lsn++ {
+		_, err := RestoreToPoint(fs, "", fmt.Sprintf("restored-%d", lsn), RecoveryTarget{LSN: lsn})
+		assertNilErr(t, err)
+	}
+}
@@ -0,0 +1,248 @@
+// provides tests for startup recovery from checkpoints and the WAL
+package index
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// exit code used by the crash child so the parent can tell a deliberate
+// crash apart from a failure
+const crashExitCode = 3
+
+// verifies that recovery only rewrites documents that need it
+func TestRestoreSelective(t *testing.T) {
+	// Test Case 1: intact documents are left untouched
+	t.Run("intact documents not rewritten", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.CreateCheckpoint())
+		before, err := I.FileSystem.Stat("a.json")
+		assertNilErr(t, err)
+
+		reopen(t)
+		after, err := I.FileSystem.Stat("a.json")
+		assertNilErr(t, err)
+		assert.Equal(t, before.ModTime(), after.ModTime())
+	})
+
+	// Test Case 2: a document newer than the snapshot isn't rolled back
+	t.Run("newer document kept", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.CreateCheckpoint())
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":2}`)))
+
+		// without the WAL only the document itself knows about v2
+		assertNilErr(t, I.wal.Close())
+		assertNilErr(t, I.FileSystem.Remove(filepath.Join(".smoldb", "wal.log")))
+		I.wal = nil
+
+		reopen(t)
+		checkContentEqual(t, "a", map[string]interface{}{"v": 2})
+	})
+
+	// Test Case 3: torn and missing documents come back from the snapshot
+	t.Run("torn and missing documents restored", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.Put(&File{FileName: "b"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.CreateCheckpoint())
+
+		makeNewFile("a.json", `{"v":`)
+		assertNilErr(t, I.FileSystem.Remove("b.json"))
+
+		reopen(t)
+		checkContentEqual(t, "a", map[string]interface{}{"v": 1})
+		checkContentEqual(t, "b", map[string]interface{}{"v": 1})
+		assertNilErr(t, mustFile(t, "a").ValidateChecksum())
+	})
+
+	// Test Case 4: keys on disk that the snapshot doesn't know stay indexed
+	t.Run("keys absent from snapshot kept", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.CreateCheckpoint())
+		makeNewJSON("later", map[string]interface{}{"v": 1})
+
+		fs := I.FileSystem
+		I = NewFileIndex("")
+		I.SetFileSystem(fs)
+		assertNilErr(t, I.RestoreFromCheckpoint())
+
+		_, ok := I.Lookup("later")
+		assert.True(t, ok)
+		_, ok = I.Lookup("a")
+		assert.True(t, ok)
+	})
+
+	// Test Case 5: documents written without a WAL carry no LSN, a newer
+	// one isn't rolled back to the snapshot either
+	t.Run("newer document without wal kept", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.CreateCheckpoint())
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":2}`)))
+
+		fs := I.FileSystem
+		I = NewFileIndex("")
+		I.SetFileSystem(fs)
+		assertNilErr(t, I.RestoreFromCheckpoint())
+		checkContentEqual(t, "a", map[string]interface{}{"v": 2})
+
+		// one written before the snapshot is
+		file := mustFile(t, "a")
+		meta, err := file.readMetadata()
+		assertNilErr(t, err)
+		meta.Modified = "2000-01-01T00:00:00Z"
+		file.mu.Lock()
+		assertNilErr(t, file.storeMetadata(meta))
+		file.mu.Unlock()
+		assertNilErr(t, I.RestoreFromCheckpoint())
+		checkContentEqual(t, "a", map[string]interface{}{"v": 1})
+	})
+}
+
+// returns the indexed file for key
+func mustFile(t *testing.T, key string) *File {
+	t.Helper()
+
+	file, ok := I.Lookup(key)
+	if !ok {
+		t.Fatalf("key %s not in index", key)
+	}
+	return file
+}
+
+// builds a database on disk that needs every recovery stage to come back:
+// documents covered by a checkpoint, WAL records after it and damaged files,
+// returns the contents recovery has to end up with
+func prepareCrashDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	I = NewFileIndex(dir)
+	assertNilErr(t, I.InitWAL(DurabilityNone))
+	for n := 0; n < 5; n++ {
+		assertNilErr(t, I.Put(&File{FileName: fmt.Sprintf("k%d", n)}, []byte(fmt.Sprintf(`{"v":%d}`, n))))
+	}
+	assertNilErr(t, I.CreateCheckpoint())
+
+	assertNilErr(t, I.PatchField(mustFile(t, "k1"), "v", "patched"))
+	assertNilErr(t, I.Put(&File{FileName: "k5"}, []byte(`{"v":5}`)))
+	assertNilErr(t, I.Delete(mustFile(t, "k2")))
+	assertNilErr(t, I.Put(&File{FileName: "k3"}, []byte(`{"v":"updated"}`)))
+	assertNilErr(t, I.wal.Close())
+
+	want := map[string]string{}
+	for _, key := range I.ListKeys() {
+		body, err := af.ReadFile(I.FileSystem, filepath.Join(dir, key+".json"))
+		assertNilErr(t, err)
+		want[key] = string(body)
+	}
+
+	// lose and tear documents from both sides of the checkpoint
+	assertNilErr(t, os.Remove(filepath.Join(dir, "k0.json")))
+	assertNilErr(t, os.WriteFile(filepath.Join(dir, "k1.json"), []byte(`{"v":`), 0644))
+	assertNilErr(t, os.WriteFile(filepath.Join(dir, "k4.json"), []byte(`{`), 0644))
+	assertNilErr(t, os.Remove(filepath.Join(dir, "k5.json")))
+	return want
+}
+
+// runs recovery the way sh.Setup does on an OS directory
+func recoverDir(t *testing.T, dir string) {
+	t.Helper()
+
+	I = NewFileIndex(dir)
+	assertNilErr(t, I.RestoreFromCheckpoint())
+	assertNilErr(t, I.InitWAL(DurabilityNone))
+	assertNilErr(t, I.WALReplay())
+	I.Regenerate()
+	assertNilErr(t, I.wal.Close())
+}
+
+// not a test on its own, run by TestRecoveryCrashMatrix in a child process
+// that recovers SMOLDB_CRASH_DIR and exits at the SMOLDB_CRASH_AT stage
+func TestRecoveryCrashChild(t *testing.T) {
+	dir, stage := os.Getenv("SMOLDB_CRASH_DIR"), os.Getenv("SMOLDB_CRASH_AT")
+	if dir == "" {
+		t.Skip("only run as a child of TestRecoveryCrashMatrix")
+	}
+	after, _ := strconv.Atoi(os.Getenv("SMOLDB_CRASH_AFTER"))
+
+	seen := 0
+	recoveryHook = func(s string) {
+		if s != stage {
+			return
+		}
+		if seen++; seen > after {
+			os.Exit(crashExitCode)
+		}
+	}
+	recoverDir(t, dir)
+	t.Fatalf("recovery finished without reaching stage %s", stage)
+}
+
+// verifies that a process killed at any stage of recovery recovers fully
+// on the next start
+func TestRecoveryCrashMatrix(t *testing.T) {
+	cases := []struct {
+		stage string
+		after int // occurrences of the stage to let through before crashing
+	}{
+		{stageRestoreDoc, 0},
+		{stageRestoreDoc, 1},
+		{stageRestoreDone, 0},
+		{stageReplayEntry, 0},
+		{stageReplayEntry, 2},
+		{stageReplayDone, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("crash at %s after %d", c.stage, c.after), func(t *testing.T) {
+			defer setup()
+			dir := t.TempDir()
+			want := prepareCrashDir(t, dir)
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestRecoveryCrashChild$")
+			cmd.Env = append(os.Environ(),
+				"SMOLDB_CRASH_DIR="+dir,
+				"SMOLDB_CRASH_AT="+c.stage,
+				"SMOLDB_CRASH_AFTER="+strconv.Itoa(c.after),
+			)
+			out, err := cmd.CombinedOutput()
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) || exitErr.ExitCode() != crashExitCode {
+				t.Fatalf("child did not crash at %s: %v\n%s", c.stage, err, out)
+			}
+
+			// recovering twice must give the same result as once
+			recoverDir(t, dir)
+			recoverDir(t, dir)
+
+			got := map[string]string{}
+			for _, key := range I.ListKeys() {
+				body, err := os.ReadFile(filepath.Join(dir, key+".json"))
+				assertNilErr(t, err)
+				got[key] = string(body)
+				assertNilErr(t, mustFile(t, key).ValidateChecksum())
+			}
+			checkDeepEquals(t, got, want)
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	af "github.com/spf13/afero"
+)
+
+// a replication stream is a sequence of encoded WAL records, exactly as
+// they are stored in wal.log. COMMIT markers in the stream are heartbeats
+// whose LSN is the last LSN of the leader when they were sent
+
+// ErrWALTruncated is returned when the records after the requested LSN were
+// already pruned, a follower that far behind has to start over from a backup
+var ErrWALTruncated = errors.New("wal: records after the requested lsn are no longer available")
+
+// ReplicatedRecord describes a record or heartbeat received from a leader
+type ReplicatedRecord struct {
+	LSN       uint64 // LSN of the record, or the leader's last LSN for heartbeats
+	Ts        int64  // when the leader wrote the record or sent the heartbeat
+	Heartbeat bool
+	Op        string   // op of the record, BATCH for batches
+	Changes   []Change // documents the record changed, in key order
+}
+
+// returns a channel that is closed on the next WAL append along with the
+// last LSN, the channel is nil without a WAL
+func (i *FileIndex) walAppended() (<-chan struct{}, uint64) {
+	i.rlock()
+	defer i.mu.RUnlock()
+
+	if i.wal == nil {
+		return nil, i.checkpointLSN
+	}
+	return i.wal.appended, i.wal.lsn
+}
+
+// StreamWAL writes every WAL record after from to w and then keeps writing
+// new ones as they are appended, until ctx is done or writing fails. A
+// heartbeat follows every batch and is repeated whenever the WAL stays idle
+// for heartbeat, flush is called after each of them
+func (i *FileIndex) StreamWAL(ctx context.Context, w io.Writer, from uint64, heartbeat time.Duration, flush func()) error {
+	if !i.WALAvailable() {
+		return fmt.Errorf("wal not initialized")
+	}
+	if last := i.LastLSN(); from > last {
+		return fmt.Errorf("lsn %d is ahead of the last lsn %d", from, last)
+	}
+
+	pos := from
+	for {
+		appended, last := i.walAppended()
+		if last > pos {
+			if err := i.writeWALRange(w, pos, last); err != nil {
+				return err
+			}
+			pos = last
+		}
+		if err := writeHeartbeat(w, pos); err != nil {
+			return err
+		}
+		flush()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-appended:
+		case <-time.After(heartbeat):
+		}
+	}
+}
+
+// writes a COMMIT marker carrying lsn
+func writeHeartbeat(w io.Writer, lsn uint64) error {
+	rec, err := encodeWALEntry(walEntry{V: int(WALFormatJSON), Op: opCommit, LSN: lsn, Ts: time.Now().UnixNano()}, false)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(rec)
+	return err
+}
+
+// writes the records with since < LSN <= until to w, they have to be there
+// without gaps
+func (i *FileIndex) writeWALRange(w io.Writer, since, until uint64) error {
+	// keep checkpoints from archiving the segments read below, without
+	// holding them up while a follower is slow to take the records
+	defer i.pinSegments()()
+
+	segments, err := i.openSegmentsAfter(since)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range segments {
+			f.Close()
+		}
+	}()
+
+	next := since + 1
+	for _, f := range segments {
+		done, err := writeSegmentRange(f, w, since, &next, until)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	if next == since+1 {
+		return ErrWALTruncated
+	}
+	return fmt.Errorf("wal ends at lsn %d, expected %d", next-1, until)
+}
+
+// opens the segments that may hold records after since under the index
+// lock, which rotations hold, so the list can't miss a segment sealed
+// meanwhile. Open segments keep their records when renamed later
+func (i *FileIndex) openSegmentsAfter(since uint64) ([]af.File, error) {
+	i.rlock()
+	defer i.mu.RUnlock()
+
+	paths, err := segmentsAfter(i.FileSystem, i.dir, since)
+	if err != nil {
+		return nil, err
+	}
+	var segments []af.File
+	for _, path := range paths {
+		f, err := i.FileSystem.Open(path)
+		if err != nil {
+			for _, open := range segments {
+				open.Close()
+			}
+			return nil, fmt.Errorf("failed to open WAL segment: %v", err)
+		}
+		segments = append(segments, f)
+	}
+	return segments, nil
+}
+
+// writes the records of a single segment from *next up to until, reports
+// whether until was reached
+func writeSegmentRange(f af.File, w io.Writer, since uint64, next *uint64, until uint64) (bool, error) {
+	reader := newWALReader(f, 0)
+	for {
+		e, err := reader.Next()
+		if err != nil {
+			// a torn record ends the segment, a gap is caught below
+			return false, nil
+		}
+		if e.Op == opCommit || e.LSN < *next {
+			continue
+		}
+		if e.LSN != *next {
+			if *next == since+1 {
+				return false, ErrWALTruncated
+			}
+			return false, fmt.Errorf("wal is missing records %d to %d", *next, e.LSN-1)
+		}
+
+		rec, err := encodeWALEntry(e, false)
+		if err != nil {
+			return false, err
+		}
+		if _, err := w.Write(rec); err != nil {
+			return false, err
+		}
+		*next++
+		if e.LSN == until {
+			return true, nil
+		}
+	}
+}
+
+// lists the archived and live WAL segments that may hold records after
+// since, segments that end before it are left out
+func segmentsAfter(fs af.Fs, dir string, since uint64) ([]string, error) {
+	archived, err := archivedSegments(fs, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archived WAL segments: %v", err)
+	}
+	live, err := walSegments(fs, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WAL segments: %v", err)
+	}
+
+	// a segment ends right before the next one starts
+	paths := append(archived, live...)
+	start := 0
+	for n := 0; n+1 < len(paths); n++ {
+		if first, ok := segmentFirstLSN(paths[n+1]); ok && first <= since+1 {
+			start = n + 1
+		}
+	}
+	return paths[start:], nil
+}
+
+// OldestLSN returns the LSN of the oldest WAL record still kept in archived
+// or live segments, 0 if there is none. Followers behind it can't catch up
+// from the WAL alone
+func (i *FileIndex) OldestLSN() uint64 {
+	i.checkpointMu.Lock()
+	defer i.checkpointMu.Unlock()
+
+	paths, err := segmentsAfter(i.FileSystem, i.dir, 0)
+	if err != nil {
+		return 0
+	}
+	for _, path := range paths {
+		if first, ok := segmentFirstLSN(path); ok {
+			return first
+		}
+		f, err := i.FileSystem.Open(path)
+		if err != nil {
+			continue
+		}
+		reader := newWALReader(f, 0)
+		for {
+			e, err := reader.Next()
+			if err != nil {
+				break
+			}
+			if e.LSN != 0 {
+				f.Close()
+				return e.LSN
+			}
+		}
+		f.Close()
+	}
+	return 0
+}
+
+// ApplyReplicated reads a replication stream from r, appends every record
+// to the local WAL under the leader's LSN and applies it. Records that were
+// already applied are skipped, a gap is an error. fn is called for every
+// applied record and heartbeat. Returns once r fails or ends
+func (i *FileIndex) ApplyReplicated(r io.Reader, fn func(ReplicatedRecord)) error {
+	reader := newWALReader(r, 0)
+	for {
+		e, err := reader.Next()
+		if err != nil {
+			return err
+		}
+		if e.Op == opCommit {
+			fn(ReplicatedRecord{LSN: e.LSN, Ts: e.Ts, Heartbeat: true})
+			continue
+		}
+
+		changes, applied, err := i.applyReplicated(e)
+		if err != nil {
+			return err
+		}
+		if applied {
+			fn(ReplicatedRecord{LSN: e.LSN, Ts: e.Ts, Op: e.Op, Changes: changes})
+		}
+	}
+}
+
+// logs and applies a single replicated record, returns the changes it
+// made and whether it was new
+func (i *FileIndex) applyReplicated(e walEntry) ([]Change, bool, error) {
+	i.lock()
+	defer i.mu.Unlock()
+
+	if i.wal == nil {
+		return nil, false, fmt.Errorf("wal not initialized")
+	}
+	if e.LSN <= i.wal.lsn {
+		return nil, false, nil
+	}
+	if err := i.wal.appendAt(e); err != nil {
+		return nil, false, err
+	}
+	// the index lock keeps every other write out while the record applies
+	keys := recordKeys(e)
+	changes := make([]Change, len(keys))
+	for k, key := range keys {
+		changes[k] = Change{Key: key, Before: i.checksumOf(key)}
+	}
+	i.applyEntry(e)
+	for k, key := range keys {
+		changes[k].After = i.checksumOf(key)
+	}
+	return changes, true, nil
+}
+
+// returns the keys a WAL record writes, sorted
+func recordKeys(e walEntry) []string {
+	if e.Op != opBatch {
+		return []string{e.Key}
+	}
+	var ops []BatchOp
+	json.Unmarshal([]byte(e.Body), &ops)
+	seen := map[string]bool{}
+	var keys []string
+	for _, op := range ops {
+		if !seen[op.Key] {
+			seen[op.Key] = true
+			keys = append(keys, op.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// returns the checksum of the document indexed under key, empty when there
+// is none, callers must hold the index lock
+func (i *FileIndex) checksumOf(key string) string {
+	file, ok := i.index[key]
+	if !ok {
+		return ""
+	}
+	file.mu.RLock()
+	defer file.mu.RUnlock()
+	return file.checksumLocked()
+}
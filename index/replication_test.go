@@ -0,0 +1,232 @@
+// provides tests for streaming the WAL to followers and applying it there
+package index
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// streams the WAL of the global index after from until the first heartbeat
+func streamOnce(t *testing.T, from uint64) ([]byte, error) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := I.StreamWAL(ctx, &buf, from, time.Hour, cancel)
+	return buf.Bytes(), err
+}
+
+// verifies that streamed WAL records rebuild the same documents elsewhere
+func TestReplication(t *testing.T) {
+	// builds a leader with a few writes and returns its stream after from
+	leader := func(t *testing.T, from uint64) []byte {
+		t.Helper()
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.PatchField(mustFile(t, "a"), "w", true))
+		assertNilErr(t, I.Put(&File{FileName: "b"}, []byte(`{"v":1}`)))
+		assertNilErr(t, I.Delete(mustFile(t, "b")))
+
+		stream, err := streamOnce(t, from)
+		assertNilErr(t, err)
+		return stream
+	}
+
+	// Test Case 1: a follower applies the stream under the leader's LSNs
+	t.Run("apply stream", func(t *testing.T) {
+		stream := leader(t, 0)
+
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		var applied []uint64
+		var changes []Change
+		var heartbeat uint64
+		err := I.ApplyReplicated(bytes.NewReader(stream), func(rec ReplicatedRecord) {
+			if rec.Heartbeat {
+				heartbeat = rec.LSN
+				return
+			}
+			applied = append(applied, rec.LSN)
+			changes = append(changes, rec.Changes...)
+		})
+		assert.Equal(t, io.EOF, err)
+		checkDeepEquals(t, applied, []uint64{1, 2, 3, 4})
+		checkDeepEquals(t, heartbeat, uint64(4))
+		checkDeepEquals(t, I.LastLSN(), uint64(4))
+		checkContentEqual(t, "a", map[string]interface{}{"v": 1, "w": true})
+		checkKeyNotInIndex(t, "b")
+
+		// each record reports the checksums around its write
+		checkDeepEquals(t, len(changes), 4)
+		checkDeepEquals(t, changes[0].Before, "")
+		checkDeepEquals(t, changes[1].Before, changes[0].After)
+		entry, err := mustFile(t, "a").merkleEntry()
+		assertNilErr(t, err)
+		checkDeepEquals(t, changes[1].After, entry.Checksum)
+		checkDeepEquals(t, changes[3].After, "")
+
+		// the applied position survives a restart and replayed records are skipped
+		reopen(t)
+		checkDeepEquals(t, I.LastLSN(), uint64(4))
+		applied = nil
+		_ = I.ApplyReplicated(bytes.NewReader(stream), func(rec ReplicatedRecord) {
+			if !rec.Heartbeat {
+				applied = append(applied, rec.LSN)
+			}
+		})
+		checkDeepEquals(t, len(applied), 0)
+	})
+
+	// Test Case 2: streams start after the requested LSN and can't skip records
+	t.Run("stream from lsn", func(t *testing.T) {
+		stream := leader(t, 2)
+
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		err := I.ApplyReplicated(bytes.NewReader(stream), func(ReplicatedRecord) {})
+		assertErr(t, err)
+		assert.NotEqual(t, io.EOF, err)
+		checkDeepEquals(t, I.LastLSN(), uint64(0))
+	})
+
+	// Test Case 3: records appended while streaming are sent right away
+	t.Run("live stream", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"v":1}`)))
+
+		r, w := io.Pipe()
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- I.StreamWAL(ctx, w, 0, time.Hour, func() {})
+			w.Close()
+		}()
+
+		reader := newWALReader(r, 0)
+		next := func() walEntry {
+			e, err := reader.Next()
+			assertNilErr(t, err)
+			return e
+		}
+		checkDeepEquals(t, next().LSN, uint64(1))
+		checkDeepEquals(t, next().Op, opCommit)
+
+		assertNilErr(t, I.Put(&File{FileName: "b"}, []byte(`{"v":2}`)))
+		e := next()
+		checkDeepEquals(t, e.Key, "b")
+		checkDeepEquals(t, e.LSN, uint64(2))
+
+		cancel()
+		go io.Copy(io.Discard, r)
+		assertNilErr(t, <-done)
+	})
+
+	// Test Case 4: records pruned by checkpoints can't be streamed
+	t.Run("pruned wal", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		I.SetSnapshotRetention(1)
+		for n := 0; n < 3; n++ {
+			assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{}`)))
+			assertNilErr(t, I.CreateCheckpoint())
+		}
+		checkDeepEquals(t, I.OldestLSN(), uint64(3))
+
+		_, err := streamOnce(t, 0)
+		assert.ErrorIs(t, err, ErrWALTruncated)
+		_, err = streamOnce(t, 2)
+		assertNilErr(t, err)
+
+		// followers ahead of the leader are turned away
+		_, err = streamOnce(t, 4)
+		assertErr(t, err)
+	})
+
+	// Test Case 5: a follower that stops reading holds up neither
+	// checkpoints nor the oldest LSN, and still gets every record
+	t.Run("stalled follower", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		for n := 0; n < 3; n++ {
+			assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{}`)))
+		}
+
+		r, w := io.Pipe()
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- I.StreamWAL(ctx, w, 0, time.Hour, func() {})
+			w.Close()
+		}()
+		first := make([]byte, 1)
+		_, err := io.ReadFull(r, first)
+		assertNilErr(t, err)
+
+		checkpointed := make(chan error, 1)
+		go func() {
+			for n := 0; n < 2; n++ {
+				if err := I.Put(&File{FileName: "b"}, []byte(`{}`)); err != nil {
+					checkpointed <- err
+					return
+				}
+				if err := I.CreateCheckpoint(); err != nil {
+					checkpointed <- err
+					return
+				}
+			}
+			I.OldestLSN()
+			checkpointed <- nil
+		}()
+		select {
+		case err := <-checkpointed:
+			assertNilErr(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("a checkpoint waited for the follower")
+		}
+
+		reader := newWALReader(io.MultiReader(bytes.NewReader(first), r), 0)
+		for lsn := uint64(1); lsn <= 3; lsn++ {
+			e, err := reader.Next()
+			assertNilErr(t, err)
+			checkDeepEquals(t, e.LSN, lsn)
+		}
+		cancel()
+		go io.Copy(io.Discard, r)
+		assertNilErr(t, <-done)
+	})
+
+	// Test Case 6: segments opened for a stream keep their records when a
+	// checkpoint seals the active one right after
+	t.Run("rotation while streaming", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		for n := 0; n < 3; n++ {
+			assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{}`)))
+		}
+
+		segments, err := I.openSegmentsAfter(0)
+		assertNilErr(t, err)
+		assertNilErr(t, I.CreateCheckpoint())
+
+		var buf bytes.Buffer
+		next := uint64(1)
+		var done bool
+		for _, f := range segments {
+			if !done {
+				done, err = writeSegmentRange(f, &buf, 0, &next, 3)
+				assertNilErr(t, err)
+			}
+			f.Close()
+		}
+		checkDeepEquals(t, done, true)
+		checkDeepEquals(t, next, uint64(4))
+	})
+}
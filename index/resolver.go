@@ -5,14 +5,50 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
+
+	"github.com/themillenniumfalcon/smolDB/metrics"
 )
 
+// RemoteStore looks up documents kept on other nodes
+type RemoteStore interface {
+	Owns(key string) bool
+	Fetch(key string) (map[string]interface{}, bool, error)
+}
+
+// Remote is set when the keys are spread over several nodes, references to
+// keys this node doesn't own are fetched through it
+var Remote RemoteStore
+
 // traverses through a JSON-like data structure and resolves any references
 // marked with "REF::" prefix, it handles nested structures including maps and slices
 // Parameters:
 //   - jsonVal: input value to process (can be any JSON-compatible type)
 //   - depthLeft: maximum depth of recursive reference resolution to prevent infinite loops
 func ResolveReferences(jsonVal interface{}, depthLeft int) interface{} {
+	return ResolveReferencesFor(jsonVal, depthLeft, nil)
+}
+
+// resolves references like ResolveReferences, a reference to a key allow
+// rejects is redacted instead of followed, a nil allow follows every key
+func ResolveReferencesFor(jsonVal interface{}, depthLeft int, allow func(key string) bool) interface{} {
+	start := time.Now()
+	res := &resolution{depth: depthLeft, allow: allow}
+	resolved := res.resolve(jsonVal, depthLeft)
+	resolveDepth.Observe(float64(res.followed))
+	resolveSeconds.Observe(metrics.Since(start))
+	return resolved
+}
+
+// resolution tracks how deep a call to ResolveReferences followed references
+type resolution struct {
+	depth    int                   // depth the resolution started with
+	followed int                   // longest chain of references followed
+	allow    func(key string) bool // keys that may be followed, nil for all
+}
+
+// does the work of ResolveReferences
+func (res *resolution) resolve(jsonVal interface{}, depthLeft int) interface{} {
 	// if no more depth allowed, return value as-is
 	if depthLeft < 1 {
 		return jsonVal
@@ -26,7 +62,7 @@ func ResolveReferences(jsonVal interface{}, depthLeft int) interface{} {
 
 		// check if string contains a reference marker
 		if strings.Contains(valString, "REF::") {
-			resolvedString := resolveString(valString, depthLeft)
+			resolvedString := res.resolveString(valString, depthLeft)
 			return resolvedString
 		}
 		return valString
@@ -39,7 +75,7 @@ func ResolveReferences(jsonVal interface{}, depthLeft int) interface{} {
 		// recursively resolve each element in the slice
 		for i := 0; i < numberOfValues; i++ {
 			pointer := val.Index(i)
-			newSlice[i] = ResolveReferences(pointer.Interface(), depthLeft)
+			newSlice[i] = res.resolve(pointer.Interface(), depthLeft)
 		}
 		return newSlice
 
@@ -50,7 +86,7 @@ func ResolveReferences(jsonVal interface{}, depthLeft int) interface{} {
 		// recursively resolve each value in the map
 		for _, key := range val.MapKeys() {
 			nestedVal := val.MapIndex(key).Interface()
-			newMap[key.String()] = ResolveReferences(nestedVal, depthLeft)
+			newMap[key.String()] = res.resolve(nestedVal, depthLeft)
 		}
 		return newMap
 
@@ -64,12 +100,30 @@ func ResolveReferences(jsonVal interface{}, depthLeft int) interface{} {
 // Parameters:
 //   - valString: the reference string to resolve (must start with "REF::")
 //   - depthLeft: remaining depth for nested reference resolution
-func resolveString(valString string, depthLeft int) interface{} {
+func (res *resolution) resolveString(valString string, depthLeft int) interface{} {
 	// extract the key by removing the "REF::" prefix
 	key := strings.Replace(valString, "REF::", "", 1)
+	if followed := res.depth - depthLeft + 1; followed > res.followed {
+		res.followed = followed
+	}
+	if res.allow != nil && !res.allow(key) {
+		return fmt.Sprintf("REF::ERR key '%s' forbidden", key)
+	}
+
+	// keys owned by another node are fetched from it
+	if Remote != nil && !Remote.Owns(key) {
+		jsonMap, ok, err := Remote.Fetch(key)
+		if err != nil {
+			return fmt.Sprintf("REF::ERR key '%s' unavailable: %s", key, err.Error())
+		}
+		if !ok {
+			return fmt.Sprintf("REF::ERR key '%s' not found", key)
+		}
+		return res.resolve(jsonMap, depthLeft-1)
+	}
 
-	// look up the key in the index
-	file, ok := I.Lookup(key)
+	// look up the key in its shard
+	file, ok := R.Lookup(key)
 	if ok {
 		jsonMap, err := file.ToMap()
 		if err != nil {
@@ -78,7 +132,7 @@ func resolveString(valString string, depthLeft int) interface{} {
 		}
 
 		// recursively resolve any references in the found map
-		return ResolveReferences(jsonMap, depthLeft-1)
+		return res.resolve(jsonMap, depthLeft-1)
 	}
 
 	return fmt.Sprintf("REF::ERR key '%s' not found", key)
@@ -166,6 +166,30 @@ func TestResolveReferences(t *testing.T) {
 			},
 		}
 
+		assert.Equal(t, got, expectedMap)
+	})
+	// Test Case 9: references to keys that aren't allowed are redacted
+	t.Run("forbidden refs are redacted", func(t *testing.T) {
+		I.SetFileSystem(af.NewMemMapFs())
+
+		makeNewJSON("first", firstContentWithRef)
+		makeNewJSON("second", secondContentWithRef)
+		makeNewJSON("third", baseContent)
+
+		I.Regenerate()
+
+		got := ResolveReferencesFor(firstContentWithRef, 2, func(key string) bool {
+			return key != "third"
+		})
+
+		expectedMap := map[string]interface{}{
+			"test": "testVal",
+			"secondVal": map[string]interface{}{
+				"just": "strings",
+				"ref":  "REF::ERR key 'third' forbidden",
+			},
+		}
+
 		assert.Equal(t, got, expectedMap)
 	})
 }
@@ -0,0 +1,374 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// shardLayout is kept in .smoldb/shards.json of a sharded database, a
+// database without it is a single unsharded FileIndex
+type shardLayout struct {
+	Shards int `json:"shards"`
+}
+
+// Router spreads keys over several FileIndex shards by the hash of the key,
+// every shard has its own directory, WAL and checkpoints so writes to
+// different shards don't contend on the same lock
+type Router struct {
+	shards []*FileIndex
+}
+
+// global router used by the api and the shell, nil for an unsharded
+// database in which case everything is routed to I
+var R *Router
+
+// creates a router over the given shards, a key always maps to the same
+// shard as long as the number of shards doesn't change
+func NewRouter(shards []*FileIndex) *Router {
+	return &Router{shards: shards}
+}
+
+// returns the path of the shards.json layout file of dir
+func shardLayoutPath(dir string) string {
+	return filepath.Join(dir, ".smoldb", "shards.json")
+}
+
+// ShardDirs returns the directories of the n shards of dir, an unsharded
+// database keeps its documents in dir itself
+func ShardDirs(dir string, n int) []string {
+	if n <= 1 {
+		return []string{dir}
+	}
+	dirs := make([]string, n)
+	for k := range dirs {
+		dirs[k] = filepath.Join(dir, "shards", fmt.Sprintf("%03d", k))
+	}
+	return dirs
+}
+
+// ReadShardCount returns the number of shards dir is split into, 1 when it
+// isn't sharded
+func ReadShardCount(fs af.Fs, dir string) (int, error) {
+	data, err := af.ReadFile(fs, shardLayoutPath(dir))
+	if os.IsNotExist(err) {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read shard layout: %v", err)
+	}
+	var layout shardLayout
+	if err := json.Unmarshal(data, &layout); err != nil || layout.Shards < 1 {
+		return 0, fmt.Errorf("invalid shard layout %s", shardLayoutPath(dir))
+	}
+	return layout.Shards, nil
+}
+
+// records that dir is split into n shards, the file is replaced atomically
+func writeShardCount(fs af.Fs, dir string, n int) error {
+	if n <= 1 {
+		if err := fs.Remove(shardLayoutPath(dir)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := fs.MkdirAll(filepath.Join(dir, ".smoldb"), 0755); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(shardLayout{Shards: n})
+	tmp := shardLayoutPath(dir) + ".tmp"
+	if err := af.WriteFile(fs, tmp, data, 0644); err != nil {
+		return err
+	}
+	return fs.Rename(tmp, shardLayoutPath(dir))
+}
+
+// Shards returns every shard of the router, just I for a nil router
+func (r *Router) Shards() []*FileIndex {
+	if r == nil {
+		return []*FileIndex{I}
+	}
+	return r.shards
+}
+
+// Shard returns the shard key belongs to
+func (r *Router) Shard(key string) *FileIndex {
+	shards := r.Shards()
+	if len(shards) == 1 {
+		return shards[0]
+	}
+	return shards[xxhash.Sum64String(key)%uint64(len(shards))]
+}
+
+// Lookup looks key up in its shard, see FileIndex.Lookup
+func (r *Router) Lookup(key string) (*File, bool) {
+	return r.Shard(key).Lookup(key)
+}
+
+// Put writes file to its shard, see FileIndex.Put
+func (r *Router) Put(file *File, bytes []byte) error {
+	return r.Shard(file.FileName).Put(file, bytes)
+}
+
+// PatchField patches a field of file in its shard, see FileIndex.PatchField
+func (r *Router) PatchField(file *File, field string, value interface{}) error {
+	return r.Shard(file.FileName).PatchField(file, field, value)
+}
+
+// Delete removes file from its shard, see FileIndex.Delete
+func (r *Router) Delete(file *File) error {
+	return r.Shard(file.FileName).Delete(file)
+}
+
+// PutChange writes file to its shard, see FileIndex.PutChange
+func (r *Router) PutChange(file *File, bytes []byte) (Change, error) {
+	return r.Shard(file.FileName).PutChange(file, bytes)
+}
+
+// PatchFieldChange patches a field of file in its shard, see
+// FileIndex.PatchFieldChange
+func (r *Router) PatchFieldChange(file *File, field string, value interface{}) (Change, error) {
+	return r.Shard(file.FileName).PatchFieldChange(file, field, value)
+}
+
+// DeleteChange removes file from its shard, see FileIndex.DeleteChange
+func (r *Router) DeleteChange(file *File) (Change, error) {
+	return r.Shard(file.FileName).DeleteChange(file)
+}
+
+// runs fn on every shard concurrently and returns the first error
+func (r *Router) each(fn func(k int, shard *FileIndex) error) error {
+	shards := r.Shards()
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for k, shard := range shards {
+		wg.Add(1)
+		go func(k int, shard *FileIndex) {
+			defer wg.Done()
+			errs[k] = fn(k, shard)
+		}(k, shard)
+	}
+	wg.Wait()
+
+	for k, err := range errs {
+		if err != nil {
+			return fmt.Errorf("shard %d: %v", k, err)
+		}
+	}
+	return nil
+}
+
+// ListKeys returns the keys of every shard, the shards are listed concurrently
+func (r *Router) ListKeys() []string {
+	lists := make([][]string, len(r.Shards()))
+	r.each(func(k int, shard *FileIndex) error {
+		lists[k] = shard.ListKeys()
+		return nil
+	})
+
+	var res []string
+	for _, keys := range lists {
+		res = append(res, keys...)
+	}
+	return res
+}
+
+// Len returns the number of keys over all shards
+func (r *Router) Len() int {
+	n := 0
+	for _, shard := range r.Shards() {
+		if shard != nil {
+			n += shard.Len()
+		}
+	}
+	return n
+}
+
+// Regenerate rebuilds the index of every shard
+func (r *Router) Regenerate() {
+	r.each(func(_ int, shard *FileIndex) error {
+		shard.Regenerate()
+		return nil
+	})
+}
+
+// Refresh rebuilds the index of every shard from its directory
+func (r *Router) Refresh() {
+	r.each(func(_ int, shard *FileIndex) error {
+		shard.Refresh()
+		return nil
+	})
+}
+
+// CreateCheckpoint takes a checkpoint of every shard, each shard has its
+// own redo point so they don't need to be taken at the same instant
+func (r *Router) CreateCheckpoint() error {
+	return r.each(func(_ int, shard *FileIndex) error {
+		return shard.CreateCheckpoint()
+	})
+}
+
+// ReshardStats describes a finished reshard
+type ReshardStats struct {
+	From      int    // number of shards before
+	To        int    // number of shards after
+	Documents int    // documents moved
+	Previous  string // where the old layout was moved to
+}
+
+// OpenRouter opens every shard of the database in dir for offline tools,
+// Close releases them again
+func OpenRouter(fs af.Fs, dir string, level DurabilityLevel) (*Router, error) {
+	n, err := ReadShardCount(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRouter(nil)
+	for _, d := range ShardDirs(dir, n) {
+		shard, err := openShard(fs, d, level)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("failed to open %s: %v", d, err)
+		}
+		r.shards = append(r.shards, shard)
+	}
+	return r, nil
+}
+
+// opens a shard the way a server does after a restart: its latest
+// checkpoint, then the WAL on top
+func openShard(fs af.Fs, dir string, level DurabilityLevel) (*FileIndex, error) {
+	idx := NewFileIndex(dir)
+	idx.FileSystem = fs
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := idx.RestoreFromCheckpoint(); err != nil {
+		return nil, err
+	}
+	if err := idx.InitWAL(level); err != nil {
+		return nil, err
+	}
+	if err := idx.WALReplay(); err != nil {
+		idx.wal.Close()
+		return nil, err
+	}
+	idx.Regenerate()
+	return idx, nil
+}
+
+// Close closes every shard, see FileIndex.Close
+func (r *Router) Close() error {
+	var firstErr error
+	for _, shard := range r.Shards() {
+		if err := shard.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Reshard rewrites the database in dir into n shards. Every document is
+// copied into a new layout in a staging directory next to dir, which
+// replaces dir once all of them were compared against the originals. The
+// old directory is moved aside rather than deleted, WAL history doesn't
+// carry over so point-in-time restores start again from the new layout
+func Reshard(fs af.Fs, dir string, n int) (*ReshardStats, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("need at least one shard, got %d", n)
+	}
+	dir = filepath.Clean(dir)
+	from, err := ReadShardCount(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	stats := &ReshardStats{From: from, To: n}
+
+	src, err := OpenRouter(fs, dir, DurabilityNone)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	staging := dir + ".reshard"
+	if err := fs.RemoveAll(staging); err != nil {
+		return nil, fmt.Errorf("failed to clear staging directory: %v", err)
+	}
+	if err := stageReshard(fs, src, staging, n, stats); err != nil {
+		fs.RemoveAll(staging)
+		return nil, err
+	}
+
+	stats.Previous = fmt.Sprintf("%s.pre-reshard-%d", dir, time.Now().UnixNano())
+	if err := fs.Rename(dir, stats.Previous); err != nil {
+		fs.RemoveAll(staging)
+		return nil, fmt.Errorf("failed to move %s aside: %v", dir, err)
+	}
+	if err := fs.Rename(staging, dir); err != nil {
+		fs.Rename(stats.Previous, dir)
+		return nil, fmt.Errorf("failed to move resharded database into place: %v", err)
+	}
+
+	log.Info("reshard: moved %d documents from %d to %d shards in %s", stats.Documents, from, n, dir)
+	return stats, nil
+}
+
+// copies every document of src into n new shards under staging and checks
+// them, the new shards end with a checkpoint
+func stageReshard(fs af.Fs, src *Router, staging string, n int, stats *ReshardStats) error {
+	dst := NewRouter(nil)
+	defer dst.Close()
+	for _, d := range ShardDirs(staging, n) {
+		shard, err := openShard(fs, d, DurabilityNone)
+		if err != nil {
+			return err
+		}
+		dst.shards = append(dst.shards, shard)
+	}
+
+	keys := src.ListKeys()
+	for _, key := range keys {
+		file, _ := src.Lookup(key)
+		body, err := file.ReadContent()
+		if err != nil {
+			return fmt.Errorf("failed to read key %s: %v", key, err)
+		}
+		target, _ := dst.Lookup(key)
+		if err := dst.Put(target, []byte(body)); err != nil {
+			return fmt.Errorf("failed to write key %s: %v", key, err)
+		}
+	}
+
+	// compare the copies before anything is replaced
+	if got := len(dst.ListKeys()); got != len(keys) {
+		return fmt.Errorf("resharded %d keys, expected %d", got, len(keys))
+	}
+	for _, key := range keys {
+		want, _ := src.Lookup(key)
+		got, ok := dst.Lookup(key)
+		if !ok {
+			return fmt.Errorf("key %s is missing after resharding", key)
+		}
+		a, errA := want.ReadContent()
+		b, errB := got.ReadContent()
+		if errA != nil || errB != nil || a != b {
+			return fmt.Errorf("key %s differs after resharding", key)
+		}
+	}
+
+	if err := dst.CreateCheckpoint(); err != nil {
+		return err
+	}
+	if err := writeShardCount(fs, staging, n); err != nil {
+		return fmt.Errorf("failed to write shard layout: %v", err)
+	}
+	stats.Documents = len(keys)
+	return nil
+}
@@ -0,0 +1,158 @@
+// provides tests for routing keys across shards and resharding a database
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	af "github.com/spf13/afero"
+)
+
+// opens a router of n shards on a fresh in-memory filesystem as the global
+// router, I is left unset like it is in a sharded server
+func setupShards(t *testing.T, n int) {
+	t.Helper()
+	fs := af.NewMemMapFs()
+	var shards []*FileIndex
+	for _, dir := range ShardDirs("db", n) {
+		shard, err := openShard(fs, dir, DurabilityNone)
+		assertNilErr(t, err)
+		shards = append(shards, shard)
+	}
+	R = NewRouter(shards)
+	I = nil
+	t.Cleanup(func() { R = nil })
+}
+
+func TestRouter(t *testing.T) {
+	// Test Case 1: keys stay on their shard and every shard gets some
+	t.Run("route keys", func(t *testing.T) {
+		setupShards(t, 4)
+		keys := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"}
+		for _, key := range keys {
+			file, ok := R.Lookup(key)
+			checkDeepEquals(t, ok, false)
+			assertNilErr(t, R.Put(file, []byte(`{"key":"`+key+`"}`)))
+		}
+
+		used := map[*FileIndex]bool{}
+		for _, key := range keys {
+			shard := R.Shard(key)
+			checkDeepEquals(t, shard == R.Shard(key), true)
+			_, ok := shard.Lookup(key)
+			checkDeepEquals(t, ok, true)
+			used[shard] = true
+		}
+		checkDeepEquals(t, len(used) > 1, true)
+		checkDeepEquals(t, len(R.ListKeys()), len(keys))
+		for _, key := range keys {
+			checkDeepEquals(t, sliceContains(R.ListKeys(), key), true)
+		}
+	})
+
+	// Test Case 2: patches, deletes and references work across shards
+	t.Run("cross shard", func(t *testing.T) {
+		setupShards(t, 3)
+		a, _ := R.Lookup("a")
+		assertNilErr(t, R.Put(a, []byte(`{"v":1}`)))
+		b, _ := R.Lookup("b")
+		assertNilErr(t, R.Put(b, []byte(`{"ref":"REF::a"}`)))
+		a, _ = R.Lookup("a")
+		assertNilErr(t, R.PatchField(a, "w", 2))
+
+		m, err := b.ToMap()
+		assertNilErr(t, err)
+		checkJSONEquals(t, ResolveReferences(m, 1), map[string]interface{}{"ref": map[string]interface{}{"v": 1, "w": 2}})
+
+		assertNilErr(t, R.Delete(a))
+		_, ok := R.Lookup("a")
+		checkDeepEquals(t, ok, false)
+		checkDeepEquals(t, R.ListKeys(), []string{"b"})
+	})
+
+	// Test Case 3: a nil router routes everything to I
+	t.Run("unsharded", func(t *testing.T) {
+		setup()
+		R = nil
+		file, _ := R.Lookup("a")
+		assertNilErr(t, R.Put(file, []byte(`{}`)))
+		_, ok := I.Lookup("a")
+		checkDeepEquals(t, ok, true)
+		checkDeepEquals(t, len(R.Shards()), 1)
+	})
+}
+
+func TestReshard(t *testing.T) {
+	// writes documents into an unsharded database the way a server does
+	populate := func(t *testing.T, dir string, n int) map[string]string {
+		t.Helper()
+		idx, err := openShard(af.NewOsFs(), dir, DurabilityNone)
+		assertNilErr(t, err)
+		want := map[string]string{}
+		for k := 0; k < n; k++ {
+			key := "k" + string(rune('a'+k))
+			want[key] = `{"n":` + string(rune('0'+k%10)) + `}`
+			assertNilErr(t, idx.Put(idx.newFile(key), []byte(want[key])))
+		}
+		assertNilErr(t, idx.wal.Close())
+		return want
+	}
+	// reopens every shard of dir and returns their documents
+	contents := func(t *testing.T, dir string, shards int) map[string]string {
+		t.Helper()
+		got := map[string]string{}
+		for _, d := range ShardDirs(dir, shards) {
+			idx, err := openShard(af.NewOsFs(), d, DurabilityNone)
+			assertNilErr(t, err)
+			for _, key := range idx.ListKeys() {
+				file, _ := idx.Lookup(key)
+				body, err := file.ReadContent()
+				assertNilErr(t, err)
+				got[key] = body
+			}
+			assertNilErr(t, idx.wal.Close())
+		}
+		return got
+	}
+
+	// Test Case 1: split a database into shards and merge it back
+	t.Run("split and merge", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "db")
+		want := populate(t, dir, 20)
+
+		stats, err := Reshard(af.NewOsFs(), dir, 4)
+		assertNilErr(t, err)
+		checkDeepEquals(t, *stats, ReshardStats{From: 1, To: 4, Documents: 20, Previous: stats.Previous})
+		n, err := ReadShardCount(af.NewOsFs(), dir)
+		assertNilErr(t, err)
+		checkDeepEquals(t, n, 4)
+		checkDeepEquals(t, contents(t, dir, 4), want)
+		// no documents are left at the top level and the old copy is kept
+		checkDeepEquals(t, len(crawlDirectory(af.NewOsFs(), dir)), 0)
+		checkDeepEquals(t, contents(t, stats.Previous, 1), want)
+
+		stats, err = Reshard(af.NewOsFs(), dir, 1)
+		assertNilErr(t, err)
+		checkDeepEquals(t, stats.From, 4)
+		n, err = ReadShardCount(af.NewOsFs(), dir)
+		assertNilErr(t, err)
+		checkDeepEquals(t, n, 1)
+		checkDeepEquals(t, contents(t, dir, 1), want)
+	})
+
+	// Test Case 2: invalid shard counts leave the database alone
+	t.Run("invalid", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "db")
+		want := populate(t, dir, 3)
+
+		_, err := Reshard(af.NewOsFs(), dir, 0)
+		assertErr(t, err)
+		assertNilErr(t, os.MkdirAll(filepath.Join(dir, ".smoldb"), 0755))
+		assertNilErr(t, os.WriteFile(shardLayoutPath(dir), []byte(`{"shards":0}`), 0644))
+		_, err = Reshard(af.NewOsFs(), dir, 2)
+		assertErr(t, err)
+		assertNilErr(t, os.Remove(shardLayoutPath(dir)))
+		checkDeepEquals(t, contents(t, dir, 1), want)
+	})
+}
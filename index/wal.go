@@ -1,17 +1,18 @@
 package index
 
 import (
-	"bufio"
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	af "github.com/spf13/afero"
 	"github.com/themillenniumfalcon/smolDB/log"
+	"github.com/themillenniumfalcon/smolDB/metrics"
 )
 
 // DurabilityLevel controls when we fsync WAL appends
@@ -32,35 +33,72 @@ const (
 	SyncDSync // best-effort; mapped to fsync for portability
 )
 
+// ParseDurability returns the durability level with the given name as used
+// by the CLI
+func ParseDurability(name string) (DurabilityLevel, error) {
+	switch name {
+	case "none":
+		return DurabilityNone, nil
+	case "commit":
+		return DurabilityCommit, nil
+	case "grouped":
+		return DurabilityGrouped, nil
+	}
+	return 0, fmt.Errorf("unknown durability '%s' (want none|commit|grouped)", name)
+}
+
+// ParseSyncMode returns the sync mode with the given name as used by the CLI
+func ParseSyncMode(name string) (SyncMode, error) {
+	switch name {
+	case "none":
+		return SyncNone, nil
+	case "fsync":
+		return SyncFsync, nil
+	case "dsync":
+		return SyncDSync, nil
+	}
+	return 0, fmt.Errorf("unknown sync mode '%s' (want none|fsync|dsync)", name)
+}
+
 // WAL operation kinds
 const (
 	opPut    = "PUT"
 	opDelete = "DELETE"
+	opPatch  = "PATCH" // Field holds the field name, Body its JSON value
 	opCommit = "COMMIT"
+	opBatch  = "BATCH" // Body holds the JSON list of the batch's BatchOps
 )
 
-// walEntry is the line-delimited JSON format we append to wal.log
+// walEntry is a single WAL record, V selects how it is encoded in wal.log
+// (see walrecord.go), v1 records are line-delimited JSON
 type walEntry struct {
 	V     int    `json:"v"`
 	Op    string `json:"op"`
 	Key   string `json:"key"`
 	Field string `json:"field,omitempty"`
 	Body  string `json:"body,omitempty"`
+	LSN   uint64 `json:"lsn,omitempty"` // log sequence number, 0 for commit markers and legacy records
 	Ts    int64  `json:"ts"`
 	Csum  uint32 `json:"csum"`
 }
 
-// WAL encapsulates write-ahead logging
+// WAL encapsulates write-ahead logging, appends go to the active segment
+// .smoldb/wal.log, checkpoints seal it into .smoldb/wal-<first lsn>.log
 type WAL struct {
-	fs                   af.Fs
-	file                 af.File
-	dir                  string
-	durability           DurabilityLevel
-	groupMs              int
-	groupBatch           int
-	appendCnt            int
-	syncMode             SyncMode
-	lastCheckpointOffset int64
+	fs         af.Fs
+	file       af.File
+	dir        string
+	durability DurabilityLevel
+	groupMs    int
+	groupBatch int
+	appendCnt  int
+	unsynced   int // records appended since the last sync
+	syncMode   SyncMode
+	format     WALFormat
+	compress   bool
+	lsn        uint64        // last assigned log sequence number
+	segFirst   uint64        // first LSN in the active segment, 0 while it is empty
+	appended   chan struct{} // closed and replaced after every append
 }
 
 func newWAL(fs af.Fs, dir string, durability DurabilityLevel, groupMs int, groupBatch int, syncMode SyncMode) (*WAL, error) {
@@ -69,30 +107,86 @@ func newWAL(fs af.Fs, dir string, durability DurabilityLevel, groupMs int, group
 	if err := fs.MkdirAll(walDir, 0o755); err != nil {
 		return nil, err
 	}
-	walPath := filepath.Join(walDir, "wal.log")
+
+	w := &WAL{fs: fs, dir: dir, durability: durability, groupMs: groupMs, groupBatch: groupBatch, syncMode: syncMode, format: WALFormatJSON, appended: make(chan struct{})}
+
+	// pick up the LSN sequence where the previous process left it
+	if err := w.scan(func(path string, e walEntry) {
+		if e.LSN > w.lsn {
+			w.lsn = e.LSN
+		}
+		if path == w.activePath() && w.segFirst == 0 && e.LSN > 0 {
+			w.segFirst = e.LSN
+		}
+	}); err != nil {
+		return nil, err
+	}
+
 	// open append-only
-	f, err := fs.OpenFile(walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	f, err := fs.OpenFile(w.activePath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
 	if err != nil {
 		return nil, err
 	}
-	return &WAL{fs: fs, file: f, dir: dir, durability: durability, groupMs: groupMs, groupBatch: groupBatch, syncMode: syncMode}, nil
+	w.file = f
+	return w, nil
+}
+
+// path of the active segment new records are appended to
+func (w *WAL) activePath() string {
+	return filepath.Join(w.dir, ".smoldb", "wal.log")
 }
 
-// Append writes one entry to the WAL and optionally fsyncs
-func (w *WAL) Append(entry walEntry) error {
+// Append writes one entry to the WAL and optionally fsyncs,
+// returns the LSN assigned to the entry
+func (w *WAL) Append(entry walEntry) (uint64, error) {
 	if w == nil || w.file == nil {
-		return fmt.Errorf("wal not initialized")
+		return 0, fmt.Errorf("wal not initialized")
+	}
+	if entry.V == 0 {
+		entry.V = int(w.format)
 	}
-	entry.V = 1
+	entry.LSN = w.lsn + 1
 	entry.Ts = time.Now().UnixNano()
-	entry.Csum = simpleChecksum(entry)
-	bytes, err := json.Marshal(entry)
+	if err := w.write(entry); err != nil {
+		return 0, err
+	}
+	return entry.LSN, nil
+}
+
+// appendAt writes an entry that already carries its LSN and timestamp,
+// as streamed from a leader, the LSN must directly follow the last one
+func (w *WAL) appendAt(entry walEntry) error {
+	if w == nil || w.file == nil {
+		return fmt.Errorf("wal not initialized")
+	}
+	if entry.LSN != w.lsn+1 {
+		return fmt.Errorf("wal: expected lsn %d, got %d", w.lsn+1, entry.LSN)
+	}
+	entry.V = int(w.format)
+	return w.write(entry)
+}
+
+// encodes and writes an entry, syncs according to the durability level and
+// wakes up anyone waiting for the next append
+func (w *WAL) write(entry walEntry) error {
+	start := time.Now()
+	defer func() { walAppendSeconds.Observe(metrics.Since(start)) }()
+
+	bytes, err := encodeWALEntry(entry, w.compress)
 	if err != nil {
 		return err
 	}
-	if _, err = w.file.Write(append(bytes, '\n')); err != nil {
+	if _, err = w.file.Write(bytes); err != nil {
 		return err
 	}
+	walBytes.Add(float64(len(bytes)))
+	w.unsynced++
+	w.lsn = entry.LSN
+	if w.segFirst == 0 {
+		w.segFirst = entry.LSN
+	}
+	defer w.notify()
+
 	switch w.durability {
 	case DurabilityCommit:
 		w.doSync()
@@ -114,135 +208,251 @@ func (w *WAL) Append(entry walEntry) error {
 	return nil
 }
 
+// wakes up everyone waiting on the current appended channel
+func (w *WAL) notify() {
+	close(w.appended)
+	w.appended = make(chan struct{})
+}
+
+// LastLSN returns the LSN of the most recent append
+func (w *WAL) LastLSN() uint64 {
+	if w == nil {
+		return 0
+	}
+	return w.lsn
+}
+
 // doSync performs the actual sync according to syncMode
 func (w *WAL) doSync() {
 	// write an explicit COMMIT marker to denote a durability boundary
-	commit := walEntry{V: 1, Op: opCommit, Ts: time.Now().UnixNano(), Csum: simpleChecksum(walEntry{Op: opCommit})}
-	bytes, err := json.Marshal(commit)
+	commit := walEntry{V: int(w.format), Op: opCommit, Ts: time.Now().UnixNano()}
+	bytes, err := encodeWALEntry(commit, false)
 	if err == nil {
-		_, _ = w.file.Write(append(bytes, '\n'))
+		if _, err := w.file.Write(bytes); err == nil {
+			walBytes.Add(float64(len(bytes)))
+		}
+	}
+	if w.durability == DurabilityGrouped {
+		groupCommitBatch.Observe(float64(w.unsynced))
 	}
+	w.unsynced = 0
 
 	switch w.syncMode {
 	case SyncNone:
 		// no fsync; commit marker still appended for auditing
 		return
 	case SyncFsync, SyncDSync:
+		start := time.Now()
 		_ = w.file.Sync()
+		walFsyncSeconds.Observe(metrics.Since(start))
 	}
 }
 
-// Close WAL file handle
+// Close commits the records grouped durability appended since the last
+// sync, or just syncs the file, and closes the WAL file handle
 func (w *WAL) Close() error {
 	if w == nil || w.file == nil {
 		return nil
 	}
-	return w.file.Close()
+	if w.durability == DurabilityGrouped && w.unsynced > 0 {
+		w.doSync()
+	} else if w.syncMode != SyncNone {
+		w.file.Sync()
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
 }
 
-// TruncateAt physically truncates the WAL file at the given offset
-// This is used after successful checkpoint creation to prevent WAL from growing indefinitely
-func (w *WAL) TruncateAt(offset int64) error {
+// rotate seals the active segment under its first LSN and starts a new one,
+// it is a no-op while the active segment is empty
+func (w *WAL) rotate() error {
 	if w == nil || w.file == nil {
 		return fmt.Errorf("wal not initialized")
 	}
+	if w.segFirst == 0 {
+		return nil
+	}
 
-	// Close current file handle
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL segment: %v", err)
+	}
 	w.file.Close()
 
-	// Open file with truncate option
-	walPath := filepath.Join(w.dir, ".smoldb", "wal.log")
-	tmpPath := walPath + ".tmp"
-
-	// Create new file with content up to offset
-	srcFile, err := w.fs.OpenFile(walPath, os.O_RDONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open WAL for truncation: %v", err)
+	sealed := filepath.Join(w.dir, ".smoldb", fmt.Sprintf("wal-%020d.log", w.segFirst))
+	if err := w.fs.Rename(w.activePath(), sealed); err != nil {
+		// keep appending to the old segment rather than losing the WAL
+		f, openErr := w.fs.OpenFile(w.activePath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if openErr == nil {
+			w.file = f
+		}
+		return fmt.Errorf("failed to seal WAL segment: %v", err)
 	}
-	defer srcFile.Close()
 
-	tmpFile, err := w.fs.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := w.fs.OpenFile(w.activePath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
 	if err != nil {
-		return fmt.Errorf("failed to create temporary WAL: %v", err)
+		return fmt.Errorf("failed to open new WAL segment: %v", err)
 	}
+	w.file = f
+	w.segFirst = 0
+	return nil
+}
 
-	// Copy content up to offset
-	if _, err := io.CopyN(tmpFile, srcFile, offset); err != nil {
-		tmpFile.Close()
-		w.fs.Remove(tmpPath)
-		return fmt.Errorf("failed to copy WAL content: %v", err)
-	}
-	tmpFile.Close()
+// segments returns the sealed segments in LSN order followed by the active one
+func (w *WAL) segments() ([]string, error) {
+	return walSegments(w.fs, w.dir)
+}
 
-	// Atomic rename
-	if err := w.fs.Rename(tmpPath, walPath); err != nil {
-		w.fs.Remove(tmpPath)
-		return fmt.Errorf("failed to rename truncated WAL: %v", err)
+// sealedSegments returns the sealed segments, i.e. all but the active one
+func (w *WAL) sealedSegments() ([]string, error) {
+	paths, err := w.segments()
+	if err != nil {
+		return nil, err
 	}
+	if len(paths) > 0 && paths[len(paths)-1] == w.activePath() {
+		paths = paths[:len(paths)-1]
+	}
+	return paths, nil
+}
 
-	// Reopen WAL for appending
-	f, err := w.fs.OpenFile(walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+// scan reads every record of every segment in order, stopping a segment
+// at its first torn record
+func (w *WAL) scan(fn func(path string, e walEntry)) error {
+	paths, err := w.segments()
 	if err != nil {
-		return fmt.Errorf("failed to reopen WAL after truncation: %v", err)
+		return err
 	}
-	w.file = f
 
+	for _, path := range paths {
+		f, err := w.fs.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		reader := newWALReader(f, 0)
+		for {
+			e, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				// anything after a torn record was never acknowledged
+				log.Warn("wal: stopping read of %s at offset %d: %s", filepath.Base(path), reader.offset, err.Error())
+				break
+			}
+			fn(path, e)
+		}
+		f.Close()
+	}
 	return nil
 }
 
-// Replay scans wal.log and re-applies any operations to reach a consistent state
+// Replay scans the WAL segments and re-applies any operations newer than
+// the index's checkpoint to reach a consistent state
 func (w *WAL) Replay(idx *FileIndex) error {
-	walPath := filepath.Join(w.dir, ".smoldb", "wal.log")
-	f, err := w.fs.OpenFile(walPath, os.O_RDONLY, 0)
-	if err != nil {
-		// no WAL yet
-		if os.IsNotExist(err) {
-			return nil
+	return w.scan(func(_ string, e walEntry) {
+		// records without an LSN predate LSNs and are always applied
+		if e.LSN != 0 && e.LSN <= idx.checkpointLSN {
+			return
 		}
-		return err
+		idx.applyEntry(e)
+		recoveryHook(stageReplayEntry)
+	})
+}
+
+// applies a single WAL record to the files and the index,
+// callers must hold the index write lock
+func (i *FileIndex) applyEntry(e walEntry) {
+	if e.Op == opBatch {
+		i.applyBatchEntry(e)
+		return
+	}
+	file := i.newFile(e.Key)
+	if indexed, ok := i.index[e.Key]; ok {
+		file = indexed
 	}
-	defer f.Close()
 
-	// If we have a checkpoint offset, seek to it
-	if w.lastCheckpointOffset > 0 {
-		if _, err := f.Seek(w.lastCheckpointOffset, 0); err != nil {
-			log.Warn("wal: failed to seek to checkpoint offset: %v", err)
-			// Fall back to full replay
-			if _, err := f.Seek(0, 0); err != nil {
-				return err
-			}
+	// documents whose metadata already reflects this record don't need
+	// rewriting, their files were fully written before the metadata
+	if e.LSN != 0 && (e.Op == opPut || e.Op == opPatch) && file.appliedLSN() >= e.LSN {
+		i.index[file.FileName] = file
+		return
+	}
+
+	switch e.Op {
+	case opPut:
+		if err := file.writeContent(e.Body, e.LSN); err != nil {
+			log.Warn("wal: put apply failed for key '%s': %s", e.Key, err.Error())
+			return
+		}
+		i.index[file.FileName] = file
+	case opDelete:
+		if err := file.Delete(); err != nil && !os.IsNotExist(err) {
+			log.Warn("wal: delete apply failed for key '%s': %s", e.Key, err.Error())
 		}
+		delete(i.index, file.FileName)
+	case opPatch:
+		if err := file.applyPatch(e.Field, []byte(e.Body), e.LSN); err != nil {
+			log.Warn("wal: patch apply failed for key '%s': %s", e.Key, err.Error())
+			return
+		}
+		i.index[file.FileName] = file
 	}
+}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
+// lists the WAL segments of dir, sealed ones sorted by first LSN followed
+// by the active wal.log
+func walSegments(fs af.Fs, dir string) ([]string, error) {
+	walDir := filepath.Join(dir, ".smoldb")
+	entries, err := af.ReadDir(fs, walDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var sealed []string
+	active := ""
+	for _, entry := range entries {
+		if entry.IsDir() {
 			continue
 		}
-		var e walEntry
-		if err := json.Unmarshal([]byte(line), &e); err != nil {
-			log.Warn("wal: skipping malformed line: %s", err.Error())
-			break
+		if entry.Name() == "wal.log" {
+			active = filepath.Join(walDir, entry.Name())
+			continue
 		}
-		file := &File{FileName: e.Key}
-		switch e.Op {
-		case opPut:
-			if err := file.ReplaceContent(e.Body); err != nil {
-				log.Warn("wal: put apply failed for key '%s': %s", e.Key, err.Error())
-			}
-			idx.index[file.FileName] = file
-		case opDelete:
-			if err := file.Delete(); err != nil {
-				log.Warn("wal: delete apply failed for key '%s': %s", e.Key, err.Error())
-			}
-			delete(idx.index, file.FileName)
+		if _, ok := segmentFirstLSN(entry.Name()); ok {
+			sealed = append(sealed, filepath.Join(walDir, entry.Name()))
 		}
 	}
-	return nil
+
+	// zero padded names sort in LSN order
+	sort.Strings(sealed)
+	if active != "" {
+		sealed = append(sealed, active)
+	}
+	return sealed, nil
+}
+
+// parses the first LSN out of a sealed segment name (wal-<lsn>.log)
+func segmentFirstLSN(path string) (uint64, bool) {
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, "wal-") || !strings.HasSuffix(name, ".log") {
+		return 0, false
+	}
+	lsn, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "wal-"), ".log"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return lsn, true
 }
 
-// simpleChecksum computes a lightweight checksum over key/op/body
+// simpleChecksum computes a lightweight checksum over key/op/body,
+// field and LSN are mixed in when set so older records still verify
 func simpleChecksum(e walEntry) uint32 {
 	const offset32 uint32 = 2166136261
 	const prime32 uint32 = 16777619
@@ -259,5 +469,15 @@ func simpleChecksum(e walEntry) uint32 {
 		sum ^= uint32(b)
 		sum *= prime32
 	}
+	for _, b := range []byte(e.Field) {
+		sum ^= uint32(b)
+		sum *= prime32
+	}
+	if e.LSN != 0 {
+		for _, b := range []byte(strconv.FormatUint(e.LSN, 10)) {
+			sum ^= uint32(b)
+			sum *= prime32
+		}
+	}
 	return sum
 }
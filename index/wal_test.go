@@ -0,0 +1,235 @@
+// provides tests for the write-ahead log record formats and replay
+package index
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	af "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// reads back every record currently in the WAL
+func readWAL(t *testing.T) []walEntry {
+	t.Helper()
+
+	data, err := af.ReadFile(I.FileSystem, filepath.Join(".smoldb", "wal.log"))
+	assertNilErr(t, err)
+
+	var entries []walEntry
+	reader := newWALReader(bytes.NewReader(data), 0)
+	for {
+		e, err := reader.Next()
+		if err == io.EOF {
+			return entries
+		}
+		assertNilErr(t, err)
+		if err != nil {
+			return entries
+		}
+		entries = append(entries, e)
+	}
+}
+
+// drops the index and the document files so replay has to recreate them
+func forgetDocuments(keys ...string) {
+	for _, key := range keys {
+		I.FileSystem.Remove(key + ".json")
+	}
+	I.index = map[string]*File{}
+}
+
+// verifies encoding and decoding of binary (v2) records
+func TestWALBinaryRecord(t *testing.T) {
+	// Test Case 1: plain record round trip
+	t.Run("binary record round trip", func(t *testing.T) {
+		e := walEntry{V: int(WALFormatBinary), Op: opPut, Key: "k", Body: `{"a":"b"}`, Ts: 42}
+		rec, err := encodeWALEntry(e, false)
+		assertNilErr(t, err)
+
+		got, err := newWALReader(bytes.NewReader(rec), 0).Next()
+		assertNilErr(t, err)
+		assert.Equal(t, e.Op, got.Op)
+		assert.Equal(t, e.Key, got.Key)
+		assert.Equal(t, e.Body, got.Body)
+		assert.Equal(t, e.Ts, got.Ts)
+	})
+
+	// Test Case 2: large bodies are compressed and still round trip
+	t.Run("compressed record round trip", func(t *testing.T) {
+		body := `{"text":"` + strings.Repeat("smoldb ", 200) + `"}`
+		e := walEntry{V: int(WALFormatBinary), Op: opPut, Key: "big", Body: body}
+
+		plain, err := encodeWALEntry(e, false)
+		assertNilErr(t, err)
+		packed, err := encodeWALEntry(e, true)
+		assertNilErr(t, err)
+		assert.Less(t, len(packed), len(plain))
+		assert.Equal(t, flagCompressed, packed[1]&flagCompressed)
+
+		got, err := newWALReader(bytes.NewReader(packed), 0).Next()
+		assertNilErr(t, err)
+		assert.Equal(t, body, got.Body)
+	})
+
+	// Test Case 3: binary records are smaller than escaped JSON records
+	t.Run("binary smaller than json", func(t *testing.T) {
+		body := `{"nested":{"quote":"\"hi\"","list":[1,2,3]}}`
+		v1, err := encodeWALEntry(walEntry{V: int(WALFormatJSON), Op: opPut, Key: "k", Body: body}, false)
+		assertNilErr(t, err)
+		v2, err := encodeWALEntry(walEntry{V: int(WALFormatBinary), Op: opPut, Key: "k", Body: body}, false)
+		assertNilErr(t, err)
+		assert.Less(t, len(v2), len(v1))
+	})
+
+	// Test Case 4: a flipped bit is caught by the CRC
+	t.Run("corrupt record detected", func(t *testing.T) {
+		rec, err := encodeWALEntry(walEntry{V: int(WALFormatBinary), Op: opPut, Key: "k", Body: "{}"}, false)
+		assertNilErr(t, err)
+		rec[len(rec)-6] ^= 0xff
+
+		_, err = newWALReader(bytes.NewReader(rec), 0).Next()
+		assert.Equal(t, errTornRecord, err)
+	})
+}
+
+// verifies that replay understands logs holding both record formats
+func TestWALReplayFormats(t *testing.T) {
+	// Test Case 1: v1 and v2 records in the same log
+	t.Run("replay mixed json and binary log", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		assertNilErr(t, I.Put(&File{FileName: "old"}, []byte(`{"format":"json"}`)))
+		I.SetWALFormat(WALFormatBinary, true)
+		assertNilErr(t, I.Put(&File{FileName: "new"}, []byte(`{"format":"binary"}`)))
+		assertNilErr(t, I.Delete(&File{FileName: "old"}))
+
+		entries := readWAL(t)
+		assert.Equal(t, 3, len(entries))
+		assert.Equal(t, int(WALFormatJSON), entries[0].V)
+		assert.Equal(t, int(WALFormatBinary), entries[1].V)
+
+		forgetDocuments("new")
+		assertNilErr(t, I.WALReplay())
+
+		assertFileDoesNotExist(t, "old")
+		checkContentEqual(t, "new", map[string]interface{}{"format": "binary"})
+	})
+
+	// Test Case 2: field patches are logged compactly and replayed
+	t.Run("replay patch records", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		file := &File{FileName: "doc"}
+		assertNilErr(t, I.Put(file, []byte(`{"a":1,"b":"big"}`)))
+		assertNilErr(t, I.PatchField(file, "a", 2))
+		I.SetWALFormat(WALFormatBinary, false)
+		assertNilErr(t, I.PatchField(file, "c", map[string]interface{}{"d": true}))
+
+		entries := readWAL(t)
+		assert.Equal(t, 3, len(entries))
+		assert.Equal(t, opPatch, entries[1].Op)
+		assert.Equal(t, "a", entries[1].Field)
+		assert.Equal(t, "2", entries[1].Body)
+		assert.Equal(t, opPatch, entries[2].Op)
+
+		forgetDocuments("doc")
+		assertNilErr(t, I.WALReplay())
+
+		checkContentEqual(t, "doc", map[string]interface{}{
+			"a": 2,
+			"b": "big",
+			"c": map[string]interface{}{"d": true},
+		})
+	})
+
+	// Test Case 3: a partial record at the tail is not applied
+	t.Run("replay stops at torn binary record", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+		I.SetWALFormat(WALFormatBinary, false)
+
+		assertNilErr(t, I.Put(&File{FileName: "whole"}, []byte(`{"ok":true}`)))
+		rec, err := encodeWALEntry(walEntry{V: int(WALFormatBinary), Op: opPut, Key: "torn", Body: `{"ok":false}`}, false)
+		assertNilErr(t, err)
+		_, err = I.wal.file.Write(rec[:len(rec)-3])
+		assertNilErr(t, err)
+
+		forgetDocuments("whole")
+		assertNilErr(t, I.WALReplay())
+
+		assertFileExists(t, "whole")
+		assertFileDoesNotExist(t, "torn")
+	})
+}
+
+// verifies rewriting a log into another record format
+func TestConvertWAL(t *testing.T) {
+	// Test Case 1: json log converted to binary keeps every record
+	t.Run("convert json log to binary", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWAL(DurabilityNone))
+
+		body := `{"text":"` + strings.Repeat("abc", 200) + `"}`
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(body)))
+		assertNilErr(t, I.Put(&File{FileName: "b"}, []byte(`{"b":1}`)))
+		assertNilErr(t, I.Delete(&File{FileName: "b"}))
+		assertNilErr(t, I.wal.Close())
+
+		stats, err := ConvertWAL(I.FileSystem, "", WALFormatBinary, true)
+		assertNilErr(t, err)
+		assert.Equal(t, 3, stats.Records)
+		assert.Less(t, stats.BytesAfter, stats.BytesBefore)
+		assert.False(t, stats.TornTail)
+
+		entries := readWAL(t)
+		assert.Equal(t, 3, len(entries))
+		for _, e := range entries {
+			assert.Equal(t, int(WALFormatBinary), e.V)
+		}
+		assert.Equal(t, body, entries[0].Body)
+		assert.Equal(t, opDelete, entries[2].Op)
+	})
+
+	// Test Case 2: missing WAL is not an error
+	t.Run("convert without wal", func(t *testing.T) {
+		setup()
+
+		stats, err := ConvertWAL(I.FileSystem, "", WALFormatBinary, false)
+		assertNilErr(t, err)
+		assert.Equal(t, 0, stats.Records)
+	})
+}
+
+// verifies that closing an index commits what grouped durability held back
+func TestCloseIndex(t *testing.T) {
+	// Test Case 1: pending grouped records get a commit marker on close
+	t.Run("grouped records are committed", func(t *testing.T) {
+		setup()
+		assertNilErr(t, I.InitWALWithOptions(DurabilityGrouped, 0, 100))
+
+		assertNilErr(t, I.Put(&File{FileName: "a"}, []byte(`{"a":1}`)))
+		assertNilErr(t, I.Put(&File{FileName: "b"}, []byte(`{"b":1}`)))
+		entries := readWAL(t)
+		assert.Equal(t, opPut, entries[len(entries)-1].Op)
+
+		assertNilErr(t, I.Close())
+		entries = readWAL(t)
+		assert.Equal(t, 3, len(entries))
+		assert.Equal(t, opCommit, entries[2].Op)
+	})
+
+	// Test Case 2: writes after close fail rather than skip the WAL
+	t.Run("writes fail after close", func(t *testing.T) {
+		assert.ErrorIs(t, I.Put(&File{FileName: "c"}, []byte(`{}`)), ErrClosed)
+		assert.ErrorIs(t, I.Delete(&File{FileName: "a"}), ErrClosed)
+		assert.ErrorIs(t, I.PatchField(&File{FileName: "a"}, "a", 2), ErrClosed)
+		assertFileDoesNotExist(t, "c")
+		assertNilErr(t, I.Close())
+	})
+}
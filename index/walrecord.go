@@ -0,0 +1,410 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	af "github.com/spf13/afero"
+)
+
+// WALFormat selects the on-disk encoding of WAL records, the value is
+// written as walEntry.V so replay can tell records apart
+type WALFormat int
+
+const (
+	WALFormatJSON   WALFormat = 1 // line-delimited JSON, the original format
+	WALFormatBinary WALFormat = 2 // length-prefixed binary with CRC32C
+)
+
+// binary record layout (v2):
+//
+//	[0]      version byte (2)
+//	[1]      flags
+//	[2:6]    payload length, big endian
+//	[6:6+n]  payload: op, ts, [lsn], key, field, body
+//	[6+n:]   CRC32C over flags, length and payload
+const (
+	walHeaderSize  = 6
+	walTrailerSize = 4
+
+	// flagCompressed marks a body compressed with DEFLATE
+	flagCompressed byte = 1 << 0
+	// flagLSN marks a payload carrying a uvarint LSN after the timestamp
+	flagLSN byte = 1 << 1
+
+	// bodies smaller than this are never worth compressing
+	minCompressSize = 256
+
+	// upper bound on a single record, guards against reading garbage lengths
+	maxRecordSize = 1 << 30
+)
+
+// errTornRecord is returned when the tail of the WAL holds a partial or
+// corrupted record, usually left behind by a crash mid-append
+var errTornRecord = errors.New("wal: torn or corrupt record")
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// op codes used by the binary format
+var opCodes = map[string]byte{
+	opPut:    1,
+	opDelete: 2,
+	opCommit: 3,
+	opPatch:  4,
+	opBatch:  5,
+}
+
+// ParseWALFormat maps a format name to a WALFormat
+func ParseWALFormat(name string) (WALFormat, error) {
+	switch name {
+	case "json", "v1":
+		return WALFormatJSON, nil
+	case "binary", "v2":
+		return WALFormatBinary, nil
+	}
+	return 0, fmt.Errorf("unknown wal format '%s' (want json|binary)", name)
+}
+
+// String returns the name of the format as used by the CLI
+func (f WALFormat) String() string {
+	switch f {
+	case WALFormatJSON:
+		return "json"
+	case WALFormatBinary:
+		return "binary"
+	}
+	return fmt.Sprintf("v%d", int(f))
+}
+
+// encodeWALEntry serializes an entry according to entry.V
+func encodeWALEntry(e walEntry, compress bool) ([]byte, error) {
+	switch WALFormat(e.V) {
+	case WALFormatJSON:
+		e.Csum = simpleChecksum(e)
+		bytes, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		return append(bytes, '\n'), nil
+	case WALFormatBinary:
+		return encodeBinaryEntry(e, compress)
+	}
+	return nil, fmt.Errorf("wal: unsupported record version %d", e.V)
+}
+
+// encodeBinaryEntry builds a v2 record, the body is stored raw or deflated
+func encodeBinaryEntry(e walEntry, compress bool) ([]byte, error) {
+	code, ok := opCodes[e.Op]
+	if !ok {
+		return nil, fmt.Errorf("wal: unknown op '%s'", e.Op)
+	}
+
+	var flags byte
+	body := []byte(e.Body)
+	if compress && len(body) >= minCompressSize {
+		if packed, err := deflate(body); err == nil && len(packed) < len(body) {
+			body = packed
+			flags |= flagCompressed
+		}
+	}
+
+	payload := make([]byte, 0, 9+3*binary.MaxVarintLen32+len(e.Key)+len(e.Field)+len(body))
+	payload = append(payload, code)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(e.Ts))
+	if e.LSN != 0 {
+		flags |= flagLSN
+		payload = binary.AppendUvarint(payload, e.LSN)
+	}
+	payload = appendBytes(payload, []byte(e.Key))
+	payload = appendBytes(payload, []byte(e.Field))
+	payload = appendBytes(payload, body)
+
+	rec := make([]byte, walHeaderSize, walHeaderSize+len(payload)+walTrailerSize)
+	rec[0] = byte(WALFormatBinary)
+	rec[1] = flags
+	binary.BigEndian.PutUint32(rec[2:walHeaderSize], uint32(len(payload)))
+	rec = append(rec, payload...)
+	rec = binary.BigEndian.AppendUint32(rec, crc32.Checksum(rec[1:], crc32c))
+	return rec, nil
+}
+
+// decodeBinaryPayload parses the payload of a v2 record
+func decodeBinaryPayload(flags byte, payload []byte) (walEntry, error) {
+	e := walEntry{V: int(WALFormatBinary)}
+	if len(payload) < 9 {
+		return e, errTornRecord
+	}
+
+	op := ""
+	for name, code := range opCodes {
+		if code == payload[0] {
+			op = name
+			break
+		}
+	}
+	if op == "" {
+		return e, fmt.Errorf("wal: unknown op code %d", payload[0])
+	}
+	e.Op = op
+	e.Ts = int64(binary.BigEndian.Uint64(payload[1:9]))
+
+	rest := payload[9:]
+	if flags&flagLSN != 0 {
+		lsn, read := binary.Uvarint(rest)
+		if read <= 0 {
+			return e, errTornRecord
+		}
+		e.LSN = lsn
+		rest = rest[read:]
+	}
+	var key, field, body []byte
+	var err error
+	if key, rest, err = readBytes(rest); err != nil {
+		return e, err
+	}
+	if field, rest, err = readBytes(rest); err != nil {
+		return e, err
+	}
+	if body, _, err = readBytes(rest); err != nil {
+		return e, err
+	}
+	if flags&flagCompressed != 0 {
+		if body, err = inflate(body); err != nil {
+			return e, fmt.Errorf("wal: failed to inflate body: %v", err)
+		}
+	}
+
+	e.Key = string(key)
+	e.Field = string(field)
+	e.Body = string(body)
+	return e, nil
+}
+
+// appends a uvarint length followed by the bytes themselves
+func appendBytes(dst []byte, b []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+// reads a uvarint length-prefixed byte slice and returns the remainder
+func readBytes(src []byte) ([]byte, []byte, error) {
+	n, read := binary.Uvarint(src)
+	if read <= 0 || uint64(len(src)-read) < n {
+		return nil, nil, errTornRecord
+	}
+	src = src[read:]
+	return src[:n], src[n:], nil
+}
+
+func deflate(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func inflate(b []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// walReader decodes a WAL that may hold a mix of v1 and v2 records
+type walReader struct {
+	r      *bufio.Reader
+	offset int64 // offset of the next unread byte
+}
+
+func newWALReader(r io.Reader, offset int64) *walReader {
+	return &walReader{r: bufio.NewReaderSize(r, 64*1024), offset: offset}
+}
+
+// Next returns the next record, io.EOF at a clean end of log and
+// errTornRecord when the remaining bytes don't form a valid record
+func (wr *walReader) Next() (walEntry, error) {
+	for {
+		b, err := wr.r.Peek(1)
+		if err != nil {
+			if err == io.EOF {
+				return walEntry{}, io.EOF
+			}
+			return walEntry{}, err
+		}
+
+		switch b[0] {
+		case '\n', '\r', ' ', '\t':
+			_, _ = wr.r.ReadByte()
+			wr.offset++
+			continue
+		case '{':
+			return wr.nextJSON()
+		case byte(WALFormatBinary):
+			return wr.nextBinary()
+		default:
+			return walEntry{}, errTornRecord
+		}
+	}
+}
+
+// reads one line-delimited JSON (v1) record
+func (wr *walReader) nextJSON() (walEntry, error) {
+	line, err := wr.r.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return walEntry{}, err
+	}
+	wr.offset += int64(len(line))
+
+	var e walEntry
+	if err := json.Unmarshal(bytes.TrimSpace(line), &e); err != nil {
+		return walEntry{}, errTornRecord
+	}
+	if e.V == 0 {
+		e.V = int(WALFormatJSON)
+	}
+	if e.Csum != simpleChecksum(e) {
+		return walEntry{}, errTornRecord
+	}
+	return e, nil
+}
+
+// reads one length-prefixed binary (v2) record
+func (wr *walReader) nextBinary() (walEntry, error) {
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(wr.r, header); err != nil {
+		return walEntry{}, errTornRecord
+	}
+	size := binary.BigEndian.Uint32(header[2:])
+	if size > maxRecordSize {
+		return walEntry{}, errTornRecord
+	}
+
+	rest := make([]byte, int(size)+walTrailerSize)
+	if _, err := io.ReadFull(wr.r, rest); err != nil {
+		return walEntry{}, errTornRecord
+	}
+	payload := rest[:size]
+
+	crc := crc32.New(crc32c)
+	crc.Write(header[1:])
+	crc.Write(payload)
+	if crc.Sum32() != binary.BigEndian.Uint32(rest[size:]) {
+		return walEntry{}, errTornRecord
+	}
+
+	e, err := decodeBinaryPayload(header[1], payload)
+	if err != nil {
+		return walEntry{}, errTornRecord
+	}
+	e.Csum = binary.BigEndian.Uint32(rest[size:])
+	wr.offset += int64(walHeaderSize + len(rest))
+	return e, nil
+}
+
+// WALConvertStats reports the outcome of a WAL format conversion
+type WALConvertStats struct {
+	Segments    int
+	Records     int
+	BytesBefore int64
+	BytesAfter  int64
+	TornTail    bool // a partial record at the end of a segment was dropped
+}
+
+// ConvertWAL rewrites every WAL segment of dir with each record encoded in
+// the given format, each segment is replaced through an atomic rename and
+// this must not be run while a server has the WAL open
+func ConvertWAL(fs af.Fs, dir string, format WALFormat, compress bool) (*WALConvertStats, error) {
+	stats := &WALConvertStats{}
+
+	paths, err := walSegments(fs, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WAL segments: %v", err)
+	}
+	for _, path := range paths {
+		if err := convertSegment(fs, path, format, compress, stats); err != nil {
+			return nil, err
+		}
+		stats.Segments++
+	}
+	return stats, nil
+}
+
+// rewrites a single segment file in the given format
+func convertSegment(fs af.Fs, path string, format WALFormat, compress bool, stats *WALConvertStats) error {
+	tmpPath := path + ".convert"
+
+	src, err := fs.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL: %v", err)
+	}
+	defer src.Close()
+	if info, err := src.Stat(); err == nil {
+		stats.BytesBefore += info.Size()
+	}
+
+	dst, err := fs.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create converted WAL: %v", err)
+	}
+	fail := func(err error) error {
+		dst.Close()
+		fs.Remove(tmpPath)
+		return err
+	}
+
+	out := bufio.NewWriter(dst)
+	reader := newWALReader(src, 0)
+	for {
+		e, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == errTornRecord {
+			stats.TornTail = true
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		e.V = int(format)
+		rec, err := encodeWALEntry(e, compress)
+		if err != nil {
+			return fail(err)
+		}
+		if _, err := out.Write(rec); err != nil {
+			return fail(fmt.Errorf("failed to write converted WAL: %v", err))
+		}
+		stats.Records++
+		stats.BytesAfter += int64(len(rec))
+	}
+
+	if err := out.Flush(); err == nil {
+		err = dst.Sync()
+	}
+	if err != nil {
+		return fail(fmt.Errorf("failed to flush converted WAL: %v", err))
+	}
+	dst.Close()
+
+	if err := fs.Rename(tmpPath, path); err != nil {
+		fs.Remove(tmpPath)
+		return fmt.Errorf("failed to replace WAL: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+// provides rate limits per client, token buckets with separate read and
+// write budgets, and admission control capping the requests served at
+// once with a bounded queue for the ones waiting
+package limit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// classes of requests with their own budget
+const (
+	Read  = "read"
+	Write = "write"
+)
+
+// ErrQueueFull is returned by Admit when every slot is taken and the queue
+// is full, ErrQueueTimeout when a request waited too long for a slot
+var (
+	ErrQueueFull    = errors.New("too many requests in flight")
+	ErrQueueTimeout = errors.New("timed out waiting for a request slot")
+)
+
+// Config sets the limits, a zero value turns its limit off. Rates are in
+// requests per second per client, bursts are how many requests a client
+// may send at once and default to the rate. At most MaxInFlight requests
+// are served at once, MaxQueue more wait up to QueueTimeout for a slot
+type Config struct {
+	ReadRate     float64
+	ReadBurst    int
+	WriteRate    float64
+	WriteBurst   int
+	MaxInFlight  int
+	MaxQueue     int
+	QueueTimeout time.Duration
+}
+
+// Validate rejects negative limits
+func (c Config) Validate() error {
+	if c.ReadRate < 0 || c.ReadBurst < 0 || c.WriteRate < 0 || c.WriteBurst < 0 {
+		return fmt.Errorf("rate limits can't be negative")
+	}
+	if c.MaxInFlight < 0 || c.MaxQueue < 0 || c.QueueTimeout < 0 {
+		return fmt.Errorf("admission limits can't be negative")
+	}
+	return nil
+}
+
+// returns the rate and the burst of a class, a burst is at least one
+// request
+func (c Config) budget(class string) (float64, float64) {
+	rate, burst := c.ReadRate, c.ReadBurst
+	if class == Write {
+		rate, burst = c.WriteRate, c.WriteBurst
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return rate, math.Max(float64(burst), 1)
+}
+
+// buckets of clients that were idle long enough to be full again are
+// dropped this often
+const pruneInterval = time.Minute
+
+// a client's budget of one class
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// identifies a bucket
+type bucketKey struct {
+	client string
+	class  string
+}
+
+// Limiter enforces a Config, it is safe for concurrent use
+type Limiter struct {
+	mu        sync.Mutex
+	cfg       Config
+	buckets   map[bucketKey]*bucket
+	lastPrune time.Time
+	inFlight  int
+	waiting   []chan struct{}
+
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// New returns a limiter enforcing cfg
+func New(cfg Config) *Limiter {
+	return &Limiter{cfg: cfg, buckets: map[bucketKey]*bucket{}, now: time.Now}
+}
+
+// Configure replaces the limits, clients keep the budget they have left
+// and waiting requests are admitted if there is room for them now
+func (l *Limiter) Configure(cfg Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg
+	l.grant()
+}
+
+// Config returns the limits in effect
+func (l *Limiter) Config() Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cfg
+}
+
+// Allow takes a request of class from the budget of client. When the
+// budget is spent it returns false and how long until the next request
+// would be allowed
+func (l *Limiter) Allow(client, class string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rate, burst := l.cfg.budget(class)
+	if rate <= 0 {
+		return true, 0
+	}
+	now := l.now()
+	if now.Sub(l.lastPrune) >= pruneInterval {
+		l.prune(now)
+	}
+
+	key := bucketKey{client, class}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+rate*now.Sub(b.last).Seconds())
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// drops the buckets that refilled since their last request, a client
+// coming back gets a full one anyway
+func (l *Limiter) prune(now time.Time) {
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		rate, burst := l.cfg.budget(key.class)
+		if rate <= 0 || b.tokens+rate*now.Sub(b.last).Seconds() >= burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Admit waits for a slot to serve a request in, release has to be called
+// once the request is served. Without a free slot the request is queued,
+// when the queue is full or the wait exceeds the timeout, or ctx ends, an
+// error is returned
+func (l *Limiter) Admit(ctx context.Context) (release func(), err error) {
+	l.mu.Lock()
+	max := l.cfg.MaxInFlight
+	if max <= 0 || l.inFlight < max && len(l.waiting) == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return l.release, nil
+	}
+	if len(l.waiting) >= l.cfg.MaxQueue {
+		l.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	ready := make(chan struct{})
+	l.waiting = append(l.waiting, ready)
+	var timeout <-chan time.Time
+	if l.cfg.QueueTimeout > 0 {
+		timer := time.NewTimer(l.cfg.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return l.release, nil
+	case <-timeout:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-ready:
+		// the slot was handed over while giving up, pass it on
+		l.inFlight--
+		l.grant()
+	default:
+		for k, w := range l.waiting {
+			if w == ready {
+				l.waiting = append(l.waiting[:k], l.waiting[k+1:]...)
+				break
+			}
+		}
+	}
+	return nil, err
+}
+
+// frees the slot of a served request
+func (l *Limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.grant()
+}
+
+// hands free slots to the requests waiting longest, the caller holds mu
+func (l *Limiter) grant() {
+	for len(l.waiting) > 0 && (l.cfg.MaxInFlight <= 0 || l.inFlight < l.cfg.MaxInFlight) {
+		close(l.waiting[0])
+		l.waiting = l.waiting[1:]
+		l.inFlight++
+	}
+}
+
+// InFlight returns the number of requests being served
+func (l *Limiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
+
+// Queued returns the number of requests waiting for a slot
+func (l *Limiter) Queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.waiting)
+}
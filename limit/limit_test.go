@@ -0,0 +1,112 @@
+package limit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	// Test Case 1: a client may send its burst, then one request per token
+	// refilled, reads and writes and other clients have their own budget
+	t.Run("rate", func(t *testing.T) {
+		now := time.Unix(0, 0)
+		l := New(Config{ReadRate: 2, WriteRate: 1, WriteBurst: 3})
+		l.now = func() time.Time { return now }
+
+		for k := 0; k < 3; k++ {
+			ok, _ := l.Allow("alice", Write)
+			assert.True(t, ok)
+		}
+		ok, wait := l.Allow("alice", Write)
+		assert.False(t, ok)
+		assert.Equal(t, time.Second, wait)
+
+		ok, _ = l.Allow("bob", Write)
+		assert.True(t, ok)
+		for k := 0; k < 2; k++ {
+			ok, _ = l.Allow("alice", Read)
+			assert.True(t, ok)
+		}
+		ok, wait = l.Allow("alice", Read)
+		assert.False(t, ok)
+		assert.Equal(t, 500*time.Millisecond, wait)
+
+		now = now.Add(time.Second)
+		ok, _ = l.Allow("alice", Write)
+		assert.True(t, ok)
+		ok, _ = l.Allow("alice", Write)
+		assert.False(t, ok)
+
+		// idle clients are forgotten, a higher rate applies right away
+		now = now.Add(time.Hour)
+		l.Allow("carol", Read)
+		assert.Len(t, l.buckets, 1)
+		l.Configure(Config{WriteRate: 10})
+		for k := 0; k < 10; k++ {
+			ok, _ = l.Allow("alice", Write)
+			assert.True(t, ok)
+		}
+		ok, _ = l.Allow("alice", Read)
+		assert.True(t, ok)
+	})
+
+	// Test Case 2: requests beyond the cap wait in order for a slot, the
+	// queue is bounded and waiting times out
+	t.Run("admission", func(t *testing.T) {
+		l := New(Config{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: time.Minute})
+		release, err := l.Admit(context.Background())
+		assert.NoError(t, err)
+
+		admitted := make(chan func())
+		go func() {
+			r, err := l.Admit(context.Background())
+			assert.NoError(t, err)
+			admitted <- r
+		}()
+		assert.Eventually(t, func() bool { return l.Queued() == 1 }, time.Second, time.Millisecond)
+		_, err = l.Admit(context.Background())
+		assert.ErrorIs(t, err, ErrQueueFull)
+
+		release()
+		second := <-admitted
+		assert.Equal(t, 1, l.InFlight())
+		assert.Equal(t, 0, l.Queued())
+
+		l.Configure(Config{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: 10 * time.Millisecond})
+		_, err = l.Admit(context.Background())
+		assert.ErrorIs(t, err, ErrQueueTimeout)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = l.Admit(ctx)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, 0, l.Queued())
+
+		second()
+		assert.Equal(t, 0, l.InFlight())
+	})
+
+	// Test Case 3: raising the cap admits waiting requests
+	t.Run("configure", func(t *testing.T) {
+		l := New(Config{MaxInFlight: 1, MaxQueue: 4})
+		release, err := l.Admit(context.Background())
+		assert.NoError(t, err)
+		admitted := make(chan func())
+		go func() {
+			r, _ := l.Admit(context.Background())
+			admitted <- r
+		}()
+		assert.Eventually(t, func() bool { return l.Queued() == 1 }, time.Second, time.Millisecond)
+
+		l.Configure(Config{})
+		(<-admitted)()
+		release()
+		assert.Equal(t, 0, l.InFlight())
+
+		assert.Error(t, Config{ReadRate: -1}.Validate())
+		assert.Error(t, Config{MaxQueue: -1}.Validate())
+		assert.NoError(t, Config{}.Validate())
+	})
+}
@@ -0,0 +1,27 @@
+//go:build !unix
+
+package lock
+
+import "os"
+
+// without advisory locks a lock is held for as long as its owner on this
+// host is running, one on another host is never taken over
+func tryLock(f *os.File) (bool, error) {
+	owner := readInfo(f)
+	if owner == nil {
+		return true, nil
+	}
+	host, _ := os.Hostname()
+	if owner.Host != host || owner.PID == os.Getpid() {
+		return owner.PID == os.Getpid(), nil
+	}
+	_, err := os.FindProcess(owner.PID)
+	return err != nil, nil
+}
+
+// readers aren't tracked without advisory locks
+func tryLockShared(f *os.File) (bool, error) {
+	return true, nil
+}
+
+func unlock(f *os.File) {}
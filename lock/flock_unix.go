@@ -0,0 +1,35 @@
+//go:build unix
+
+package lock
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// takes the advisory lock on f without waiting, reports false when another
+// process holds it. The kernel drops it when the owner exits, however it
+// exits
+func tryLock(f *os.File) (bool, error) {
+	return flock(f, syscall.LOCK_EX)
+}
+
+// takes a shared advisory lock on f, reports false when a process holds it
+// exclusively
+func tryLockShared(f *os.File) (bool, error) {
+	return flock(f, syscall.LOCK_SH)
+}
+
+func flock(f *os.File, how int) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// gives up the advisory lock on f
+func unlock(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,307 @@
+// provides the process lock that keeps a second server off a database
+// directory, an advisory lock on the lock file is held for as long as the
+// owning process runs and the file records who that is
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File is the name of the lock file inside a database directory
+const File = "smoldb_lock"
+
+// ReadersFile is the file read-only processes hold a shared lock on, it is
+// never removed
+const ReadersFile = "smoldb_readers"
+
+// Info identifies the process that owns a lock
+type Info struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+func (i *Info) String() string {
+	if i == nil {
+		return "unknown owner"
+	}
+	return fmt.Sprintf("pid %d on %s since %s", i.PID, i.Host, i.Started.Format(time.RFC3339))
+}
+
+// State is whether a database directory is locked
+type State string
+
+const (
+	// Free means there is no lock file
+	Free State = "free"
+	// Held means a running process holds the lock
+	Held State = "held"
+	// Stale means the lock file outlived its owner, the next server to
+	// start takes it over
+	Stale State = "stale"
+)
+
+// Status describes the lock of a database directory, Owner is nil when the
+// file doesn't say who wrote it. Readers is set while read-only processes
+// have the database open
+type Status struct {
+	State   State  `json:"state"`
+	Path    string `json:"path"`
+	Owner   *Info  `json:"owner,omitempty"`
+	Readers bool   `json:"readers"`
+}
+
+// HeldError is returned when another running process holds the lock
+type HeldError struct {
+	Path  string
+	Owner *Info
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("database is in use, %s is held by %s", e.Path, e.Owner)
+}
+
+// ErrReaders is returned while read-only processes have the database open
+var ErrReaders = errors.New("database is open read-only by other processes")
+
+// Path returns the location of the lock file of dir
+func Path(dir string) string {
+	return filepath.Join(dir, File)
+}
+
+// Lock is a lock held by this process
+type Lock struct {
+	file *os.File
+	path string
+	keep bool // the file outlives the lock
+	// Stale is set when a lock left behind by an unclean shutdown was taken
+	// over, Previous is its owner if the file said
+	Stale    bool
+	Previous *Info
+}
+
+// Acquire locks dir for this process, a stale lock left behind by a process
+// that died is taken over. Fails with a *HeldError while another process
+// holds it
+func Acquire(dir string) (*Lock, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create database directory: %v", err)
+		}
+	}
+	path := Path(dir)
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open lock file: %v", err)
+		}
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+		}
+		if !locked {
+			owner := readInfo(f)
+			f.Close()
+			return nil, &HeldError{Path: path, Owner: owner}
+		}
+
+		// the previous owner may have removed the file between our open and
+		// lock, then the lock is on a file nobody else sees
+		if !samePath(f, path) {
+			unlock(f)
+			f.Close()
+			continue
+		}
+
+		l := &Lock{file: f, path: path, Previous: readInfo(f)}
+		if info, err := f.Stat(); err == nil && info.Size() > 0 {
+			l.Stale = true
+		}
+		if err := l.write(); err != nil {
+			l.Release()
+			return nil, err
+		}
+		return l, nil
+	}
+}
+
+// records this process as the owner
+func (l *Lock) write() error {
+	host, _ := os.Hostname()
+	data, err := json.Marshal(Info{PID: os.Getpid(), Host: host, Started: time.Now().UTC().Truncate(time.Second)})
+	if err != nil {
+		return err
+	}
+	if err := l.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to write lock file: %v", err)
+	}
+	if _, err := l.file.WriteAt(append(data, '\n'), 0); err != nil {
+		return fmt.Errorf("failed to write lock file: %v", err)
+	}
+	return l.file.Sync()
+}
+
+// AcquireShared opens dir for reading next to the server that writes it,
+// any number of processes can hold the shared lock at once and admin tools
+// refuse to run while they do
+func AcquireShared(dir string) (*Lock, error) {
+	path := filepath.Join(dir, ReadersFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+	locked, err := tryLockShared(f)
+	if err == nil && !locked {
+		err = fmt.Errorf("an admin tool is running")
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+	return &Lock{file: f, path: path, keep: true}, nil
+}
+
+// AcquireExclusive keeps read-only processes off dir until it is released,
+// admin tools hold it for their whole run. Fails with ErrReaders while any
+// of them has the database open
+func AcquireExclusive(dir string) (*Lock, error) {
+	path := filepath.Join(dir, ReadersFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+	locked, err := tryLock(f)
+	if err == nil && !locked {
+		err = ErrReaders
+	}
+	if err != nil {
+		f.Close()
+		if err == ErrReaders {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+	return &Lock{file: f, path: path, keep: true}, nil
+}
+
+// Release removes the lock file and then gives up the lock, so the next
+// process always creates a fresh one. A file that was moved or replaced
+// since is left alone. Locks on the readers file only give up the lock
+func (l *Lock) Release() error {
+	if l.keep {
+		unlock(l.file)
+		return l.file.Close()
+	}
+	var err error
+	if samePath(l.file, l.path) {
+		err = os.Remove(l.path)
+	}
+	unlock(l.file)
+	l.file.Close()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Inspect reports whether dir is locked and by whom, without taking the
+// lock over
+func Inspect(dir string) (*Status, error) {
+	path := Path(dir)
+	readers, err := hasReaders(dir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return &Status{State: Free, Path: path, Readers: readers}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+	defer f.Close()
+
+	s := &Status{State: Held, Path: path, Owner: readInfo(f), Readers: readers}
+	locked, err := tryLock(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check lock %s: %v", path, err)
+	}
+	if locked {
+		unlock(f)
+		s.State = Stale
+	}
+	return s, nil
+}
+
+// reports whether read-only processes hold the shared lock of dir
+func hasReaders(dir string) (bool, error) {
+	f, err := os.OpenFile(filepath.Join(dir, ReadersFile), os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open lock file: %v", err)
+	}
+	defer f.Close()
+	locked, err := tryLock(f)
+	if err != nil {
+		return false, fmt.Errorf("failed to check readers: %v", err)
+	}
+	if locked {
+		unlock(f)
+	}
+	return !locked, nil
+}
+
+// Break removes the lock file of dir. A lock a running process holds is
+// only removed with force, that process keeps running and a new server
+// started afterwards doesn't see it
+func Break(dir string, force bool) (*Status, error) {
+	s, err := Inspect(dir)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case s.State == Free:
+		return s, fmt.Errorf("%s isn't locked", dir)
+	case s.State == Held && !force:
+		return s, &HeldError{Path: s.Path, Owner: s.Owner}
+	}
+	if err := os.Remove(s.Path); err != nil && !os.IsNotExist(err) {
+		return s, fmt.Errorf("failed to remove lock file: %v", err)
+	}
+	return s, nil
+}
+
+// reads the owner recorded in a lock file, nil when there is none
+func readInfo(f *os.File) *Info {
+	data, err := io.ReadAll(io.NewSectionReader(f, 0, 1<<16))
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	info := &Info{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil
+	}
+	return info
+}
+
+// reports whether the open file f still is the one at path
+func samePath(f *os.File, path string) bool {
+	opened, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(opened, current)
+}
@@ -0,0 +1,140 @@
+package lock
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLock(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+
+	// Test Case 1: the lock records its owner and keeps others out until it
+	// is released
+	t.Run("held", func(t *testing.T) {
+		l, err := Acquire(dir)
+		assert.NoError(t, err)
+		assert.False(t, l.Stale)
+
+		s, err := Inspect(dir)
+		assert.NoError(t, err)
+		assert.Equal(t, Held, s.State)
+		assert.Equal(t, os.Getpid(), s.Owner.PID)
+		assert.False(t, s.Owner.Started.IsZero())
+
+		_, err = Acquire(dir)
+		var held *HeldError
+		assert.ErrorAs(t, err, &held)
+		assert.Equal(t, os.Getpid(), held.Owner.PID)
+
+		_, err = Break(dir, false)
+		assert.ErrorAs(t, err, &held)
+
+		assert.NoError(t, l.Release())
+		s, err = Inspect(dir)
+		assert.NoError(t, err)
+		assert.Equal(t, Free, s.State)
+	})
+
+	// Test Case 2: a lock file nobody holds is stale and taken over
+	t.Run("stale", func(t *testing.T) {
+		data, _ := json.Marshal(Info{PID: 999999, Host: "elsewhere"})
+		assert.NoError(t, os.WriteFile(Path(dir), data, 0644))
+
+		s, err := Inspect(dir)
+		assert.NoError(t, err)
+		assert.Equal(t, Stale, s.State)
+		assert.Equal(t, 999999, s.Owner.PID)
+
+		l, err := Acquire(dir)
+		assert.NoError(t, err)
+		assert.True(t, l.Stale)
+		assert.Equal(t, "elsewhere", l.Previous.Host)
+		assert.NoError(t, l.Release())
+
+		// files written before owners were recorded are stale too
+		assert.NoError(t, os.WriteFile(Path(dir), nil, 0644))
+		l, err = Acquire(dir)
+		assert.NoError(t, err)
+		assert.NoError(t, l.Release())
+	})
+
+	// Test Case 3: breaking removes a stale lock, a held one only when forced
+	t.Run("break", func(t *testing.T) {
+		_, err := Break(dir, false)
+		assert.Error(t, err)
+
+		assert.NoError(t, os.WriteFile(Path(dir), nil, 0644))
+		s, err := Break(dir, false)
+		assert.NoError(t, err)
+		assert.Equal(t, Stale, s.State)
+		assert.NoFileExists(t, Path(dir))
+
+		l, err := Acquire(dir)
+		assert.NoError(t, err)
+		s, err = Break(dir, true)
+		assert.NoError(t, err)
+		assert.Equal(t, Held, s.State)
+		assert.NoError(t, l.Release())
+	})
+
+	// Test Case 4: readers share their lock with each other and the server
+	t.Run("readers", func(t *testing.T) {
+		l, err := Acquire(dir)
+		assert.NoError(t, err)
+		r1, err := AcquireShared(dir)
+		assert.NoError(t, err)
+		r2, err := AcquireShared(dir)
+		assert.NoError(t, err)
+
+		s, err := Inspect(dir)
+		assert.NoError(t, err)
+		assert.Equal(t, Held, s.State)
+		assert.True(t, s.Readers)
+
+		assert.NoError(t, l.Release())
+		assert.NoError(t, r1.Release())
+		s, err = Inspect(dir)
+		assert.NoError(t, err)
+		assert.Equal(t, Free, s.State)
+		assert.True(t, s.Readers)
+
+		assert.NoError(t, r2.Release())
+		s, err = Inspect(dir)
+		assert.NoError(t, err)
+		assert.False(t, s.Readers)
+	})
+
+	// Test Case 5: an admin tool keeps readers out and readers keep it out
+	t.Run("exclusive", func(t *testing.T) {
+		admin, err := AcquireExclusive(dir)
+		assert.NoError(t, err)
+		_, err = AcquireShared(dir)
+		assert.ErrorContains(t, err, "an admin tool is running")
+		assert.NoError(t, admin.Release())
+
+		r, err := AcquireShared(dir)
+		assert.NoError(t, err)
+		_, err = AcquireExclusive(dir)
+		assert.ErrorIs(t, err, ErrReaders)
+		assert.NoError(t, r.Release())
+		assert.FileExists(t, filepath.Join(dir, ReadersFile))
+	})
+
+	// Test Case 6: releasing a lock whose file was replaced leaves the new
+	// one in place
+	t.Run("replaced", func(t *testing.T) {
+		l, err := Acquire(dir)
+		assert.NoError(t, err)
+		assert.NoError(t, os.Rename(Path(dir), Path(dir)+".old"))
+		next, err := Acquire(dir)
+		assert.NoError(t, err)
+
+		assert.NoError(t, l.Release())
+		assert.FileExists(t, Path(dir))
+		assert.NoError(t, next.Release())
+	})
+}
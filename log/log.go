@@ -5,6 +5,8 @@ package log
 import (
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/sirupsen/logrus"
@@ -29,6 +31,41 @@ var (
 	errCol     = color.New(color.FgRed).SprintFunc()
 )
 
+// RequestIDHeader carries the ID of an HTTP request, it is set on the
+// response before the handler runs so log lines about the request carry it
+const RequestIDHeader = "X-Request-ID"
+
+// Fields are extra values attached to a log line, in json format they are
+// keys of their own
+type Fields map[string]interface{}
+
+// maps level names to the logging level constants
+func ParseLevel(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "fatal":
+		return FATAL, nil
+	case "warn", "warning":
+		return WARN, nil
+	case "info":
+		return INFO, nil
+	}
+	return 0, fmt.Errorf("unknown log level '%s', expected fatal, warn or info", name)
+}
+
+// selects how log lines are written outside of shell mode, text for
+// humans or json, one object per line, for log pipelines
+func SetFormat(format string) error {
+	switch format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	default:
+		return fmt.Errorf("unknown log format '%s', expected text or json", format)
+	}
+	return nil
+}
+
 // configures the minimum logging level for the application, maps the custom log levels to logrus levels
 func SetLoggingLevel(l int) {
 	switch l {
@@ -72,7 +109,26 @@ func Info(format string, args ...interface{}) {
 // useful for HTTP handlers that need to log their responses
 func WInfo(w http.ResponseWriter, format string, args ...interface{}) {
 	fmt.Fprintf(w, format, args...)
-	Info(format, args...)
+	RInfo(w, format, args...)
+}
+
+// logs an informational message about the request w answers, tagged
+// with its request ID
+func RInfo(w http.ResponseWriter, format string, args ...interface{}) {
+	if IsShellMode {
+		Info(format, args...)
+		return
+	}
+	requestEntry(w).Info(fmt.Sprintf(format, args...))
+}
+
+// logs an informational message with extra fields
+func InfoFields(fields Fields, format string, args ...interface{}) {
+	if IsShellMode {
+		Info(format, args...)
+		return
+	}
+	logrus.WithFields(logrus.Fields(fields)).Info(fmt.Sprintf(format, args...))
 }
 
 // logs a warning message. In shell mode, it prints in yellow color,
@@ -90,7 +146,25 @@ func Warn(format string, args ...interface{}) {
 // useful for HTTP handlers that need to log their warning responses
 func WWarn(w http.ResponseWriter, format string, args ...interface{}) {
 	fmt.Fprintf(w, format, args...)
-	Warn(format, args...)
+	RWarn(w, format, args...)
+}
+
+// logs a warning message about the request w answers, tagged with its
+// request ID
+func RWarn(w http.ResponseWriter, format string, args ...interface{}) {
+	if IsShellMode {
+		Warn(format, args...)
+		return
+	}
+	requestEntry(w).Warnf(format, args...)
+}
+
+// returns a logrus entry carrying the request ID of the response w, if any
+func requestEntry(w http.ResponseWriter) *logrus.Entry {
+	if id := w.Header().Get(RequestIDHeader); id != "" {
+		return logrus.WithField("request_id", id)
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
 }
 
 // logs a fatal error and terminates the program. In shell mode, it prints in red color and panics,
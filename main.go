@@ -3,102 +3,467 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/acl"
 	"github.com/themillenniumfalcon/smolDB/admin"
 	"github.com/themillenniumfalcon/smolDB/api"
+	"github.com/themillenniumfalcon/smolDB/audit"
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/cluster"
+	"github.com/themillenniumfalcon/smolDB/config"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/limit"
+	"github.com/themillenniumfalcon/smolDB/lock"
 	"github.com/themillenniumfalcon/smolDB/log"
+	"github.com/themillenniumfalcon/smolDB/metrics"
+	"github.com/themillenniumfalcon/smolDB/replica"
+	"github.com/themillenniumfalcon/smolDB/ring"
 	"github.com/themillenniumfalcon/smolDB/sh"
+	"github.com/themillenniumfalcon/smolDB/tlsconf"
 	"github.com/urfave/cli/v2"
 )
 
 // initializes and starts the HTTP server with all API endpoints configured
-func serve(port int, dir string, durability string, groupMs int, groupBatch int, syncMode string) error {
+func serve(port int, dir string, durability string, groupMs int, groupBatch int, syncMode string, walFormat string, walCompress bool, checkpointInterval time.Duration, checkpointRetain int) error {
 	log.Info("initializing smolDB")
 	// initialize database
-	sh.SetupWithOptions(dir, durability, groupMs, groupBatch, syncMode)
+	sh.SetupWithOptions(dir, durability, groupMs, groupBatch, syncMode, walFormat, walCompress)
+
+	startCheckpoints(checkpointInterval, checkpointRetain)
 
 	// set up HTTP router
 	router := httprouter.New()
 
 	// register API endpoints
+	readRoutes(router)
+	walRoutes(router)
+	router.POST("/regenerate", api.RegenerateIndex)
+	writeRoutes(router, func(h httprouter.Handle) httprouter.Handle { return h })
+
+	log.Info("starting api server on port %d", port)
+	// start HTTP server
+	return listen(port, router)
+}
+
+// periodic checkpoints keep the WAL short and recovery fast, every shard
+// takes its own
+func startCheckpoints(interval time.Duration, retain int) {
+	for _, shard := range index.R.Shards() {
+		shard.SetSnapshotRetention(retain)
+		if interval > 0 {
+			shard.StartPeriodicCheckpoints(interval)
+		}
+	}
+	if interval > 0 {
+		log.Info("taking checkpoints every %s", interval)
+	}
+}
+
+// registers the endpoints that don't modify the database, served by
+// leaders and read-only followers alike
+func readRoutes(router *httprouter.Router) {
 	// base routes
 	router.GET("/", api.Health)
 	router.GET("/keys", api.GetKeys)
-	router.POST("/regenerate", api.RegenerateIndex)
 
 	// key-based routes
 	router.GET("/key/:key", api.GetKey)
-	router.PUT("/key/:key", api.UpdateKey)
-	router.DELETE("/key/:key", api.DeleteKey)
 
 	// field-based routes
 	router.GET("/key/:key/field/:field", api.GetKeyField)
-	router.PATCH("/key/:key/field/:field", api.PatchKeyField)
+
+	// batch routes
+	router.POST("/batch/get", api.BatchGet)
+
+	// bulk routes, imports are registered with the other writes
+	router.GET("/export", api.Export)
 
 	// integrity routes
 	router.GET("/integrity/:key", api.CheckKeyIntegrity)
-	router.POST("/integrity/:key/repair", api.RepairKeyIntegrity)
 
-	log.Info("starting api server on port %d", port)
-	// start HTTP server
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), router)
+	// anti-entropy routes, peers compare their trees to find differences
+	router.GET("/merkle", api.GetMerkleTree)
+	router.GET("/merkle/buckets/:bucket", api.GetMerkleBucket)
+	router.GET("/merkle/docs/:key", api.GetMerkleDocument)
+}
+
+// registers the endpoints that need the WAL, read-only servers don't open
+// it
+func walRoutes(router *httprouter.Router) {
+	// replication routes, followers can be streamed from as well
+	router.GET("/replication/stream", api.Unsharded(api.ReplicationStream))
+	router.GET("/replication/status", api.Unsharded(api.ReplicationStatus))
+
+	// admin routes
+	router.POST("/admin/backup", api.Unsharded(api.Backup))
+}
+
+// registers the endpoints that modify the database, each served by wrap of
+// its handler
+func writeRoutes(router *httprouter.Router, wrap func(httprouter.Handle) httprouter.Handle) {
+	router.PUT("/key/:key", wrap(api.UpdateKey))
+	router.DELETE("/key/:key", wrap(api.DeleteKey))
+	router.PATCH("/key/:key/field/:field", wrap(api.PatchKeyField))
+	router.POST("/batch/put", wrap(api.BatchPut))
+	router.POST("/batch/delete", wrap(api.BatchDelete))
+	router.POST("/import", wrap(api.Import))
+	router.POST("/integrity/:key/repair", wrap(api.RepairKeyIntegrity))
+}
+
+// answers the writes of a server that doesn't take any with 405, Allow
+// names GET when the path can be read
+func refuseWrites(router *httprouter.Router) func(httprouter.Handle) httprouter.Handle {
+	return func(httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			allow := ""
+			if h, _, _ := router.Lookup(http.MethodGet, r.URL.Path); h != nil {
+				allow = http.MethodGet
+			}
+			w.Header().Set("Allow", allow)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// serves the database in dir next to the server that writes it, writes are
+// answered with 405 and the index is refreshed from disk every refresh
+func serveReadOnly(port int, dir string, refresh time.Duration) error {
+	sh.SetupReadOnly(dir, refresh)
+
+	router := httprouter.New()
+	readRoutes(router)
+	writeRoutes(router, refuseWrites(router))
+	router.POST("/regenerate", api.RegenerateIndex)
+
+	log.Info("starting read-only api server on port %d", port)
+	return listen(port, router)
+}
+
+// starts a read-only follower of the leader at the given URL, a fresh
+// follower or one too far behind is seeded from a backup of the leader first
+func replicate(port int, dir string, leader string, durability string, groupMs int, groupBatch int, syncMode string, walFormat string, walCompress bool, checkpointInterval time.Duration, checkpointRetain int) error {
+	if err := requireUnsharded(dir, "replication"); err != nil {
+		return err
+	}
+	seed, err := replica.NeedsSeed(af.NewOsFs(), dir, leader)
+	if err != nil {
+		log.Warn("couldn't reach leader %s, resuming from the local copy: %s", leader, err.Error())
+	}
+	if seed {
+		lsn, err := replica.Seed(af.NewOsFs(), dir, leader)
+		if err != nil {
+			return err
+		}
+		log.Info("seeded follower at lsn %d", lsn)
+	}
+
+	sh.SetupWithOptions(dir, durability, groupMs, groupBatch, syncMode, walFormat, walCompress)
+	startCheckpoints(checkpointInterval, checkpointRetain)
+
+	follower := replica.NewFollower(leader, index.I, dir)
+	api.SetFollower(follower)
+	ctx, stopFollower := context.WithCancel(context.Background())
+	go func() {
+		if err := follower.Run(ctx); err != nil && ctx.Err() == nil {
+			log.Warn("replication stopped: %s", err.Error())
+		}
+	}()
+
+	// writes are only accepted by the leader
+	router := httprouter.New()
+	readRoutes(router)
+	walRoutes(router)
+	writeRoutes(router, refuseWrites(router))
+
+	log.Info("starting read-only replica of %s on port %d", leader, port)
+	return listen(port, router, stopFollower)
+}
+
+// starts a member of a raft cluster, writes sent to followers are redirected
+// to the leader and only applied once a majority of the nodes stored them
+func clusterServe(port int, dir string, id string, addr string, bootstrap bool, join string, snapshotThreshold uint64, durability string, groupMs int, groupBatch int, syncMode string, walFormat string, walCompress bool, checkpointRetain int) error {
+	if err := requireUnsharded(dir, "cluster mode"); err != nil {
+		return err
+	}
+	sh.SetupWithOptions(dir, durability, groupMs, groupBatch, syncMode, walFormat, walCompress)
+	// the node takes checkpoints itself when it compacts its log
+	index.I.SetSnapshotRetention(checkpointRetain)
+
+	node, err := cluster.NewNode(cluster.Config{
+		ID:                id,
+		Addr:              addr,
+		Dir:               dir,
+		SnapshotThreshold: snapshotThreshold,
+		OnApply:           api.AuditApplied,
+	}, index.I)
+	if err != nil {
+		return err
+	}
+	if bootstrap {
+		if err := node.Bootstrap(); err != nil {
+			return err
+		}
+	}
+	api.SetCluster(node)
+	node.Start()
+
+	if join != "" {
+		go func() {
+			member := cluster.Member{ID: id, Addr: addr}
+			for {
+				ctx, cancel := context.WithTimeout(context.Background(), api.WriteTimeout)
+				err := cluster.Join(ctx, join, member)
+				cancel()
+				if err == nil {
+					log.Info("joined the cluster through %s", join)
+					return
+				}
+				log.Warn("failed to join the cluster through %s: %s", join, err.Error())
+				time.Sleep(time.Second)
+			}
+		}()
+	}
+
+	router := httprouter.New()
+	readRoutes(router)
+	walRoutes(router)
+	router.PUT("/key/:key", api.LeaderOnly(api.UpdateKey))
+	router.DELETE("/key/:key", api.LeaderOnly(api.DeleteKey))
+	router.PATCH("/key/:key/field/:field", api.LeaderOnly(api.PatchKeyField))
+	router.POST("/batch/put", api.LeaderOnly(api.BatchPut))
+	router.POST("/batch/delete", api.LeaderOnly(api.BatchDelete))
+	router.POST("/import", api.LeaderOnly(api.Import))
+
+	// cluster routes
+	router.GET("/cluster/status", api.ClusterStatus)
+	router.POST("/cluster/members", api.LeaderOnly(api.ClusterJoin))
+	router.DELETE("/cluster/members/:id", api.LeaderOnly(api.ClusterLeave))
+	router.POST("/cluster/raft/vote", api.ClusterVote)
+	router.POST("/cluster/raft/append", api.ClusterAppend)
+	router.POST("/cluster/raft/snapshot", api.ClusterSnapshot)
+
+	log.Info("starting cluster node %s on port %d", id, port)
+	return listen(port, router, node.Stop)
+}
+
+// starts a node of a consistent-hash ring, keys are spread over the nodes
+// listed in the config file and requests for keys owned by another node are
+// forwarded to it
+func ringServe(port int, dir string, config string, id string, durability string, groupMs int, groupBatch int, syncMode string, walFormat string, walCompress bool, checkpointInterval time.Duration, checkpointRetain int) error {
+	cfg, err := ring.LoadConfig(config)
+	if err != nil {
+		return err
+	}
+	forwarder, err := ring.NewForwarder(cfg, id)
+	if err != nil {
+		return err
+	}
+
+	sh.SetupWithOptions(dir, durability, groupMs, groupBatch, syncMode, walFormat, walCompress)
+	startCheckpoints(checkpointInterval, checkpointRetain)
+	// references to keys of other nodes are fetched from them
+	index.Remote = forwarder
+
+	router := httprouter.New()
+	router.GET("/", api.Health)
+	router.GET("/keys", forwarder.Keys)
+	router.POST("/regenerate", api.RegenerateIndex)
+
+	// key-based routes are served by the node owning the key
+	router.GET("/key/:key", forwarder.Handle(api.GetKey))
+	router.PUT("/key/:key", forwarder.Handle(api.UpdateKey))
+	router.DELETE("/key/:key", forwarder.Handle(api.DeleteKey))
+	router.GET("/key/:key/field/:field", forwarder.Handle(api.GetKeyField))
+	router.PATCH("/key/:key/field/:field", forwarder.Handle(api.PatchKeyField))
+	router.GET("/integrity/:key", forwarder.Handle(api.CheckKeyIntegrity))
+	router.POST("/integrity/:key/repair", forwarder.Handle(api.RepairKeyIntegrity))
+
+	// backups only cover the keys of this node
+	router.POST("/admin/backup", api.Unsharded(api.Backup))
+
+	log.Info("starting ring node %s of %d on port %d", id, len(cfg.Nodes), port)
+	return listen(port, router)
+}
+
+// certs holds the certificates of the server when it serves TLS
+var certs *tlsconf.Reloader
+
+// how long a shutdown waits for requests in flight and whether it takes a
+// checkpoint before releasing the lock
+var (
+	drainTimeout    = 30 * time.Second
+	finalCheckpoint bool
+)
+
+// serves router on port, every request is logged and, with metrics
+// enabled, recorded and the metrics are served at /metrics. With a
+// certificate configured it is served over TLS. On a term signal requests
+// in flight are drained, stop is called, e.g. to halt replication, and the
+// database is closed
+func listen(port int, router *httprouter.Router, stop ...func()) error {
+	if metrics.Enabled() {
+		router.GET("/metrics", api.Metrics)
+		log.Info("serving metrics at /metrics")
+	}
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: api.Middleware(router)}
+	// replication streams never finish on their own
+	server.RegisterOnShutdown(api.StopStreams)
+	reloadOnHangup()
+	stopping := sh.HandleShutdown()
+
+	served := make(chan error, 1)
+	go func() {
+		if certs == nil {
+			served <- server.ListenAndServe()
+			return
+		}
+		server.TLSConfig = certs.ServerConfig()
+		go certs.Watch(context.Background())
+		log.Info("serving tls")
+		served <- server.ListenAndServeTLS("", "")
+	}()
+	select {
+	case err := <-served:
+		sh.Close(false)
+		return err
+	case <-stopping:
+	}
+
+	log.Info("draining requests for up to %s", drainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warn("requests still running after %s, closing their connections", drainTimeout)
+		server.Close()
+	}
+	for _, fn := range stop {
+		fn()
+	}
+	if err := sh.Close(finalCheckpoint); err != nil {
+		return err
+	}
+	log.Info("shut down cleanly")
+	return nil
+}
+
+// reads the certificates of the server and makes connections to other
+// nodes verify theirs against peerCA and present its own
+func setupTLS(certFile, keyFile, clientCAFile, peerCAFile string) error {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return fmt.Errorf("--tls-client-ca needs --tls-cert and --tls-key")
+		}
+		return nil
+	}
+	var err error
+	if certs, err = tlsconf.New(certFile, keyFile, clientCAFile); err != nil {
+		return err
+	}
+	var peerCAs *x509.CertPool
+	if peerCAFile != "" {
+		if peerCAs, err = tlsconf.LoadPool(peerCAFile); err != nil {
+			return err
+		}
+	}
+	http.DefaultTransport.(*http.Transport).TLSClientConfig = certs.ClientConfig(peerCAs)
+	return nil
+}
+
+// stands in for a missing checksum in audit output
+func orNone(checksum string) string {
+	if checksum == "" {
+		return "-"
+	}
+	return checksum
+}
+
+// refuses to start a mode that follows the WAL of a single FileIndex on a
+// sharded database
+func requireUnsharded(dir string, mode string) error {
+	n, err := index.ReadShardCount(af.NewOsFs(), dir)
+	if err != nil {
+		return err
+	}
+	if n > 1 {
+		return fmt.Errorf("%s needs an unsharded database, %s is split into %d shards", mode, dir, n)
+	}
+	return nil
 }
 
 // sets up the CLI interface and handles both server and shell modes of operation
-func main() {
-	app := &cli.App{
+func newApp() *cli.App {
+	return &cli.App{
 		Name:  "smoldb",
 		Usage: "an in-memory JSON database",
-		// global flags for port and directory
-		Flags: []cli.Flag{
-			&cli.IntFlag{
-				Name:        "port",
-				Aliases:     []string{"p"},
-				Value:       8080,
-				Usage:       "port to run smoldb on",
-				DefaultText: "8080",
-			},
-			&cli.StringFlag{
-				Name:        "dir",
-				Aliases:     []string{"d"},
-				Value:       "db",
-				Usage:       "directory to look for keys",
-				DefaultText: "db",
-			},
-			&cli.StringFlag{
-				Name:        "durability",
-				Usage:       "durability level: none|commit|grouped",
-				Value:       "commit",
-				DefaultText: "commit",
-				EnvVars:     []string{"SMOLDB_DURABILITY"},
-			},
-			&cli.IntFlag{
-				Name:        "group-commit-ms",
-				Usage:       "group commit fsync interval in ms (used when durability=grouped)",
-				Value:       0,
-				DefaultText: "0",
-				EnvVars:     []string{"SMOLDB_GROUP_COMMIT_MS"},
-			},
-			&cli.IntFlag{
-				Name:        "group-commit-batch",
-				Usage:       "group commit fsync after this many appends (used when durability=grouped)",
-				Value:       0,
-				DefaultText: "0",
-				EnvVars:     []string{"SMOLDB_GROUP_COMMIT_BATCH"},
-			},
-			&cli.StringFlag{
-				Name:        "sync-mode",
-				Usage:       "sync mode: none|fsync|dsync (dsync best-effort)",
-				Value:       "fsync",
-				DefaultText: "fsync",
-				EnvVars:     []string{"SMOLDB_SYNC_MODE"},
-			},
+		Flags: globalFlags(),
+		Before: func(c *cli.Context) error {
+			if path := c.String("settings"); path != "" {
+				var err error
+				if settings, err = config.Load(path); err != nil {
+					return err
+				}
+			}
+			if err := applyConfig(c, c.App.Flags, ""); err != nil {
+				return err
+			}
+			if err := log.SetFormat(c.String("log-format")); err != nil {
+				return err
+			}
+			level, err := log.ParseLevel(c.String("log-level"))
+			if err != nil {
+				return err
+			}
+			log.SetLoggingLevel(level)
+			audit.MaxSize = c.Int64("audit-max-size") << 20
+			if c.Bool("metrics") {
+				metrics.Enable()
+			}
+			drainTimeout = c.Duration("drain-timeout")
+			finalCheckpoint = c.Bool("final-checkpoint")
+			if err := setupTLS(c.String("tls-cert"), c.String("tls-key"), c.String("tls-client-ca"), c.String("tls-peer-ca")); err != nil {
+				return err
+			}
+			if strings.Contains(c.String("auth"), "mtls") && c.String("tls-client-ca") == "" {
+				return fmt.Errorf("--auth mtls needs --tls-client-ca")
+			}
+			authenticator, err := auth.New(auth.Config{
+				Mode:        c.String("auth"),
+				APIKeysFile: c.String("api-keys-file"),
+				APIKeys:     c.String("api-keys"),
+				JWTAlg:      c.String("jwt-alg"),
+				JWTKeyFile:  c.String("jwt-key-file"),
+			})
+			if err != nil {
+				return err
+			}
+			api.SetAuth(authenticator, c.StringSlice("auth-public"))
+			limits, err := limitConfig(c)
+			if err != nil {
+				return err
+			}
+			limiter = limit.New(limits)
+			api.SetLimits(limiter, c.StringSlice("limit-exempt"))
+			startup = c
+			auth.Token = c.String("peer-token")
+			if aclPath = c.String("acl"); aclPath != "" {
+				policy, err := acl.Load(aclPath)
+				if err != nil {
+					return err
+				}
+				acl.Set(policy)
+			}
+			return nil
 		},
-		// command definitions for 'start' and 'shell'
+		// command definitions for 'start', 'replicate' and 'shell'
 		Commands: []*cli.Command{
 			{
 				Name: "admin",
@@ -129,6 +494,499 @@ func main() {
 							return nil
 						},
 					},
+					{
+						Name:  "wal",
+						Usage: "write-ahead log maintenance",
+						Subcommands: []*cli.Command{
+							{
+								Name:  "convert",
+								Usage: "rewrite the WAL in another record format",
+								Flags: []cli.Flag{
+									&cli.StringFlag{
+										Name:  "to",
+										Usage: "target record format: json|binary",
+										Value: "binary",
+									},
+									&cli.BoolFlag{
+										Name:  "compress",
+										Usage: "compress large bodies (binary format only)",
+									},
+									&cli.BoolFlag{
+										Name:  "force",
+										Usage: "convert even if database is locked",
+										Value: false,
+									},
+								},
+								Action: func(c *cli.Context) error {
+									stats, err := admin.ConvertWAL(c.String("dir"), c.String("to"), c.Bool("compress"), c.Bool("force"))
+									if err != nil {
+										return err
+									}
+									log.Info("WAL conversion complete:")
+									log.Info("- Records converted: %d", stats.Records)
+									log.Info("- Size before: %d bytes", stats.BytesBefore)
+									log.Info("- Size after: %d bytes", stats.BytesAfter)
+									if stats.TornTail {
+										log.Warn("- Dropped a torn record at the end of the log")
+									}
+									return nil
+								},
+							},
+						},
+					},
+					{
+						Name:  "backup",
+						Usage: "write a consistent backup of an offline database to a tar file",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "out",
+								Usage: "file to write the backup to",
+							},
+							&cli.StringFlag{
+								Name:  "incremental",
+								Usage: "earlier backup (or its manifest) to back up the changes since",
+							},
+							&cli.BoolFlag{
+								Name:  "gzip",
+								Usage: "gzip compress the backup",
+							},
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "back up even if database is locked",
+								Value: false,
+							},
+						},
+						Action: func(c *cli.Context) error {
+							if c.String("out") == "" {
+								return fmt.Errorf("backup needs --out <file>")
+							}
+							manifest, err := admin.BackupDB(c.String("dir"), c.String("out"), c.String("incremental"), c.Bool("gzip"), c.Bool("force"))
+							if err != nil {
+								return err
+							}
+							log.Info("Backup complete:")
+							log.Info("- Type: %s", manifest.Type)
+							log.Info("- Documents: %d", len(manifest.Documents))
+							if manifest.Type == index.BackupIncremental {
+								log.Info("- Deleted since parent: %d", len(manifest.Deleted))
+							}
+							log.Info("- WAL records: %d", manifest.WALRecords)
+							log.Info("- Backed up at lsn: %d", manifest.LSN)
+							return nil
+						},
+						Subcommands: []*cli.Command{
+							{
+								Name:  "verify",
+								Usage: "check a full backup and its incrementals without restoring them",
+								Flags: []cli.Flag{
+									&cli.StringSliceFlag{
+										Name:     "from",
+										Usage:    "backup files of the chain, the full backup first",
+										Required: true,
+									},
+								},
+								Action: func(c *cli.Context) error {
+									manifests, err := admin.VerifyBackups(c.StringSlice("from"))
+									if err != nil {
+										return err
+									}
+									log.Info("Backup chain verified:")
+									for _, m := range manifests {
+										log.Info("- %s %s: %d documents, %d WAL records, lsn %d", m.Type, m.ID, len(m.Documents), m.WALRecords, m.LSN)
+									}
+									return nil
+								},
+							},
+						},
+					},
+					{
+						Name:  "restore",
+						Usage: "restore a backup over the database, or rebuild it as it was at an earlier point into a new directory",
+						Flags: []cli.Flag{
+							&cli.StringSliceFlag{
+								Name:  "from",
+								Usage: "backup files to restore, a full backup followed by its incrementals, replaces the database after verifying them",
+							},
+							&cli.StringFlag{
+								Name:  "to",
+								Usage: "restore target: an lsn or a timestamp, e.g. 2024-05-01T14:03:00Z",
+							},
+							&cli.StringFlag{
+								Name:  "into",
+								Usage: "directory to write the restored database to, must be empty (with --to)",
+							},
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "restore a backup even if database is locked",
+								Value: false,
+							},
+						},
+						Action: func(c *cli.Context) error {
+							if len(c.StringSlice("from")) > 0 {
+								stats, err := admin.RestoreBackup(c.String("dir"), c.StringSlice("from"), c.Bool("force"))
+								if err != nil {
+									return err
+								}
+								log.Info("Restore complete:")
+								log.Info("- Backups: %d", stats.Backups)
+								log.Info("- Documents: %d", stats.Documents)
+								if stats.Deleted > 0 {
+									log.Info("- Deleted by incrementals: %d", stats.Deleted)
+								}
+								log.Info("- WAL records replayed: %d", stats.WALRecords)
+								log.Info("- Restored to lsn: %d", stats.LSN)
+								if stats.Previous != "" {
+									log.Info("- Previous database moved to: %s", stats.Previous)
+								}
+								return nil
+							}
+
+							if c.String("to") == "" || c.String("into") == "" {
+								return fmt.Errorf("restore needs either --from <backup> or --to <lsn|timestamp> with --into <dir>")
+							}
+							stats, err := admin.RestoreToPoint(c.String("dir"), c.String("to"), c.String("into"))
+							if err != nil {
+								return err
+							}
+							log.Info("Restore complete:")
+							if stats.Snapshot != "" {
+								log.Info("- Checkpoint: %s (%d documents)", stats.Snapshot, stats.Documents)
+							} else {
+								log.Info("- Checkpoint: none, replayed the WAL from the start")
+							}
+							log.Info("- WAL records replayed: %d", stats.Records)
+							log.Info("- Restored to lsn: %d", stats.LSN)
+							return nil
+						},
+					},
+					{
+						Name:  "export",
+						Usage: "write the documents of an offline database as NDJSON, one {key, doc, meta} object per line",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "out",
+								Usage: "file to write the export to, stdout when empty",
+							},
+							&cli.StringFlag{
+								Name:  "prefix",
+								Usage: "only export keys starting with this prefix",
+							},
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "export even if database is locked",
+								Value: false,
+							},
+						},
+						Action: func(c *cli.Context) error {
+							stats, err := admin.ExportDB(c.String("dir"), c.String("out"), c.String("prefix"), c.Bool("force"))
+							if err != nil {
+								return err
+							}
+							log.Info("Export complete:")
+							log.Info("- Documents: %d", stats.Exported)
+							if stats.Skipped > 0 {
+								log.Warn("- Skipped, unreadable: %d", stats.Skipped)
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "import",
+						Usage: "write the documents of an NDJSON export into an offline database",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "from",
+								Usage: "file to import, stdin when empty",
+							},
+							&cli.StringFlag{
+								Name:  "conflict",
+								Usage: "what to do with a key that exists: skip, overwrite or fail",
+								Value: index.ImportSkip,
+							},
+							&cli.IntFlag{
+								Name:  "batch",
+								Usage: "number of documents written per batch",
+								Value: index.DefaultImportBatch,
+							},
+							&cli.BoolFlag{
+								Name:  "dry-run",
+								Usage: "validate every line and report what would be imported",
+							},
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "import even if database is locked",
+								Value: false,
+							},
+						},
+						Action: func(c *cli.Context) error {
+							opts := index.ImportOptions{
+								Conflict:  c.String("conflict"),
+								BatchSize: c.Int("batch"),
+								DryRun:    c.Bool("dry-run"),
+								Progress: func(stats index.ImportStats) {
+									log.Info("%d lines read, %d imported, %d skipped", stats.Lines, stats.Imported, stats.Skipped)
+								},
+							}
+							stats, err := admin.ImportDB(c.String("dir"), c.String("from"), opts, c.Bool("force"))
+							if err != nil {
+								return err
+							}
+							if opts.DryRun {
+								log.Info("Import dry run complete:")
+							} else {
+								log.Info("Import complete:")
+							}
+							log.Info("- Lines: %d", stats.Lines)
+							log.Info("- Imported: %d", stats.Imported)
+							log.Info("- Skipped, key exists: %d", stats.Skipped)
+							if stats.Failed > 0 {
+								for _, e := range stats.Errors {
+									log.Warn("  - %s", e.Error())
+								}
+								return fmt.Errorf("%d lines can't be imported", stats.Failed)
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "reshard",
+						Usage: "split the database into a number of hash shards, or merge them back with --shards 1",
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:     "shards",
+								Usage:    "number of shards to split the database into",
+								Required: true,
+							},
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "reshard even if database is locked",
+								Value: false,
+							},
+						},
+						Action: func(c *cli.Context) error {
+							stats, err := admin.Reshard(c.String("dir"), c.Int("shards"), c.Bool("force"))
+							if err != nil {
+								return err
+							}
+							log.Info("Reshard complete:")
+							log.Info("- Shards: %d -> %d", stats.From, stats.To)
+							log.Info("- Documents moved: %d", stats.Documents)
+							log.Info("- Previous database moved to: %s", stats.Previous)
+							return nil
+						},
+					},
+					{
+						Name:  "rebalance",
+						Usage: "move keys to the ring nodes owning them after a node was added or removed",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "config",
+								Usage:    "ring config file listing the nodes after the change",
+								Required: true,
+							},
+							&cli.StringSliceFlag{
+								Name:  "drain",
+								Usage: "base url of a node being removed, its keys are moved to the remaining nodes",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							cfg, err := ring.LoadConfig(c.String("config"))
+							if err != nil {
+								return err
+							}
+							stats, err := ring.Rebalance(context.Background(), cfg, c.StringSlice("drain"))
+							if err != nil {
+								return err
+							}
+							log.Info("Rebalance complete:")
+							log.Info("- Nodes scanned: %d", stats.Nodes)
+							log.Info("- Keys scanned: %d", stats.Scanned)
+							log.Info("- Keys moved: %d", stats.Moved)
+							return nil
+						},
+					},
+					{
+						Name:  "audit",
+						Usage: "inspect the audit log of changes",
+						Subcommands: []*cli.Command{
+							{
+								Name:  "query",
+								Usage: "list who changed what and when, oldest first",
+								Flags: []cli.Flag{
+									&cli.StringFlag{
+										Name:  "key",
+										Usage: "only changes of this key",
+									},
+									&cli.StringFlag{
+										Name:  "since",
+										Usage: "only changes at or after this time, RFC3339 or YYYY-MM-DD",
+									},
+									&cli.StringFlag{
+										Name:  "until",
+										Usage: "only changes at or before this time, RFC3339 or YYYY-MM-DD",
+									},
+								},
+								Action: func(c *cli.Context) error {
+									entries, err := admin.QueryAudit(c.String("dir"), c.String("key"), c.String("since"), c.String("until"))
+									if err != nil {
+										return err
+									}
+									for _, e := range entries {
+										line := fmt.Sprintf("%s %s %s", e.Time.Format(time.RFC3339Nano), e.Op, e.Client)
+										if e.Key != "" {
+											line += fmt.Sprintf(" key=%s before=%s after=%s", e.Key, orNone(e.Before), orNone(e.After))
+										}
+										if e.Detail != "" {
+											line += " " + e.Detail
+										}
+										if e.RequestID != "" {
+											line += " request_id=" + e.RequestID
+										}
+										fmt.Println(line)
+									}
+									log.Info("%d entries", len(entries))
+									return nil
+								},
+							},
+						},
+					},
+					{
+						Name:  "acl",
+						Usage: "inspect access control policies",
+						Subcommands: []*cli.Command{
+							{
+								Name:  "check",
+								Usage: "report whether a policy allows an operation, fails when it doesn't",
+								Flags: []cli.Flag{
+									&cli.StringFlag{
+										Name:     "policy",
+										Usage:    "policy file to check",
+										Required: true,
+									},
+									&cli.StringFlag{
+										Name:  "identity",
+										Usage: "identity making the request, anonymous when empty",
+									},
+									&cli.StringSliceFlag{
+										Name:  "role",
+										Usage: "role claimed by the identity's token, can be repeated",
+									},
+									&cli.StringFlag{
+										Name:     "op",
+										Usage:    "operation: read|write|patch|delete|admin",
+										Required: true,
+									},
+									&cli.StringFlag{
+										Name:  "key",
+										Usage: "key operated on, the whole database when empty",
+									},
+								},
+								Action: func(c *cli.Context) error {
+									ok, reason, err := admin.CheckACL(c.String("policy"), c.String("identity"), c.StringSlice("role"), c.String("op"), c.String("key"))
+									if err != nil {
+										return err
+									}
+									if !ok {
+										return fmt.Errorf("denied: %s", reason)
+									}
+									fmt.Printf("allowed: %s\n", reason)
+									return nil
+								},
+							},
+						},
+					},
+					{
+						Name:  "lock",
+						Usage: "inspect or break the lock a server holds on the database",
+						Subcommands: []*cli.Command{
+							{
+								Name:  "status",
+								Usage: "report whether the database is free, held by a running server or left locked by one that died",
+								Action: func(c *cli.Context) error {
+									s, err := lock.Inspect(c.String("dir"))
+									if err != nil {
+										return err
+									}
+									log.Info("Lock %s: %s", s.Path, s.State)
+									if s.State != lock.Free {
+										log.Info("- Owner: %s", s.Owner)
+									}
+									if s.State == lock.Stale {
+										log.Info("- The next server to start takes it over")
+									}
+									if s.Readers {
+										log.Info("- Opened read-only by other processes")
+									}
+									return nil
+								},
+							},
+							{
+								Name:  "break",
+								Usage: "remove the lock file",
+								Flags: []cli.Flag{
+									&cli.BoolFlag{
+										Name:  "force",
+										Usage: "remove it even while a running server holds it, that server isn't stopped",
+									},
+								},
+								Action: func(c *cli.Context) error {
+									s, err := lock.Break(c.String("dir"), c.Bool("force"))
+									if err != nil {
+										return err
+									}
+									log.Info("Removed %s lock %s of %s", s.State, s.Path, s.Owner)
+									return nil
+								},
+							},
+						},
+					},
+					{
+						Name:  "sync",
+						Usage: "compare the database with a peer server through Merkle trees and repair the keys that differ",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "peer",
+								Usage:    "base url of the server to sync with, e.g. http://localhost:8081",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "prefer",
+								Usage: "which copy of a differing key wins: modified (last modified) or lsn (highest lsn)",
+								Value: "modified",
+							},
+							&cli.BoolFlag{
+								Name:  "dry-run",
+								Usage: "only report what would be repaired",
+							},
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "sync even if database is locked",
+								Value: false,
+							},
+						},
+						Action: func(c *cli.Context) error {
+							report, err := admin.SyncDB(c.String("dir"), c.String("peer"), c.String("prefer"), c.Bool("dry-run"), c.Bool("force"))
+							if err != nil {
+								return err
+							}
+							if report.DryRun {
+								log.Info("Sync dry run against %s:", report.Peer)
+							} else {
+								log.Info("Sync with %s complete:", report.Peer)
+							}
+							log.Info("- Differing buckets: %d", report.Buckets)
+							log.Info("- Keys compared: %d", report.Compared)
+							log.Info("- Pulled from peer: %d", report.Count(admin.SyncPull))
+							log.Info("- Pushed to peer: %d", report.Count(admin.SyncPush))
+							if n := report.Count(admin.SyncConflict); n > 0 {
+								log.Warn("- Conflicts left alone: %d", n)
+							}
+							for _, a := range report.Actions {
+								log.Info("  - %s %s: %s", a.Action, a.Key, a.Reason)
+							}
+							return nil
+						},
+					},
 					{
 						Name:  "verify",
 						Usage: "verify database integrity",
@@ -174,7 +1032,15 @@ func main() {
 				Name:    "start",
 				Aliases: []string{"st"},
 				Usage:   "start a smoldb server",
+				Flags: append([]cli.Flag{
+					checkpointIntervalFlag(),
+					checkpointRetainFlag(),
+				}, readOnlyFlags()...),
+				Before: configured(),
 				Action: func(c *cli.Context) error {
+					if c.Bool("read-only") {
+						return serveReadOnly(c.Int("port"), c.String("dir"), c.Duration("refresh-interval"))
+					}
 					return serve(
 						c.Int("port"),
 						c.String("dir"),
@@ -182,64 +1048,148 @@ func main() {
 						c.Int("group-commit-ms"),
 						c.Int("group-commit-batch"),
 						c.String("sync-mode"),
+						c.String("wal-format"),
+						c.Bool("wal-compress"),
+						c.Duration("checkpoint-interval"),
+						c.Int("checkpoint-retain"),
 					)
 				},
 			}, {
-				Name:    "shell",
-				Aliases: []string{"sh"},
-				Usage:   "start an interactive smoldb shell",
+				Name:  "replicate",
+				Usage: "start a read-only smoldb server that follows a leader",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "from",
+						Usage: "base url of the leader, e.g. http://localhost:8080 (required)",
+					},
+					checkpointIntervalFlag(),
+					checkpointRetainFlag(),
+				},
+				Before: configured("from"),
+				Action: func(c *cli.Context) error {
+					return replicate(
+						c.Int("port"),
+						c.String("dir"),
+						c.String("from"),
+						c.String("durability"),
+						c.Int("group-commit-ms"),
+						c.Int("group-commit-batch"),
+						c.String("sync-mode"),
+						c.String("wal-format"),
+						c.Bool("wal-compress"),
+						c.Duration("checkpoint-interval"),
+						c.Int("checkpoint-retain"),
+					)
+				},
+			}, {
+				Name:  "cluster",
+				Usage: "start a smoldb node that replicates writes through raft",
 				Flags: []cli.Flag{
-					&cli.IntFlag{
-						Name:        "port",
-						Aliases:     []string{"p"},
-						Value:       8080,
-						Usage:       "port to run smoldb on",
-						DefaultText: "8080",
+					&cli.StringFlag{
+						Name:  "id",
+						Usage: "unique name of this node, e.g. n1 (required)",
+					},
+					&cli.StringFlag{
+						Name:  "addr",
+						Usage: "base url the other nodes and clients reach this node at, e.g. http://10.0.0.1:8080 (required)",
+					},
+					&cli.BoolFlag{
+						Name:  "bootstrap",
+						Usage: "start a new cluster with this node as its only member (ignored once it has state)",
+					},
+					&cli.StringFlag{
+						Name:  "join",
+						Usage: "base url of any member to ask to add this node",
 					},
+					&cli.Uint64Flag{
+						Name:        "snapshot-threshold",
+						Usage:       "checkpoint and compact the raft log after this many entries",
+						Value:       1024,
+						DefaultText: "1024",
+						EnvVars:     []string{"SMOLDB_SNAPSHOT_THRESHOLD"},
+					},
+					checkpointRetainFlag(),
+				},
+				Before: configured("id", "addr"),
+				Action: func(c *cli.Context) error {
+					return clusterServe(
+						c.Int("port"),
+						c.String("dir"),
+						c.String("id"),
+						c.String("addr"),
+						c.Bool("bootstrap"),
+						c.String("join"),
+						c.Uint64("snapshot-threshold"),
+						c.String("durability"),
+						c.Int("group-commit-ms"),
+						c.Int("group-commit-batch"),
+						c.String("sync-mode"),
+						c.String("wal-format"),
+						c.Bool("wal-compress"),
+						c.Int("checkpoint-retain"),
+					)
+				},
+			}, {
+				Name:  "ring",
+				Usage: "start a smoldb node that owns part of the keys of a consistent-hash ring",
+				Flags: []cli.Flag{
 					&cli.StringFlag{
-						Name:        "durability",
-						Usage:       "durability level: none|commit|grouped",
-						Value:       "commit",
-						DefaultText: "commit",
-						EnvVars:     []string{"SMOLDB_DURABILITY"},
-					},
-					&cli.IntFlag{
-						Name:        "group-commit-ms",
-						Usage:       "group commit fsync interval in ms (used when durability=grouped)",
-						Value:       0,
-						DefaultText: "0",
-						EnvVars:     []string{"SMOLDB_GROUP_COMMIT_MS"},
-					},
-					&cli.IntFlag{
-						Name:        "group-commit-batch",
-						Usage:       "group commit fsync after this many appends (used when durability=grouped)",
-						Value:       0,
-						DefaultText: "0",
-						EnvVars:     []string{"SMOLDB_GROUP_COMMIT_BATCH"},
+						Name:    "config",
+						Usage:   "ring config file listing every node, the same on all of them (required)",
+						EnvVars: []string{"SMOLDB_RING_CONFIG"},
 					},
 					&cli.StringFlag{
-						Name:        "sync-mode",
-						Usage:       "sync mode: none|fsync|dsync (dsync best-effort)",
-						Value:       "fsync",
-						DefaultText: "fsync",
-						EnvVars:     []string{"SMOLDB_SYNC_MODE"},
+						Name:  "id",
+						Usage: "id of this node in the ring config (required)",
 					},
+					checkpointIntervalFlag(),
+					checkpointRetainFlag(),
 				},
+				Before: configured("config", "id"),
 				Action: func(c *cli.Context) error {
+					return ringServe(
+						c.Int("port"),
+						c.String("dir"),
+						c.String("config"),
+						c.String("id"),
+						c.String("durability"),
+						c.Int("group-commit-ms"),
+						c.Int("group-commit-batch"),
+						c.String("sync-mode"),
+						c.String("wal-format"),
+						c.Bool("wal-compress"),
+						c.Duration("checkpoint-interval"),
+						c.Int("checkpoint-retain"),
+					)
+				},
+			}, {
+				Name:    "shell",
+				Aliases: []string{"sh"},
+				Usage:   "start an interactive smoldb shell",
+				Flags:   append(append([]cli.Flag{portFlag()}, walFlags()...), readOnlyFlags()...),
+				Before:  configured(),
+				Action: func(c *cli.Context) error {
+					if c.Bool("read-only") {
+						return sh.ShellReadOnly(c.String("dir"), c.Duration("refresh-interval"))
+					}
 					return sh.ShellWithOptions(
 						c.String("dir"),
 						c.String("durability"),
 						c.Int("group-commit-ms"),
 						c.Int("group-commit-batch"),
 						c.String("sync-mode"),
+						c.String("wal-format"),
+						c.Bool("wal-compress"),
 					)
 				},
 			},
 		},
 	}
+}
 
+func main() {
 	// run the application
-	err := app.Run(os.Args)
+	err := newApp().Run(os.Args)
 	if err != nil {
 		log.Fatal(err)
 	}
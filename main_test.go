@@ -0,0 +1,272 @@
+// provides an end to end test of a consistent-hash ring, every node runs in
+// its own process
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/ring"
+)
+
+// not a test on its own, run by TestRing in a child process that serves
+// one node of the ring
+func TestRingNodeChild(t *testing.T) {
+	config := os.Getenv("SMOLDB_TEST_RING_CONFIG")
+	if config == "" {
+		t.Skip("only run as a child of TestRing")
+	}
+	port, _ := strconv.Atoi(os.Getenv("SMOLDB_TEST_RING_PORT"))
+	err := ringServe(port, os.Getenv("SMOLDB_TEST_RING_DIR"), config, os.Getenv("SMOLDB_TEST_RING_ID"), "commit", 0, 0, "fsync", "json", false, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testRing runs ring nodes as child processes of the test
+type testRing struct {
+	t     *testing.T
+	root  string
+	ports map[string]int
+	procs map[string]*exec.Cmd
+}
+
+func newTestRing(t *testing.T) *testRing {
+	r := &testRing{t: t, root: t.TempDir(), ports: map[string]int{}, procs: map[string]*exec.Cmd{}}
+	t.Cleanup(func() {
+		for id := range r.procs {
+			r.stop(id)
+		}
+	})
+	return r
+}
+
+// base url of a node, a free port is picked the first time
+func (r *testRing) addr(id string) string {
+	if _, ok := r.ports[id]; !ok {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			r.t.Fatal(err)
+		}
+		r.ports[id] = l.Addr().(*net.TCPAddr).Port
+		l.Close()
+	}
+	return fmt.Sprintf("http://127.0.0.1:%d", r.ports[id])
+}
+
+// writes a ring config listing the given nodes, returns its path and contents
+func (r *testRing) config(name string, ids ...string) (string, *ring.Config) {
+	cfg := &ring.Config{VNodes: 16}
+	for _, id := range ids {
+		cfg.Nodes = append(cfg.Nodes, ring.Node{ID: id, Addr: r.addr(id)})
+	}
+	data, _ := json.Marshal(cfg)
+	path := filepath.Join(r.root, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		r.t.Fatal(err)
+	}
+	return path, cfg
+}
+
+// starts the node id with the given config and waits until it serves
+func (r *testRing) start(id, config string) {
+	r.t.Helper()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRingNodeChild$")
+	cmd.Env = append(os.Environ(),
+		"SMOLDB_TEST_RING_CONFIG="+config,
+		"SMOLDB_TEST_RING_ID="+id,
+		"SMOLDB_TEST_RING_DIR="+filepath.Join(r.root, id),
+		"SMOLDB_TEST_RING_PORT="+strconv.Itoa(r.ports[id]),
+	)
+	if err := os.MkdirAll(filepath.Join(r.root, id), 0755); err != nil {
+		r.t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		r.t.Fatal(err)
+	}
+	r.procs[id] = cmd
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if status, _ := r.do(http.MethodGet, r.addr(id)+"/", "", false); status == http.StatusOK {
+			return
+		}
+		if time.Now().After(deadline) {
+			r.t.Fatalf("node %s didn't come up", id)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// stops a node the way an operator would, it releases its lock
+func (r *testRing) stop(id string) {
+	cmd := r.procs[id]
+	cmd.Process.Signal(syscall.SIGTERM)
+	cmd.Wait()
+	delete(r.procs, id)
+}
+
+// sends a request, local ones are marked as forwarded so the receiving node
+// answers from its own keys
+func (r *testRing) do(method, url, body string, local bool) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if local {
+		req.Header.Set(ring.ForwardedHeader, "test")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(data)
+}
+
+// checks that every key is stored on its owner under cfg only and can be
+// read through any of the given nodes
+func (r *testRing) checkPlacement(cfg *ring.Config, keys []string, via ...string) {
+	r.t.Helper()
+
+	owners := ring.New(cfg.Nodes, cfg.VNodes)
+	for _, key := range keys {
+		for _, n := range cfg.Nodes {
+			status, _ := r.do(http.MethodGet, n.Addr+"/key/"+key, "", true)
+			want := http.StatusNotFound
+			if owners.Owner(key).ID == n.ID {
+				want = http.StatusOK
+			}
+			assert.Equal(r.t, want, status, "%s on %s", key, n.ID)
+		}
+		for _, id := range via {
+			status, body := r.do(http.MethodGet, r.addr(id)+"/key/"+key, "", false)
+			assert.Equal(r.t, http.StatusOK, status, "%s through %s", key, id)
+			assert.JSONEq(r.t, `{"key":"`+key+`"}`, body)
+		}
+	}
+}
+
+// verifies that keys are spread over processes, forwarded between them and
+// rebalanced when nodes join and leave
+func TestRing(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts several processes")
+	}
+	r := newTestRing(t)
+	config, cfg := r.config("ring-1.json", "n1", "n2", "n3")
+	for _, id := range []string{"n1", "n2", "n3"} {
+		r.start(id, config)
+	}
+
+	var keys []string
+	for k := 0; k < 30; k++ {
+		keys = append(keys, fmt.Sprintf("key%d", k))
+	}
+
+	// Test Case 1: any node accepts writes and reads for every key
+	t.Run("forward", func(t *testing.T) {
+		for k, key := range keys {
+			via := []string{"n1", "n2", "n3"}[k%3]
+			status, body := r.do(http.MethodPut, r.addr(via)+"/key/"+key, `{"key":"`+key+`"}`, false)
+			assert.Equal(t, http.StatusOK, status, body)
+		}
+		r.checkPlacement(cfg, keys, "n1", "n2", "n3")
+
+		status, body := r.do(http.MethodGet, r.addr("n2")+"/keys", "", false)
+		assert.Equal(t, http.StatusOK, status)
+		var listed struct {
+			Files []string `json:"files"`
+		}
+		assert.NoError(t, json.Unmarshal([]byte(body), &listed))
+		assert.ElementsMatch(t, keys, listed.Files)
+	})
+
+	// Test Case 2: references resolve to keys on other nodes
+	t.Run("references", func(t *testing.T) {
+		owners := ring.New(cfg.Nodes, cfg.VNodes)
+		var target string
+		for _, key := range keys {
+			if owners.Owner(key).ID != owners.Owner("ref").ID {
+				target = key
+				break
+			}
+		}
+		status, _ := r.do(http.MethodPut, r.addr("n1")+"/key/ref", `{"to":"REF::`+target+`","missing":"REF::nope"}`, false)
+		assert.Equal(t, http.StatusOK, status)
+
+		status, body := r.do(http.MethodGet, r.addr("n3")+"/key/ref?depth=1", "", false)
+		assert.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `{"to":{"key":"`+target+`"},"missing":"REF::ERR key 'nope' not found"}`, body)
+
+		status, _ = r.do(http.MethodDelete, r.addr("n2")+"/key/ref", "", false)
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	// Test Case 3: a new node takes over its share of the keys
+	t.Run("add node", func(t *testing.T) {
+		config, cfg := r.config("ring-2.json", "n1", "n2", "n3", "n4")
+		for _, id := range []string{"n1", "n2", "n3"} {
+			r.stop(id)
+			r.start(id, config)
+		}
+		r.start("n4", config)
+
+		stats, err := ring.Rebalance(context.Background(), cfg, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, stats.Nodes)
+		assert.Equal(t, len(keys), stats.Scanned)
+		assert.Greater(t, stats.Moved, 0)
+		r.checkPlacement(cfg, keys, "n1", "n4")
+
+		// nothing is left to move
+		stats, err = ring.Rebalance(context.Background(), cfg, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, stats.Moved)
+	})
+
+	// Test Case 4: a removed node is drained into the remaining ones
+	t.Run("remove node", func(t *testing.T) {
+		config, cfg := r.config("ring-3.json", "n1", "n3", "n4")
+		for _, id := range []string{"n1", "n3", "n4"} {
+			r.stop(id)
+			r.start(id, config)
+		}
+
+		stats, err := ring.Rebalance(context.Background(), cfg, []string{r.addr("n2")})
+		assert.NoError(t, err)
+		assert.Equal(t, 4, stats.Nodes)
+		assert.Greater(t, stats.Moved, 0)
+		r.checkPlacement(cfg, keys, "n3")
+
+		status, body := r.do(http.MethodGet, r.addr("n2")+"/keys", "", true)
+		assert.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `{"files":null}`, body)
+	})
+
+	// Test Case 5: the ring config of a command and the settings file are
+	// given apart
+	t.Run("cli", func(t *testing.T) {
+		config, _ := r.config("ring-3.json", "n1", "n3", "n4")
+		path := filepath.Join(r.root, "smoldb.yaml")
+		assert.NoError(t, os.WriteFile(path, []byte("ring:\n  id: n1\n"), 0644))
+		err := newApp().Run([]string{"smoldb", "--settings", path, "-d", filepath.Join(r.root, "cli"), "admin", "rebalance", "--config", config})
+		assert.NoError(t, err)
+		assert.Equal(t, path, settings.Path)
+	})
+}
@@ -0,0 +1,275 @@
+// provides counters, histograms and gauges exposed in the Prometheus text
+// format, observations are dropped until metrics are enabled
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefBuckets are the default histogram buckets for latencies in seconds
+var DefBuckets = []float64{.0001, .0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// SizeBuckets are histogram buckets for sizes in bytes, 64B to 16MB
+var SizeBuckets = ExponentialBuckets(64, 4, 10)
+
+var enabled atomic.Bool
+
+// Enable starts recording observations
+func Enable() {
+	enabled.Store(true)
+}
+
+// Enabled reports whether observations are recorded, callers use it to
+// skip measuring something that won't be recorded
+func Enabled() bool {
+	return enabled.Load()
+}
+
+// ExponentialBuckets returns n buckets, the first is start and every
+// following one factor times the previous
+func ExponentialBuckets(start, factor float64, n int) []float64 {
+	res := make([]float64, n)
+	for k := range res {
+		res[k] = start
+		start *= factor
+	}
+	return res
+}
+
+// a metric written out by the registry
+type collector interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+	names      = map[string]bool{}
+)
+
+// adds a metric to the registry, names must be unique
+func register(name string, c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if names[name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+	names[name] = true
+	registry = append(registry, c)
+}
+
+// WriteTo writes every metric in the Prometheus text format
+func WriteTo(w io.Writer) {
+	registryMu.Lock()
+	collectors := append([]collector(nil), registry...)
+	registryMu.Unlock()
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves every metric in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
+
+// Since returns the seconds elapsed since start
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// vec holds one value per combination of label values
+type vec[T any] struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*T
+	newT   func() *T
+}
+
+// returns the value for the label values, creating it on first use, the
+// caller holds mu
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	t, ok := v.values[key]
+	if !ok {
+		t = v.newT()
+		v.values[key] = t
+	}
+	return t
+}
+
+// calls fn for every value ordered by label values, with the values
+// formatted as label pairs
+func (v *vec[T]) each(fn func(labels []string, t *T)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var pairs []string
+		if len(v.labels) > 0 {
+			for k, value := range strings.Split(key, "\xff") {
+				pairs = append(pairs, fmt.Sprintf(`%s="%s"`, v.labels[k], escaper.Replace(value)))
+			}
+		}
+		fn(pairs, v.values[key])
+	}
+}
+
+// writes the HELP and TYPE lines
+func (v *vec[T]) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, kind)
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	vec[float64]
+}
+
+// NewCounter registers a counter with the given label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec[float64]{name: name, help: help, labels: labels, values: map[string]*float64{}, newT: func() *float64 { return new(float64) }}}
+	register(name, c)
+	return c
+}
+
+// Add adds v to the counter of the label values
+func (c *Counter) Add(v float64, labels ...string) {
+	if !Enabled() {
+		return
+	}
+	c.mu.Lock()
+	*c.with(labels) += v
+	c.mu.Unlock()
+}
+
+// Inc adds one to the counter of the label values
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.header(w, "counter")
+	c.each(func(labels []string, v *float64) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, braces(labels), formatFloat(*v))
+	})
+}
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	vec[histogramValue]
+	buckets []float64
+}
+
+// counts of one combination of label values, counts[k] holds the
+// observations up to buckets[k] that didn't fit a smaller bucket
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the given upper bounds, in
+// increasing order, and label names
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{buckets: buckets}
+	h.vec = vec[histogramValue]{name: name, help: help, labels: labels, values: map[string]*histogramValue{}, newT: func() *histogramValue {
+		return &histogramValue{counts: make([]uint64, len(buckets))}
+	}}
+	register(name, h)
+	return h
+}
+
+// Observe records v for the label values
+func (h *Histogram) Observe(v float64, labels ...string) {
+	if !Enabled() {
+		return
+	}
+	k := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	value := h.with(labels)
+	if k < len(h.buckets) {
+		value.counts[k]++
+	}
+	value.count++
+	value.sum += v
+	h.mu.Unlock()
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.header(w, "histogram")
+	h.each(func(labels []string, v *histogramValue) {
+		var cumulative uint64
+		for k, bound := range h.buckets {
+			cumulative += v.counts[k]
+			le := append(labels[:len(labels):len(labels)], fmt.Sprintf(`le="%s"`, formatFloat(bound)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braces(le), cumulative)
+		}
+		le := append(labels[:len(labels):len(labels)], `le="+Inf"`)
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braces(le), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, braces(labels), formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, braces(labels), v.count)
+	})
+}
+
+// Gauge is a value read when the metrics are written
+type Gauge struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewGauge registers a gauge reporting the value of fn
+func NewGauge(name, help string, fn func() float64) *Gauge {
+	g := &Gauge{name: name, help: help, fn: fn}
+	register(name, g)
+	return g
+}
+
+func (g *Gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", g.name, g.help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+// wraps label pairs in braces, nothing when there are none
+func braces(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapes label values the way the text format expects
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
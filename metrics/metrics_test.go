@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	requests := NewCounter("test_requests_total", "Requests served.", "route")
+	latency := NewHistogram("test_latency_seconds", "Request latency.", []float64{0.1, 1})
+	NewGauge("test_keys", "Keys stored.", func() float64 { return 42 })
+
+	// Test Case 1: nothing is recorded until metrics are enabled
+	t.Run("disabled", func(t *testing.T) {
+		requests.Inc("/a")
+		latency.Observe(0.5)
+		var out bytes.Buffer
+		WriteTo(&out)
+		assert.NotContains(t, out.String(), `test_requests_total{route="/a"}`)
+		assert.NotContains(t, out.String(), "test_latency_seconds_count")
+	})
+
+	// Test Case 2: values are written in the text format
+	t.Run("text format", func(t *testing.T) {
+		Enable()
+		requests.Inc("/a")
+		requests.Add(2, `/b"\`)
+		latency.Observe(0.05)
+		latency.Observe(0.5)
+		latency.Observe(5)
+
+		rr := httptest.NewRecorder()
+		Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+		assert.True(t, strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+		out := rr.Body.String()
+		for _, line := range []string{
+			"# TYPE test_requests_total counter",
+			`test_requests_total{route="/a"} 1`,
+			`test_requests_total{route="/b\"\\"} 2`,
+			"# TYPE test_latency_seconds histogram",
+			`test_latency_seconds_bucket{le="0.1"} 1`,
+			`test_latency_seconds_bucket{le="1"} 2`,
+			`test_latency_seconds_bucket{le="+Inf"} 3`,
+			"test_latency_seconds_sum 5.55",
+			"test_latency_seconds_count 3",
+			"# TYPE test_keys gauge",
+			"test_keys 42",
+		} {
+			assert.Contains(t, out, line+"\n")
+		}
+
+		assert.Panics(t, func() { NewGauge("test_keys", "again", func() float64 { return 0 }) })
+		assert.Panics(t, func() { requests.Inc() })
+	})
+}
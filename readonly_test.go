@@ -0,0 +1,145 @@
+// provides an end to end test of a read-only server next to the server
+// writing the same database
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/lock"
+)
+
+// not a test on its own, run by TestReadOnly in a child process that serves
+// the database, read-only when SMOLDB_TEST_READ_ONLY is set
+func TestReadOnlyChild(t *testing.T) {
+	dir := os.Getenv("SMOLDB_TEST_READ_ONLY_DIR")
+	if dir == "" {
+		t.Skip("only run as a child of TestReadOnly")
+	}
+	port, _ := strconv.Atoi(os.Getenv("SMOLDB_TEST_READ_ONLY_PORT"))
+	var err error
+	if os.Getenv("SMOLDB_TEST_READ_ONLY") != "" {
+		err = serveReadOnly(port, dir, 50*time.Millisecond)
+	} else {
+		err = serve(port, dir, "commit", 0, 0, "fsync", "json", false, 0, 3)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// starts a child serving dir, returns its base url once it answers
+func startReadOnlyChild(t *testing.T, dir string, readOnly bool) (string, *exec.Cmd) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	addr := fmt.Sprintf("http://127.0.0.1:%d", port)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestReadOnlyChild$")
+	cmd.Env = append(os.Environ(), "SMOLDB_TEST_READ_ONLY_DIR="+dir, "SMOLDB_TEST_READ_ONLY_PORT="+strconv.Itoa(port))
+	if readOnly {
+		cmd.Env = append(cmd.Env, "SMOLDB_TEST_READ_ONLY=1")
+	}
+	assert.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if res, err := http.Get(addr + "/"); err == nil {
+			res.Body.Close()
+			return addr, cmd
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't come up")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// sends a request, returns the status and body
+func send(t *testing.T, method string, url string, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return 0, ""
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(data)
+}
+
+// verifies that a read-only server runs next to the writer, sees its
+// writes and refuses its own
+func TestReadOnly(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	writer, _ := startReadOnlyChild(t, dir, false)
+	reader, _ := startReadOnlyChild(t, dir, true)
+
+	// Test Case 1: writes made by the server show up on the reader
+	t.Run("refresh", func(t *testing.T) {
+		status, _ := send(t, http.MethodPut, writer+"/key/doc", `{"hello":"world"}`)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Eventually(t, func() bool {
+			status, body := send(t, http.MethodGet, reader+"/key/doc", "")
+			return status == http.StatusOK && body == `{"hello":"world"}`
+		}, 5*time.Second, 20*time.Millisecond)
+	})
+
+	// Test Case 2: the reader refuses writes and leaves the files alone
+	t.Run("writes", func(t *testing.T) {
+		status, _ := send(t, http.MethodPut, reader+"/key/doc", `{"hello":"reader"}`)
+		assert.Equal(t, http.StatusMethodNotAllowed, status)
+		status, _ = send(t, http.MethodDelete, reader+"/key/doc", "")
+		assert.Equal(t, http.StatusMethodNotAllowed, status)
+
+		routes := map[string]string{
+			"PUT /key/doc":               "GET",
+			"DELETE /key/doc":            "GET",
+			"PATCH /key/doc/field/hello": "GET",
+			"POST /batch/put":            "",
+			"POST /batch/delete":         "",
+			"POST /import":               "",
+			"POST /integrity/doc/repair": "",
+		}
+		for route, allow := range routes {
+			method, path, _ := strings.Cut(route, " ")
+			req, err := http.NewRequest(method, reader+path, strings.NewReader(`{"keys":["doc"]}`))
+			assert.NoError(t, err)
+			res, err := http.DefaultClient.Do(req)
+			if !assert.NoError(t, err, route) {
+				continue
+			}
+			res.Body.Close()
+			assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode, route)
+			assert.Equal(t, []string{allow}, res.Header.Values("Allow"), route)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "doc.json"))
+		assert.NoError(t, err)
+		assert.Equal(t, `{"hello":"world"}`, string(data))
+	})
+
+	// Test Case 3: the lock shows the writer and the reader
+	t.Run("lock", func(t *testing.T) {
+		s, err := lock.Inspect(dir)
+		assert.NoError(t, err)
+		assert.Equal(t, lock.Held, s.State)
+		assert.True(t, s.Readers)
+	})
+}
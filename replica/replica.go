@@ -0,0 +1,380 @@
+// provides the follower side of asynchronous replication, a follower tails
+// the WAL of a leader over HTTP and applies it to its own index
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	af "github.com/spf13/afero"
+	"github.com/themillenniumfalcon/smolDB/audit"
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// how long to wait before reconnecting, doubled after every failed attempt
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 5 * time.Second
+)
+
+// how often the applied position is written to the state file at most
+const saveInterval = time.Second
+
+// ErrReseed is returned when the leader no longer has the records the
+// follower needs, the follower has to be seeded from a backup again
+var ErrReseed = errors.New("leader no longer has the WAL after the applied lsn, restart the follower to reseed it")
+
+// Status describes the replication state of a follower
+type Status struct {
+	Leader      string  `json:"leader"`
+	Connected   bool    `json:"connected"`
+	AppliedLSN  uint64  `json:"appliedLsn"`
+	LeaderLSN   uint64  `json:"leaderLsn"`
+	LagRecords  uint64  `json:"lagRecords"`
+	LagSeconds  float64 `json:"lagSeconds"`
+	LastContact string  `json:"lastContact,omitempty"`
+	Reconnects  int     `json:"reconnects"`
+	LastError   string  `json:"lastError,omitempty"`
+}
+
+// state is what a follower keeps in .smoldb/replica.json between restarts,
+// the local WAL holds the applied position itself, the copy here is for
+// operators and tells which leader the data came from
+type state struct {
+	Leader  string `json:"leader"`
+	LSN     uint64 `json:"lsn"`
+	Updated string `json:"updated"`
+}
+
+// Follower tails the WAL of a leader and applies it to a local index
+type Follower struct {
+	leader  string
+	idx     *index.FileIndex
+	fs      af.Fs
+	dir     string
+	client  *http.Client
+	Idle    time.Duration // the connection is considered dead after this long without a heartbeat
+	mu      sync.Mutex
+	status  Status
+	leaderT int64 // leader timestamp of the last heartbeat
+	applied int64 // leader timestamp of the last applied record
+	saved   time.Time
+}
+
+// NewFollower creates a follower of the leader at the given base URL that
+// applies to idx, whose files live in dir
+func NewFollower(leader string, idx *index.FileIndex, dir string) *Follower {
+	leader = strings.TrimSuffix(leader, "/")
+	return &Follower{
+		leader: leader,
+		idx:    idx,
+		fs:     idx.FileSystem,
+		dir:    dir,
+		client: &http.Client{},
+		Idle:   5 * time.Second,
+		status: Status{Leader: leader, AppliedLSN: idx.LastLSN()},
+	}
+}
+
+// Status returns the current replication state
+func (f *Follower) Status() Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.status
+	if s.LeaderLSN > s.AppliedLSN {
+		s.LagRecords = s.LeaderLSN - s.AppliedLSN
+		if f.leaderT > f.applied && f.applied > 0 {
+			s.LagSeconds = time.Duration(f.leaderT - f.applied).Seconds()
+		}
+	}
+	return s
+}
+
+// Run replicates until ctx is done, reconnecting with backoff after every
+// failure. It only returns early with ErrReseed
+func (f *Follower) Run(ctx context.Context) error {
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		err := f.stream(ctx)
+		if ctx.Err() != nil {
+			f.save(true)
+			return nil
+		}
+		f.disconnected(err)
+		if errors.Is(err, ErrReseed) {
+			return err
+		}
+		log.Warn("replication: lost leader %s: %v", f.leader, err)
+
+		// a connection that lasted a while starts the backoff over
+		if time.Since(start) > maxBackoff {
+			backoff = minBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// streams from the applied position until the connection fails
+func (f *Follower) stream(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	from := f.idx.LastLSN()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/replication/stream?from=%d", f.leader, from), nil)
+	if err != nil {
+		return err
+	}
+	auth.Attach(req)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return ErrReseed
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("leader answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	f.connected()
+
+	// a leader that stops sending heartbeats is as good as gone
+	watchdog := time.AfterFunc(f.Idle, cancel)
+	defer watchdog.Stop()
+
+	err = f.idx.ApplyReplicated(resp.Body, func(rec index.ReplicatedRecord) {
+		watchdog.Reset(f.Idle)
+		f.record(rec)
+		f.audit(rec)
+	})
+	if err == io.EOF {
+		err = fmt.Errorf("leader closed the stream")
+	}
+	if ctx.Err() != nil && err != nil {
+		err = fmt.Errorf("no heartbeat from leader in %s", f.Idle)
+	}
+	return err
+}
+
+// updates the status after a record or heartbeat arrived
+func (f *Follower) record(rec index.ReplicatedRecord) {
+	f.mu.Lock()
+	f.status.LastContact = time.Now().UTC().Format(time.RFC3339Nano)
+	if rec.Heartbeat {
+		f.status.LeaderLSN = rec.LSN
+		f.leaderT = rec.Ts
+	} else {
+		f.status.AppliedLSN = rec.LSN
+		f.applied = rec.Ts
+		if rec.LSN > f.status.LeaderLSN {
+			f.status.LeaderLSN = rec.LSN
+		}
+	}
+	f.mu.Unlock()
+
+	f.save(false)
+}
+
+// records the changes an applied record made in the audit log, under
+// the leader they came from
+func (f *Follower) audit(rec index.ReplicatedRecord) {
+	for _, c := range rec.Changes {
+		audit.Record(audit.Entry{
+			Client: "leader " + f.leader,
+			Op:     audit.OpOf(rec.Op, c.After),
+			Key:    c.Key,
+			Before: c.Before,
+			After:  c.After,
+			Detail: fmt.Sprintf("replicated at lsn %d", rec.LSN),
+		})
+	}
+}
+
+func (f *Follower) connected() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.status.Connected = true
+	f.status.LastError = ""
+	log.Info("replication: streaming from %s after lsn %d", f.leader, f.status.AppliedLSN)
+}
+
+func (f *Follower) disconnected(err error) {
+	f.mu.Lock()
+	if f.status.Connected {
+		f.status.Reconnects++
+	}
+	f.status.Connected = false
+	if err != nil {
+		f.status.LastError = err.Error()
+	}
+	f.mu.Unlock()
+
+	f.save(true)
+}
+
+// writes the applied position to the state file, at most once every
+// saveInterval unless forced
+func (f *Follower) save(force bool) {
+	f.mu.Lock()
+	if !force && time.Since(f.saved) < saveInterval {
+		f.mu.Unlock()
+		return
+	}
+	f.saved = time.Now()
+	f.mu.Unlock()
+
+	s := state{Leader: f.leader, LSN: f.idx.LastLSN(), Updated: time.Now().UTC().Format(time.RFC3339)}
+	if err := saveState(f.fs, f.dir, s); err != nil {
+		log.Warn("replication: failed to save position: %v", err)
+	}
+}
+
+// path of the state file in dir
+func statePath(dir string) string {
+	return filepath.Join(dir, ".smoldb", "replica.json")
+}
+
+// writes the state file atomically
+func saveState(fs af.Fs, dir string, s state) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(filepath.Dir(statePath(dir)), 0755); err != nil {
+		return err
+	}
+	tmp := statePath(dir) + ".tmp"
+	if err := af.WriteFile(fs, tmp, data, 0644); err != nil {
+		return err
+	}
+	return fs.Rename(tmp, statePath(dir))
+}
+
+// reads the state file, nil if there is none
+func loadState(fs af.Fs, dir string) (*state, error) {
+	data, err := af.ReadFile(fs, statePath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	s := &state{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", statePath(dir), err)
+	}
+	return s, nil
+}
+
+// leaderStatus is the part of a leader's GET /replication/status a
+// follower needs
+type leaderStatus struct {
+	LSN       uint64 `json:"lsn"`
+	OldestLSN uint64 `json:"oldestLsn"`
+}
+
+// fetches the replication status of the leader
+func fetchLeaderStatus(client *http.Client, leader string) (*leaderStatus, error) {
+	req, err := http.NewRequest(http.MethodGet, leader+"/replication/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	auth.Attach(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("leader answered %s", resp.Status)
+	}
+	s := &leaderStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(s); err != nil {
+		return nil, fmt.Errorf("failed to decode leader status: %v", err)
+	}
+	return s, nil
+}
+
+// NeedsSeed reports whether the database in dir has to be seeded from a
+// backup of the leader before it can follow it: it never followed this
+// leader, or it is behind the oldest record the leader still keeps
+func NeedsSeed(fs af.Fs, dir, leader string) (bool, error) {
+	leader = strings.TrimSuffix(leader, "/")
+	s, err := loadState(fs, dir)
+	if err != nil {
+		return false, err
+	}
+	if s == nil || s.Leader != leader {
+		return true, nil
+	}
+
+	status, err := fetchLeaderStatus(&http.Client{Timeout: 10 * time.Second}, leader)
+	if err != nil {
+		return false, err
+	}
+	if status.LSN <= s.LSN {
+		return false, nil
+	}
+	return status.OldestLSN == 0 || status.OldestLSN > s.LSN+1, nil
+}
+
+// Seed replaces the database in dir with a backup streamed from the leader,
+// the previous contents are moved aside. Returns the LSN it is at
+func Seed(fs af.Fs, dir, leader string) (uint64, error) {
+	leader = strings.TrimSuffix(leader, "/")
+	if _, err := url.Parse(leader); err != nil {
+		return 0, fmt.Errorf("invalid leader url: %v", err)
+	}
+
+	log.Info("replication: seeding %s from a backup of %s", dir, leader)
+	req, err := http.NewRequest(http.MethodPost, leader+"/admin/backup", nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch backup from leader: %v", err)
+	}
+	auth.Attach(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch backup from leader: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("leader answered %s to the backup request", resp.Status)
+	}
+
+	stats, err := index.RestoreBackup(fs, []io.Reader{resp.Body}, dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to restore backup from leader: %v", err)
+	}
+	if stats.Previous != "" {
+		log.Info("replication: previous contents of %s moved to %s", dir, stats.Previous)
+	}
+	if err := saveState(fs, dir, state{Leader: leader, LSN: stats.LSN, Updated: time.Now().UTC().Format(time.RFC3339)}); err != nil {
+		return 0, err
+	}
+	return stats.LSN, nil
+}
@@ -0,0 +1,189 @@
+package ring
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/auth"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// ForwardedHeader marks a request sent by another node, such a request is
+// always handled by the node that receives it so it can't loop
+const ForwardedHeader = "X-Smoldb-Forwarded"
+
+// RequestTimeout bounds requests made to other nodes
+var RequestTimeout = 10 * time.Second
+
+// Forwarder sends requests for keys this node doesn't own to their owner
+type Forwarder struct {
+	ring   *Ring
+	self   Node
+	client *http.Client
+}
+
+// NewForwarder creates the forwarder of the node with the given id
+func NewForwarder(cfg *Config, self string) (*Forwarder, error) {
+	node, ok := cfg.Node(self)
+	if !ok {
+		return nil, fmt.Errorf("node '%s' isn't listed in the ring config", self)
+	}
+	return &Forwarder{
+		ring:   New(cfg.Nodes, cfg.VNodes),
+		self:   node,
+		client: &http.Client{Timeout: RequestTimeout},
+	}, nil
+}
+
+// Owns reports whether this node owns key
+func (f *Forwarder) Owns(key string) bool {
+	return f.ring.Owner(key).ID == f.self.ID
+}
+
+// Fetch returns the document key from the node owning it, references in it
+// are left unresolved
+func (f *Forwarder) Fetch(key string) (map[string]interface{}, bool, error) {
+	owner := f.ring.Owner(key)
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	status, body, err := call(ctx, f.client, f.self.ID, http.MethodGet, keyURL(owner.Addr, key)+"?depth=0", nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if status == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if status != http.StatusOK {
+		return nil, false, fmt.Errorf("%s answered %d: %s", owner.ID, status, strings.TrimSpace(string(body)))
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, false, fmt.Errorf("invalid document from %s: %v", owner.ID, err)
+	}
+	return doc, true, nil
+}
+
+// Handle wraps the handler of a route with a :key parameter, requests for
+// keys owned by another node are forwarded there and its answer is relayed
+func (f *Forwarder) Handle(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		key := ps.ByName("key")
+		if r.Header.Get(ForwardedHeader) != "" || f.Owns(key) {
+			h(w, r, ps)
+			return
+		}
+		f.forward(w, r, f.ring.Owner(key))
+	}
+}
+
+// relays r to owner and its answer back to the client
+func (f *Forwarder) forward(w http.ResponseWriter, r *http.Request, owner Node) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, owner.Addr+r.URL.RequestURI(), r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.WWarn(w, "err forwarding to node '%s': %s", owner.ID, err.Error())
+		return
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set(ForwardedHeader, f.self.ID)
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		log.WWarn(w, "err forwarding to node '%s': %s", owner.ID, err.Error())
+		return
+	}
+	defer res.Body.Close()
+	for name, values := range res.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
+
+// Keys handles GET /keys, the keys of every node are gathered, a request
+// from another node only lists the local ones. Only the keys the client may
+// read are listed
+func (f *Forwarder) Keys(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	files := index.R.ListKeys()
+	if r.Header.Get(ForwardedHeader) == "" {
+		for _, n := range f.ring.Nodes() {
+			if n.ID == f.self.ID {
+				continue
+			}
+			keys, err := listKeys(r.Context(), f.client, f.self.ID, n.Addr)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				log.WWarn(w, "err listing keys of node '%s': %s", n.ID, err.Error())
+				return
+			}
+			files = append(files, keys...)
+		}
+		sort.Strings(files)
+	}
+	files = acl.Readable(auth.FromContext(r.Context()), files)
+
+	data := struct {
+		Files []string `json:"files"`
+	}{
+		Files: files,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// returns the url of key on the node at addr
+func keyURL(addr, key string) string {
+	return addr + "/key/" + url.PathEscape(key)
+}
+
+// sends a request to another node marked as forwarded by from, returns the
+// status and body of the answer
+func call(ctx context.Context, client *http.Client, from, method, url string, body []byte) (int, []byte, error) {
+	var rd io.Reader
+	if body != nil {
+		rd = strings.NewReader(string(body))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, rd)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set(ForwardedHeader, from)
+	auth.Attach(req)
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	return res.StatusCode, data, err
+}
+
+// returns the keys stored on the node at addr itself
+func listKeys(ctx context.Context, client *http.Client, from, addr string) ([]string, error) {
+	status, body, err := call(ctx, client, from, http.MethodGet, addr+"/keys", nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %d: %s", addr, status, strings.TrimSpace(string(body)))
+	}
+	var data struct {
+		Files []string `json:"files"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, fmt.Errorf("invalid key list from %s: %v", addr, err)
+	}
+	return data.Files, nil
+}
@@ -0,0 +1,102 @@
+package ring
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RebalanceStats describes a finished rebalance
+type RebalanceStats struct {
+	Nodes   int // nodes scanned, including drained ones
+	Scanned int // keys looked at
+	Moved   int // keys moved to their owner
+}
+
+// Rebalance moves every key to the node owning it under cfg. It is run
+// once all nodes were restarted with the new configuration: keys are
+// listed on every node of cfg and on the drained nodes at the given
+// addresses, which are being removed, and each key stored on a node that
+// doesn't own it is copied to its owner and then deleted. A key the owner
+// already has was written there since and only the stale copy is deleted
+func Rebalance(ctx context.Context, cfg *Config, drain []string) (*RebalanceStats, error) {
+	r := New(cfg.Nodes, cfg.VNodes)
+	client := &http.Client{Timeout: RequestTimeout}
+	stats := &RebalanceStats{}
+
+	var sources []string
+	for _, n := range cfg.Nodes {
+		sources = append(sources, n.Addr)
+	}
+	for _, addr := range drain {
+		sources = append(sources, strings.TrimSuffix(addr, "/"))
+	}
+
+	// every node is listed before anything moves, an unreachable node
+	// stops the rebalance before it starts
+	listed := make([][]string, len(sources))
+	for k, src := range sources {
+		keys, err := listKeys(ctx, client, "rebalance", src)
+		if err != nil {
+			return stats, err
+		}
+		listed[k] = keys
+		stats.Nodes++
+	}
+
+	for k, src := range sources {
+		for _, key := range listed[k] {
+			stats.Scanned++
+			owner := r.Owner(key)
+			if owner.Addr == src {
+				continue
+			}
+			if err := move(ctx, client, key, src, owner.Addr); err != nil {
+				return stats, fmt.Errorf("failed to move key %s from %s to %s: %v", key, src, owner.ID, err)
+			}
+			stats.Moved++
+		}
+	}
+	return stats, nil
+}
+
+// copies key from the node at src to the node at dst unless dst has it
+// already, then deletes it on src. Any other answer from dst leaves the
+// key where it is
+func move(ctx context.Context, client *http.Client, key, src, dst string) error {
+	status, msg, err := call(ctx, client, "rebalance", http.MethodGet, keyURL(dst, key)+"?depth=0", nil)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusOK:
+		// written on the owner since, the copy on src is stale
+	case http.StatusNotFound:
+		status, body, err := call(ctx, client, "rebalance", http.MethodGet, keyURL(src, key)+"?depth=0", nil)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("reading it answered %d: %s", status, strings.TrimSpace(string(body)))
+		}
+		status, msg, err := call(ctx, client, "rebalance", http.MethodPut, keyURL(dst, key), body)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("writing it answered %d: %s", status, strings.TrimSpace(string(msg)))
+		}
+	default:
+		return fmt.Errorf("looking it up on the owner answered %d: %s", status, strings.TrimSpace(string(msg)))
+	}
+
+	status, msg, err = call(ctx, client, "rebalance", http.MethodDelete, keyURL(src, key), nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusNotFound {
+		return fmt.Errorf("deleting it answered %d: %s", status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// provides tests for moving keys between nodes after the ring changed
+package ring
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNode serves the key endpoints a rebalance uses from a map
+type fakeNode struct {
+	mu     sync.Mutex
+	docs   map[string]string
+	refuse int // status answered to reads of single keys when set
+}
+
+func (f *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/keys" {
+		files := []string{}
+		for key := range f.docs {
+			files = append(files, key)
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"files": files})
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/key/")
+	switch r.Method {
+	case http.MethodGet:
+		if f.refuse != 0 {
+			w.WriteHeader(f.refuse)
+			return
+		}
+		body, ok := f.docs[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(body))
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		f.docs[key] = string(body)
+	case http.MethodDelete:
+		delete(f.docs, key)
+	}
+}
+
+// stores a document on a fake node
+func (f *fakeNode) put(key, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.docs[key] = body
+}
+
+// makes a fake node answer reads of single keys with status, 0 serves them
+func (f *fakeNode) refuseWith(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refuse = status
+}
+
+// the documents of a fake node
+func (f *fakeNode) snapshot() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := map[string]string{}
+	for key, body := range f.docs {
+		res[key] = body
+	}
+	return res
+}
+
+func TestRebalance(t *testing.T) {
+	src := &fakeNode{docs: map[string]string{}}
+	dst := &fakeNode{docs: map[string]string{}}
+	srcServer := httptest.NewServer(src)
+	defer srcServer.Close()
+	dstServer := httptest.NewServer(dst)
+	defer dstServer.Close()
+	cfg := &Config{Nodes: []Node{{ID: "a", Addr: srcServer.URL}, {ID: "b", Addr: dstServer.URL}}, VNodes: DefaultVNodes}
+
+	// keys the new ring places on b, all still stored on a
+	r := New(cfg.Nodes, cfg.VNodes)
+	var moving []string
+	for k := 0; len(moving) < 3; k++ {
+		key := fmt.Sprintf("key-%d", k)
+		if r.Owner(key).ID == "b" {
+			moving = append(moving, key)
+			src.put(key, `{"from":"a"}`)
+		}
+	}
+
+	// Test Case 1: an owner that refuses the lookup keeps the only copy
+	// where it is
+	t.Run("owner refuses", func(t *testing.T) {
+		for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusServiceUnavailable} {
+			dst.refuseWith(status)
+			_, err := Rebalance(context.Background(), cfg, nil)
+			assert.Error(t, err, status)
+			assert.Len(t, src.snapshot(), len(moving), status)
+			assert.Empty(t, dst.snapshot(), status)
+		}
+		dst.refuseWith(0)
+	})
+
+	// Test Case 2: missing keys are copied, keys the owner has already are
+	// kept as they are there, both are deleted on the old node
+	t.Run("move", func(t *testing.T) {
+		dst.put(moving[0], `{"from":"b"}`)
+		stats, err := Rebalance(context.Background(), cfg, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, len(moving), stats.Moved)
+		assert.Empty(t, src.snapshot())
+		docs := dst.snapshot()
+		assert.Equal(t, `{"from":"b"}`, docs[moving[0]])
+		assert.Equal(t, `{"from":"a"}`, docs[moving[1]])
+		assert.Len(t, docs, len(moving))
+	})
+}
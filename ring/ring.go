@@ -0,0 +1,133 @@
+// provides a consistent-hash ring that spreads keys over several smolDB
+// nodes listed in a static configuration file, any node accepts requests
+// and forwards them to the node that owns the key
+package ring
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// DefaultVNodes is the number of points every node gets on the ring when
+// the configuration doesn't set one
+const DefaultVNodes = 64
+
+// Node is a member of the ring
+type Node struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"` // base url, e.g. http://10.0.0.1:8080
+}
+
+// Config is the static cluster configuration, every node is started with
+// the same file
+type Config struct {
+	VNodes int    `json:"vnodes,omitempty"`
+	Nodes  []Node `json:"nodes"`
+}
+
+// LoadConfig reads and checks a configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ring config: %v", err)
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse ring config %s: %v", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid ring config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// checks that there are nodes with unique ids and addresses, fills in defaults
+func (c *Config) validate() error {
+	if len(c.Nodes) == 0 {
+		return fmt.Errorf("no nodes listed")
+	}
+	if c.VNodes < 0 {
+		return fmt.Errorf("vnodes must not be negative")
+	}
+	if c.VNodes == 0 {
+		c.VNodes = DefaultVNodes
+	}
+	ids, addrs := map[string]bool{}, map[string]bool{}
+	for k := range c.Nodes {
+		n := &c.Nodes[k]
+		n.Addr = strings.TrimSuffix(n.Addr, "/")
+		if n.ID == "" || n.Addr == "" {
+			return fmt.Errorf("node %d needs an id and an addr", k)
+		}
+		if ids[n.ID] || addrs[n.Addr] {
+			return fmt.Errorf("node %s is listed twice", n.ID)
+		}
+		ids[n.ID], addrs[n.Addr] = true, true
+	}
+	return nil
+}
+
+// Node returns the node with the given id
+func (c *Config) Node(id string) (Node, bool) {
+	for _, n := range c.Nodes {
+		if n.ID == id {
+			return n, true
+		}
+	}
+	return Node{}, false
+}
+
+// point is one virtual node on the ring
+type point struct {
+	hash uint64
+	node int
+}
+
+// Ring maps keys to nodes, every node owns the arcs before its virtual
+// nodes so adding or removing a node only moves the keys of its arcs
+type Ring struct {
+	nodes  []Node
+	points []point
+}
+
+// New builds a ring with vnodes points per node
+func New(nodes []Node, vnodes int) *Ring {
+	if vnodes < 1 {
+		vnodes = DefaultVNodes
+	}
+	r := &Ring{nodes: nodes}
+	for k, n := range nodes {
+		for v := 0; v < vnodes; v++ {
+			r.points = append(r.points, point{hash: xxhash.Sum64String(n.ID + "#" + strconv.Itoa(v)), node: k})
+		}
+	}
+	sort.Slice(r.points, func(a, b int) bool {
+		if r.points[a].hash != r.points[b].hash {
+			return r.points[a].hash < r.points[b].hash
+		}
+		return r.nodes[r.points[a].node].ID < r.nodes[r.points[b].node].ID
+	})
+	return r
+}
+
+// Owner returns the node key belongs to, the first virtual node at or after
+// the hash of the key
+func (r *Ring) Owner(key string) Node {
+	h := xxhash.Sum64String(key)
+	k := sort.Search(len(r.points), func(k int) bool { return r.points[k].hash >= h })
+	if k == len(r.points) {
+		k = 0
+	}
+	return r.nodes[r.points[k].node]
+}
+
+// Nodes returns the members of the ring
+func (r *Ring) Nodes() []Node {
+	return r.nodes
+}
@@ -0,0 +1,101 @@
+// provides tests for the consistent-hash ring and its configuration
+package ring
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// nodes a, b, c... at made up addresses
+func testNodes(ids ...string) []Node {
+	var nodes []Node
+	for _, id := range ids {
+		nodes = append(nodes, Node{ID: id, Addr: "http://" + id})
+	}
+	return nodes
+}
+
+func TestRing(t *testing.T) {
+	keys := make([]string, 3000)
+	for k := range keys {
+		keys[k] = fmt.Sprintf("key-%d", k)
+	}
+
+	// Test Case 1: every node owns a fair share of the keys
+	t.Run("spread", func(t *testing.T) {
+		r := New(testNodes("a", "b", "c"), DefaultVNodes)
+		owned := map[string]int{}
+		for _, key := range keys {
+			owned[r.Owner(key).ID]++
+		}
+		for _, id := range []string{"a", "b", "c"} {
+			assert.Greater(t, owned[id], len(keys)/6, id)
+		}
+		// the ring doesn't depend on the order nodes are listed in
+		other := New(testNodes("c", "a", "b"), DefaultVNodes)
+		for _, key := range keys {
+			assert.Equal(t, r.Owner(key), other.Owner(key))
+		}
+	})
+
+	// Test Case 2: adding or removing a node only moves its own keys
+	t.Run("membership", func(t *testing.T) {
+		before := New(testNodes("a", "b", "c"), DefaultVNodes)
+		after := New(testNodes("a", "b", "c", "d"), DefaultVNodes)
+		moved := 0
+		for _, key := range keys {
+			if was, is := before.Owner(key), after.Owner(key); was != is {
+				assert.Equal(t, "d", is.ID)
+				moved++
+			}
+		}
+		assert.Greater(t, moved, 0)
+		assert.Less(t, moved, len(keys)/2)
+
+		removed := New(testNodes("a", "c"), DefaultVNodes)
+		for _, key := range keys {
+			if was := before.Owner(key); was.ID != "b" {
+				assert.Equal(t, was, removed.Owner(key))
+			}
+		}
+	})
+}
+
+func TestLoadConfig(t *testing.T) {
+	write := func(t *testing.T, data string) string {
+		path := filepath.Join(t.TempDir(), "ring.json")
+		assert.NoError(t, os.WriteFile(path, []byte(data), 0644))
+		return path
+	}
+
+	// Test Case 1: defaults are filled in
+	t.Run("valid", func(t *testing.T) {
+		cfg, err := LoadConfig(write(t, `{"nodes":[{"id":"a","addr":"http://a/"},{"id":"b","addr":"http://b"}]}`))
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultVNodes, cfg.VNodes)
+		assert.Equal(t, testNodes("a", "b"), cfg.Nodes)
+		node, ok := cfg.Node("b")
+		assert.True(t, ok)
+		assert.Equal(t, "http://b", node.Addr)
+	})
+
+	// Test Case 2: broken configurations are refused
+	t.Run("invalid", func(t *testing.T) {
+		for _, data := range []string{
+			`{"nodes":[]}`,
+			`{"nodes":[{"id":"a"}]}`,
+			`{"nodes":[{"id":"a","addr":"http://a"},{"id":"a","addr":"http://b"}]}`,
+			`{"vnodes":-1,"nodes":[{"id":"a","addr":"http://a"}]}`,
+			`nodes: a`,
+		} {
+			_, err := LoadConfig(write(t, data))
+			assert.Error(t, err, data)
+		}
+		_, err := NewForwarder(&Config{Nodes: testNodes("a")}, "b")
+		assert.Error(t, err)
+	})
+}
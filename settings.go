@@ -0,0 +1,219 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/themillenniumfalcon/smolDB/acl"
+	"github.com/themillenniumfalcon/smolDB/config"
+	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/limit"
+	"github.com/themillenniumfalcon/smolDB/log"
+	"github.com/urfave/cli/v2"
+)
+
+// settings is the configuration file given with --settings, nil without one
+var settings *config.File
+
+// explicit holds the flags given on the command line or through the
+// environment, the configuration file never overrides them, not even when
+// it is reloaded
+var explicit = map[string]bool{}
+
+// aclPath is the policy file in use, read again on reload
+var aclPath string
+
+// limiter holds requests to the limits in use, which are changed on
+// reload
+var limiter *limit.Limiter
+
+// startup is the context the app started with, flags given explicitly
+// keep the value they had in it
+var startup *cli.Context
+
+// gives the flags of a command, the global ones when command is empty,
+// their value from the configuration file unless they were set on the
+// command line or through the environment
+func applyConfig(c *cli.Context, flags []cli.Flag, command string) error {
+	for _, flag := range flags {
+		name := flag.Names()[0]
+		if c.IsSet(name) {
+			explicit[name] = true
+			continue
+		}
+		v, ok := settings.Get(name, command)
+		if !ok {
+			continue
+		}
+		for _, value := range v.Values {
+			if err := c.Set(name, value); err != nil {
+				return fmt.Errorf("%s: %s: invalid value '%s': %v", settings.Path, v.Key, value, err)
+			}
+		}
+	}
+	return nil
+}
+
+// returns the Before of a command that opens the database: its flags are
+// taken from the configuration file unless given, required ones have to be
+// set one way or the other and the WAL settings have to be valid
+func configured(required ...string) cli.BeforeFunc {
+	return func(c *cli.Context) error {
+		command := c.Command.Name
+		if err := applyConfig(c, c.Command.Flags, command); err != nil {
+			return err
+		}
+		for _, name := range required {
+			if c.String(name) == "" {
+				key := name
+				for _, s := range config.Settings {
+					if s.Flag == name && s.Command == command {
+						key = s.Key
+					}
+				}
+				return fmt.Errorf("--%s is required, on the command line or as %s in the config file", name, key)
+			}
+		}
+		return validateWAL(c)
+	}
+}
+
+// rejects unknown WAL settings instead of falling back to the defaults
+func validateWAL(c *cli.Context) error {
+	if _, err := index.ParseDurability(c.String("durability")); err != nil {
+		return err
+	}
+	if _, err := index.ParseSyncMode(c.String("sync-mode")); err != nil {
+		return err
+	}
+	_, err := index.ParseWALFormat(c.String("wal-format"))
+	return err
+}
+
+// returns the limits the flags of c set
+func limitConfig(c *cli.Context) (limit.Config, error) {
+	cfg := limit.Config{
+		ReadRate:     c.Float64("rate-limit-read"),
+		ReadBurst:    c.Int("rate-limit-read-burst"),
+		WriteRate:    c.Float64("rate-limit-write"),
+		WriteBurst:   c.Int("rate-limit-write-burst"),
+		MaxInFlight:  c.Int("max-in-flight"),
+		MaxQueue:     c.Int("max-queue"),
+		QueueTimeout: c.Duration("queue-timeout"),
+	}
+	return cfg, cfg.Validate()
+}
+
+// returns the limits file sets, flags given explicitly keep their value
+// and the ones file no longer sets get their default back. The routes
+// exempt from limits only change with a restart
+func reloadLimits(file *config.File) (limit.Config, error) {
+	set := flag.NewFlagSet("limits", flag.ContinueOnError)
+	flags := limitFlags()
+	for _, f := range flags {
+		if err := f.Apply(set); err != nil {
+			return limit.Config{}, err
+		}
+	}
+	for _, f := range flags {
+		name := f.Names()[0]
+		if name == "limit-exempt" {
+			continue
+		}
+		if explicit[name] {
+			if err := set.Set(name, fmt.Sprint(startup.Value(name))); err != nil {
+				return limit.Config{}, err
+			}
+			continue
+		}
+		if v, ok := file.Get(name, ""); ok {
+			for _, value := range v.Values {
+				if err := set.Set(name, value); err != nil {
+					return limit.Config{}, fmt.Errorf("%s: %s: invalid value '%s': %v", file.Path, v.Key, value, err)
+				}
+			}
+		}
+	}
+	return limitConfig(cli.NewContext(startup.App, set, nil))
+}
+
+// reads the configuration file and the ACL policy again and applies the
+// settings that are safe to change while serving: the log level, the
+// policy and the limits. Nothing changes unless all of them are valid
+func reloadSettings() error {
+	file := settings
+	if settings != nil {
+		var err error
+		if file, err = config.Load(settings.Path); err != nil {
+			return err
+		}
+	}
+	// returns the single value the file gives a global flag
+	value := func(flag string) (string, bool) {
+		v, ok := file.Get(flag, "")
+		if !ok || explicit[flag] || len(v.Values) == 0 {
+			return "", false
+		}
+		return v.Values[0], true
+	}
+
+	level := -1
+	if name, ok := value("log-level"); ok {
+		var err error
+		if level, err = log.ParseLevel(name); err != nil {
+			return fmt.Errorf("%s: log.level: %v", file.Path, err)
+		}
+	}
+	path := aclPath
+	if p, ok := value("acl"); ok {
+		path = p
+	} else if !explicit["acl"] && aclPath != "" {
+		return fmt.Errorf("access control can't be turned off without a restart")
+	}
+	var policy *acl.Policy
+	if path != "" {
+		var err error
+		if policy, err = acl.Load(path); err != nil {
+			return err
+		}
+	}
+
+	var limits limit.Config
+	if limiter != nil {
+		var err error
+		if limits, err = reloadLimits(file); err != nil {
+			return err
+		}
+	}
+
+	if level >= 0 {
+		log.SetLoggingLevel(level)
+	}
+	settings, aclPath = file, path
+	acl.Set(policy)
+	if limiter != nil {
+		limiter.Configure(limits)
+	}
+	return nil
+}
+
+// reloads the settings on SIGHUP for as long as the process runs
+func reloadOnHangup() {
+	if settings == nil && aclPath == "" {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadSettings(); err != nil {
+				log.Warn("keeping the previous settings: %s", err.Error())
+				continue
+			}
+			log.Info("reloaded settings")
+		}
+	}()
+}
@@ -6,17 +6,23 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http/httptest"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	af "github.com/spf13/afero"
 	"github.com/themillenniumfalcon/smolDB/api"
+	"github.com/themillenniumfalcon/smolDB/audit"
 	"github.com/themillenniumfalcon/smolDB/index"
+	"github.com/themillenniumfalcon/smolDB/lock"
 	"github.com/themillenniumfalcon/smolDB/log"
 )
 
@@ -24,50 +30,116 @@ import (
 // when no depth parameter is provided
 const DefaultDepth = 0
 
+// held is the lock on the database directory while it is open
+var held *lock.Lock
+
+// readOnly is set when the database was opened next to the server that
+// writes it
+var readOnly bool
+
+// ErrReadOnly is returned by commands that would modify a database opened
+// read-only
+var ErrReadOnly = errors.New("database is opened read-only")
+
 // removes the lock file, allowing other instances to access the database
-func releaseLock(dir string) error {
-	lockdir := getLockLocation(dir)
-	return index.I.FileSystem.Remove(lockdir)
+func releaseLock() error {
+	if held == nil {
+		return nil
+	}
+	err := held.Release()
+	held = nil
+	return err
 }
 
 // performs graceful shutdown operations when the program is terminated,
-// releases the lock file and logs any errors that occur during cleanup
-func cleanup(dir string) {
+// closes the database and logs any errors that occur during cleanup
+func cleanup() {
 	log.Info("\ncaught term signal! cleaning up...")
 
-	// handles graceful shutdown and releases lock file
-	err := releaseLock(dir)
-	if err != nil {
-		log.Warn("couldn't remove lock")
+	if err := Close(false); err != nil {
 		log.Fatal(err)
-		return
 	}
 }
 
-// constructs the path for the lock file based on the provided directory,
-// if dir is empty or ".", the lock file is created in the current directory
-func getLockLocation(dir string) string {
-	base := "smoldb_lock"
-	if dir == "" || dir == "." {
-		return base
+// Close shuts the open database down once nothing writes to it anymore:
+// takes a final checkpoint when asked to, syncs and closes the WAL of every
+// shard and the audit log, and only then releases the lock
+func Close(checkpoint bool) error {
+	if checkpoint && !readOnly {
+		if err := index.R.CreateCheckpoint(); err != nil {
+			log.Warn("failed to take final checkpoint: %s", err.Error())
+		} else {
+			log.Info("took final checkpoint")
+		}
+	}
+	if err := index.R.Close(); err != nil {
+		log.Warn("failed to close WAL: %s", err.Error())
+	}
+	if audit.L != nil {
+		audit.L.Close()
 	}
 
-	return dir + "/" + base
+	if err := releaseLock(); err != nil {
+		log.Warn("couldn't remove lock")
+		return err
+	}
+	return nil
 }
 
-// attempts to create a lock file to ensure only one instance
-// of smolDB is running against a specific database directory,
-// returns an error if the lock already exists or cannot be created
-func acquireLock(dir string) error {
-	_, err := index.I.FileSystem.Stat(getLockLocation(dir))
+// stop is closed on a term signal once a server took over shutting down
+var (
+	stopMu sync.Mutex
+	stop   chan struct{}
+)
 
-	// create lock if it doesn't exist
-	if os.IsNotExist(err) {
-		_, err = index.I.FileSystem.Create(getLockLocation(dir))
-		return err
+// HandleShutdown makes a term signal close the returned channel instead of
+// exiting, the caller then drains its requests and calls Close. A second
+// signal exits right away
+func HandleShutdown() <-chan struct{} {
+	stopMu.Lock()
+	defer stopMu.Unlock()
+	if stop == nil {
+		stop = make(chan struct{})
 	}
+	return stop
+}
+
+// waits for term signals, the first one either hands shutdown to the server
+// or cleans up and exits
+func handleSignals() {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-c
+		stopMu.Lock()
+		handled := stop
+		stopMu.Unlock()
+		if handled == nil {
+			cleanup()
+			os.Exit(1)
+		}
+		log.Info("caught term signal! shutting down...")
+		close(handled)
 
-	return fmt.Errorf("couldn't acquire lock on %s", dir)
+		<-c
+		log.Warn("caught second term signal, exiting without cleaning up")
+		os.Exit(1)
+	}()
+}
+
+// locks the database directory so only one instance of smolDB runs against
+// it, a lock left behind by a process that died is taken over
+func acquireLock(dir string) error {
+	l, err := lock.Acquire(dir)
+	if err != nil {
+		return err
+	}
+	if l.Stale {
+		log.Warn("database was not shut down cleanly, took over the stale lock of %s", l.Previous)
+	}
+	held = l
+	return nil
 }
 
 // execInput processes the user input and executes the corresponding command,
@@ -84,11 +156,15 @@ func execInput(input string, dir string) (err error) {
 	case "lookup":
 		return lookupWrapper(args)
 	case "delete":
+		if readOnly {
+			return ErrReadOnly
+		}
 		return deleteWrapper(args)
 	case "regenerate":
-		index.I.Regenerate()
+		index.R.Regenerate()
+		audit.Record(audit.Entry{Client: shellClient(), Op: audit.OpRegenerate})
 	case "exit":
-		cleanup(dir)
+		cleanup()
 		os.Exit(0)
 	default:
 		log.Warn("'%s' is not a valid command.", args[0])
@@ -101,151 +177,158 @@ func execInput(input string, dir string) (err error) {
 // initializes the database, acquires the lock, and sets up signal handling
 // for graceful shutdown, also ensures the index is up to date
 func Setup(dir string) {
-	// initialize database setup
+	SetupWithOptions(dir, "commit", 0, 0, "fsync", "json", false)
+}
+
+// SetupWithOptions is like Setup, but allows configuring durability, group commit interval
+// and the record format used for new WAL appends
+func SetupWithOptions(dir string, durability string, groupCommitMs int, groupCommitBatch int, syncMode string, walFormat string, walCompress bool) {
 	log.Info("initializing smolDB")
-	index.I = index.NewFileIndex(dir)
 
-	// First verify lock status
-	if _, err := os.Stat(getLockLocation(dir)); err == nil {
-		log.Warn("Database was not shutdown cleanly, lock file exists")
+	// pick durability level, sync mode and WAL record format, replay
+	// understands every format regardless
+	level, err := index.ParseDurability(durability)
+	if err != nil {
+		log.Fatal(err)
+		return
 	}
-
-	// Restore from latest checkpoint if available
-	if err := index.I.RestoreFromCheckpoint(); err != nil {
-		log.Warn("failed to restore from checkpoint: %s", err.Error())
+	mode, err := index.ParseSyncMode(syncMode)
+	if err != nil {
+		log.Fatal(err)
+		return
 	}
-
-	// initialize WAL with commit durability and replay from last checkpoint
-	if err := index.I.InitWAL(index.DurabilityCommit); err != nil {
-		log.Warn("failed to init WAL: %s", err.Error())
-	} else {
-		if index.I != nil && index.I.WALAvailable() {
-			if err := index.I.WALReplay(); err != nil {
-				log.Warn("failed to replay WAL: %s", err.Error())
-			}
-		}
+	format, err := index.ParseWALFormat(walFormat)
+	if err != nil {
+		log.Fatal(err)
+		return
 	}
 
-	// Rebuild index after recovery
-	index.I.Regenerate()
+	// lock acquisition, before recovery writes to the database
+	if err := acquireLock(dir); err != nil {
+		log.Fatal(err)
+		return
+	}
 
-	// lock acquisition
-	err := acquireLock(dir)
+	// a sharded database opens every shard on its own, keys are routed to
+	// them by hash
+	shards, err := index.ReadShardCount(af.NewOsFs(), dir)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
+	if shards == 1 {
+		index.I = openIndex(dir, level, groupCommitMs, groupCommitBatch, mode, format, walCompress)
+		index.R = nil
+	} else {
+		var list []*index.FileIndex
+		for _, shardDir := range index.ShardDirs(dir, shards) {
+			list = append(list, openIndex(shardDir, level, groupCommitMs, groupCommitBatch, mode, format, walCompress))
+		}
+		index.I = nil
+		index.R = index.NewRouter(list)
+		log.Info("opened %d shards", shards)
+	}
+
+	// changes are recorded in the audit log
+	if audit.L, err = audit.Open(af.NewOsFs(), dir); err != nil {
+		log.Warn("failed to open audit log, changes aren't audited: %s", err.Error())
+	}
 
 	// generating index once again, ensures the index is fresh and accounts
 	// for any changes that might have occurred during startup
-	index.I.Regenerate()
-
-	// creates a buffered channel c to receive OS signals
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	index.R.Regenerate()
 
-	// launches a goroutine that waits for a signal at channel c
-	// when a signal is received, it calls cleanup function to release the lock and exits the program
-	go func() {
-		<-c
-		cleanup(dir)
-		os.Exit(1)
-	}()
+	// a term signal releases the lock, servers drain their requests first
+	handleSignals()
 }
 
-// SetupWithOptions is like Setup, but allows configuring durability and group commit interval
-func SetupWithOptions(dir string, durability string, groupCommitMs int, groupCommitBatch int, syncMode string) {
-	log.Info("initializing smolDB")
-	index.I = index.NewFileIndex(dir)
+// SetupReadOnly opens the database in dir next to the server that writes
+// it: takes the shared lock, leaves the WAL and audit log alone and
+// rebuilds the index from disk every refresh to pick up the server's
+// changes
+func SetupReadOnly(dir string, refresh time.Duration) {
+	log.Info("initializing smolDB read-only")
+	readOnly = true
 
-	// First verify lock status
-	if _, err := os.Stat(getLockLocation(dir)); err == nil {
-		log.Warn("Database was not shutdown cleanly, lock file exists")
+	var err error
+	if held, err = lock.AcquireShared(dir); err != nil {
+		log.Fatal(err)
+		return
 	}
 
+	shards, err := index.ReadShardCount(af.NewOsFs(), dir)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	var list []*index.FileIndex
+	for _, shardDir := range index.ShardDirs(dir, shards) {
+		idx := index.NewFileIndex(shardDir)
+		idx.Regenerate()
+		list = append(list, idx)
+	}
+	if shards == 1 {
+		index.I, index.R = list[0], nil
+	} else {
+		index.I, index.R = nil, index.NewRouter(list)
+	}
+
+	if refresh > 0 {
+		go func() {
+			for range time.Tick(refresh) {
+				index.R.Refresh()
+			}
+		}()
+		log.Info("refreshing the index every %s", refresh)
+	}
+
+	handleSignals()
+}
+
+// opens the FileIndex of a database or shard directory: restores its latest
+// checkpoint, opens the WAL with the given options and replays it
+func openIndex(dir string, level index.DurabilityLevel, groupCommitMs int, groupCommitBatch int, syncMode index.SyncMode, format index.WALFormat, walCompress bool) *index.FileIndex {
+	idx := index.NewFileIndex(dir)
+
 	// Restore from latest checkpoint if available
-	if err := index.I.RestoreFromCheckpoint(); err != nil {
+	if err := idx.RestoreFromCheckpoint(); err != nil {
 		log.Warn("failed to restore from checkpoint: %s", err.Error())
 	}
 
-	// pick durability level
-	level := index.DurabilityCommit
-	switch durability {
-	case "none":
-		level = index.DurabilityNone
-	case "commit":
-		level = index.DurabilityCommit
-	case "grouped":
-		level = index.DurabilityGrouped
-	}
-
-	// set sync mode
-	switch syncMode {
-	case "none":
-		index.I.SetSyncMode(index.SyncNone)
-	case "fsync":
-		index.I.SetSyncMode(index.SyncFsync)
-	case "dsync":
-		index.I.SetSyncMode(index.SyncDSync)
-	default:
-		index.I.SetSyncMode(index.SyncFsync)
-	}
+	idx.SetSyncMode(syncMode)
+	idx.SetWALFormat(format, walCompress)
 
 	// initialize WAL with chosen durability and grouped interval/batch
-	if err := index.I.InitWALWithOptions(level, groupCommitMs, groupCommitBatch); err != nil {
+	if err := idx.InitWALWithOptions(level, groupCommitMs, groupCommitBatch); err != nil {
 		log.Warn("failed to init WAL: %s", err.Error())
-	} else {
-		if index.I != nil && index.I.WALAvailable() {
-			_ = index.I.WALReplay()
+	} else if idx.WALAvailable() {
+		if err := idx.WALReplay(); err != nil {
+			log.Warn("failed to replay WAL: %s", err.Error())
 		}
 	}
-	index.I.Regenerate()
-
-	// lock acquisition
-	err := acquireLock(dir)
-	if err != nil {
-		log.Fatal(err)
-		return
-	}
-
-	// generating index once again, ensures the index is fresh and accounts
-	// for any changes that might have occurred during startup
-	index.I.Regenerate()
-
-	// creates a buffered channel c to receive OS signals
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
-	// launches a goroutine that waits for a signal at channel c
-	// when a signal is received, it calls cleanup function to release the lock and exits the program
-	go func() {
-		<-c
-		cleanup(dir)
-		os.Exit(1)
-	}()
+	// Rebuild index after recovery
+	idx.Regenerate()
+	return idx
 }
 
 // ShellWithOptions runs the shell with durability configuration
-func ShellWithOptions(dir string, durability string, groupCommitMs int, groupCommitBatch int, syncMode string) error {
+func ShellWithOptions(dir string, durability string, groupCommitMs int, groupCommitBatch int, syncMode string, walFormat string, walCompress bool) error {
 	log.IsShellMode = true
 	log.Info("starting smoldb shell...")
 
-	SetupWithOptions(dir, durability, groupCommitMs, groupCommitBatch, syncMode)
-	reader := bufio.NewReader(os.Stdin)
-
-	// the main shell loop, displays a prompt, read user input, and executes input
-	for {
-		log.Prompt("smoldb> ")
+	SetupWithOptions(dir, durability, groupCommitMs, groupCommitBatch, syncMode, walFormat, walCompress)
+	return run(dir)
+}
 
-		input, err := reader.ReadString('\n')
-		if err != nil {
-			log.Warn("err reading input: %s", err.Error())
-		}
+// ShellReadOnly runs the shell on a database a server is writing, delete
+// is refused
+func ShellReadOnly(dir string, refresh time.Duration) error {
+	log.IsShellMode = true
+	log.Info("starting read-only smoldb shell...")
 
-		if err = execInput(input, dir); err != nil {
-			log.Warn("err executing input: %s", err.Error())
-		}
-	}
+	SetupReadOnly(dir, refresh)
+	return run(dir)
 }
 
 // shell initializes and runs the interactive shell interface for smolDB,
@@ -255,9 +338,12 @@ func Shell(dir string) error {
 	log.Info("starting smoldb shell...")
 
 	Setup(dir)
-	reader := bufio.NewReader(os.Stdin)
+	return run(dir)
+}
 
-	// the main shell loop, displays a prompt, read user input, and executes input
+// the main shell loop, displays a prompt, read user input, and executes input
+func run(dir string) error {
+	reader := bufio.NewReader(os.Stdin)
 	for {
 		log.Prompt("smoldb> ")
 
@@ -298,7 +384,7 @@ func healthWrapper() error {
 
 // listAllWrapper displays all keys present in the database index
 func listAllWrapper() {
-	files := index.I.ListKeys()
+	files := index.R.ListKeys()
 	log.Success("found %d files in index:", len(files))
 
 	for _, f := range files {
@@ -315,7 +401,7 @@ func lookupWrapper(args []string) error {
 	}
 
 	key := args[1]
-	f, ok := index.I.Lookup(key)
+	f, ok := index.R.Lookup(key)
 	if !ok {
 		return fmt.Errorf("key doesn't exist")
 	}
@@ -355,16 +441,23 @@ func deleteWrapper(args []string) error {
 	}
 
 	key := args[1]
-	f, ok := index.I.Lookup(key)
+	f, ok := index.R.Lookup(key)
 	if !ok {
 		return fmt.Errorf("key doesn't exist")
 	}
 
-	err := index.I.Delete(f)
+	before := index.R.Checksum(key)
+	err := index.R.Delete(f)
 	if err != nil {
 		return err
 	}
+	audit.Record(audit.Entry{Client: shellClient(), Op: audit.OpDelete, Key: key, Before: before})
 
 	log.Success("deleted key %s", key)
 	return nil
 }
+
+// identifies changes made through the shell in the audit log
+func shellClient() string {
+	return "shell:" + audit.LocalUser()
+}
@@ -0,0 +1,124 @@
+// provides an end to end test of shutting a server down while it is being
+// written to
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/index"
+)
+
+// not a test on its own, run by TestShutdown in a child process that serves
+// the database
+func TestShutdownChild(t *testing.T) {
+	dir := os.Getenv("SMOLDB_TEST_SHUTDOWN_DIR")
+	if dir == "" {
+		t.Skip("only run as a child of TestShutdown")
+	}
+	port, _ := strconv.Atoi(os.Getenv("SMOLDB_TEST_SHUTDOWN_PORT"))
+	drainTimeout = 5 * time.Second
+	finalCheckpoint = true
+	// grouped durability leaves records unsynced until shutdown commits them
+	if err := serve(port, dir, "grouped", 0, 1000, "fsync", "json", false, 0, 3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// verifies that a term signal while writes are running lets every
+// acknowledged write reach the database and the WAL before the lock goes
+func TestShutdown(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	addr := fmt.Sprintf("http://127.0.0.1:%d", port)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestShutdownChild$")
+	cmd.Env = append(os.Environ(), "SMOLDB_TEST_SHUTDOWN_DIR="+dir, "SMOLDB_TEST_SHUTDOWN_PORT="+strconv.Itoa(port))
+	assert.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if res, err := http.Get(addr + "/"); err == nil {
+			res.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't come up")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// writers keep going until the server stops answering
+	var mu sync.Mutex
+	acked := map[string]string{}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				key := fmt.Sprintf("w%d-%d", w, n)
+				body := fmt.Sprintf(`{"writer":%d,"n":%d}`, w, n)
+				req, _ := http.NewRequest(http.MethodPut, addr+"/key/"+key, strings.NewReader(body))
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					return
+				}
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					return
+				}
+				mu.Lock()
+				acked[key] = body
+				mu.Unlock()
+			}
+		}(w)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	assert.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	wg.Wait()
+	assert.NoError(t, cmd.Wait(), "the server exits cleanly")
+
+	// Test Case 1: every acknowledged write is on disk and the lock is gone
+	t.Run("writes kept", func(t *testing.T) {
+		assert.NotEmpty(t, acked)
+		for key, body := range acked {
+			data, err := os.ReadFile(filepath.Join(dir, key+".json"))
+			assert.NoError(t, err, key)
+			assert.Equal(t, body, string(data))
+		}
+		_, err := os.Stat(filepath.Join(dir, "smoldb_lock"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	// Test Case 2: the WAL holds every write and a final checkpoint was taken
+	t.Run("wal and checkpoint", func(t *testing.T) {
+		// opened the way the server opens it, the checkpoint archived the
+		// sealed segments
+		idx := index.NewFileIndex(dir)
+		assert.NoError(t, idx.RestoreFromCheckpoint())
+		assert.NoError(t, idx.InitWAL(index.DurabilityCommit))
+		defer idx.Close()
+		assert.GreaterOrEqual(t, idx.LastLSN(), uint64(len(acked)))
+		checkpoint, err := idx.LatestCheckpoint()
+		assert.NoError(t, err)
+		assert.NotEmpty(t, checkpoint)
+	})
+}
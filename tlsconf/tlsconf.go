@@ -0,0 +1,172 @@
+// provides TLS configuration for the server and its connections to other
+// nodes, certificates are read from files and reloaded when they change
+package tlsconf
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/themillenniumfalcon/smolDB/log"
+)
+
+// PollInterval is how often the certificate files are checked for changes
+var PollInterval = 5 * time.Second
+
+// Reloader holds the certificate of the server and the CAs client
+// certificates are verified against, as last read from their files
+type Reloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+// New reads the certificate and key and, when clientCAFile is set, the CAs
+// clients have to present a certificate signed by
+func New(certFile, keyFile, clientCAFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again, on failure the previous certificates are
+// kept
+func (r *Reloader) Reload() error {
+	modTimes := r.readModTimes()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load tls certificate: %v", err)
+	}
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		if clientCAs, err = LoadPool(r.clientCAFile); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.clientCAs, r.modTimes = &cert, clientCAs, modTimes
+	return nil
+}
+
+// returns the modification times of the files
+func (r *Reloader) readModTimes() map[string]time.Time {
+	res := map[string]time.Time{}
+	for _, name := range []string{r.certFile, r.keyFile, r.clientCAFile} {
+		if name == "" {
+			continue
+		}
+		if info, err := os.Stat(name); err == nil {
+			res[name] = info.ModTime()
+		}
+	}
+	return res
+}
+
+// reports whether a file changed since it was last read
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for name, t := range r.readModTimes() {
+		if !t.Equal(r.modTimes[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Certificate returns the current certificate of the server
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// ServerConfig returns the configuration of the server, every handshake
+// uses the current certificates. With client CAs every client has to
+// present a certificate signed by one of them
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			conf := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+			}
+			if r.clientCAs != nil {
+				conf.ClientCAs = r.clientCAs
+				conf.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return conf, nil
+		},
+	}
+}
+
+// ClientConfig returns the configuration of connections to other nodes,
+// their certificates are verified against rootCAs, the system pool when
+// nil, and the current certificate of the server is presented to them
+func (r *Reloader) ClientConfig(rootCAs *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    rootCAs,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.Certificate(), nil
+		},
+	}
+}
+
+// Watch reloads the certificates on SIGHUP and when their files change,
+// until ctx is done
+func (r *Reloader) Watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+		}
+		if err := r.Reload(); err != nil {
+			log.Warn("keeping the previous tls certificates: %s", err.Error())
+			continue
+		}
+		log.Info("reloaded tls certificates")
+	}
+}
+
+// LoadPool reads the PEM certificates in file into a pool
+func LoadPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca certificates: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
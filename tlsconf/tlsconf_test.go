@@ -0,0 +1,175 @@
+package tlsconf
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/themillenniumfalcon/smolDB/auth"
+)
+
+// ca signs throwaway certificates
+type ca struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var serial int64
+
+// creates a self-signed CA
+func newCA(t *testing.T) *ca {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &ca{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issues a certificate for name, valid for localhost, as PEM cert and key
+func (c *ca) issue(t *testing.T, name string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, &key.PublicKey, c.key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// returns a client trusting c that presents cert and key when given
+func client(t *testing.T, c *ca, cert, key []byte) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	conf := &tls.Config{RootCAs: pool}
+	if cert != nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		assert.NoError(t, err)
+		conf.Certificates = []tls.Certificate{pair}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	serverCA, clientCA := newCA(t), newCA(t)
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	writeCert := func(name string, modTime time.Time) {
+		cert, key := serverCA.issue(t, name)
+		assert.NoError(t, os.WriteFile(certFile, cert, 0o600))
+		assert.NoError(t, os.WriteFile(keyFile, key, 0o600))
+		assert.NoError(t, os.Chtimes(certFile, modTime, modTime))
+		assert.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	}
+	writeCert("server-1", time.Now().Add(-time.Minute))
+	assert.NoError(t, os.WriteFile(caFile, clientCA.pem, 0o600))
+
+	r, err := New(certFile, keyFile, caFile)
+	assert.NoError(t, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id, err := auth.ClientCert{}.Authenticate(req)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(id.Name))
+	}))
+	server.TLS = r.ServerConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	// returns the common name the server presented and the body it answered
+	get := func(c *http.Client) (string, string, error) {
+		res, err := c.Get(server.URL)
+		if err != nil {
+			return "", "", err
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.TLS.PeerCertificates[0].Subject.CommonName, string(body), nil
+	}
+	aliceCert, aliceKey := clientCA.issue(t, "alice")
+
+	// Test Case 1: clients need a certificate signed by the client CA, its
+	// subject is the identity
+	t.Run("mtls", func(t *testing.T) {
+		name, body, err := get(client(t, serverCA, aliceCert, aliceKey))
+		assert.NoError(t, err)
+		assert.Equal(t, "server-1", name)
+		assert.Equal(t, "alice", body)
+
+		_, _, err = get(client(t, serverCA, nil, nil))
+		assert.Error(t, err)
+
+		malloryCert, malloryKey := serverCA.issue(t, "mallory")
+		_, _, err = get(client(t, serverCA, malloryCert, malloryKey))
+		assert.Error(t, err)
+	})
+
+	// Test Case 2: changed files are picked up, broken ones are ignored
+	t.Run("reload", func(t *testing.T) {
+		defer func(interval time.Duration) { PollInterval = interval }(PollInterval)
+		PollInterval = 10 * time.Millisecond
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go r.Watch(ctx)
+
+		writeCert("server-2", time.Now())
+		assert.Eventually(t, func() bool {
+			name, _, err := get(client(t, serverCA, aliceCert, aliceKey))
+			return err == nil && name == "server-2"
+		}, 5*time.Second, 10*time.Millisecond)
+
+		assert.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+		assert.Error(t, r.Reload())
+		name, _, err := get(client(t, serverCA, aliceCert, aliceKey))
+		assert.NoError(t, err)
+		assert.Equal(t, "server-2", name)
+	})
+
+	// Test Case 3: connections to other nodes present the server certificate
+	t.Run("client", func(t *testing.T) {
+		conf := r.ClientConfig(nil)
+		cert, err := conf.GetClientCertificate(nil)
+		assert.NoError(t, err)
+		assert.Same(t, r.Certificate(), cert)
+	})
+}